@@ -1,19 +1,34 @@
 package app
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"github.com/mxk/go-imap/imap"
-	"reflect"
+	"net"
+	"strings"
 	"time"
 )
 
-var (
-	Authenticators = map[string]reflect.Value{
-		"test": reflect.ValueOf(NewTestAuthenticator),
-		"imap": reflect.ValueOf(NewImapAuthenticator),
-	}
-)
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "test",
+		Keys: []ConfigKey{
+			{Name: "global_password", Required: true},
+		},
+		New: NewTestAuthenticator,
+	})
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "imap",
+		Keys: append([]ConfigKey{
+			{Name: "server", Required: true},
+			{Name: "tls_mode", Default: "starttls", Validate: ValidateOneOf("imaps", "starttls", "none")},
+			{Name: "username_template", Default: "%e"},
+		}, TLSConfigKeys...),
+		New: NewImapAuthenticator,
+	})
+}
 
 // Authenticator is an interface representing a method to authenticate a user.
 // Only one function must be implemented: Authenticate(username, password
@@ -23,26 +38,232 @@ type Authenticator interface {
 	Authenticate(username, password string) error
 }
 
+// Identity describes an authenticated user. Only the email is mandatory, the
+// other fields are filled when the authentication backend knows them.
+type Identity struct {
+	Email       string   // canonical email address of the user
+	DisplayName string   // display name of the user
+	Groups      []string // groups the user belongs to
+	Status      string   // account status reported by the backend ("active", ...)
+}
+
+// ContextAuthenticator is an Authenticator honouring the deadline and the
+// cancellation of a context, and returning an Identity describing the
+// authenticated user. AuthenticateContext returns a nil *Identity and an
+// error when the authentication fails.
+type ContextAuthenticator interface {
+	Authenticator
+	AuthenticateContext(ctx context.Context, username, password string) (*Identity, error)
+}
+
+// AuthClient describes the client (the browser of the user) of an
+// authentication, the backends may forward it to their server.
+type AuthClient struct {
+	IP      string // IP address of the client (empty if unknown)
+	Secured bool   // the client is connected to Gorgon with TLS
+}
+
+// authClientKey is the key of the AuthClient in a context.
+type authClientKey struct{}
+
+// WithAuthClient returns a copy of the context carrying the client of the
+// authentication.
+func WithAuthClient(ctx context.Context, client AuthClient) context.Context {
+	return context.WithValue(ctx, authClientKey{}, client)
+}
+
+// AuthClientFromContext returns the client of the authentication carried by
+// the context, or an empty AuthClient.
+func AuthClientFromContext(ctx context.Context) AuthClient {
+	client, _ := ctx.Value(authClientKey{}).(AuthClient)
+	return client
+}
+
+// AuthenticatorAdapter implements the ContextAuthenticator interface for an
+// Authenticator knowing nothing about contexts and identities. The identity
+// only contains the username (email) used to authenticate the user.
+type AuthenticatorAdapter struct {
+	Authenticator
+}
+
+// AuthenticateContext calls the Authenticate function of the adapted
+// Authenticator. If the context is done before the end of the
+// authentication, returns the error of the context (the authentication keeps
+// running in the background until the backend returns).
+func (a AuthenticatorAdapter) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- a.Authenticate(username, password)
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{Email: username}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NewContextAuthenticator returns the authenticator as a ContextAuthenticator,
+// the authenticator is wrapped in an AuthenticatorAdapter if it does not
+// implement the ContextAuthenticator interface.
+func NewContextAuthenticator(authenticator Authenticator) ContextAuthenticator {
+	if contextAuthenticator, ok := authenticator.(ContextAuthenticator); ok {
+		return contextAuthenticator
+	}
+	return AuthenticatorAdapter{authenticator}
+}
+
+// contextWithTimeout returns a context done after the timeout (if positive)
+// or when ctx is done. The cancel function must be called once the
+// authentication is done.
+func contextWithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// dialContext connects to the address on the network, with TLS if a
+// *tls.Config is provided. The deadline of the context is applied to the
+// connection, and its pending reads and writes are interrupted when the
+// context is done: the context must be cancelled once the connection is
+// closed (see contextWithTimeout).
+func dialContext(ctx context.Context, network, address string, tlsConfig *tls.Config) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, network, address)
+	} else {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Unix(1, 0))
+	}()
+	return conn, nil
+}
+
+// contextError returns the error of the context if it is done (the
+// connection to the backend was interrupted), else returns err.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// CredentialsError is returned by an Authenticator when the credentials are
+// rejected (unknown user, wrong password, ...). Any other error returned by
+// an Authenticator is a hard error (unreachable server, invalid response,
+// ...) where the credentials could not be checked.
+type CredentialsError struct {
+	Message string // description of the error
+}
+
+func (e CredentialsError) Error() string {
+	return e.Message
+}
+
+// IsCredentialsError returns true if the error means that the credentials
+// are rejected, false if the error is a hard error.
+func IsCredentialsError(err error) bool {
+	if _, ok := err.(CredentialsError); ok {
+		return true
+	}
+	return err == ErrPasswordMismatch
+}
+
+// emailInDomain returns true if the email address is an address of the
+// domain.
+func emailInDomain(email, domain string) bool {
+	i := strings.LastIndex(email, "@")
+	return i > 0 && strings.EqualFold(email[i+1:], domain)
+}
+
 // NewAuthenticator returns an Authenticator based on the provided name. The
-// authenticator is configured from app.Config.
-func NewAuthenticator(app GorgonApp, name string) (authenticator Authenticator, err error) {
-	if _, ok := Authenticators[name]; !ok {
-		err := errors.New("Authenticator '" + name + "' does not exist.")
+// configuration section of the backend is checked (see
+// AuthenticatorBackend.CheckConfig) before creating the authenticator from
+// app.Config, all the errors found in the section are returned at once. The
+// authenticator is wrapped in a CachingAuthenticator if the cache is enabled
+// in the section.
+func NewAuthenticator(app GorgonApp, name string) (Authenticator, error) {
+	backend, ok := LookupAuthenticator(name)
+	if !ok {
+		return nil, errors.New("Authenticator '" + name + "' does not exist.")
+	}
+
+	config, err := backend.CheckConfig(app.Config)
+	if err != nil {
 		return nil, err
 	}
+	app.Config = config
 
-	// call the function to create the authenticator, the app is the only
-	// argument passed to the function
-	params := []reflect.Value{reflect.ValueOf(app)}
-	results := Authenticators[name].Call(params)
+	authenticator, err := backend.New(app)
+	if err != nil {
+		return nil, err
+	}
+	if authenticator == nil {
+		return nil, errors.New("Authenticator '" + name + "' returned no authenticator")
+	}
+	return newCachingAuthenticatorFromConfig(app, backend, authenticator), nil
+}
 
-	// cast the first returned value as an Authenticator interface ...
-	authenticator = results[0].Interface().(Authenticator)
-	if results[1].Interface() != nil {
-		// ... and the second returned value as an error
-		err = results[1].Interface().(error)
+// FormatUsername creates a login name from an email address and a template.
+// The following sequences are replaced in the template:
+// - %e: the full email address
+// - %u: the local part of the email address (before the last "@")
+// - %d: the domain part of the email address (after the last "@")
+// - %%: a literal "%"
+// An empty template returns the email address without modification.
+func FormatUsername(template, email string) string {
+	if template == "" {
+		return email
 	}
-	return
+
+	local, domain := email, ""
+	if i := strings.LastIndex(email, "@"); i != -1 {
+		local, domain = email[:i], email[i+1:]
+	}
+
+	var username bytes.Buffer
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' || i+1 == len(template) {
+			username.WriteByte(template[i])
+			continue
+		}
+		i++
+		switch template[i] {
+		case 'e':
+			username.WriteString(email)
+		case 'u':
+			username.WriteString(local)
+		case 'd':
+			username.WriteString(domain)
+		case '%':
+			username.WriteByte('%')
+		default:
+			username.WriteByte('%')
+			username.WriteByte(template[i])
+		}
+	}
+	return username.String()
 }
 
 // TestAuthenticator implements the Authenticator interface and is a very
@@ -65,7 +286,7 @@ type TestAuthenticator struct {
 // Authenticate uses a global password to authenticate all users.
 func (a TestAuthenticator) Authenticate(username, password string) (err error) {
 	if a.GlobalPassword != password {
-		err = errors.New("TestAuthenticator: authentication failed")
+		err = CredentialsError{"TestAuthenticator: authentication failed"}
 	}
 	return
 }
@@ -74,18 +295,22 @@ func (a TestAuthenticator) Authenticate(username, password string) (err error) {
 func NewTestAuthenticator(app GorgonApp) (Authenticator, error) {
 	app.Logger.Warning("You are using the test authenticator. Do *NOT* use this " +
 		"authenticator in a production environment.")
-	global_password, ok := app.Config.Get("auth:test", "global_password")
-	if !ok {
-		panic("'global_password' variable missing from 'auth:test' section")
-	}
+	global_password, _ := app.Config.Get("auth:test", "global_password")
 
 	authenticator := TestAuthenticator{global_password}
 	return authenticator, nil
 }
 
 // ImapAuthenticator implements the Authenticator interface to authenticate
-// users against an Imap server. The username (email) and password are passed
-// without modification to the Imap server.
+// users against an Imap server. The login name sent to the Imap server is
+// created from the username (email) with the username template (see
+// FormatUsername), the password is passed without modification.
+//
+// The connection to the Imap server is secured according to the TLS mode:
+// - imaps: implicit TLS (default port 993)
+// - starttls: the connection switches to TLS with the STARTTLS command, the
+//   authentication is refused if the server does not advertise STARTTLS
+// - none: no TLS, the password is sent in clear
 //
 // An example configuration looks like this:
 //
@@ -95,65 +320,153 @@ func NewTestAuthenticator(app GorgonApp) (Authenticator, error) {
 //
 // [auth:imap]
 // server = imap.example.com
+// tls_mode = starttls
 // verify_cert = true
+// ca_file = /etc/ssl/certs/ca-certificates.crt
+// server_name = imap.example.com
+// min_tls_version = 1.2
+// username_template = %u
 //
 type ImapAuthenticator struct {
-	Server        string // hostname or address of an Imap server
-	TLSVerifyCert bool   // should verify the certificate presented by the server
+	Server           string      // hostname or address of an Imap server
+	TLSMode          string      // "imaps", "starttls" or "none"
+	TLSVerifyCert    bool        // should verify the certificate presented by the server
+	TLSConfig        *tls.Config // TLS configuration used to connect to the server
+	UsernameTemplate string      // template used to create the Imap login name
 }
 
-// Authenticate uses an Imap server to authenticate users. The username (email)
-// and password are passed without modification to the Imap server.
-func (a ImapAuthenticator) Authenticate(username, password string) (err error) {
-	client, err := imap.Dial(a.Server)
-	if client != nil {
-		defer client.Logout(30 * time.Second)
+// Authenticate uses an Imap server to authenticate users. The login name is
+// created from the username (email) with the username template, the password
+// is passed without modification to the Imap server.
+func (a ImapAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext uses an Imap server to authenticate users, the
+// connection is interrupted when the context is done.
+func (a ImapAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	if err := a.authenticate(ctx, FormatUsername(a.UsernameTemplate, username), password); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return &Identity{Email: username}, nil
+}
+
+// authenticate connects to the Imap server and checks the login name and the
+// password.
+func (a ImapAuthenticator) authenticate(ctx context.Context, username, password string) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the Imap client uses the default port (143 or 993) if none is provided
+	server, tlsConfig := a.Server, a.TLSConfig
+	switch a.TLSMode {
+	case "imaps":
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "993")
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	case "starttls", "none":
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "143")
+		}
+		tlsConfig = nil
+	default:
+		return errors.New("ImapAuthenticator: unknown tls_mode '" + a.TLSMode + "'")
 	}
+	conn, err := dialContext(ctx, "tcp", server, tlsConfig)
 	if err != nil {
 		return
 	}
-
-	tlsConfig := tls.Config{
-		InsecureSkipVerify: a.TLSVerifyCert,
+	host, _, _ := net.SplitHostPort(server)
+	client, err := imap.NewClient(conn, host, 30*time.Second)
+	if err != nil {
+		conn.Close()
+		return
 	}
+	defer client.Logout(30 * time.Second)
 
-	return ImapAuthenticate(client, username, password, &tlsConfig)
+	if a.TLSMode == "starttls" {
+		return ImapAuthenticate(client, username, password, a.TLSConfig)
+	}
+	return imapLogin(client, username, password)
 }
 
 // ImapAuthenticate tries to authenticate a user. If the IMAP server advertive
 // the STARTTLS capability, the connection switches to TLS and use the provided
-// *tls.Config. If the authentication is successful, returns nil, else returns
-// an error.
+// *tls.Config. If a *tls.Config is provided and the IMAP server does not
+// advertise the STARTTLS capability, the authentication is refused to never
+// send the password in clear. If the authentication is successful, returns
+// nil, else returns an error.
 func ImapAuthenticate(client *imap.Client, username, password string, tlsConfig *tls.Config) (err error) {
 	if client.Caps["STARTTLS"] {
 		if _, err = client.StartTLS(tlsConfig); err != nil {
 			return
 		}
+	} else if tlsConfig != nil {
+		return errors.New("ImapAuthenticate: STARTTLS is not supported by the server")
 	}
 
-	if client.State() == imap.Login {
-		if _, err = client.Login(username, password); err != nil {
-			return
+	return imapLogin(client, username, password)
+}
+
+// imapLogin authenticates a user on an established connection. The SASL PLAIN
+// mechanism (AUTHENTICATE command) is used if the server advertises it and the
+// connection is encrypted, else the LOGIN command is used.
+func imapLogin(client *imap.Client, username, password string) (err error) {
+	if client.State() != imap.Login {
+		return
+	}
+
+	if client.Caps["AUTH=PLAIN"] {
+		_, err = client.Auth(imap.PlainAuth(username, password, ""))
+		if _, ok := err.(imap.NotAvailableError); !ok {
+			return imapError(err)
 		}
+		// PLAIN is not available on an unencrypted connection, fall back
+		// to the LOGIN command
 	}
 
-	return
+	_, err = client.Login(username, password)
+	return imapError(err)
+}
+
+// imapError returns a CredentialsError if the error is a NO response from the
+// server (the credentials are rejected), else returns the error unchanged.
+func imapError(err error) error {
+	if rsp, ok := err.(imap.ResponseError); ok && rsp.Response != nil && rsp.Status == imap.NO {
+		return CredentialsError{"ImapAuthenticator: " + rsp.Error()}
+	}
+	return err
 }
 
 // NewImapAuthenticator returns a populated ImapAuthenticator
 func NewImapAuthenticator(app GorgonApp) (Authenticator, error) {
-	server, ok := app.Config.Get("auth:imap", "server")
-	if !ok {
-		panic("'server' variable missing from 'auth:imap' section")
+	server, _ := app.Config.Get("auth:imap", "server")
+	tlsMode, _ := app.Config.Get("auth:imap", "tls_mode")
+
+	// the hostname is the name expected in the server certificate, the Imap
+	// client uses the default port (143 or 993) if none is provided
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
 	}
-	verifyCert, ok := app.Config.Get("auth:imap", "verify_cert")
-	if !ok {
-		verifyCert = "true"
+
+	tlsConfig, err := NewTLSConfig(app.Config, "auth:imap", host)
+	if err != nil {
+		return nil, err
 	}
 
+	usernameTemplate, _ := app.Config.Get("auth:imap", "username_template")
+
 	authenticator := ImapAuthenticator{
-		Server:        server,
-		TLSVerifyCert: verifyCert == "true",
+		Server:           server,
+		TLSMode:          tlsMode,
+		TLSVerifyCert:    !tlsConfig.InsecureSkipVerify,
+		TLSConfig:        tlsConfig,
+		UsernameTemplate: usernameTemplate,
 	}
 	return authenticator, nil
 }
@@ -0,0 +1,254 @@
+package app
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/op/go-logging"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// CacheConfigKeys are the configuration variables of the authentication
+	// cache, accepted in the section of every authentication backend.
+	CacheConfigKeys = []ConfigKey{
+		{Name: "cache", Default: "false", Validate: ValidateBool},
+		{Name: "cache_ttl", Default: "300", Validate: ValidateSeconds},
+		{Name: "cache_negative_ttl", Default: "30", Validate: ValidateNonNegativeInt},
+		{Name: "cache_size", Default: "1000", Validate: ValidatePositiveInt},
+	}
+)
+
+// CachingAuthenticator implements the Authenticator interface and caches the
+// results of another Authenticator, to avoid a round trip to the backend
+// (and its rate limits) each time a user logs in.
+//
+// The passwords are never kept: only a salted Argon2id hash of the password is
+// stored for each username, with the identity returned by the backend. A
+// successful authentication is cached for TTL, a rejected password for
+// NegativeTTL (0 disables the negative cache). Hard errors are never cached.
+// When the cache is full, the least recently used username is evicted.
+//
+// The cache is enabled in the section of any authentication backend, for
+// example:
+//
+// [auth:imap]
+// server = imap.example.com
+// cache = true
+// cache_ttl = 300
+// cache_negative_ttl = 30
+// cache_size = 1000
+//
+type CachingAuthenticator struct {
+	Authenticator Authenticator   // authenticator whose results are cached
+	Name          string          // name of the cached backend, used in the logs
+	TTL           time.Duration   // lifetime of a successful authentication
+	NegativeTTL   time.Duration   // lifetime of a rejected password
+	MaxSize       int             // maximum number of usernames in the cache
+	Logger        *logging.Logger // logger for the cache hits and misses (optional)
+	cache         *authCache
+}
+
+// authCache is the content of a CachingAuthenticator, shared by its copies.
+type authCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element // entries by username
+	lru     *list.List               // usernames, most recently used first
+}
+
+// authCacheEntry holds the cached results for a username: the last
+// successful authentication and the last rejected password.
+type authCacheEntry struct {
+	username string
+	positive *authCacheResult
+	negative *authCacheResult
+}
+
+// authCacheResult is a cached result, the password is stored as a salted
+// hash.
+type authCacheResult struct {
+	salt     []byte
+	hash     []byte
+	identity *Identity // identity returned by the backend (positive results)
+	err      error     // CredentialsError returned by the backend (negative results)
+	expires  time.Time
+}
+
+// NewCachingAuthenticator returns a CachingAuthenticator with an empty cache.
+func NewCachingAuthenticator(authenticator Authenticator, name string, ttl, negativeTTL time.Duration, maxSize int, logger *logging.Logger) CachingAuthenticator {
+	return CachingAuthenticator{
+		Authenticator: authenticator,
+		Name:          name,
+		TTL:           ttl,
+		NegativeTTL:   negativeTTL,
+		MaxSize:       maxSize,
+		Logger:        logger,
+		cache:         &authCache{entries: map[string]*list.Element{}, lru: list.New()},
+	}
+}
+
+// authCacheKey is the HMAC key of the cached passwords, generated randomly
+// for each process since the cache is never persisted.
+var authCacheKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("cannot generate the authentication cache key: " + err.Error())
+	}
+	return key
+}()
+
+// hashCachedPassword returns the HMAC-SHA256 of the salt and the password,
+// keyed with authCacheKey. A keyed hash is enough for a cache that lives in
+// memory, and unlike a password hash it does not cost CPU and memory to each
+// login.
+func hashCachedPassword(password string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, authCacheKey)
+	mac.Write(salt)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// matches returns true if the result is still valid and the password matches
+// the hash.
+func (r *authCacheResult) matches(password string, now time.Time) bool {
+	if r == nil || now.After(r.expires) {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hashCachedPassword(password, r.salt), r.hash) == 1
+}
+
+// Authenticate returns the cached result for the credentials, or calls the
+// cached Authenticator.
+func (a CachingAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext returns the cached result for the credentials, or calls
+// the cached Authenticator with the context and caches its result.
+func (a CachingAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	if result := a.lookup(username, password); result != nil {
+		a.log("Authentication cache hit for '" + username + "' (" + a.Name + ")")
+		if result.err != nil {
+			return nil, result.err
+		}
+		identity := *result.identity
+		return &identity, nil
+	}
+	a.log("Authentication cache miss for '" + username + "' (" + a.Name + ")")
+
+	identity, err := NewContextAuthenticator(a.Authenticator).AuthenticateContext(ctx, username, password)
+	if err == nil {
+		// as AuthenticatorAdapter, a backend without identity
+		// authenticates the username
+		if identity == nil {
+			identity = &Identity{Email: username}
+		}
+		a.store(username, password, identity, nil)
+	} else if IsCredentialsError(err) && a.NegativeTTL > 0 {
+		a.store(username, password, nil, err)
+	}
+	return identity, err
+}
+
+// lookup returns the cached result matching the credentials, or nil.
+func (a CachingAuthenticator) lookup(username, password string) *authCacheResult {
+	a.cache.mutex.Lock()
+	element, found := a.cache.entries[username]
+	if !found {
+		a.cache.mutex.Unlock()
+		return nil
+	}
+	entry := element.Value.(*authCacheEntry)
+	positive, negative := entry.positive, entry.negative
+	a.cache.lru.MoveToFront(element)
+	a.cache.mutex.Unlock()
+
+	// the hashes are computed without holding the lock
+	now := time.Now()
+	if positive.matches(password, now) {
+		return positive
+	}
+	if negative.matches(password, now) {
+		return negative
+	}
+	return nil
+}
+
+// store adds the result of the backend in the cache, a positive result if err
+// is nil.
+func (a CachingAuthenticator) store(username, password string, identity *Identity, err error) {
+	salt := make([]byte, 16)
+	if _, e := rand.Read(salt); e != nil {
+		return
+	}
+	result := &authCacheResult{salt: salt, hash: hashCachedPassword(password, salt)}
+	if err == nil {
+		copied := *identity
+		result.identity = &copied
+		result.expires = time.Now().Add(a.TTL)
+	} else {
+		result.err = err
+		result.expires = time.Now().Add(a.NegativeTTL)
+	}
+
+	a.cache.mutex.Lock()
+	defer a.cache.mutex.Unlock()
+	element, found := a.cache.entries[username]
+	if !found {
+		element = a.cache.lru.PushFront(&authCacheEntry{username: username})
+		a.cache.entries[username] = element
+	} else {
+		a.cache.lru.MoveToFront(element)
+	}
+	entry := element.Value.(*authCacheEntry)
+	if err == nil {
+		// the previous rejected password may be the new password
+		entry.positive, entry.negative = result, nil
+	} else {
+		entry.negative = result
+	}
+
+	for a.cache.lru.Len() > a.MaxSize {
+		oldest := a.cache.lru.Back()
+		a.cache.lru.Remove(oldest)
+		delete(a.cache.entries, oldest.Value.(*authCacheEntry).username)
+	}
+}
+
+// Len returns the number of usernames in the cache.
+func (a CachingAuthenticator) Len() int {
+	a.cache.mutex.Lock()
+	defer a.cache.mutex.Unlock()
+	return a.cache.lru.Len()
+}
+
+func (a CachingAuthenticator) log(message string) {
+	if a.Logger != nil {
+		a.Logger.Info(message)
+	}
+}
+
+// newCachingAuthenticatorFromConfig wraps the authenticator in a
+// CachingAuthenticator if the cache is enabled in the section of the backend.
+// The section has been checked against CacheConfigKeys.
+func newCachingAuthenticatorFromConfig(app GorgonApp, backend AuthenticatorBackend, authenticator Authenticator) Authenticator {
+	section := backend.Section()
+	if enabled, _ := app.Config.Get(section, "cache"); enabled != "true" {
+		return authenticator
+	}
+	value, _ := app.Config.Get(section, "cache_ttl")
+	ttl, _ := strconv.Atoi(value)
+	value, _ = app.Config.Get(section, "cache_negative_ttl")
+	negativeTTL, _ := strconv.Atoi(value)
+	value, _ = app.Config.Get(section, "cache_size")
+	maxSize, _ := strconv.Atoi(value)
+
+	return NewCachingAuthenticator(authenticator, backend.Name,
+		time.Duration(ttl)*time.Second, time.Duration(negativeTTL)*time.Second, maxSize, app.Logger)
+}
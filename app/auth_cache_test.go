@@ -0,0 +1,169 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// countingAuthenticator is an Authenticator counting the calls to another
+// Authenticator.
+type countingAuthenticator struct {
+	Authenticator
+	calls *int
+}
+
+func (a countingAuthenticator) Authenticate(username, password string) error {
+	*a.calls++
+	return a.Authenticator.Authenticate(username, password)
+}
+
+func TestCachingAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// the cache is disabled by default
+	authenticator, err := NewAuthenticator(app, "test")
+	assert.NoError(t, err)
+	assert.IsType(t, TestAuthenticator{}, authenticator)
+
+	// the cache is enabled in the section of the backend
+	app.Config = ini.File{"auth:test": ini.Section{
+		"global_password":    "verysecret",
+		"cache":              "true",
+		"cache_ttl":          "60",
+		"cache_negative_ttl": "0",
+		"cache_size":         "10",
+	}}
+	authenticator, err = NewAuthenticator(app, "test")
+	assert.NoError(t, err)
+	assert.IsType(t, CachingAuthenticator{}, authenticator)
+	cachingAuthenticator := authenticator.(CachingAuthenticator)
+	assert.Equal(t, TestAuthenticator{"verysecret"}, cachingAuthenticator.Authenticator)
+	assert.Equal(t, "test", cachingAuthenticator.Name)
+	assert.Equal(t, 60*time.Second, cachingAuthenticator.TTL)
+	assert.Equal(t, time.Duration(0), cachingAuthenticator.NegativeTTL)
+	assert.Equal(t, 10, cachingAuthenticator.MaxSize)
+
+	// default values
+	app.Config = ini.File{"auth:test": ini.Section{"global_password": "verysecret", "cache": "true"}}
+	authenticator, err = NewAuthenticator(app, "test")
+	assert.NoError(t, err)
+	cachingAuthenticator = authenticator.(CachingAuthenticator)
+	assert.Equal(t, 300*time.Second, cachingAuthenticator.TTL)
+	assert.Equal(t, 30*time.Second, cachingAuthenticator.NegativeTTL)
+	assert.Equal(t, 1000, cachingAuthenticator.MaxSize)
+
+	// invalid configurations
+	for _, section := range []ini.Section{
+		{"cache": "yes"},
+		{"cache": "true", "cache_ttl": "0"},
+		{"cache": "true", "cache_negative_ttl": "-1"},
+		{"cache": "true", "cache_size": "0"},
+	} {
+		section["global_password"] = "verysecret"
+		app.Config = ini.File{"auth:test": section}
+		_, err = NewAuthenticator(app, "test")
+		assert.Error(t, err)
+	}
+}
+
+func TestCachingAuthenticate(t *testing.T) {
+	var calls int
+	backend := countingAuthenticator{TestAuthenticator{"verysecret"}, &calls}
+	logs := logging.NewMemoryBackend(100)
+	logger := logging.MustGetLogger("gorgon-cache-test")
+	logger.SetBackend(logging.AddModuleLevel(logs))
+	authenticator := NewCachingAuthenticator(backend, "test", time.Minute, time.Minute, 2, logger)
+
+	// a successful authentication is cached
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Equal(t, 1, calls)
+	messages := []string{}
+	for node := logs.Head(); node != nil; node = node.Next() {
+		messages = append(messages, node.Record.Message())
+	}
+	assert.Equal(t, []string{
+		"Authentication cache miss for 'alice@example.com' (test)",
+		"Authentication cache hit for 'alice@example.com' (test)",
+	}, messages)
+
+	// a rejected password is cached, without hiding the valid password
+	err := authenticator.Authenticate("alice@example.com", "bad password")
+	assert.True(t, IsCredentialsError(err))
+	err = authenticator.Authenticate("alice@example.com", "bad password")
+	assert.True(t, IsCredentialsError(err))
+	assert.Equal(t, 2, calls)
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Equal(t, 2, calls)
+
+	// another password is not in the cache
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "other password"))
+	assert.Equal(t, 3, calls)
+
+	// the least recently used username is evicted
+	assert.NoError(t, authenticator.Authenticate("bob@example.com", "verysecret"))
+	assert.NoError(t, authenticator.Authenticate("carol@example.com", "verysecret"))
+	assert.Equal(t, 2, authenticator.Len())
+	calls = 0
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Equal(t, 1, calls)
+
+	// the cached results expire
+	authenticator = NewCachingAuthenticator(backend, "test", 50*time.Millisecond, 50*time.Millisecond, 10, nil)
+	calls = 0
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "bad password"))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "bad password"))
+	assert.Equal(t, 4, calls)
+
+	// the negative cache can be disabled
+	authenticator = NewCachingAuthenticator(backend, "test", time.Minute, 0, 10, nil)
+	calls = 0
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "bad password"))
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "bad password"))
+	assert.Equal(t, 2, calls)
+
+	// hard errors are never cached
+	calls = 0
+	authenticator = NewCachingAuthenticator(stubAuthenticator{errors.New("connection refused"), &calls}, "stub", time.Minute, time.Minute, 10, nil)
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 0, authenticator.Len())
+}
+
+func TestCachingAuthenticatorIdentity(t *testing.T) {
+	var calls int
+	backend := ChainAuthenticator{
+		Names:    []string{"stub"},
+		Backends: []Authenticator{stubAuthenticator{nil, &calls}},
+		Mode:     "first-success",
+	}
+	authenticator := NewCachingAuthenticator(backend, "chain", time.Minute, time.Minute, 10, nil)
+
+	// the cached identity is a copy
+	identity, err := authenticator.AuthenticateContext(context.Background(), "alice@example.com", "verysecret")
+	assert.NoError(t, err)
+	identity.DisplayName = "Mallory"
+	identity, err = authenticator.AuthenticateContext(context.Background(), "alice@example.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "alice@example.com"}, identity)
+	assert.Equal(t, 1, calls)
+
+	// a backend returning no identity authenticates the username
+	authenticator = NewCachingAuthenticator(identityAuthenticator{nil}, "nil", time.Minute, time.Minute, 10, nil)
+	for i := 0; i < 2; i++ {
+		identity, err = authenticator.AuthenticateContext(context.Background(), "alice@example.com", "verysecret")
+		assert.NoError(t, err)
+		assert.Equal(t, &Identity{Email: "alice@example.com"}, identity)
+	}
+}
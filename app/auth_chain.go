@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "chain",
+		Keys: []ConfigKey{
+			{Name: "backends", Required: true, Validate: ValidateNotEmpty},
+			{Name: "mode", Default: "first-success", Validate: ValidateOneOf("first-success", "all-must-pass")},
+		},
+		New: NewChainAuthenticator,
+	})
+}
+
+// ChainAuthenticator implements the Authenticator interface to authenticate
+// users with several backends, tried in order. Each backend is configured in
+// its own section, as if it was the only authentication backend.
+//
+// The mode defines how the results of the backends are combined:
+// - first-success: the user is authenticated by the first backend accepting
+//   the credentials, the next backend is tried when the credentials are
+//   rejected (useful to migrate users from a backend to another one)
+// - all-must-pass: the user is authenticated if all the backends accept the
+//   credentials
+//
+// In both modes, a hard error of a backend (unreachable server, invalid
+// response, ...) stops the chain: the user is not authenticated and the
+// next backends are not tried.
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = chain
+//
+// [auth:chain]
+// backends = ldap, file
+// mode = first-success
+//
+type ChainAuthenticator struct {
+	Names    []string        // names of the backends
+	Backends []Authenticator // backends, in the same order as the names
+	Mode     string          // "first-success" or "all-must-pass"
+}
+
+// Authenticate tries the backends in order, according to the mode.
+func (a ChainAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext tries the backends in order, according to the mode. The
+// context is passed to each backend. The identity is the one returned by the
+// backend accepting the credentials (first-success), or by the first backend
+// (all-must-pass).
+func (a ChainAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	if len(a.Backends) == 0 {
+		return nil, errors.New("ChainAuthenticator: no backend configured")
+	}
+
+	var first *Identity
+	for i, backend := range a.Backends {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		identity, err := NewContextAuthenticator(backend).AuthenticateContext(ctx, username, password)
+		if err == nil {
+			if a.Mode == "first-success" {
+				return identity, nil
+			}
+			if first == nil {
+				first = identity
+			}
+			continue
+		}
+		if !IsCredentialsError(err) {
+			return nil, errors.New("ChainAuthenticator: '" + a.Names[i] + "' backend failed: " + err.Error())
+		}
+		if a.Mode == "all-must-pass" {
+			return nil, CredentialsError{"ChainAuthenticator: credentials rejected by the '" + a.Names[i] + "' backend"}
+		}
+	}
+
+	if a.Mode == "all-must-pass" {
+		return first, nil
+	}
+	return nil, CredentialsError{"ChainAuthenticator: credentials rejected by all backends"}
+}
+
+// NewChainAuthenticator returns a populated ChainAuthenticator. Each backend
+// is created with NewAuthenticator.
+func NewChainAuthenticator(app GorgonApp) (Authenticator, error) {
+	value, _ := app.Config.Get("auth:chain", "backends")
+	mode, _ := app.Config.Get("auth:chain", "mode")
+
+	authenticator := ChainAuthenticator{Mode: mode}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "chain" {
+			return nil, errors.New("'backends' can't contain 'chain' in 'auth:chain' section")
+		}
+		backend, err := NewAuthenticator(app, name)
+		if err != nil {
+			return nil, err
+		}
+		authenticator.Names = append(authenticator.Names, name)
+		authenticator.Backends = append(authenticator.Backends, backend)
+	}
+	if len(authenticator.Backends) == 0 {
+		return nil, errors.New("'backends' variable missing from 'auth:chain' section")
+	}
+	return authenticator, nil
+}
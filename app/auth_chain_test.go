@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// stubAuthenticator is an Authenticator returning a fixed result, and
+// counting the calls to Authenticate.
+type stubAuthenticator struct {
+	err   error
+	calls *int
+}
+
+func (a stubAuthenticator) Authenticate(username, password string) error {
+	*a.calls++
+	return a.err
+}
+
+// identityAuthenticator is a ContextAuthenticator accepting any password and
+// returning a fixed identity (possibly nil).
+type identityAuthenticator struct {
+	identity *Identity
+}
+
+func (a identityAuthenticator) Authenticate(username, password string) error {
+	return nil
+}
+
+func (a identityAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	return a.identity, nil
+}
+
+func TestIsCredentialsError(t *testing.T) {
+	assert.True(t, IsCredentialsError(CredentialsError{"rejected"}))
+	assert.True(t, IsCredentialsError(ErrPasswordMismatch))
+	assert.False(t, IsCredentialsError(errors.New("connection refused")))
+	assert.False(t, IsCredentialsError(nil))
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create a chain authenticator
+	authenticator, err := NewAuthenticator(app, "chain")
+	assert.NoError(t, err)
+	assert.IsType(t, ChainAuthenticator{}, authenticator)
+	chainAuthenticator := authenticator.(ChainAuthenticator)
+	assert.Equal(t, []string{"file", "test"}, chainAuthenticator.Names)
+	assert.Len(t, chainAuthenticator.Backends, 2)
+	assert.IsType(t, &FileAuthenticator{}, chainAuthenticator.Backends[0])
+	assert.IsType(t, TestAuthenticator{}, chainAuthenticator.Backends[1])
+	assert.Equal(t, "first-success", chainAuthenticator.Mode)
+
+	// try to authenticate with the backends
+	assert.NoError(t, authenticator.Authenticate("bcrypt@example.com", "verysecret"))
+	assert.NoError(t, authenticator.Authenticate("bob@example.com", "secretpasswordfortests"))
+	err = authenticator.Authenticate("bob@example.com", "bad password")
+	assert.Error(t, err)
+	assert.True(t, IsCredentialsError(err))
+
+	// invalid configurations
+	for _, section := range []ini.Section{
+		{},
+		{"backends": " , "},
+		{"backends": "file", "mode": "any"},
+		{"backends": "file, chain"},
+		{"backends": "file, doesnotexist"},
+	} {
+		app.Config["auth:chain"] = section
+		_, err = NewAuthenticator(app, "chain")
+		assert.Error(t, err)
+	}
+}
+
+func TestChainAuthenticate(t *testing.T) {
+	var first, second int
+	rejected := CredentialsError{"rejected"}
+	hardError := errors.New("connection refused")
+	chain := func(mode string, err1, err2 error) ChainAuthenticator {
+		first, second = 0, 0
+		return ChainAuthenticator{
+			Names:    []string{"first", "second"},
+			Backends: []Authenticator{stubAuthenticator{err1, &first}, stubAuthenticator{err2, &second}},
+			Mode:     mode,
+		}
+	}
+
+	// first-success: the first backend accepting the credentials wins
+	assert.NoError(t, chain("first-success", nil, rejected).Authenticate("alice@example.com", "verysecret"))
+	assert.Equal(t, 0, second)
+	assert.NoError(t, chain("first-success", rejected, nil).Authenticate("alice@example.com", "verysecret"))
+	assert.Equal(t, 1, second)
+	err := chain("first-success", rejected, rejected).Authenticate("alice@example.com", "verysecret")
+	assert.True(t, IsCredentialsError(err))
+
+	// first-success: a hard error stops the chain
+	err = chain("first-success", hardError, nil).Authenticate("alice@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.False(t, IsCredentialsError(err))
+	assert.Equal(t, 0, second)
+
+	// all-must-pass: all the backends must accept the credentials
+	assert.NoError(t, chain("all-must-pass", nil, nil).Authenticate("alice@example.com", "verysecret"))
+	assert.Equal(t, 1, second)
+	err = chain("all-must-pass", nil, rejected).Authenticate("alice@example.com", "verysecret")
+	assert.True(t, IsCredentialsError(err))
+	err = chain("all-must-pass", rejected, nil).Authenticate("alice@example.com", "verysecret")
+	assert.True(t, IsCredentialsError(err))
+	assert.Equal(t, 0, second)
+
+	// all-must-pass: a hard error stops the chain
+	err = chain("all-must-pass", nil, hardError).Authenticate("alice@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.False(t, IsCredentialsError(err))
+
+	// identities
+	identity, err := chain("first-success", rejected, nil).AuthenticateContext(context.Background(), "alice@example.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "alice@example.com"}, identity)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = chain("first-success", nil, nil).AuthenticateContext(ctx, "alice@example.com", "verysecret")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, first)
+
+	// no backend
+	assert.Error(t, ChainAuthenticator{Mode: "first-success"}.Authenticate("alice@example.com", "verysecret"))
+}
@@ -0,0 +1,205 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DovecotAuthenticator implements the Authenticator interface to authenticate
+// users with the authentication server of Dovecot, using the Dovecot auth
+// client protocol (VERSION, CPID and AUTH with the PLAIN mechanism) on a UNIX
+// or TCP socket. All the passdb configuration of Dovecot (lockouts, policy,
+// ...) is reused without an IMAP round-trip. The IP address of the client
+// (see AuthClient) is sent to Dovecot, and the connection with the user is
+// declared secured if the client is connected to Gorgon with TLS, or always
+// with Secured (Gorgon behind an HTTPS reverse proxy).
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = dovecot
+//
+// [auth:dovecot]
+// network = unix
+// address = /var/run/dovecot/auth-client
+// service = gorgon
+// secured = false
+// username_template = %e
+//
+type DovecotAuthenticator struct {
+	Network          string        // "unix" or "tcp"
+	Address          string        // path of the UNIX socket or address (host:port) of the TCP socket
+	Service          string        // service name sent to Dovecot (used in passdb lookups)
+	Secured          bool          // always tell Dovecot that the connection with the user is secured (TLS)
+	UsernameTemplate string        // template used to create the Dovecot login name
+	Timeout          time.Duration // maximum duration of the authentication
+}
+
+// Authenticate uses the authentication server of Dovecot to authenticate
+// users. The login name is created from the username (email) with the
+// username template.
+func (a DovecotAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext uses the authentication server of Dovecot to
+// authenticate users, the connection is interrupted when the context is
+// done.
+func (a DovecotAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	if err := a.authenticate(ctx, FormatUsername(a.UsernameTemplate, username), password, AuthClientFromContext(ctx)); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return &Identity{Email: username}, nil
+}
+
+// authenticate sends the login name and the password to the authentication
+// server of Dovecot, with the IP address of the client.
+func (a DovecotAuthenticator) authenticate(ctx context.Context, username, password string, client AuthClient) error {
+	if strings.ContainsAny(username, "\x00\t\n") || strings.ContainsRune(password, 0) {
+		return CredentialsError{"DovecotAuthenticator: invalid character in credentials"}
+	}
+
+	ctx, cancel := contextWithTimeout(ctx, a.Timeout)
+	defer cancel()
+	conn, err := dialContext(ctx, a.Network, a.Address, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+
+	// handshake: send our version and process ID, read the server handshake
+	// until "DONE"
+	text.PrintfLine("VERSION\t1\t2")
+	text.PrintfLine("CPID\t%d", os.Getpid())
+	plain := false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return err
+		}
+		fields := strings.Split(line, "\t")
+		if fields[0] == "DONE" {
+			break
+		}
+		switch fields[0] {
+		case "VERSION":
+			if len(fields) < 2 || fields[1] != "1" {
+				return errors.New("DovecotAuthenticator: unsupported protocol version (" + line + ")")
+			}
+		case "MECH":
+			if len(fields) >= 2 && strings.ToUpper(fields[1]) == "PLAIN" {
+				plain = true
+			}
+		}
+	}
+	if !plain {
+		return errors.New("DovecotAuthenticator: the PLAIN mechanism is not supported by the server")
+	}
+
+	response := base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+	command := "AUTH\t1\tPLAIN\tservice=" + a.Service
+	if ip := net.ParseIP(client.IP); ip != nil {
+		command += "\trip=" + ip.String()
+	}
+	if a.Secured || client.Secured {
+		command += "\tsecured"
+	}
+	if err = text.PrintfLine("%s\tresp=%s", command, response); err != nil {
+		return err
+	}
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return err
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || fields[1] != "1" {
+			// not a response to our request
+			continue
+		}
+		switch fields[0] {
+		case "OK":
+			return nil
+		case "FAIL":
+			return dovecotFailure(fields[2:])
+		case "CONT":
+			return errors.New("DovecotAuthenticator: unexpected challenge from the server")
+		}
+	}
+}
+
+// dovecotFailure returns an error describing a FAIL response, using the
+// "reason" and "temp" parameters of the response. A FAIL response without the
+// "temp" parameter returns a CredentialsError.
+func dovecotFailure(parameters []string) error {
+	message, reason, temporary := "DovecotAuthenticator: authentication failed", "", false
+	for _, parameter := range parameters {
+		switch {
+		case parameter == "temp":
+			message = "DovecotAuthenticator: temporary authentication failure"
+			temporary = true
+		case strings.HasPrefix(parameter, "reason="):
+			reason = strings.TrimPrefix(parameter, "reason=")
+		}
+	}
+	if reason != "" {
+		message += " (" + reason + ")"
+	}
+	if temporary {
+		return errors.New(message)
+	}
+	return CredentialsError{message}
+}
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "dovecot",
+		Keys: []ConfigKey{
+			{Name: "network", Default: "unix", Validate: ValidateOneOf("unix", "tcp")},
+			{Name: "address"},
+			{Name: "service", Default: "gorgon"},
+			{Name: "secured", Default: "false", Validate: ValidateBool},
+			{Name: "username_template", Default: "%e"},
+			{Name: "timeout", Default: "10", Validate: ValidateSeconds},
+		},
+		New: NewDovecotAuthenticator,
+	})
+}
+
+// NewDovecotAuthenticator returns a populated DovecotAuthenticator.
+func NewDovecotAuthenticator(app GorgonApp) (Authenticator, error) {
+	network, _ := app.Config.Get("auth:dovecot", "network")
+	address, ok := app.Config.Get("auth:dovecot", "address")
+	if !ok {
+		if network == "tcp" {
+			return nil, errors.New("'address' variable missing from 'auth:dovecot' section")
+		}
+		address = "/var/run/dovecot/auth-client"
+	}
+	service, _ := app.Config.Get("auth:dovecot", "service")
+	secured, _ := app.Config.Get("auth:dovecot", "secured")
+	usernameTemplate, _ := app.Config.Get("auth:dovecot", "username_template")
+	value, _ := app.Config.Get("auth:dovecot", "timeout")
+	seconds, _ := strconv.Atoi(value)
+
+	authenticator := DovecotAuthenticator{
+		Network:          network,
+		Address:          address,
+		Service:          service,
+		Secured:          secured == "true",
+		UsernameTemplate: usernameTemplate,
+		Timeout:          time.Duration(seconds) * time.Second,
+	}
+	return authenticator, nil
+}
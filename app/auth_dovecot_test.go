@@ -0,0 +1,225 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// dovecotServer is a minimal stand-in for the authentication server of
+// Dovecot. It only understands the VERSION, CPID and AUTH (PLAIN) commands.
+type dovecotServer struct {
+	listener  net.Listener
+	mechanism string // mechanism advertised by the server
+
+	mutex    sync.Mutex
+	requests []string // AUTH requests received, without the resp parameter
+}
+
+// newDovecotServer starts a stand-in Dovecot authentication server.
+func newDovecotServer(t *testing.T, network, address, mechanism string) *dovecotServer {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dovecotServer{listener: listener, mechanism: mechanism}
+	go s.serve()
+	return s
+}
+
+func (s *dovecotServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *dovecotServer) Close() {
+	s.listener.Close()
+}
+
+func (s *dovecotServer) Requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+func (s *dovecotServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *dovecotServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("VERSION\t1\t2")
+	text.PrintfLine("MECH\t%s\tplaintext", s.mechanism)
+	text.PrintfLine("MECH\tLOGIN\tplaintext")
+	text.PrintfLine("SPID\t1234")
+	text.PrintfLine("CUID\t1")
+	text.PrintfLine("COOKIE\t0123456789abcdef0123456789abcdef")
+	text.PrintfLine("DONE")
+
+	handshake := false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Split(line, "\t")
+		switch fields[0] {
+		case "VERSION":
+			if len(fields) != 3 || fields[1] != "1" {
+				return
+			}
+		case "CPID":
+			handshake = true
+		case "AUTH":
+			if !handshake || len(fields) < 4 {
+				return
+			}
+			id, username, password := fields[1], "", ""
+			request := []string{}
+			for _, parameter := range fields {
+				if strings.HasPrefix(parameter, "resp=") {
+					decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(parameter, "resp="))
+					parts := strings.Split(string(decoded), "\x00")
+					if len(parts) == 3 {
+						username, password = parts[1], parts[2]
+					}
+				} else {
+					request = append(request, parameter)
+				}
+			}
+			s.mutex.Lock()
+			s.requests = append(s.requests, strings.Join(request, "\t"))
+			s.mutex.Unlock()
+
+			// an unrelated line, the client must ignore it
+			text.PrintfLine("FAIL\t42\treason=unrelated")
+			switch {
+			case username == "alice@example.com" && password == "verysecret":
+				text.PrintfLine("OK\t%s\tuser=%s", id, username)
+			case username == "locked@example.com":
+				text.PrintfLine("FAIL\t%s\tuser=%s\treason=Account is locked", id, username)
+			case username == "broken@example.com":
+				text.PrintfLine("FAIL\t%s\ttemp", id)
+			default:
+				text.PrintfLine("FAIL\t%s\tuser=%s", id, username)
+			}
+		}
+	}
+}
+
+func TestDovecotAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create a Dovecot authenticator
+	authenticator, err := NewAuthenticator(app, "dovecot")
+	assert.NoError(t, err)
+	assert.IsType(t, DovecotAuthenticator{}, authenticator)
+	dovecotAuthenticator := authenticator.(DovecotAuthenticator)
+	assert.Equal(t, "tcp", dovecotAuthenticator.Network)
+	assert.Equal(t, "dovecot.example.com:12345", dovecotAuthenticator.Address)
+	assert.Equal(t, "persona", dovecotAuthenticator.Service)
+	assert.False(t, dovecotAuthenticator.Secured)
+	assert.Equal(t, "%u", dovecotAuthenticator.UsernameTemplate)
+	assert.Equal(t, 10*time.Second, dovecotAuthenticator.Timeout)
+
+	// default values
+	app.Config = ini.File{"auth:dovecot": ini.Section{}}
+	authenticator, err = NewAuthenticator(app, "dovecot")
+	assert.NoError(t, err)
+	dovecotAuthenticator = authenticator.(DovecotAuthenticator)
+	assert.Equal(t, "unix", dovecotAuthenticator.Network)
+	assert.Equal(t, "/var/run/dovecot/auth-client", dovecotAuthenticator.Address)
+	assert.Equal(t, "gorgon", dovecotAuthenticator.Service)
+	assert.False(t, dovecotAuthenticator.Secured)
+
+	// invalid configurations
+	for _, section := range []ini.Section{
+		{"network": "udp"},
+		{"network": "tcp"},
+		{"timeout": "-1"},
+	} {
+		app.Config = ini.File{"auth:dovecot": section}
+		_, err = NewAuthenticator(app, "dovecot")
+		assert.Error(t, err)
+	}
+}
+
+func TestDovecotAuthenticate(t *testing.T) {
+	var (
+		s             *dovecotServer
+		authenticator DovecotAuthenticator
+	)
+
+	// UNIX socket
+	dir, err := ioutil.TempDir("", "gorgon-dovecot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s = newDovecotServer(t, "unix", filepath.Join(dir, "auth-client"), "PLAIN")
+	authenticator = DovecotAuthenticator{Network: "unix", Address: s.Addr(), Service: "gorgon", Secured: true, Timeout: time.Second}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("alice@example.com", "bad password")))
+	assert.Equal(t, "AUTH\t1\tPLAIN\tservice=gorgon\tsecured", s.Requests()[0])
+
+	// failure reasons
+	err = authenticator.Authenticate("locked@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Account is locked")
+	err = authenticator.Authenticate("broken@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "temporary")
+	assert.False(t, IsCredentialsError(err))
+
+	// invalid characters in the username
+	assert.Error(t, authenticator.Authenticate("alice@example.com\tresp=", "verysecret"))
+	s.Close()
+
+	// TCP socket with a username template
+	s = newDovecotServer(t, "tcp", "127.0.0.1:0", "PLAIN")
+	authenticator = DovecotAuthenticator{Network: "tcp", Address: s.Addr(), Service: "persona", UsernameTemplate: "%u@example.com", Timeout: time.Second}
+	assert.NoError(t, authenticator.Authenticate("alice@foobar.com", "verysecret"))
+	assert.Equal(t, "AUTH\t1\tPLAIN\tservice=persona", s.Requests()[0])
+
+	// the client of the authentication is sent to Dovecot, the connection is
+	// secured only if the client is connected with TLS
+	ctx := WithAuthClient(context.Background(), AuthClient{IP: "192.0.2.1", Secured: true})
+	_, err = authenticator.AuthenticateContext(ctx, "alice@foobar.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, "AUTH\t1\tPLAIN\tservice=persona\trip=192.0.2.1\tsecured", s.Requests()[1])
+	ctx = WithAuthClient(context.Background(), AuthClient{IP: "2001:db8::1"})
+	_, err = authenticator.AuthenticateContext(ctx, "alice@foobar.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, "AUTH\t1\tPLAIN\tservice=persona\trip=2001:db8::1", s.Requests()[2])
+	ctx = WithAuthClient(context.Background(), AuthClient{IP: "192.0.2.1\tsecured"})
+	_, err = authenticator.AuthenticateContext(ctx, "alice@foobar.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, "AUTH\t1\tPLAIN\tservice=persona", s.Requests()[3])
+	s.Close()
+
+	// PLAIN not supported by the server
+	s = newDovecotServer(t, "tcp", "127.0.0.1:0", "CRAM-MD5")
+	authenticator = DovecotAuthenticator{Network: "tcp", Address: s.Addr(), Service: "gorgon", Timeout: time.Second}
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Empty(t, s.Requests())
+	s.Close()
+}
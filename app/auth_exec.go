@@ -0,0 +1,162 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExecAuthenticator implements the Authenticator interface to authenticate
+// users with an external program speaking the checkpassword protocol
+// (https://cr.yp.to/checkpwd/interface.html). The program reads the
+// username, the password and a timestamp, each terminated by a NUL byte, on
+// file descriptor 3. Its exit code gives the result of the authentication:
+// - 0: the user is authenticated
+// - 1: the credentials are rejected
+// - any other exit code is a temporary failure of the program
+//
+// The program is started with an empty environment, only the variables
+// listed in the configuration are passed ("NAME" copies the variable from the
+// Gorgon environment, "NAME=value" sets it). The program is killed if it does
+// not exit before the timeout, and at most max_processes programs run at the
+// same time.
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = exec
+//
+// [auth:exec]
+// command = /usr/local/bin/checkpassword /bin/true
+// timeout = 10
+// env = PATH, LANG=C
+// max_processes = 4
+//
+type ExecAuthenticator struct {
+	Command []string      // program to run and its arguments
+	Env     []string      // environment of the program ("NAME=value")
+	Timeout time.Duration // maximum duration of the program, including the wait for a free slot
+	slots   chan struct{} // limit the number of programs running at the same time
+}
+
+// Authenticate runs the checkpassword program with the username (email) and
+// the password.
+func (a ExecAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext runs the checkpassword program with the username
+// (email) and the password. The program is killed when the context is done.
+func (a ExecAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	if strings.ContainsRune(username, 0) || strings.ContainsRune(password, 0) {
+		return nil, CredentialsError{"ExecAuthenticator: invalid character in credentials"}
+	}
+	data := []byte(username + "\x00" + password + "\x00" + strconv.FormatInt(time.Now().Unix(), 10) + "\x00")
+	// the checkpassword protocol allows at most 512 bytes
+	if len(data) > 512 {
+		return nil, CredentialsError{"ExecAuthenticator: credentials too long"}
+	}
+
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+
+	if a.slots != nil {
+		select {
+		case a.slots <- struct{}{}:
+			defer func() { <-a.slots }()
+		case <-ctx.Done():
+			return nil, errors.New("ExecAuthenticator: too many checkpassword programs running")
+		}
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	defer writer.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, a.Command[0], a.Command[1:]...)
+	cmd.Env = a.Env
+	cmd.ExtraFiles = []*os.File{reader} // file descriptor 3
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	reader.Close()
+	// the data fits in the pipe buffer, the write never blocks
+	writer.Write(data)
+	writer.Close()
+
+	err = cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, errors.New("ExecAuthenticator: checkpassword program timed out")
+	} else if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if exitErr.ExitCode() == 1 {
+			return nil, CredentialsError{"ExecAuthenticator: credentials rejected"}
+		}
+		return nil, errors.New("ExecAuthenticator: checkpassword program failed (" + exitErr.Error() + "): " + strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Email: username}, nil
+}
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "exec",
+		Keys: []ConfigKey{
+			{Name: "command", Required: true, Validate: ValidateNotEmpty},
+			{Name: "timeout", Default: "10", Validate: ValidateSeconds},
+			{Name: "max_processes", Default: "4", Validate: ValidatePositiveInt},
+			{Name: "env"},
+		},
+		New: NewExecAuthenticator,
+	})
+}
+
+// NewExecAuthenticator returns a populated ExecAuthenticator.
+func NewExecAuthenticator(app GorgonApp) (Authenticator, error) {
+	command, _ := app.Config.Get("auth:exec", "command")
+	value, _ := app.Config.Get("auth:exec", "timeout")
+	seconds, _ := strconv.Atoi(value)
+	value, _ = app.Config.Get("auth:exec", "max_processes")
+	maxProcesses, _ := strconv.Atoi(value)
+
+	env := []string{}
+	if value, ok := app.Config.Get("auth:exec", "env"); ok {
+		for _, variable := range strings.Split(value, ",") {
+			variable = strings.TrimSpace(variable)
+			if variable == "" {
+				continue
+			}
+			if !strings.Contains(variable, "=") {
+				variable = variable + "=" + os.Getenv(variable)
+			}
+			env = append(env, variable)
+		}
+	}
+
+	authenticator := ExecAuthenticator{
+		Command: strings.Fields(command),
+		Env:     env,
+		Timeout: time.Duration(seconds) * time.Second,
+		slots:   make(chan struct{}, maxProcesses),
+	}
+	return authenticator, nil
+}
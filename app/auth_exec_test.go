@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestExecAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create an exec authenticator
+	os.Setenv("GORGON_TEST_LANG", "fr_FR.UTF-8")
+	defer os.Unsetenv("GORGON_TEST_LANG")
+	authenticator, err := NewAuthenticator(app, "exec")
+	assert.NoError(t, err)
+	assert.IsType(t, ExecAuthenticator{}, authenticator)
+	execAuthenticator := authenticator.(ExecAuthenticator)
+	assert.Equal(t, []string{"../tests/checkpassword.sh", "/bin/true"}, execAuthenticator.Command)
+	assert.Equal(t, []string{"GORGON_TEST_LANG=fr_FR.UTF-8", "GORGON_TEST=hello"}, execAuthenticator.Env)
+	assert.Equal(t, 5*time.Second, execAuthenticator.Timeout)
+	assert.Equal(t, 2, cap(execAuthenticator.slots))
+
+	// invalid configurations
+	for _, section := range []ini.Section{
+		{},
+		{"command": " "},
+		{"command": "/bin/true", "timeout": "never"},
+		{"command": "/bin/true", "max_processes": "0"},
+	} {
+		app.Config = ini.File{"auth:exec": section}
+		_, err = NewAuthenticator(app, "exec")
+		assert.Error(t, err)
+	}
+}
+
+func TestExecAuthenticate(t *testing.T) {
+	authenticator := ExecAuthenticator{
+		Command: []string{"../tests/checkpassword.sh", "/bin/true"},
+		Env:     []string{"PATH=" + os.Getenv("PATH"), "GORGON_TEST=hello"},
+		Timeout: 5 * time.Second,
+		slots:   make(chan struct{}, 1),
+	}
+
+	// try to authenticate with valid and invalid credentials
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("alice@example.com", "bad password")))
+	assert.Error(t, authenticator.Authenticate("bob@example.com", "verysecret"))
+
+	// the credentials can't contain NUL bytes and are limited to 512 bytes
+	assert.Error(t, authenticator.Authenticate("alice@example.com\x00", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("alice@example.com", strings.Repeat("x", 512)))
+
+	// temporary failure of the program
+	err := authenticator.Authenticate("broken@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "database unavailable")
+	assert.False(t, IsCredentialsError(err))
+
+	// only the configured environment is passed to the program
+	assert.NoError(t, authenticator.Authenticate("env@example.com", "verysecret"))
+	authenticator.Env = []string{"PATH=" + os.Getenv("PATH")}
+	assert.Error(t, authenticator.Authenticate("env@example.com", "verysecret"))
+
+	// the program is killed after the timeout
+	authenticator.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	err = authenticator.Authenticate("slow@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	// no free slot before the timeout
+	authenticator.slots <- struct{}{}
+	err = authenticator.Authenticate("alice@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "too many")
+	<-authenticator.slots
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+
+	// the program is killed when the context is canceled
+	authenticator.Timeout = 5 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	identity, err := authenticator.AuthenticateContext(ctx, "slow@example.com", "verysecret")
+	assert.Nil(t, identity)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+	identity, err = authenticator.AuthenticateContext(context.Background(), "alice@example.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "alice@example.com"}, identity)
+
+	// the program does not exist
+	authenticator.Command = []string{"../tests/this-program-does-not-exist"}
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+}
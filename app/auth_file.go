@@ -0,0 +1,124 @@
+package app
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileAuthenticator implements the Authenticator interface to authenticate
+// users against a password file. Each line of the file contains a username
+// (email) and a password hash separated by a colon (htpasswd style), empty
+// lines and lines starting with "#" are ignored. Supported hash schemes are
+// listed in CheckPasswordHash.
+//
+// The file is reloaded when it changes on disk.
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = file
+//
+// [auth:file]
+// path = /etc/gorgon/passwords
+//
+type FileAuthenticator struct {
+	Path string // path to the password file
+
+	mutex   sync.Mutex        // protects the fields below
+	modTime time.Time         // modification time of the loaded file
+	size    int64             // size of the loaded file
+	hashes  map[string]string // username => password hash
+}
+
+// Authenticate looks up the password hash of the user in the password file
+// and checks the password against it. A dummy hash is checked for an unknown
+// user, not to reveal the existing users by the response time.
+func (a *FileAuthenticator) Authenticate(username, password string) error {
+	hash, err := a.lookup(username)
+	if err != nil {
+		if IsCredentialsError(err) {
+			CheckPasswordHash(dummyPasswordHash, password)
+		}
+		return err
+	}
+	return CheckPasswordHash(hash, password)
+}
+
+// lookup returns the password hash of the user, the password file is
+// reloaded first if it has changed since the last load.
+func (a *FileAuthenticator) lookup(username string) (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return "", err
+	}
+	if a.hashes == nil || !info.ModTime().Equal(a.modTime) || info.Size() != a.size {
+		hashes, err := readPasswordFile(a.Path)
+		if err != nil {
+			return "", err
+		}
+		a.hashes = hashes
+		a.modTime = info.ModTime()
+		a.size = info.Size()
+	}
+
+	hash, ok := a.hashes[username]
+	if !ok {
+		return "", CredentialsError{"FileAuthenticator: unknown user '" + username + "'"}
+	}
+	return hash, nil
+}
+
+// readPasswordFile parses a password file. Fields following the password hash
+// (as in Dovecot passwd-files) are ignored.
+func readPasswordFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		hashes[fields[0]] = fields[1]
+	}
+	return hashes, scanner.Err()
+}
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "file",
+		Keys: []ConfigKey{
+			{Name: "path", Required: true},
+		},
+		New: NewFileAuthenticator,
+	})
+}
+
+// NewFileAuthenticator returns a populated FileAuthenticator.
+func NewFileAuthenticator(app GorgonApp) (Authenticator, error) {
+	path, _ := app.Config.Get("auth:file", "path")
+
+	authenticator := &FileAuthenticator{Path: path}
+
+	// load the password file a first time to detect errors early
+	if _, err := readPasswordFile(path); err != nil {
+		return nil, err
+	}
+	return authenticator, nil
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create a File authenticator
+	authenticator, err := NewAuthenticator(app, "file")
+	assert.NoError(t, err)
+	assert.IsType(t, &FileAuthenticator{}, authenticator)
+	fileAuthenticator := authenticator.(*FileAuthenticator)
+	assert.Equal(t, "../tests/passwords", fileAuthenticator.Path)
+
+	// try to authenticate with the good password
+	for _, username := range []string{"bcrypt@example.com", "sha512@example.com", "argon2id@example.com", "scrypt@example.com"} {
+		assert.NoError(t, authenticator.Authenticate(username, "verysecret"), username)
+	}
+
+	// try to authenticate with a wrong password
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("bcrypt@example.com", "bad password")))
+
+	// try to authenticate an unknown user
+	assert.Error(t, authenticator.Authenticate("unknown@example.com", "verysecret"))
+
+	// plaintext passwords are not supported
+	assert.Error(t, authenticator.Authenticate("plain@example.com", "verysecret"))
+}
+
+func TestFileAuthenticatorReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "gorgon-passwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("alice@example.com:$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga\n")
+	file.Close()
+
+	authenticator := &FileAuthenticator{Path: file.Name()}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("bob@example.com", "verysecret"))
+
+	// replace the content of the file, the new content must be used
+	err = ioutil.WriteFile(file.Name(), []byte("bob@example.com:$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga\n"), 0600)
+	assert.NoError(t, err)
+	modTime := time.Now().Add(time.Minute)
+	os.Chtimes(file.Name(), modTime, modTime)
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.NoError(t, authenticator.Authenticate("bob@example.com", "verysecret"))
+
+	// the file has been removed
+	os.Remove(file.Name())
+	assert.Error(t, authenticator.Authenticate("bob@example.com", "verysecret"))
+}
@@ -0,0 +1,235 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HttpAuthenticator implements the Authenticator interface to authenticate
+// users against an HTTP service (webhook). The username and the password are
+// sent in a POST request to the configured URL, encoded as JSON
+// ({"username": "...", "password": "..."}) or as form data
+// (username=...&password=...).
+//
+// The response status code gives the result of the authentication:
+// - 2xx: the user is authenticated
+// - 401 or 403: the credentials are rejected
+// - any other status code (including redirections) is an error of the HTTP
+//   service
+//
+// A successful response may contain a JSON object describing the user, used
+// to create the Identity: {"email": "...", "display_name": "...", "groups":
+// ["..."], "status": "..."}. All the fields are optional, the email defaults
+// to the username.
+//
+// If a HMAC secret is configured, the request is signed with HMAC-SHA256:
+// the current time (Unix timestamp) is sent in the "X-Gorgon-Timestamp"
+// header, and the signature of the timestamp, a dot and the request body is
+// sent in the "X-Gorgon-Signature" header ("sha256=" followed by the hex
+// encoded signature). The HTTP service should refuse the old timestamps, a
+// captured request can't be replayed later.
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = http
+//
+// [auth:http]
+// url = https://accounts.example.com/gorgon/authenticate
+// format = json
+// timeout = 10
+// hmac_secret = changeme
+// cert_file = /etc/gorgon/client.crt
+// key_file = /etc/gorgon/client.key
+// verify_cert = true
+//
+type HttpAuthenticator struct {
+	URL        string       // URL of the HTTP service
+	Format     string       // encoding of the request body, "json" or "form"
+	HMACSecret []byte       // secret used to sign the request body, no signature if empty
+	Client     *http.Client // HTTP client used to send requests (TLS configuration and timeout)
+}
+
+// httpIdentity is the JSON object describing the user in a successful
+// response.
+type httpIdentity struct {
+	Email       string   `json:"email"`
+	DisplayName string   `json:"display_name"`
+	Groups      []string `json:"groups"`
+	Status      string   `json:"status"`
+}
+
+// Authenticate sends the username (email) and the password to the HTTP
+// service and checks the response status code.
+func (a HttpAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext sends the username (email) and the password to the
+// HTTP service and checks the response status code. The request is cancelled
+// when the context is done.
+func (a HttpAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	var (
+		body        []byte
+		contentType string
+		err         error
+	)
+	switch a.Format {
+	case "json":
+		contentType = "application/json"
+		body, err = json.Marshal(map[string]string{
+			"username": username,
+			"password": password,
+		})
+		if err != nil {
+			return nil, err
+		}
+	case "form":
+		contentType = "application/x-www-form-urlencoded"
+		body = []byte(url.Values{
+			"username": {username},
+			"password": {password},
+		}.Encode())
+	default:
+		return nil, errors.New("HttpAuthenticator: unknown format '" + a.Format + "'")
+	}
+
+	request, err := http.NewRequest("POST", a.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("User-Agent", "Gorgon/"+Version)
+	if len(a.HMACSecret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set("X-Gorgon-Timestamp", timestamp)
+		request.Header.Set("X-Gorgon-Signature", "sha256="+httpSignature(a.HMACSecret, timestamp, body))
+	}
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		identity := &Identity{Email: username}
+		if strings.HasPrefix(response.Header.Get("Content-Type"), "application/json") {
+			var user httpIdentity
+			if err := json.NewDecoder(io.LimitReader(response.Body, 65536)).Decode(&user); err != nil {
+				return nil, errors.New("HttpAuthenticator: invalid JSON response from the HTTP service: " + err.Error())
+			}
+			if user.Email != "" {
+				identity.Email = user.Email
+			}
+			identity.DisplayName = user.DisplayName
+			identity.Groups = user.Groups
+			identity.Status = user.Status
+		}
+		return identity, nil
+	case response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden:
+		return nil, CredentialsError{"HttpAuthenticator: credentials rejected (" + response.Status + ")"}
+	}
+	return nil, errors.New("HttpAuthenticator: unexpected response from the HTTP service (" + response.Status + ")")
+}
+
+// httpSignature returns the hex encoded HMAC-SHA256 signature of the
+// timestamp and the body of a request.
+func httpSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "http",
+		Keys: append([]ConfigKey{
+			{Name: "url", Required: true, Validate: validateHttpURL},
+			{Name: "format", Default: "json", Validate: ValidateOneOf("json", "form")},
+			{Name: "timeout", Default: "10", Validate: ValidateSeconds},
+			{Name: "hmac_secret"},
+			{Name: "cert_file"},
+			{Name: "key_file"},
+		}, TLSConfigKeys...),
+		New: NewHttpAuthenticator,
+	})
+}
+
+// validateHttpURL accepts http and https URLs.
+func validateHttpURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("must be an http or https URL")
+	}
+	return nil
+}
+
+// NewHttpAuthenticator returns a populated HttpAuthenticator.
+func NewHttpAuthenticator(app GorgonApp) (Authenticator, error) {
+	rawURL, _ := app.Config.Get("auth:http", "url")
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	format, _ := app.Config.Get("auth:http", "format")
+	value, _ := app.Config.Get("auth:http", "timeout")
+	seconds, _ := strconv.Atoi(value)
+	timeout := time.Duration(seconds) * time.Second
+	hmacSecret, _ := app.Config.Get("auth:http", "hmac_secret")
+
+	tlsConfig, err := NewTLSConfig(app.Config, "auth:http", u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	// client certificate used to authenticate Gorgon to the HTTP service
+	certFile, hasCert := app.Config.Get("auth:http", "cert_file")
+	keyFile, hasKey := app.Config.Get("auth:http", "key_file")
+	if hasCert != hasKey {
+		return nil, errors.New("'cert_file' and 'key_file' must be used together in 'auth:http' section")
+	}
+	if hasCert {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	authenticator := HttpAuthenticator{
+		URL:        rawURL,
+		Format:     format,
+		HMACSecret: []byte(hmacSecret),
+		Client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			// never send the credentials to another URL
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	return authenticator, nil
+}
@@ -0,0 +1,259 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// httpAuthHandler is a stand-in HTTP authentication service. It accepts JSON
+// and form requests, and checks the HMAC signature and its timestamp (5
+// minutes at most) if a secret is set.
+func httpAuthHandler(secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if secret != "" {
+			timestamp := r.Header.Get("X-Gorgon-Timestamp")
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(timestamp + "."))
+			mac.Write(body)
+			if r.Header.Get("X-Gorgon-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			seconds, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil || time.Since(time.Unix(seconds, 0)) > 5*time.Minute {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		var username, password string
+		switch r.Header.Get("Content-Type") {
+		case "application/json":
+			credentials := map[string]string{}
+			if err := json.Unmarshal(body, &credentials); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			username, password = credentials["username"], credentials["password"]
+		case "application/x-www-form-urlencoded":
+			values, err := url.ParseQuery(string(body))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			username, password = values.Get("username"), values.Get("password")
+		default:
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		switch {
+		case username == "alice@example.com" && password == "verysecret":
+			w.WriteHeader(http.StatusNoContent)
+		case username == "carol" && password == "verysecret":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"email": "carol@example.com", "display_name": "Carol", "groups": ["staff"], "status": "active"}`))
+		case username == "garbage@example.com":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("not JSON"))
+		case username == "locked@example.com":
+			w.WriteHeader(http.StatusForbidden)
+		case username == "broken@example.com":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestHttpAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create an HTTP authenticator
+	authenticator, err := NewAuthenticator(app, "http")
+	assert.NoError(t, err)
+	assert.IsType(t, HttpAuthenticator{}, authenticator)
+	httpAuthenticator := authenticator.(HttpAuthenticator)
+	assert.Equal(t, "https://accounts.example.com/gorgon/authenticate", httpAuthenticator.URL)
+	assert.Equal(t, "form", httpAuthenticator.Format)
+	assert.Equal(t, []byte("changeme"), httpAuthenticator.HMACSecret)
+	assert.Equal(t, 5*time.Second, httpAuthenticator.Client.Timeout)
+	transport := httpAuthenticator.Client.Transport.(*http.Transport)
+	assert.Equal(t, "accounts.example.com", transport.TLSClientConfig.ServerName)
+
+	// client certificate
+	certificate, certPEM := newTestCertificate(t)
+	keyDER, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, _ := ioutil.TempFile("", "gorgon-cert")
+	defer os.Remove(certFile.Name())
+	certFile.Write(certPEM)
+	certFile.Close()
+	keyFile, _ := ioutil.TempFile("", "gorgon-key")
+	defer os.Remove(keyFile.Name())
+	pem.Encode(keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	keyFile.Close()
+
+	app.Config = ini.File{"auth:http": ini.Section{
+		"url":       "https://accounts.example.com/gorgon/authenticate",
+		"cert_file": certFile.Name(),
+		"key_file":  keyFile.Name(),
+	}}
+	authenticator, err = NewAuthenticator(app, "http")
+	assert.NoError(t, err)
+	httpAuthenticator = authenticator.(HttpAuthenticator)
+	assert.Equal(t, "json", httpAuthenticator.Format)
+	assert.Equal(t, 10*time.Second, httpAuthenticator.Client.Timeout)
+	transport = httpAuthenticator.Client.Transport.(*http.Transport)
+	assert.Len(t, transport.TLSClientConfig.Certificates, 1)
+
+	// invalid configurations
+	for _, section := range []ini.Section{
+		{},
+		{"url": "ftp://accounts.example.com/"},
+		{"url": "https://accounts.example.com/", "format": "xml"},
+		{"url": "https://accounts.example.com/", "timeout": "never"},
+		{"url": "https://accounts.example.com/", "cert_file": certFile.Name()},
+	} {
+		app.Config = ini.File{"auth:http": section}
+		_, err = NewAuthenticator(app, "http")
+		assert.Error(t, err)
+	}
+}
+
+func TestHttpAuthenticate(t *testing.T) {
+	var (
+		server        *httptest.Server
+		authenticator HttpAuthenticator
+	)
+
+	// JSON and form requests
+	server = httptest.NewServer(httpAuthHandler(""))
+	for _, format := range []string{"json", "form"} {
+		authenticator = HttpAuthenticator{URL: server.URL, Format: format, Client: server.Client()}
+		assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+		assert.True(t, IsCredentialsError(authenticator.Authenticate("alice@example.com", "bad password")))
+		assert.True(t, IsCredentialsError(authenticator.Authenticate("locked@example.com", "verysecret")))
+		err := authenticator.Authenticate("broken@example.com", "verysecret")
+		assert.Error(t, err)
+		assert.False(t, IsCredentialsError(err))
+	}
+
+	// identity returned by the HTTP service
+	authenticator = HttpAuthenticator{URL: server.URL, Format: "json", Client: server.Client()}
+	identity, err := authenticator.AuthenticateContext(context.Background(), "carol", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "carol@example.com", DisplayName: "Carol", Groups: []string{"staff"}, Status: "active"}, identity)
+	identity, err = authenticator.AuthenticateContext(context.Background(), "alice@example.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "alice@example.com"}, identity)
+	_, err = authenticator.AuthenticateContext(context.Background(), "garbage@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.False(t, IsCredentialsError(err))
+	server.Close()
+
+	// HMAC signature
+	server = httptest.NewServer(httpAuthHandler("changeme"))
+	authenticator = HttpAuthenticator{URL: server.URL, Format: "json", HMACSecret: []byte("changeme"), Client: server.Client()}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	authenticator.HMACSecret = []byte("wrong secret")
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	authenticator.HMACSecret = nil
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	server.Close()
+
+	// the signature covers the timestamp, an old request can't be replayed
+	var captured *http.Request
+	var capturedBody []byte
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		captured = r
+		capturedBody, _ = ioutil.ReadAll(r.Body)
+	}))
+	authenticator = HttpAuthenticator{URL: server.URL, Format: "json", HMACSecret: []byte("changeme"), Client: server.Client()}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	server.Close()
+	if assert.NotNil(t, captured) {
+		timestamp := captured.Header.Get("X-Gorgon-Timestamp")
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), time.Unix(seconds, 0), 5*time.Second)
+		assert.Equal(t, "sha256="+httpSignature([]byte("changeme"), timestamp, capturedBody), captured.Header.Get("X-Gorgon-Signature"))
+
+		replay := func(timestamp string) int {
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(capturedBody))
+			req.Header = captured.Header
+			req.Header.Set("X-Gorgon-Timestamp", timestamp)
+			w := httptest.NewRecorder()
+			httpAuthHandler("changeme")(w, req)
+			return w.Code
+		}
+		assert.Equal(t, http.StatusNoContent, replay(timestamp))
+		old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+		assert.Equal(t, http.StatusBadRequest, replay(old))
+	}
+
+	// client certificate required by the HTTP service
+	server = httptest.NewUnstartedServer(httpAuthHandler(""))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	clientCertificate, _ := newTestCertificate(t)
+	client := server.Client()
+	authenticator = HttpAuthenticator{URL: server.URL, Format: "json", Client: client}
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{clientCertificate}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	server.Close()
+
+	// redirections are not followed
+	server = httptest.NewServer(http.RedirectHandler("/elsewhere", http.StatusTemporaryRedirect))
+	app := GorgonApp{Config: ini.File{"auth:http": ini.Section{"url": server.URL}}}
+	a, err := NewAuthenticator(app, "http")
+	assert.NoError(t, err)
+	assert.Error(t, a.Authenticate("alice@example.com", "verysecret"))
+	server.Close()
+
+	// timeout
+	slow := make(chan struct{})
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-slow
+	}))
+	authenticator = HttpAuthenticator{URL: server.URL, Format: "json", Client: &http.Client{Timeout: 50 * time.Millisecond}}
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+
+	// deadline of the context
+	authenticator.Client = server.Client()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = authenticator.AuthenticateContext(ctx, "alice@example.com", "verysecret")
+	assert.Error(t, err)
+	close(slow)
+	server.Close()
+}
@@ -0,0 +1,259 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"net"
+	"strings"
+)
+
+// LdapAuthenticator implements the Authenticator interface to authenticate
+// users against an LDAP directory. The user entry is first searched with a
+// service account (or anonymously), then the password is checked by binding
+// as the DN of the found entry. The display name and the groups of the user
+// are read from the attributes of the entry: the groups are the values of the
+// groups attribute, or the value of the first RDN of the values which are DNs
+// (for example "staff" for "cn=staff,ou=groups,dc=example,dc=com" in
+// memberOf).
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = ldap
+//
+// [auth:ldap]
+// server = ldap.example.com:389
+// tls_mode = starttls
+// verify_cert = true
+// ca_file = /etc/ssl/certs/ca-certificates.crt
+// base_dn = ou=people,dc=example,dc=com
+// filter = (mail=%s)
+// bind_dn = cn=gorgon,dc=example,dc=com
+// bind_password = servicepassword
+// name_attribute = displayName
+// groups_attribute = memberOf
+//
+type LdapAuthenticator struct {
+	Server          string      // address (host:port) of the LDAP server
+	TLSMode         string      // "ldaps", "starttls" or "none"
+	TLSVerifyCert   bool        // should verify the certificate presented by the server
+	TLSConfig       *tls.Config // TLS configuration used to connect to the server (built from TLSVerifyCert if nil)
+	BaseDN          string      // base DN used to search users
+	Filter          string      // search filter, "%s" is replaced by the username
+	BindDN          string      // DN of the service account (empty for anonymous search)
+	BindPassword    string      // password of the service account
+	NameAttribute   string      // attribute containing the display name of the user (empty to ignore)
+	GroupsAttribute string      // attribute containing the groups of the user (empty to ignore)
+}
+
+// Authenticate searches the user entry in the LDAP directory, then binds as
+// this entry with the given password. If the bind is successful, returns nil,
+// else returns an error.
+func (a LdapAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext searches the user entry in the LDAP directory, then
+// binds as this entry with the given password. The identity is filled from
+// the attributes of the entry, the connection is interrupted when the
+// context is done.
+func (a LdapAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	identity, err := a.authenticate(ctx, username, password)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return identity, nil
+}
+
+// authenticate searches the user entry and binds as this entry.
+func (a LdapAuthenticator) authenticate(ctx context.Context, username, password string) (identity *Identity, err error) {
+	// an empty password results in an "unauthenticated bind" which succeeds
+	// on most LDAP servers, never let it through
+	if password == "" {
+		return nil, CredentialsError{"LdapAuthenticator: empty password"}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// bind with the service account to search the user entry
+	if a.BindDN != "" {
+		if err = conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return
+		}
+	}
+
+	attributes := []string{"dn"}
+	for _, attribute := range []string{a.NameAttribute, a.GroupsAttribute} {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	filter := strings.Replace(a.Filter, "%s", ldap.EscapeFilter(username), -1)
+	request := ldap.NewSearchRequest(
+		a.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter,
+		attributes,
+		nil,
+	)
+	result, err := conn.Search(request)
+	if err != nil {
+		return
+	}
+	if len(result.Entries) == 0 {
+		return nil, CredentialsError{"LdapAuthenticator: no entry found for '" + filter + "'"}
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("LdapAuthenticator: %d entries found for '%s'", len(result.Entries), filter)
+	}
+	entry := result.Entries[0]
+
+	// bind as the user to check the password
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, CredentialsError{"LdapAuthenticator: " + err.Error()}
+	}
+	if err != nil {
+		return
+	}
+
+	identity = &Identity{Email: username}
+	if a.NameAttribute != "" {
+		identity.DisplayName = entry.GetAttributeValue(a.NameAttribute)
+	}
+	if a.GroupsAttribute != "" {
+		for _, value := range entry.GetAttributeValues(a.GroupsAttribute) {
+			identity.Groups = append(identity.Groups, ldapGroupName(value))
+		}
+	}
+	return identity, nil
+}
+
+// ldapGroupName returns the value of the first RDN of a group DN, or the
+// value unchanged if it is not a DN.
+func ldapGroupName(value string) string {
+	dn, err := ldap.ParseDN(value)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return value
+	}
+	return dn.RDNs[0].Attributes[0].Value
+}
+
+// dial opens a connection to the LDAP server according to the TLS mode, the
+// connection is interrupted when the context is done.
+func (a LdapAuthenticator) dial(ctx context.Context) (*ldap.Conn, error) {
+	tlsConfig := a.TLSConfig
+	if tlsConfig == nil {
+		host, _, err := net.SplitHostPort(a.Server)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: !a.TLSVerifyCert,
+		}
+	}
+
+	switch a.TLSMode {
+	case "ldaps":
+		netConn, err := dialContext(ctx, "tcp", a.Server, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn := ldap.NewConn(netConn, true)
+		conn.Start()
+		return conn, nil
+	case "starttls":
+		netConn, err := dialContext(ctx, "tcp", a.Server, nil)
+		if err != nil {
+			return nil, err
+		}
+		conn := ldap.NewConn(netConn, false)
+		conn.Start()
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	case "none":
+		netConn, err := dialContext(ctx, "tcp", a.Server, nil)
+		if err != nil {
+			return nil, err
+		}
+		conn := ldap.NewConn(netConn, false)
+		conn.Start()
+		return conn, nil
+	}
+	return nil, errors.New("LdapAuthenticator: unknown tls_mode '" + a.TLSMode + "'")
+}
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "ldap",
+		Keys: append([]ConfigKey{
+			{Name: "server", Required: true},
+			{Name: "base_dn", Required: true},
+			{Name: "filter", Default: "(mail=%s)"},
+			{Name: "tls_mode", Default: "starttls", Validate: ValidateOneOf("ldaps", "starttls", "none")},
+			{Name: "bind_dn"},
+			{Name: "bind_password"},
+			{Name: "name_attribute", Default: "displayName"},
+			{Name: "groups_attribute", Default: "memberOf"},
+		}, TLSConfigKeys...),
+		New: NewLdapAuthenticator,
+	})
+}
+
+// NewLdapAuthenticator returns a populated LdapAuthenticator.
+func NewLdapAuthenticator(app GorgonApp) (Authenticator, error) {
+	server, _ := app.Config.Get("auth:ldap", "server")
+	baseDN, _ := app.Config.Get("auth:ldap", "base_dn")
+	filter, _ := app.Config.Get("auth:ldap", "filter")
+	tlsMode, _ := app.Config.Get("auth:ldap", "tls_mode")
+	bindDN, _ := app.Config.Get("auth:ldap", "bind_dn")
+	bindPassword, _ := app.Config.Get("auth:ldap", "bind_password")
+	nameAttribute, _ := app.Config.Get("auth:ldap", "name_attribute")
+	groupsAttribute, _ := app.Config.Get("auth:ldap", "groups_attribute")
+
+	// use the default port if none is provided
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+		if tlsMode == "ldaps" {
+			server = net.JoinHostPort(server, "636")
+		} else {
+			server = net.JoinHostPort(server, "389")
+		}
+	}
+
+	// the hostname is the name expected in the server certificate
+	tlsConfig, err := NewTLSConfig(app.Config, "auth:ldap", host)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticator := LdapAuthenticator{
+		Server:          server,
+		TLSMode:         tlsMode,
+		TLSVerifyCert:   !tlsConfig.InsecureSkipVerify,
+		TLSConfig:       tlsConfig,
+		BaseDN:          baseDN,
+		Filter:          filter,
+		BindDN:          bindDN,
+		BindPassword:    bindPassword,
+		NameAttribute:   nameAttribute,
+		GroupsAttribute: groupsAttribute,
+	}
+	return authenticator, nil
+}
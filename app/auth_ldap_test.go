@@ -0,0 +1,234 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// ldapServer is a minimal stand-in LDAP server. It only understands the bind,
+// search and unbind operations, which is enough to test the search-then-bind
+// flow of the LdapAuthenticator.
+type ldapServer struct {
+	listener  net.Listener
+	passwords  map[string]string              // DN => password
+	entries    map[string]string              // filter => DN
+	attributes map[string]map[string][]string // DN => attributes of the entry
+}
+
+// newLdapServer starts a stand-in LDAP server listening on a random port.
+func newLdapServer(t *testing.T) *ldapServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ldapServer{
+		listener: listener,
+		passwords: map[string]string{
+			"cn=gorgon,dc=example,dc=com":           "servicepassword",
+			"uid=alice,ou=people,dc=example,dc=com": "verysecret",
+		},
+		entries: map[string]string{
+			"(mail=alice@example.com)": "uid=alice,ou=people,dc=example,dc=com",
+		},
+		attributes: map[string]map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=com": {
+				"displayName": {"Alice Liddell"},
+				"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com", "admins"},
+			},
+		},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *ldapServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *ldapServer) Close() {
+	s.listener.Close()
+}
+
+func (s *ldapServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ldapServer) handle(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := request.Children[1].Value.(string)
+			password := request.Children[2].Data.String()
+			if p, ok := s.passwords[dn]; ok && p == password {
+				bound = dn
+				s.respond(conn, messageID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+			} else {
+				bound = ""
+				s.respond(conn, messageID, ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+			}
+		case ldap.ApplicationSearchRequest:
+			if bound != "cn=gorgon,dc=example,dc=com" {
+				s.respond(conn, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)
+				continue
+			}
+			filter, _ := ldap.DecompileFilter(request.Children[6])
+			if dn, ok := s.entries[filter]; ok {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+				attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+				for name, values := range s.attributes[dn] {
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+					for _, value := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+					}
+					attribute.AppendChild(set)
+					attributes.AppendChild(attribute)
+				}
+				entry.AppendChild(attributes)
+				s.send(conn, messageID, entry)
+			}
+			s.respond(conn, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// respond sends an LDAPResult of the given type.
+func (s *ldapServer) respond(conn net.Conn, messageID int64, tag ber.Tag, code int) {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(code), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	s.send(conn, messageID, result)
+}
+
+// send wraps a protocol operation in an LDAPMessage and writes it.
+func (s *ldapServer) send(conn net.Conn, messageID int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func TestLdapAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create an LDAP authenticator
+	authenticator, err := NewAuthenticator(app, "ldap")
+	assert.IsType(t, LdapAuthenticator{}, authenticator)
+	ldapAuthenticator := authenticator.(LdapAuthenticator)
+	assert.Equal(t, "ldap.example.com:636", ldapAuthenticator.Server)
+	assert.Equal(t, "ldaps", ldapAuthenticator.TLSMode)
+	assert.True(t, ldapAuthenticator.TLSVerifyCert)
+	if assert.NotNil(t, ldapAuthenticator.TLSConfig) {
+		assert.Equal(t, "ldap.example.com", ldapAuthenticator.TLSConfig.ServerName)
+		assert.Equal(t, uint16(tls.VersionTLS12), ldapAuthenticator.TLSConfig.MinVersion)
+	}
+	assert.Equal(t, "ou=people,dc=example,dc=com", ldapAuthenticator.BaseDN)
+	assert.Equal(t, "(mail=%s)", ldapAuthenticator.Filter)
+	assert.Equal(t, "cn=gorgon,dc=example,dc=com", ldapAuthenticator.BindDN)
+	assert.Equal(t, "servicepassword", ldapAuthenticator.BindPassword)
+	assert.Equal(t, "displayName", ldapAuthenticator.NameAttribute)
+	assert.Equal(t, "memberOf", ldapAuthenticator.GroupsAttribute)
+	assert.NoError(t, err)
+
+	// the TLS options are shared with the other backends
+	app.Config = ini.File{"auth:ldap": ini.Section{
+		"server":          "ldap.example.com",
+		"base_dn":         "ou=people,dc=example,dc=com",
+		"verify_cert":     "false",
+		"server_name":     "directory.example.com",
+		"min_tls_version": "1.3",
+	}}
+	authenticator, err = NewAuthenticator(app, "ldap")
+	if assert.NoError(t, err) {
+		ldapAuthenticator = authenticator.(LdapAuthenticator)
+		assert.Equal(t, "ldap.example.com:389", ldapAuthenticator.Server)
+		assert.False(t, ldapAuthenticator.TLSVerifyCert)
+		assert.True(t, ldapAuthenticator.TLSConfig.InsecureSkipVerify)
+		assert.Equal(t, "directory.example.com", ldapAuthenticator.TLSConfig.ServerName)
+		assert.Equal(t, uint16(tls.VersionTLS13), ldapAuthenticator.TLSConfig.MinVersion)
+	}
+	app.Config = ini.File{"auth:ldap": ini.Section{
+		"server":  "ldap.example.com",
+		"base_dn": "ou=people,dc=example,dc=com",
+		"ca_file": "../tests/missing.pem",
+	}}
+	_, err = NewAuthenticator(app, "ldap")
+	assert.Error(t, err)
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	s := newLdapServer(t)
+	defer s.Close()
+
+	authenticator := LdapAuthenticator{
+		Server:       s.Addr(),
+		TLSMode:      "none",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		Filter:       "(mail=%s)",
+		BindDN:       "cn=gorgon,dc=example,dc=com",
+		BindPassword: "servicepassword",
+	}
+
+	// try to authenticate with the good password
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+
+	// the identity is filled from the attributes of the entry
+	identity, err := authenticator.AuthenticateContext(context.Background(), "alice@example.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "alice@example.com"}, identity)
+	authenticator.NameAttribute = "displayName"
+	authenticator.GroupsAttribute = "memberOf"
+	identity, err = authenticator.AuthenticateContext(context.Background(), "alice@example.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "alice@example.com", DisplayName: "Alice Liddell", Groups: []string{"staff", "admins"}}, identity)
+
+	// the authentication is aborted when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = authenticator.AuthenticateContext(ctx, "alice@example.com", "verysecret")
+	assert.Equal(t, context.Canceled, err)
+
+	// try to authenticate with a wrong password
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("alice@example.com", "bad password")))
+
+	// try to authenticate with an empty password (unauthenticated bind)
+	assert.Error(t, authenticator.Authenticate("alice@example.com", ""))
+
+	// try to authenticate an unknown user
+	assert.Error(t, authenticator.Authenticate("bob@example.com", "verysecret"))
+
+	// try to inject a filter
+	assert.Error(t, authenticator.Authenticate("*", "verysecret"))
+
+	// try to authenticate with a wrong service account
+	authenticator.BindPassword = "bad password"
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+}
@@ -0,0 +1,204 @@
+package app
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Pop3Authenticator implements the Authenticator interface to authenticate
+// users against a POP3 server. The APOP command is used when the server
+// greeting contains a timestamp and APOP is enabled, else the USER and PASS
+// commands are used.
+//
+// The connection to the POP3 server is secured according to the TLS mode:
+// - pop3s: implicit TLS (default port 995)
+// - stls: the connection switches to TLS with the STLS command, the
+//   authentication is refused if the server does not support STLS (default
+//   port 110)
+// - none: no TLS, the password is sent in clear (default port 110)
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = pop3
+//
+// [auth:pop3]
+// server = pop.example.com:995
+// tls_mode = pop3s
+// verify_cert = true
+// apop = false
+// username_template = %e
+//
+type Pop3Authenticator struct {
+	Server           string        // address (host:port) of the POP3 server
+	TLSMode          string        // "pop3s", "stls" or "none"
+	TLSConfig        *tls.Config   // TLS configuration used to connect to the server
+	APOP             bool          // use APOP when the server supports it
+	UsernameTemplate string        // template used to create the POP3 login name
+	Timeout          time.Duration // maximum duration of the POP3 session
+}
+
+// Authenticate uses a POP3 server to authenticate users. The login name is
+// created from the username (email) with the username template, the password
+// is passed without modification to the POP3 server.
+func (a Pop3Authenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext uses a POP3 server to authenticate users, the
+// connection is interrupted when the context is done.
+func (a Pop3Authenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	if err := a.authenticate(ctx, FormatUsername(a.UsernameTemplate, username), password); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return &Identity{Email: username}, nil
+}
+
+// authenticate connects to the POP3 server and checks the login name and the
+// password.
+func (a Pop3Authenticator) authenticate(ctx context.Context, username, password string) (err error) {
+	ctx, cancel := contextWithTimeout(ctx, a.Timeout)
+	defer cancel()
+
+	var conn net.Conn
+	switch a.TLSMode {
+	case "pop3s":
+		tlsConfig := a.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		conn, err = dialContext(ctx, "tcp", a.Server, tlsConfig)
+	case "stls", "none":
+		conn, err = dialContext(ctx, "tcp", a.Server, nil)
+	default:
+		return errors.New("Pop3Authenticator: unknown tls_mode '" + a.TLSMode + "'")
+	}
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	greeting, err := pop3Response(text)
+	if err != nil {
+		return
+	}
+
+	if a.TLSMode == "stls" {
+		if _, err = pop3Command(text, "STLS"); err != nil {
+			return errors.New("Pop3Authenticator: STLS is not supported by the server")
+		}
+		conn = tls.Client(conn, a.TLSConfig)
+		text = textproto.NewConn(conn)
+	}
+
+	// the APOP timestamp is a msg-id ("<...>") in the greeting
+	start, end := strings.Index(greeting, "<"), strings.LastIndex(greeting, ">")
+	if a.APOP && start != -1 && end > start {
+		digest := md5.Sum([]byte(greeting[start:end+1] + password))
+		_, err = pop3Command(text, "APOP "+username+" "+hex.EncodeToString(digest[:]))
+	} else {
+		if _, err = pop3Command(text, "USER "+username); err == nil {
+			_, err = pop3Command(text, "PASS "+password)
+		}
+	}
+	if err != nil {
+		// a negative response is a rejection of the credentials, unless the
+		// server reports a temporary problem (RFC 3206)
+		if response, ok := err.(pop3Error); ok && !strings.Contains(string(response), "[SYS/") &&
+			!strings.Contains(string(response), "[IN-USE]") {
+			return CredentialsError{err.Error()}
+		}
+		return
+	}
+
+	pop3Command(text, "QUIT")
+	return
+}
+
+// pop3Command sends a command to a POP3 server and returns the response.
+func pop3Command(text *textproto.Conn, command string) (string, error) {
+	if strings.ContainsAny(command, "\r\n") {
+		return "", errors.New("Pop3Authenticator: invalid character in command")
+	}
+	if err := text.PrintfLine("%s", command); err != nil {
+		return "", err
+	}
+	return pop3Response(text)
+}
+
+// pop3Error is a negative response ("-ERR") from a POP3 server.
+type pop3Error string
+
+func (e pop3Error) Error() string {
+	return "Pop3Authenticator: " + string(e)
+}
+
+// pop3Response reads a single line response from a POP3 server. Returns a
+// pop3Error if the response is not positive ("+OK").
+func pop3Response(text *textproto.Conn) (string, error) {
+	line, err := text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return "", pop3Error(line)
+	}
+	return line, nil
+}
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "pop3",
+		Keys: append([]ConfigKey{
+			{Name: "server", Required: true},
+			{Name: "tls_mode", Default: "pop3s", Validate: ValidateOneOf("pop3s", "stls", "none")},
+			{Name: "apop", Default: "false", Validate: ValidateBool},
+			{Name: "username_template", Default: "%e"},
+		}, TLSConfigKeys...),
+		New: NewPop3Authenticator,
+	})
+}
+
+// NewPop3Authenticator returns a populated Pop3Authenticator.
+func NewPop3Authenticator(app GorgonApp) (Authenticator, error) {
+	server, _ := app.Config.Get("auth:pop3", "server")
+	tlsMode, _ := app.Config.Get("auth:pop3", "tls_mode")
+	apop, _ := app.Config.Get("auth:pop3", "apop")
+	usernameTemplate, _ := app.Config.Get("auth:pop3", "username_template")
+
+	// use the default port if none is provided
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+		if tlsMode == "pop3s" {
+			server = net.JoinHostPort(server, "995")
+		} else {
+			server = net.JoinHostPort(server, "110")
+		}
+	}
+
+	tlsConfig, err := NewTLSConfig(app.Config, "auth:pop3", host)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticator := Pop3Authenticator{
+		Server:           server,
+		TLSMode:          tlsMode,
+		TLSConfig:        tlsConfig,
+		APOP:             apop == "true",
+		UsernameTemplate: usernameTemplate,
+		Timeout:          30 * time.Second,
+	}
+	return authenticator, nil
+}
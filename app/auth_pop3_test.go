@@ -0,0 +1,208 @@
+package app
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pop3Server is a minimal stand-in POP3 server. It only understands the STLS,
+// USER, PASS, APOP and QUIT commands.
+type pop3Server struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config // TLS configuration used by the server, nil disables STLS
+	implicitTLS bool        // the connection is encrypted from the start (pop3s)
+	timestamp   string      // APOP timestamp sent in the greeting, if any
+
+	mutex         sync.Mutex
+	clearTextPass bool     // a PASS command has been received in clear
+	commands      []string // commands received (without arguments)
+}
+
+// newPop3Server starts a stand-in POP3 server listening on a random port.
+func newPop3Server(t *testing.T, tlsConfig *tls.Config, implicitTLS bool, timestamp string) *pop3Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &pop3Server{
+		listener:    listener,
+		tlsConfig:   tlsConfig,
+		implicitTLS: implicitTLS,
+		timestamp:   timestamp,
+	}
+	go s.serve()
+	return s
+}
+
+func (s *pop3Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *pop3Server) Close() {
+	s.listener.Close()
+}
+
+func (s *pop3Server) ClearTextPass() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.clearTextPass
+}
+
+func (s *pop3Server) Commands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.commands
+}
+
+func (s *pop3Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *pop3Server) handle(conn net.Conn) {
+	encrypted := s.implicitTLS
+	if encrypted {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	if s.timestamp != "" {
+		text.PrintfLine("+OK POP3 server ready %s", s.timestamp)
+	} else {
+		text.PrintfLine("+OK POP3 server ready")
+	}
+	username := ""
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+		command := strings.ToUpper(fields[0])
+		s.mutex.Lock()
+		s.commands = append(s.commands, command)
+		s.mutex.Unlock()
+
+		switch {
+		case command == "STLS" && s.tlsConfig != nil && !encrypted:
+			text.PrintfLine("+OK Begin TLS negotiation")
+			conn = tls.Server(conn, s.tlsConfig)
+			text = textproto.NewConn(conn)
+			encrypted = true
+		case command == "USER" && len(fields) == 2:
+			username = fields[1]
+			text.PrintfLine("+OK")
+		case command == "PASS" && len(fields) == 2:
+			s.mutex.Lock()
+			s.clearTextPass = s.clearTextPass || !encrypted
+			s.mutex.Unlock()
+			if username == "alice@example.com" && fields[1] == "verysecret" {
+				text.PrintfLine("+OK Logged in")
+			} else {
+				text.PrintfLine("-ERR [AUTH] Authentication failed")
+			}
+		case command == "APOP" && len(fields) == 3 && s.timestamp != "":
+			digest := md5.Sum([]byte(s.timestamp + "verysecret"))
+			if fields[1] == "alice@example.com" && fields[2] == hex.EncodeToString(digest[:]) {
+				text.PrintfLine("+OK Logged in")
+			} else {
+				text.PrintfLine("-ERR [AUTH] Authentication failed")
+			}
+		case command == "QUIT":
+			text.PrintfLine("+OK Bye")
+			return
+		default:
+			text.PrintfLine("-ERR Unknown command")
+		}
+	}
+}
+
+func TestPop3Authenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create a POP3 authenticator
+	authenticator, err := NewAuthenticator(app, "pop3")
+	assert.NoError(t, err)
+	assert.IsType(t, Pop3Authenticator{}, authenticator)
+	pop3Authenticator := authenticator.(Pop3Authenticator)
+	assert.Equal(t, "pop.example.com:110", pop3Authenticator.Server)
+	assert.Equal(t, "stls", pop3Authenticator.TLSMode)
+	assert.Equal(t, "pop.example.com", pop3Authenticator.TLSConfig.ServerName)
+	assert.True(t, pop3Authenticator.APOP)
+	assert.Equal(t, "%e", pop3Authenticator.UsernameTemplate)
+}
+
+func TestPop3Authenticate(t *testing.T) {
+	var (
+		s             *pop3Server
+		authenticator Pop3Authenticator
+	)
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+
+	// STLS and USER/PASS
+	s = newPop3Server(t, serverConfig, false, "")
+	authenticator = Pop3Authenticator{Server: s.Addr(), TLSMode: "stls", TLSConfig: clientConfig}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("alice@example.com", "bad password")))
+	assert.Error(t, authenticator.Authenticate("bob@example.com", "verysecret"))
+	assert.False(t, s.ClearTextPass())
+	s.Close()
+
+	// STLS not supported by the server, the password must not be sent
+	s = newPop3Server(t, nil, false, "")
+	authenticator = Pop3Authenticator{Server: s.Addr(), TLSMode: "stls", TLSConfig: clientConfig}
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.NotContains(t, s.Commands(), "PASS")
+	s.Close()
+
+	// implicit TLS
+	s = newPop3Server(t, serverConfig, true, "")
+	authenticator = Pop3Authenticator{Server: s.Addr(), TLSMode: "pop3s", TLSConfig: clientConfig}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "bad password"))
+
+	// implicit TLS with an untrusted certificate
+	authenticator.TLSConfig = &tls.Config{ServerName: "localhost"}
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	s.Close()
+
+	// APOP, the password is never sent
+	s = newPop3Server(t, nil, false, "<1896.697170952@pop.example.com>")
+	authenticator = Pop3Authenticator{Server: s.Addr(), TLSMode: "none", APOP: true}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "bad password"))
+	assert.NotContains(t, s.Commands(), "PASS")
+	assert.Contains(t, s.Commands(), "APOP")
+	s.Close()
+
+	// APOP enabled but no timestamp in the greeting, with a username template
+	s = newPop3Server(t, nil, false, "")
+	authenticator = Pop3Authenticator{Server: s.Addr(), TLSMode: "none", APOP: true, UsernameTemplate: "%u@example.com"}
+	assert.NoError(t, authenticator.Authenticate("alice@foobar.com", "verysecret"))
+	assert.True(t, s.ClearTextPass())
+	s.Close()
+
+	// invalid characters in the username
+	s = newPop3Server(t, nil, false, "")
+	authenticator = Pop3Authenticator{Server: s.Addr(), TLSMode: "none"}
+	assert.Error(t, authenticator.Authenticate("alice@example.com\r\nQUIT", "verysecret"))
+	s.Close()
+}
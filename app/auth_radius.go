@@ -0,0 +1,312 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RADIUS packet codes (RFC 2865)
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+
+	// RADIUS attribute types (RFC 2865 and RFC 3579)
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusNASIdentifier        = 32
+	radiusMessageAuthenticator = 80
+)
+
+// RadiusAuthenticator implements the Authenticator interface to authenticate
+// users against RADIUS servers, with PAP Access-Request packets (RFC 2865).
+// The packets contain the User-Name, User-Password (encrypted with the shared
+// secret), NAS-Identifier and Message-Authenticator attributes.
+//
+// Each server is tried in turn: if a server does not respond before the
+// timeout, the request is sent again up to the number of retries, then the
+// next server is used. An Access-Reject (or an Access-Challenge, not
+// supported) from any server rejects the credentials. The responses must
+// contain a valid Message-Authenticator, the other ones are ignored.
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = radius
+//
+// [auth:radius]
+// servers = radius1.example.com:1812, radius2.example.com:1812
+// secret = sharedsecret
+// nas_identifier = gorgon
+// timeout = 3
+// retries = 2
+// username_template = %e
+//
+type RadiusAuthenticator struct {
+	Servers          []string      // addresses (host:port) of the RADIUS servers
+	Secret           []byte        // secret shared with the RADIUS servers
+	NASIdentifier    string        // value of the NAS-Identifier attribute
+	Timeout          time.Duration // time to wait for a response before retrying
+	Retries          int           // number of retries for each server
+	UsernameTemplate string        // template used to create the RADIUS User-Name
+}
+
+// Authenticate sends an Access-Request to the RADIUS servers. The User-Name
+// is created from the username (email) with the username template.
+func (a RadiusAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext sends an Access-Request to the RADIUS servers, no
+// request is sent again once the context is done.
+func (a RadiusAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	if err := a.authenticate(ctx, FormatUsername(a.UsernameTemplate, username), password); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return &Identity{Email: username}, nil
+}
+
+// authenticate sends an Access-Request with the User-Name and the password
+// to each server in turn, until one of them responds.
+func (a RadiusAuthenticator) authenticate(ctx context.Context, username, password string) error {
+	if len(username) == 0 || len(username) > 253 {
+		return errors.New("RadiusAuthenticator: invalid username length")
+	}
+	if len(password) == 0 || len(password) > 128 {
+		return CredentialsError{"RadiusAuthenticator: invalid password length"}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var lastErr error
+	for _, server := range a.Servers {
+		code, err := a.exchange(ctx, server, username, password)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			// the server is unreachable, try the next one
+			lastErr = err
+			continue
+		}
+		switch code {
+		case radiusAccessAccept:
+			return nil
+		case radiusAccessReject:
+			return CredentialsError{"RadiusAuthenticator: credentials rejected"}
+		case radiusAccessChallenge:
+			return errors.New("RadiusAuthenticator: Access-Challenge is not supported")
+		}
+		return errors.New("RadiusAuthenticator: unexpected response code " + strconv.Itoa(int(code)))
+	}
+	if lastErr == nil {
+		lastErr = errors.New("RadiusAuthenticator: no RADIUS server configured")
+	}
+	return lastErr
+}
+
+// exchange sends an Access-Request to a RADIUS server, and returns the code
+// of the first valid response. Each attempt waits for the timeout, at most
+// until the deadline of the context.
+func (a RadiusAuthenticator) exchange(ctx context.Context, server, username, password string) (byte, error) {
+	conn, err := dialContext(ctx, "udp", server, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	request, err := a.newAccessRequest(username, password)
+	if err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, 4096)
+	for attempt := 0; attempt <= a.Retries; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return 0, err
+		}
+		if _, err = conn.Write(request); err != nil {
+			return 0, err
+		}
+		deadline := time.Now().Add(a.Timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(response)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return 0, err
+			}
+			// silently discard invalid responses (RFC 2865, section 3)
+			if a.validResponse(request, response[:n]) {
+				return response[0], nil
+			}
+		}
+	}
+	return 0, errors.New("RadiusAuthenticator: no response from " + server)
+}
+
+// newAccessRequest returns an Access-Request packet with a random identifier
+// and a random Request Authenticator.
+func (a RadiusAuthenticator) newAccessRequest(username, password string) ([]byte, error) {
+	header := make([]byte, 20)
+	if _, err := rand.Read(header[1:20]); err != nil {
+		return nil, err
+	}
+	header[0] = radiusAccessRequest
+	authenticator := header[4:20]
+
+	// User-Password: the password is padded to a multiple of 16 bytes, and
+	// each block is XOR'ed with MD5(secret + previous block)
+	padded := make([]byte, (len(password)+15)/16*16)
+	copy(padded, password)
+	previous := authenticator
+	for i := 0; i < len(padded); i += 16 {
+		hash := md5.Sum(append(append([]byte{}, a.Secret...), previous...))
+		for j := 0; j < 16; j++ {
+			padded[i+j] ^= hash[j]
+		}
+		previous = padded[i : i+16]
+	}
+
+	packet := bytes.NewBuffer(header)
+	radiusAttribute(packet, radiusUserName, []byte(username))
+	radiusAttribute(packet, radiusUserPassword, padded)
+	if a.NASIdentifier != "" {
+		radiusAttribute(packet, radiusNASIdentifier, []byte(a.NASIdentifier))
+	}
+	// Message-Authenticator: HMAC-MD5 of the packet, computed with the
+	// attribute value set to zeros
+	radiusAttribute(packet, radiusMessageAuthenticator, make([]byte, 16))
+
+	data := packet.Bytes()
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	mac := hmac.New(md5.New, a.Secret)
+	mac.Write(data)
+	copy(data[len(data)-16:], mac.Sum(nil))
+	return data, nil
+}
+
+// validResponse checks the identifier, length and Response Authenticator of
+// a response to the given request, and its Message-Authenticator. The
+// responses without Message-Authenticator are refused, they could be forged
+// (BlastRADIUS, CVE-2024-3596).
+func (a RadiusAuthenticator) validResponse(request, response []byte) bool {
+	if len(response) < 20 || response[1] != request[1] {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(response[2:4]))
+	if length < 20 || length > len(response) {
+		return false
+	}
+	response = response[:length]
+
+	// Response Authenticator: MD5(Code + Identifier + Length + Request
+	// Authenticator + Attributes + Secret)
+	hash := md5.New()
+	hash.Write(response[:4])
+	hash.Write(request[4:20])
+	hash.Write(response[20:])
+	hash.Write(a.Secret)
+	if !hmac.Equal(hash.Sum(nil), response[4:20]) {
+		return false
+	}
+
+	authenticated := false
+	for i := 20; i+2 <= len(response); {
+		attributeLength := int(response[i+1])
+		if attributeLength < 2 || i+attributeLength > len(response) {
+			return false
+		}
+		if response[i] == radiusMessageAuthenticator {
+			if attributeLength != 18 {
+				return false
+			}
+			// HMAC-MD5 of the response, computed with the Request
+			// Authenticator and the attribute value set to zeros
+			data := append([]byte{}, response...)
+			copy(data[4:20], request[4:20])
+			copy(data[i+2:i+18], make([]byte, 16))
+			mac := hmac.New(md5.New, a.Secret)
+			mac.Write(data)
+			if !hmac.Equal(mac.Sum(nil), response[i+2:i+18]) {
+				return false
+			}
+			authenticated = true
+		}
+		i += attributeLength
+	}
+	return authenticated
+}
+
+// radiusAttribute appends an attribute to a RADIUS packet.
+func radiusAttribute(packet *bytes.Buffer, attributeType byte, value []byte) {
+	packet.WriteByte(attributeType)
+	packet.WriteByte(byte(len(value) + 2))
+	packet.Write(value)
+}
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "radius",
+		Keys: []ConfigKey{
+			{Name: "servers", Required: true, Validate: ValidateNotEmpty},
+			{Name: "secret", Required: true, Validate: ValidateNotEmpty},
+			{Name: "nas_identifier", Default: "gorgon"},
+			{Name: "username_template", Default: "%e"},
+			{Name: "timeout", Default: "3", Validate: ValidateSeconds},
+			{Name: "retries", Default: "2", Validate: ValidateNonNegativeInt},
+		},
+		New: NewRadiusAuthenticator,
+	})
+}
+
+// NewRadiusAuthenticator returns a populated RadiusAuthenticator.
+func NewRadiusAuthenticator(app GorgonApp) (Authenticator, error) {
+	value, _ := app.Config.Get("auth:radius", "servers")
+	servers := []string{}
+	for _, server := range strings.Split(value, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		// use the default port if none is provided
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "1812")
+		}
+		servers = append(servers, server)
+	}
+	secret, _ := app.Config.Get("auth:radius", "secret")
+	nasIdentifier, _ := app.Config.Get("auth:radius", "nas_identifier")
+	usernameTemplate, _ := app.Config.Get("auth:radius", "username_template")
+	value, _ = app.Config.Get("auth:radius", "timeout")
+	seconds, _ := strconv.Atoi(value)
+	value, _ = app.Config.Get("auth:radius", "retries")
+	retries, _ := strconv.Atoi(value)
+
+	authenticator := RadiusAuthenticator{
+		Servers:          servers,
+		Secret:           []byte(secret),
+		NASIdentifier:    nasIdentifier,
+		Timeout:          time.Duration(seconds) * time.Second,
+		Retries:          retries,
+		UsernameTemplate: usernameTemplate,
+	}
+	return authenticator, nil
+}
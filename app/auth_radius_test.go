@@ -0,0 +1,237 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// radiusServer is a minimal stand-in RADIUS server. It decodes PAP
+// Access-Request packets and answers with Access-Accept or Access-Reject.
+type radiusServer struct {
+	conn   net.PacketConn
+	secret []byte
+	drop   int  // number of requests to ignore before answering
+	noMAC  bool // answer without Message-Authenticator
+
+	mutex         sync.Mutex
+	requests      int    // number of requests received
+	nasIdentifier string // NAS-Identifier of the last request
+	validMAC      bool   // the Message-Authenticator of the last request is valid
+}
+
+// newRadiusServer starts a stand-in RADIUS server listening on a random port.
+func newRadiusServer(t *testing.T, secret string, drop int) *radiusServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &radiusServer{conn: conn, secret: []byte(secret), drop: drop}
+	go s.serve()
+	return s
+}
+
+func (s *radiusServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *radiusServer) Close() {
+	s.conn.Close()
+}
+
+func (s *radiusServer) Requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+// LastRequest returns the NAS-Identifier of the last request, and whether its
+// Message-Authenticator is valid.
+func (s *radiusServer) LastRequest() (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.nasIdentifier, s.validMAC
+}
+
+func (s *radiusServer) serve() {
+	buffer := make([]byte, 4096)
+	for {
+		n, addr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		request := append([]byte{}, buffer[:n]...)
+
+		s.mutex.Lock()
+		s.requests++
+		drop := s.requests <= s.drop
+		s.mutex.Unlock()
+		if drop || request[0] != radiusAccessRequest {
+			continue
+		}
+
+		// decode the attributes
+		var username, password, nasIdentifier string
+		validMAC := false
+		for i := 20; i+2 <= len(request); i += int(request[i+1]) {
+			value := request[i+2 : i+int(request[i+1])]
+			switch request[i] {
+			case radiusUserName:
+				username = string(value)
+			case radiusUserPassword:
+				decoded := make([]byte, len(value))
+				previous := request[4:20]
+				for j := 0; j < len(value); j += 16 {
+					hash := md5.Sum(append(append([]byte{}, s.secret...), previous...))
+					for k := 0; k < 16; k++ {
+						decoded[j+k] = value[j+k] ^ hash[k]
+					}
+					previous = value[j : j+16]
+				}
+				password = string(decoded)
+				for len(password) > 0 && password[len(password)-1] == 0 {
+					password = password[:len(password)-1]
+				}
+			case radiusNASIdentifier:
+				nasIdentifier = string(value)
+			case radiusMessageAuthenticator:
+				data := append([]byte{}, request...)
+				copy(data[i+2:i+18], make([]byte, 16))
+				mac := hmac.New(md5.New, s.secret)
+				mac.Write(data)
+				validMAC = hmac.Equal(mac.Sum(nil), value)
+			}
+		}
+		s.mutex.Lock()
+		s.nasIdentifier = nasIdentifier
+		s.validMAC = validMAC
+		s.mutex.Unlock()
+
+		code := byte(radiusAccessReject)
+		if validMAC && username == "alice@example.com" && password == "verysecret" {
+			code = radiusAccessAccept
+		}
+
+		// an invalid response (wrong identifier), the client must ignore it
+		invalid := []byte{radiusAccessAccept, request[1] + 1, 0, 20}
+		invalid = append(invalid, make([]byte, 16)...)
+		s.conn.WriteTo(invalid, addr)
+
+		// the Message-Authenticator is computed with the Request
+		// Authenticator, then the Response Authenticator over the whole
+		// response
+		response := append([]byte{code, request[1], 0, 20}, request[4:20]...)
+		s.mutex.Lock()
+		noMAC := s.noMAC
+		s.mutex.Unlock()
+		if !noMAC {
+			response = append(response, radiusMessageAuthenticator, 18)
+			response = append(response, make([]byte, 16)...)
+			binary.BigEndian.PutUint16(response[2:4], uint16(len(response)))
+			mac := hmac.New(md5.New, s.secret)
+			mac.Write(response)
+			copy(response[len(response)-16:], mac.Sum(nil))
+		}
+		binary.BigEndian.PutUint16(response[2:4], uint16(len(response)))
+		hash := md5.New()
+		hash.Write(response)
+		hash.Write(s.secret)
+		copy(response[4:20], hash.Sum(nil))
+		s.conn.WriteTo(response, addr)
+	}
+}
+
+func TestRadiusAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create a RADIUS authenticator
+	authenticator, err := NewAuthenticator(app, "radius")
+	assert.NoError(t, err)
+	assert.IsType(t, RadiusAuthenticator{}, authenticator)
+	radiusAuthenticator := authenticator.(RadiusAuthenticator)
+	assert.Equal(t, []string{"radius1.example.com:1812", "radius2.example.com:1645"}, radiusAuthenticator.Servers)
+	assert.Equal(t, []byte("sharedsecret"), radiusAuthenticator.Secret)
+	assert.Equal(t, "persona", radiusAuthenticator.NASIdentifier)
+	assert.Equal(t, 3*time.Second, radiusAuthenticator.Timeout)
+	assert.Equal(t, 1, radiusAuthenticator.Retries)
+	assert.Equal(t, "%e", radiusAuthenticator.UsernameTemplate)
+
+	// invalid configurations
+	for _, section := range []ini.Section{
+		{"secret": "sharedsecret"},
+		{"servers": " , ", "secret": "sharedsecret"},
+		{"servers": "radius.example.com"},
+		{"servers": "radius.example.com", "secret": "sharedsecret", "timeout": "0"},
+		{"servers": "radius.example.com", "secret": "sharedsecret", "retries": "-1"},
+	} {
+		app.Config = ini.File{"auth:radius": section}
+		_, err = NewAuthenticator(app, "radius")
+		assert.Error(t, err)
+	}
+}
+
+func TestRadiusAuthenticate(t *testing.T) {
+	var (
+		s             *radiusServer
+		authenticator RadiusAuthenticator
+	)
+
+	// try to authenticate with valid and invalid credentials
+	s = newRadiusServer(t, "sharedsecret", 0)
+	authenticator = RadiusAuthenticator{Servers: []string{s.Addr()}, Secret: []byte("sharedsecret"), NASIdentifier: "gorgon", Timeout: time.Second}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	nasIdentifier, validMAC := s.LastRequest()
+	assert.Equal(t, "gorgon", nasIdentifier)
+	assert.True(t, validMAC)
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("alice@example.com", "bad password")))
+	assert.Error(t, authenticator.Authenticate("bob@example.com", "verysecret"))
+	// passwords longer than 16 bytes use several blocks
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecretverysecretverysecret"))
+	// empty or too long passwords are refused without a request
+	assert.Error(t, authenticator.Authenticate("alice@example.com", ""))
+	assert.Error(t, authenticator.Authenticate("alice@example.com", string(make([]byte, 129))))
+	assert.Equal(t, 4, s.Requests())
+
+	// wrong shared secret, the responses are ignored
+	authenticator.Secret = []byte("wrongsecret")
+	authenticator.Timeout = 50 * time.Millisecond
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+
+	// the responses without Message-Authenticator are ignored (BlastRADIUS)
+	authenticator.Secret = []byte("sharedsecret")
+	s.mutex.Lock()
+	s.noMAC = true
+	s.mutex.Unlock()
+	err := authenticator.Authenticate("alice@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.False(t, IsCredentialsError(err))
+	s.Close()
+
+	// the first request is lost, the request is sent again
+	s = newRadiusServer(t, "sharedsecret", 1)
+	authenticator = RadiusAuthenticator{Servers: []string{s.Addr()}, Secret: []byte("sharedsecret"), Timeout: 50 * time.Millisecond, Retries: 1}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Equal(t, 2, s.Requests())
+	s.Close()
+
+	// failover: the first server never responds, the second one is used
+	dead := newRadiusServer(t, "sharedsecret", 1000)
+	s = newRadiusServer(t, "sharedsecret", 0)
+	authenticator = RadiusAuthenticator{Servers: []string{dead.Addr(), s.Addr()}, Secret: []byte("sharedsecret"), Timeout: 50 * time.Millisecond, Retries: 2}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Equal(t, 3, dead.Requests())
+	assert.Equal(t, 1, s.Requests())
+
+	// no server responds
+	s.Close()
+	dead.Close()
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+}
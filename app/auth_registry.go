@@ -0,0 +1,243 @@
+package app
+
+import (
+	"errors"
+	"github.com/vaughan0/go-ini"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	authenticatorsMutex sync.RWMutex
+	authenticators      = map[string]AuthenticatorBackend{}
+)
+
+// ConfigValidator checks the value of a configuration variable. The returned
+// error completes the sentence "'<variable>' ... in '<section>' section", for
+// example "must be a positive number".
+type ConfigValidator func(value string) error
+
+// ConfigKey describes a variable of the configuration section of an
+// authentication backend.
+type ConfigKey struct {
+	Name     string          // name of the variable
+	Required bool            // the variable must be set
+	Default  string          // value used when the variable is not set (if not empty)
+	Validate ConfigValidator // checks the value of the variable (optional)
+}
+
+// AuthenticatorFactory creates an Authenticator from the configuration of the
+// app. The configuration section of the backend has already been checked
+// against the keys of the backend, and the default values are set.
+type AuthenticatorFactory func(app GorgonApp) (Authenticator, error)
+
+// AuthenticatorBackend describes an authentication backend. The backend is
+// configured in the "auth:<name>" section, only the declared keys are allowed
+// in this section (with the keys of the authentication cache, see
+// CacheConfigKeys).
+type AuthenticatorBackend struct {
+	Name string               // name of the backend, used by the "auth" variable
+	Keys []ConfigKey          // variables of the configuration section
+	New  AuthenticatorFactory // function creating the Authenticator
+}
+
+// Section returns the name of the configuration section of the backend.
+func (b AuthenticatorBackend) Section() string {
+	return "auth:" + b.Name
+}
+
+// CheckConfig checks the configuration section of the backend: required
+// variables, unknown variables (typos) and values. All the problems are
+// returned in a ConfigErrors. On success, returns a copy of the configuration
+// where the default values are set in the section of the backend.
+func (b AuthenticatorBackend) CheckConfig(config ini.File) (ini.File, error) {
+	keys := append(append([]ConfigKey{}, b.Keys...), CacheConfigKeys...)
+	return checkConfigSection(config, b.Section(), keys)
+}
+
+// checkConfigSection checks a configuration section against the given keys,
+// see CheckConfig.
+func checkConfigSection(config ini.File, section string, keys []ConfigKey) (ini.File, error) {
+	values := ini.Section{}
+	for key, value := range config[section] {
+		values[key] = value
+	}
+
+	var errs ConfigErrors
+	known := map[string]bool{}
+	for _, key := range keys {
+		known[key.Name] = true
+		value, ok := values[key.Name]
+		if !ok {
+			if key.Required {
+				errs = append(errs, errors.New("'"+key.Name+"' variable missing from '"+section+"' section"))
+			} else if key.Default != "" {
+				values[key.Name] = key.Default
+			}
+			continue
+		}
+		if key.Validate != nil {
+			if err := key.Validate(value); err != nil {
+				errs = append(errs, errors.New("'"+key.Name+"' "+err.Error()+" in '"+section+"' section"))
+			}
+		}
+	}
+
+	unknown := []string{}
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		errs = append(errs, errors.New("unknown variable '"+key+"' in '"+section+"' section"))
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	checked := ini.File{}
+	for name, s := range config {
+		checked[name] = s
+	}
+	checked[section] = values
+	return checked, nil
+}
+
+// ConfigErrors is a list of configuration errors, reported all at once.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// RegisterAuthenticator adds an authentication backend, the backend can then
+// be used with NewAuthenticator. Returns an error if the backend is invalid
+// or if a backend with the same name is already registered.
+func RegisterAuthenticator(backend AuthenticatorBackend) error {
+	if backend.Name == "" {
+		return errors.New("RegisterAuthenticator: the backend has no name")
+	}
+	if backend.New == nil {
+		return errors.New("RegisterAuthenticator: the '" + backend.Name + "' backend has no factory")
+	}
+	names := map[string]bool{}
+	for _, key := range CacheConfigKeys {
+		names[key.Name] = true
+	}
+	for _, key := range backend.Keys {
+		if key.Name == "" {
+			return errors.New("RegisterAuthenticator: the '" + backend.Name + "' backend has a key without name")
+		}
+		if names[key.Name] {
+			return errors.New("RegisterAuthenticator: the '" + backend.Name + "' backend declares the '" + key.Name + "' key twice")
+		}
+		names[key.Name] = true
+	}
+
+	authenticatorsMutex.Lock()
+	defer authenticatorsMutex.Unlock()
+	if _, ok := authenticators[backend.Name]; ok {
+		return errors.New("RegisterAuthenticator: the '" + backend.Name + "' backend is already registered")
+	}
+	authenticators[backend.Name] = backend
+	return nil
+}
+
+// mustRegisterAuthenticator registers a backend provided by Gorgon, an error
+// is a programming error.
+func mustRegisterAuthenticator(backend AuthenticatorBackend) {
+	if err := RegisterAuthenticator(backend); err != nil {
+		panic(err)
+	}
+}
+
+// LookupAuthenticator returns the registered backend with the given name.
+func LookupAuthenticator(name string) (AuthenticatorBackend, bool) {
+	authenticatorsMutex.RLock()
+	defer authenticatorsMutex.RUnlock()
+	backend, ok := authenticators[name]
+	return backend, ok
+}
+
+// RegisteredAuthenticators returns the sorted names of the registered
+// backends.
+func RegisteredAuthenticators() []string {
+	authenticatorsMutex.RLock()
+	defer authenticatorsMutex.RUnlock()
+	names := make([]string, 0, len(authenticators))
+	for name := range authenticators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateOneOf returns a ConfigValidator accepting only the given values.
+func ValidateOneOf(values ...string) ConfigValidator {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = "'" + value + "'"
+	}
+	message := "must be " + quoted[0]
+	if len(quoted) > 1 {
+		message = "must be one of " + strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+	}
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return errors.New(message)
+	}
+}
+
+// ValidateBool accepts "true" and "false".
+func ValidateBool(value string) error {
+	if value != "true" && value != "false" {
+		return errors.New("must be one of 'true' or 'false'")
+	}
+	return nil
+}
+
+// ValidatePositiveInt accepts integers greater than zero.
+func ValidatePositiveInt(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+		return errors.New("must be a positive number")
+	}
+	return nil
+}
+
+// ValidateNonNegativeInt accepts integers greater than or equal to zero.
+func ValidateNonNegativeInt(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 0 {
+		return errors.New("must be a non-negative number")
+	}
+	return nil
+}
+
+// ValidateSeconds accepts a positive number of seconds.
+func ValidateSeconds(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+		return errors.New("must be a positive number of seconds")
+	}
+	return nil
+}
+
+// ValidateNotEmpty rejects empty values (or values made of separators only,
+// spaces and commas).
+func ValidateNotEmpty(value string) error {
+	if strings.Trim(value, " \t,") == "" {
+		return errors.New("must not be empty")
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestRegisterAuthenticator(t *testing.T) {
+	factory := func(app GorgonApp) (Authenticator, error) {
+		value, _ := app.Config.Get("auth:registrytest", "password")
+		return TestAuthenticator{value}, nil
+	}
+
+	// the built-in backends are registered
+	assert.Subset(t, RegisteredAuthenticators(), []string{"test", "imap", "ldap", "file", "shadow", "sql", "smtp",
+		"pop3", "http", "exec", "dovecot", "radius", "chain"})
+
+	// invalid backends
+	assert.Error(t, RegisterAuthenticator(AuthenticatorBackend{New: factory}))
+	assert.Error(t, RegisterAuthenticator(AuthenticatorBackend{Name: "registrytest"}))
+	assert.Error(t, RegisterAuthenticator(AuthenticatorBackend{
+		Name: "registrytest",
+		Keys: []ConfigKey{{Name: "password"}, {Name: "password"}},
+		New:  factory,
+	}))
+	assert.Error(t, RegisterAuthenticator(AuthenticatorBackend{Name: "registrytest", Keys: []ConfigKey{{}}, New: factory}))
+	assert.Error(t, RegisterAuthenticator(AuthenticatorBackend{Name: "registrytest", Keys: []ConfigKey{{Name: "cache_ttl"}}, New: factory}))
+	assert.Error(t, RegisterAuthenticator(AuthenticatorBackend{Name: "test", New: factory}))
+	_, ok := LookupAuthenticator("registrytest")
+	assert.False(t, ok)
+
+	// a valid backend
+	assert.NoError(t, RegisterAuthenticator(AuthenticatorBackend{
+		Name: "registrytest",
+		Keys: []ConfigKey{{Name: "password", Default: "verysecret"}},
+		New:  factory,
+	}))
+	backend, ok := LookupAuthenticator("registrytest")
+	assert.True(t, ok)
+	assert.Equal(t, "auth:registrytest", backend.Section())
+	assert.Contains(t, RegisteredAuthenticators(), "registrytest")
+
+	// the backend can be used with NewAuthenticator
+	app := NewApp("../tests/gorgon.ini")
+	authenticator, err := NewAuthenticator(app, "registrytest")
+	assert.NoError(t, err)
+	assert.Equal(t, TestAuthenticator{"verysecret"}, authenticator)
+
+	// a backend returning no authenticator
+	assert.NoError(t, RegisterAuthenticator(AuthenticatorBackend{
+		Name: "registrytestnil",
+		New:  func(app GorgonApp) (Authenticator, error) { return nil, nil },
+	}))
+	_, err = NewAuthenticator(app, "registrytestnil")
+	assert.Error(t, err)
+}
+
+func TestCheckConfig(t *testing.T) {
+	backend := AuthenticatorBackend{
+		Name: "check",
+		Keys: []ConfigKey{
+			{Name: "server", Required: true},
+			{Name: "mode", Default: "fast", Validate: ValidateOneOf("fast", "slow")},
+			{Name: "timeout", Default: "10", Validate: ValidateSeconds},
+			{Name: "comment"},
+		},
+	}
+
+	// the default values are set in a copy of the configuration
+	config := ini.File{"global": ini.Section{"auth": "check"}, "auth:check": ini.Section{"server": "example.com"}}
+	checked, err := backend.CheckConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, ini.Section{
+		"server":             "example.com",
+		"mode":               "fast",
+		"timeout":            "10",
+		"cache":              "false",
+		"cache_ttl":          "300",
+		"cache_negative_ttl": "30",
+		"cache_size":         "1000",
+	}, checked["auth:check"])
+	assert.Equal(t, config["global"], checked["global"])
+	assert.Equal(t, ini.Section{"server": "example.com"}, config["auth:check"])
+
+	// all the errors are reported at once
+	config = ini.File{"auth:check": ini.Section{"mode": "medium", "timeout": "-1", "sever": "example.com"}}
+	_, err = backend.CheckConfig(config)
+	assert.IsType(t, ConfigErrors{}, err)
+	assert.Equal(t, ConfigErrors{
+		errors.New("'server' variable missing from 'auth:check' section"),
+		errors.New("'mode' must be one of 'fast' or 'slow' in 'auth:check' section"),
+		errors.New("'timeout' must be a positive number of seconds in 'auth:check' section"),
+		errors.New("unknown variable 'sever' in 'auth:check' section"),
+	}, err)
+	assert.Contains(t, err.Error(), "; unknown variable 'sever'")
+
+	// missing section
+	_, err = backend.CheckConfig(ini.File{})
+	assert.Len(t, err, 1)
+}
+
+func TestConfigValidators(t *testing.T) {
+	assert.NoError(t, ValidateOneOf("a", "b", "c")("b"))
+	assert.EqualError(t, ValidateOneOf("a", "b", "c")("d"), "must be one of 'a', 'b' or 'c'")
+	assert.EqualError(t, ValidateOneOf("a")("d"), "must be 'a'")
+	assert.NoError(t, ValidateBool("false"))
+	assert.Error(t, ValidateBool("yes"))
+	assert.NoError(t, ValidatePositiveInt("1"))
+	assert.Error(t, ValidatePositiveInt("0"))
+	assert.NoError(t, ValidateNonNegativeInt("0"))
+	assert.EqualError(t, ValidateNonNegativeInt("-1"), "must be a non-negative number")
+	assert.NoError(t, ValidateSeconds("30"))
+	assert.Error(t, ValidateSeconds("thirty"))
+	assert.NoError(t, ValidateNotEmpty("a, b"))
+	assert.Error(t, ValidateNotEmpty(" , "))
+}
+
+func TestBuiltinAuthenticatorsConfig(t *testing.T) {
+	app := NewApp("../tests/gorgon.ini")
+
+	// missing variables are errors, not panics
+	for _, name := range []string{"test", "imap"} {
+		app.Config = ini.File{}
+		_, err := NewAuthenticator(app, name)
+		assert.Error(t, err)
+	}
+
+	// typos are detected
+	app.Config = ini.File{"auth:imap": ini.Section{"server": "imap.example.com", "tls_mod": "imaps"}}
+	_, err := NewAuthenticator(app, "imap")
+	assert.EqualError(t, err, "unknown variable 'tls_mod' in 'auth:imap' section")
+
+	// the TLS variables are accepted by the backends using NewTLSConfig
+	app.Config = ini.File{"auth:smtp": ini.Section{"server": "smtp.example.com", "verify_cert": "maybe"}}
+	_, err = NewAuthenticator(app, "smtp")
+	assert.EqualError(t, err, "'verify_cert' must be one of 'true' or 'false' in 'auth:smtp' section")
+}
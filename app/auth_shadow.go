@@ -0,0 +1,285 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShadowAuthenticator implements the Authenticator interface to authenticate
+// users against the local Unix accounts, described by the passwd(5) and
+// shadow(5) files. The login name is created from the username (email) with
+// the username template (see FormatUsername), then translated with the
+// optional map file. Each line of the map file contains a name (as created
+// by the template) and a login name separated by spaces, empty lines and
+// lines starting with "#" are ignored.
+//
+// Supported hash schemes are listed in CheckPasswordHash, the usual schemes
+// of the shadow file being SHA-256-crypt ("$5$"), SHA-512-crypt ("$6$"),
+// yescrypt ("$y$") and bcrypt ("$2b$"). The authentication is refused for:
+// - accounts with a UID lower than MinUID (system accounts)
+// - locked accounts (hash starting with "!") and accounts without password
+//   (empty hash or "*")
+// - expired accounts (expiration date of the shadow file)
+//
+// The files are reloaded when they change on disk. The shadow file is only
+// readable by root and the "shadow" group on most systems: Gorgon must be run
+// with the appropriate permissions.
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = shadow
+//
+// [auth:shadow]
+// passwd_file = /etc/passwd
+// shadow_file = /etc/shadow
+// map_file = /etc/gorgon/logins
+// username_template = %u
+// min_uid = 1000
+//
+type ShadowAuthenticator struct {
+	PasswdPath       string // path to the passwd file
+	ShadowPath       string // path to the shadow file
+	MapPath          string // path to the file mapping names to login names (optional)
+	UsernameTemplate string // template used to create the login name
+	MinUID           int    // minimum UID of the accounts allowed to log in
+
+	mutex  sync.Mutex             // protects the fields below
+	stamps []fileStamp            // modification times and sizes of the loaded files
+	users  map[string]*shadowUser // login name => account
+	logins map[string]string      // name => login name (map file)
+}
+
+// shadowUser is an account described by the passwd and shadow files.
+type shadowUser struct {
+	uid     int
+	gecos   string // full name (first field of the GECOS field)
+	hash    string // password hash, empty if the account is not in the shadow file
+	expires int64  // expiration date in days since the epoch, -1 if none
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Authenticate checks the password of the Unix account of the user.
+func (a *ShadowAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext checks the password of the Unix account of the user
+// and returns an identity with the full name of the account.
+func (a *ShadowAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	login := FormatUsername(a.UsernameTemplate, username)
+	user, err := a.lookup(login)
+	if err != nil {
+		// a dummy hash is checked for an unknown user, not to reveal the
+		// existing accounts by the response time
+		if IsCredentialsError(err) {
+			CheckPasswordHash(dummyPasswordHash, password)
+		}
+		return nil, err
+	}
+
+	if user.uid < a.MinUID {
+		return nil, CredentialsError{"ShadowAuthenticator: system account '" + login + "'"}
+	}
+	if strings.HasPrefix(user.hash, "!") {
+		return nil, CredentialsError{"ShadowAuthenticator: locked account '" + login + "'"}
+	}
+	if user.hash == "" || user.hash == "*" {
+		return nil, CredentialsError{"ShadowAuthenticator: no password for account '" + login + "'"}
+	}
+	if user.expires != -1 && time.Now().Unix()/86400 >= user.expires {
+		return nil, CredentialsError{"ShadowAuthenticator: expired account '" + login + "'"}
+	}
+
+	if err := CheckPasswordHash(user.hash, password); err == ErrPasswordMismatch {
+		return nil, CredentialsError{"ShadowAuthenticator: bad password for '" + login + "'"}
+	} else if err != nil {
+		return nil, err
+	}
+	return &Identity{Email: username, DisplayName: user.gecos}, nil
+}
+
+// lookup returns the account of the user, the files are reloaded first if
+// one of them has changed since the last load.
+func (a *ShadowAuthenticator) lookup(name string) (*shadowUser, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	paths := []string{a.PasswdPath, a.ShadowPath}
+	if a.MapPath != "" {
+		paths = append(paths, a.MapPath)
+	}
+	stamps := make([]fileStamp, len(paths))
+	changed := a.users == nil
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{info.ModTime(), info.Size()}
+		if !changed && (!stamps[i].modTime.Equal(a.stamps[i].modTime) || stamps[i].size != a.stamps[i].size) {
+			changed = true
+		}
+	}
+	if changed {
+		users, logins, err := a.load()
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+		a.logins = logins
+		a.stamps = stamps
+	}
+
+	if login, ok := a.logins[name]; ok {
+		name = login
+	}
+	user, ok := a.users[name]
+	if !ok {
+		return nil, CredentialsError{"ShadowAuthenticator: unknown user '" + name + "'"}
+	}
+	return user, nil
+}
+
+// load reads the passwd, shadow and map files.
+func (a *ShadowAuthenticator) load() (map[string]*shadowUser, map[string]string, error) {
+	users := make(map[string]*shadowUser)
+	err := readColonFile(a.PasswdPath, func(fields []string) {
+		// name:password:UID:GID:GECOS:directory:shell
+		if len(fields) < 7 {
+			return
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return
+		}
+		gecos := strings.SplitN(fields[4], ",", 2)[0]
+		users[fields[0]] = &shadowUser{uid: uid, gecos: gecos, expires: -1}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = readColonFile(a.ShadowPath, func(fields []string) {
+		// name:password:lastchg:min:max:warn:inactive:expire:reserved
+		if len(fields) < 9 {
+			return
+		}
+		user, ok := users[fields[0]]
+		if !ok {
+			return
+		}
+		user.hash = fields[1]
+		if fields[7] != "" {
+			expires, err := strconv.ParseInt(fields[7], 10, 64)
+			if err != nil {
+				// the expiration date can't be checked, lock the account
+				user.hash = "!"
+				return
+			}
+			user.expires = expires
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logins := make(map[string]string)
+	if a.MapPath != "" {
+		if logins, err = readLoginMapFile(a.MapPath); err != nil {
+			return nil, nil, err
+		}
+	}
+	return users, logins, nil
+}
+
+// readColonFile calls fn with the fields of each line of a colon separated
+// file (passwd or shadow), empty lines and lines starting with "#" are
+// ignored.
+func readColonFile(path string, fn func(fields []string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
+
+// readLoginMapFile parses a file mapping names to login names.
+func readLoginMapFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	logins := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		logins[fields[0]] = fields[1]
+	}
+	return logins, scanner.Err()
+}
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "shadow",
+		Keys: []ConfigKey{
+			{Name: "passwd_file", Default: "/etc/passwd"},
+			{Name: "shadow_file", Default: "/etc/shadow"},
+			{Name: "map_file"},
+			{Name: "username_template", Default: "%u"},
+			{Name: "min_uid", Default: "1000", Validate: ValidateNonNegativeInt},
+		},
+		New: NewShadowAuthenticator,
+	})
+}
+
+// NewShadowAuthenticator returns a populated ShadowAuthenticator.
+func NewShadowAuthenticator(app GorgonApp) (Authenticator, error) {
+	passwdPath, _ := app.Config.Get("auth:shadow", "passwd_file")
+	shadowPath, _ := app.Config.Get("auth:shadow", "shadow_file")
+	mapPath, _ := app.Config.Get("auth:shadow", "map_file")
+	usernameTemplate, _ := app.Config.Get("auth:shadow", "username_template")
+	value, _ := app.Config.Get("auth:shadow", "min_uid")
+	minUID, _ := strconv.Atoi(value)
+
+	authenticator := &ShadowAuthenticator{
+		PasswdPath:       passwdPath,
+		ShadowPath:       shadowPath,
+		MapPath:          mapPath,
+		UsernameTemplate: usernameTemplate,
+		MinUID:           minUID,
+	}
+
+	// load the files a first time to detect errors early
+	if _, _, err := authenticator.load(); err != nil {
+		return nil, err
+	}
+	return authenticator, nil
+}
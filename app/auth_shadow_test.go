@@ -0,0 +1,79 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadowAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create a Shadow authenticator
+	authenticator, err := NewAuthenticator(app, "shadow")
+	assert.NoError(t, err)
+	assert.IsType(t, &ShadowAuthenticator{}, authenticator)
+	shadowAuthenticator := authenticator.(*ShadowAuthenticator)
+	assert.Equal(t, "../tests/passwd", shadowAuthenticator.PasswdPath)
+	assert.Equal(t, "../tests/shadow", shadowAuthenticator.ShadowPath)
+	assert.Equal(t, "../tests/logins", shadowAuthenticator.MapPath)
+	assert.Equal(t, "%u", shadowAuthenticator.UsernameTemplate)
+	assert.Equal(t, 1000, shadowAuthenticator.MinUID)
+
+	// try to authenticate with the good password ($6$, $5$, $y$ and $2b$)
+	for _, username := range []string{"alice@example.com", "bob@example.com", "carol@example.com", "dave@example.com"} {
+		assert.NoError(t, authenticator.Authenticate(username, "verysecret"), username)
+	}
+
+	// try to authenticate with a wrong password
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("alice@example.com", "bad password")))
+
+	// the name created with the template is translated with the map file
+	identity, err := shadowAuthenticator.AuthenticateContext(context.Background(), "alice.liddell@example.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "alice.liddell@example.com", DisplayName: "Alice Liddell"}, identity)
+
+	// unknown, system, locked, passwordless and expired accounts are refused
+	for _, username := range []string{"unknown@example.com", "root@example.com", "daemon@example.com",
+		"erin@example.com", "grace@example.com", "frank@example.com"} {
+		err := authenticator.Authenticate(username, "verysecret")
+		assert.True(t, IsCredentialsError(err), username)
+	}
+
+	// missing files are hard errors
+	shadowAuthenticator = &ShadowAuthenticator{PasswdPath: "../tests/passwd", ShadowPath: "../tests/missing", MinUID: 1000}
+	err = shadowAuthenticator.Authenticate("alice@example.com", "verysecret")
+	assert.Error(t, err)
+	assert.False(t, IsCredentialsError(err))
+	app.Config["auth:shadow"]["shadow_file"] = "../tests/missing"
+	_, err = NewAuthenticator(app, "shadow")
+	assert.Error(t, err)
+}
+
+func TestShadowAuthenticatorReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorgon-shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwd := filepath.Join(dir, "passwd")
+	shadow := filepath.Join(dir, "shadow")
+	ioutil.WriteFile(passwd, []byte("alice:x:1000:1000:Alice:/home/alice:/bin/sh\n"), 0644)
+	ioutil.WriteFile(shadow, []byte("alice:$5$gorgonsalt$4suWjsurwiusgb/Mh7bPszCyIDZkGpbE.Qttnmxj.a6:19000:0:99999:7:::\n"), 0600)
+
+	authenticator := &ShadowAuthenticator{PasswdPath: passwd, ShadowPath: shadow, UsernameTemplate: "%u", MinUID: 1000}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+
+	// lock the account, the new content must be used
+	err = ioutil.WriteFile(shadow, []byte("alice:!$5$gorgonsalt$4suWjsurwiusgb/Mh7bPszCyIDZkGpbE.Qttnmxj.a6:19000:0:99999:7:::\n"), 0600)
+	assert.NoError(t, err)
+	modTime := time.Now().Add(time.Minute)
+	os.Chtimes(shadow, modTime, modTime)
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("alice@example.com", "verysecret")))
+}
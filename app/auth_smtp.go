@@ -0,0 +1,247 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SmtpAuthenticator implements the Authenticator interface to authenticate
+// users against an SMTP submission server with the SMTP AUTH extension. The
+// PLAIN mechanism is used if the server advertises it, else the LOGIN
+// mechanism. No mail is ever sent, the connection is closed as soon as the
+// authentication is done.
+//
+// The connection to the SMTP server is secured according to the TLS mode:
+// - smtps: implicit TLS (default port 465)
+// - starttls: the connection switches to TLS with the STARTTLS command, the
+//   authentication is refused if the server does not advertise STARTTLS
+//   (default port 587)
+// - none: no TLS, the password is sent in clear (default port 587)
+//
+// An example configuration looks like this:
+//
+// [global]
+// ...
+// auth = smtp
+//
+// [auth:smtp]
+// server = smtp.example.com:587
+// tls_mode = starttls
+// verify_cert = true
+// helo = gorgon.example.com
+// username_template = %e
+//
+type SmtpAuthenticator struct {
+	Server           string        // address (host:port) of the SMTP server
+	TLSMode          string        // "smtps", "starttls" or "none"
+	TLSConfig        *tls.Config   // TLS configuration used to connect to the server
+	Helo             string        // name sent in the EHLO command
+	UsernameTemplate string        // template used to create the SMTP login name
+	Timeout          time.Duration // maximum duration of the SMTP session
+}
+
+// Authenticate uses an SMTP server to authenticate users. The login name is
+// created from the username (email) with the username template, the password
+// is passed without modification to the SMTP server.
+func (a SmtpAuthenticator) Authenticate(username, password string) error {
+	_, err := a.AuthenticateContext(context.Background(), username, password)
+	return err
+}
+
+// AuthenticateContext uses an SMTP server to authenticate users, the
+// connection is interrupted when the context is done.
+func (a SmtpAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	if err := a.authenticate(ctx, FormatUsername(a.UsernameTemplate, username), password); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return &Identity{Email: username}, nil
+}
+
+// authenticate connects to the SMTP server and checks the login name and the
+// password with the AUTH command.
+func (a SmtpAuthenticator) authenticate(ctx context.Context, username, password string) (err error) {
+	ctx, cancel := contextWithTimeout(ctx, a.Timeout)
+	defer cancel()
+	client, err := dialSMTP(ctx, a.Server, a.TLSMode, a.TLSConfig, a.Helo)
+	if err != nil {
+		return errors.New("SmtpAuthenticator: " + err.Error())
+	}
+	defer client.Close()
+
+	auth, err := newSMTPAuth(client, username, password)
+	if err != nil {
+		return errors.New("SmtpAuthenticator: " + err.Error())
+	}
+	if err = client.Auth(auth); err != nil {
+		// 535: authentication credentials invalid (RFC 4954)
+		if textErr, ok := err.(*textproto.Error); ok && textErr.Code == 535 {
+			return CredentialsError{"SmtpAuthenticator: " + err.Error()}
+		}
+		return
+	}
+	client.Quit()
+	return
+}
+
+// dialSMTP connects to an SMTP server and sends the EHLO command. The
+// connection is secured according to the TLS mode ("smtps", "starttls" or
+// "none", see SmtpAuthenticator) and interrupted when the context is done
+// (see dialContext).
+func dialSMTP(ctx context.Context, server, tlsMode string, tlsConfig *tls.Config, helo string) (*smtp.Client, error) {
+	var conn net.Conn
+	var err error
+	switch tlsMode {
+	case "smtps":
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		conn, err = dialContext(ctx, "tcp", server, tlsConfig)
+	case "starttls", "none":
+		conn, err = dialContext(ctx, "tcp", server, nil)
+	default:
+		return nil, errors.New("unknown tls_mode '" + tlsMode + "'")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(server)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err = client.Hello(helo); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	if tlsMode == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, errors.New("STARTTLS is not supported by the server")
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// newSMTPAuth returns the authentication mechanism used with the server:
+// PLAIN if the server advertises it, else LOGIN.
+func newSMTPAuth(client *smtp.Client, username, password string) (smtp.Auth, error) {
+	ok, mechanisms := client.Extension("AUTH")
+	if !ok {
+		return nil, errors.New("AUTH is not supported by the server")
+	}
+	var auth smtp.Auth
+	for _, mechanism := range strings.Fields(strings.ToUpper(mechanisms)) {
+		if mechanism == "PLAIN" {
+			auth = smtpPlainAuth{username, password}
+			break
+		} else if mechanism == "LOGIN" {
+			auth = smtpLoginAuth{username, password}
+		}
+	}
+	if auth == nil {
+		return nil, errors.New("no supported AUTH mechanism (" + mechanisms + ")")
+	}
+	return auth, nil
+}
+
+// smtpPlainAuth implements the PLAIN authentication mechanism (RFC 4616). The
+// TLS policy is enforced by the SmtpAuthenticator, unlike smtp.PlainAuth
+// there is no restriction on unencrypted connections.
+type smtpPlainAuth struct {
+	username, password string
+}
+
+func (a smtpPlainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a smtpPlainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
+
+// smtpLoginAuth implements the non-standard but widely deployed LOGIN
+// authentication mechanism.
+type smtpLoginAuth struct {
+	username, password string
+}
+
+func (a smtpLoginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a smtpLoginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected server challenge")
+}
+
+func init() {
+	mustRegisterAuthenticator(AuthenticatorBackend{
+		Name: "smtp",
+		Keys: append([]ConfigKey{
+			{Name: "server", Required: true},
+			{Name: "tls_mode", Default: "starttls", Validate: ValidateOneOf("smtps", "starttls", "none")},
+			{Name: "helo", Default: "localhost"},
+			{Name: "username_template", Default: "%e"},
+		}, TLSConfigKeys...),
+		New: NewSmtpAuthenticator,
+	})
+}
+
+// NewSmtpAuthenticator returns a populated SmtpAuthenticator.
+func NewSmtpAuthenticator(app GorgonApp) (Authenticator, error) {
+	server, _ := app.Config.Get("auth:smtp", "server")
+	tlsMode, _ := app.Config.Get("auth:smtp", "tls_mode")
+	helo, _ := app.Config.Get("auth:smtp", "helo")
+	usernameTemplate, _ := app.Config.Get("auth:smtp", "username_template")
+
+	// use the default port if none is provided
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+		if tlsMode == "smtps" {
+			server = net.JoinHostPort(server, "465")
+		} else {
+			server = net.JoinHostPort(server, "587")
+		}
+	}
+
+	tlsConfig, err := NewTLSConfig(app.Config, "auth:smtp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticator := SmtpAuthenticator{
+		Server:           server,
+		TLSMode:          tlsMode,
+		TLSConfig:        tlsConfig,
+		Helo:             helo,
+		UsernameTemplate: usernameTemplate,
+		Timeout:          30 * time.Second,
+	}
+	return authenticator, nil
+}
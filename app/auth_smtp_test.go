@@ -0,0 +1,282 @@
+package app
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpServer is a minimal stand-in SMTP server. It only understands the EHLO,
+// STARTTLS, AUTH (PLAIN and LOGIN), MAIL, RCPT, DATA and QUIT commands, the
+// messages received are captured.
+type smtpServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config // TLS configuration used by the server
+	implicitTLS bool        // the connection is encrypted from the start (smtps)
+	extensions  []string    // extensions advertised before TLS
+
+	mutex          sync.Mutex
+	clearTextAuth  bool          // an AUTH command has been received in clear
+	unknownCommand []string      // unexpected commands received
+	messages       []smtpMessage // messages received
+}
+
+// smtpMessage is a message received by the stand-in SMTP server.
+type smtpMessage struct {
+	From string   // envelope sender
+	To   []string // envelope recipients
+	Data string   // content of the message (headers and body)
+}
+
+// newSmtpServer starts a stand-in SMTP server listening on a random port.
+func newSmtpServer(t *testing.T, tlsConfig *tls.Config, implicitTLS bool, extensions ...string) *smtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{
+		listener:    listener,
+		tlsConfig:   tlsConfig,
+		implicitTLS: implicitTLS,
+		extensions:  extensions,
+	}
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *smtpServer) Close() {
+	s.listener.Close()
+}
+
+func (s *smtpServer) ClearTextAuth() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.clearTextAuth
+}
+
+func (s *smtpServer) UnknownCommands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.unknownCommand
+}
+
+func (s *smtpServer) Messages() []smtpMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.messages
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	encrypted := s.implicitTLS
+	if encrypted {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 smtp.example.com ESMTP ready")
+	var message *smtpMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "EHLO":
+			lines := []string{"smtp.example.com"}
+			for _, extension := range s.extensions {
+				if !(encrypted && extension == "STARTTLS") {
+					lines = append(lines, extension)
+				}
+			}
+			for i, l := range lines {
+				if i == len(lines)-1 {
+					text.PrintfLine("250 %s", l)
+				} else {
+					text.PrintfLine("250-%s", l)
+				}
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			conn = tls.Server(conn, s.tlsConfig)
+			text = textproto.NewConn(conn)
+			encrypted = true
+		case "AUTH":
+			s.mutex.Lock()
+			s.clearTextAuth = s.clearTextAuth || !encrypted
+			s.mutex.Unlock()
+
+			username, password := "", ""
+			switch {
+			case len(fields) >= 2 && strings.ToUpper(fields[1]) == "PLAIN":
+				response := ""
+				if len(fields) == 3 {
+					response = fields[2]
+				} else {
+					text.PrintfLine("334 ")
+					response, _ = text.ReadLine()
+				}
+				decoded, _ := base64.StdEncoding.DecodeString(response)
+				parts := strings.Split(string(decoded), "\x00")
+				if len(parts) == 3 {
+					username, password = parts[1], parts[2]
+				}
+			case len(fields) == 2 && strings.ToUpper(fields[1]) == "LOGIN":
+				text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+				response, _ := text.ReadLine()
+				decoded, _ := base64.StdEncoding.DecodeString(response)
+				username = string(decoded)
+				text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				response, _ = text.ReadLine()
+				decoded, _ = base64.StdEncoding.DecodeString(response)
+				password = string(decoded)
+			default:
+				text.PrintfLine("504 Unrecognized authentication type")
+				continue
+			}
+
+			if username == "alice@example.com" && password == "verysecret" {
+				text.PrintfLine("235 Authentication successful")
+			} else {
+				text.PrintfLine("535 Authentication credentials invalid")
+			}
+		case "MAIL":
+			message = &smtpMessage{From: smtpPath(line)}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if message == nil {
+				text.PrintfLine("503 Bad sequence of commands")
+				continue
+			}
+			message.To = append(message.To, smtpPath(line))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			if message == nil || len(message.To) == 0 {
+				text.PrintfLine("503 Bad sequence of commands")
+				continue
+			}
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			message.Data = string(data)
+			s.mutex.Lock()
+			s.messages = append(s.messages, *message)
+			s.mutex.Unlock()
+			message = nil
+			text.PrintfLine("250 OK: queued")
+		case "*":
+			// cancellation of an AUTH exchange
+			text.PrintfLine("501 Authentication cancelled")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			s.mutex.Lock()
+			s.unknownCommand = append(s.unknownCommand, line)
+			s.mutex.Unlock()
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// smtpPath returns the address between angle brackets of a MAIL or RCPT
+// command.
+func smtpPath(line string) string {
+	start, end := strings.Index(line, "<"), strings.LastIndex(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func TestSmtpAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create an SMTP authenticator
+	authenticator, err := NewAuthenticator(app, "smtp")
+	assert.NoError(t, err)
+	assert.IsType(t, SmtpAuthenticator{}, authenticator)
+	smtpAuthenticator := authenticator.(SmtpAuthenticator)
+	assert.Equal(t, "smtp.example.com:465", smtpAuthenticator.Server)
+	assert.Equal(t, "smtps", smtpAuthenticator.TLSMode)
+	assert.Equal(t, "smtp.example.com", smtpAuthenticator.TLSConfig.ServerName)
+	assert.Equal(t, "localhost", smtpAuthenticator.Helo)
+	assert.Equal(t, "%e", smtpAuthenticator.UsernameTemplate)
+}
+
+func TestSmtpAuthenticate(t *testing.T) {
+	var (
+		s             *smtpServer
+		authenticator SmtpAuthenticator
+	)
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+
+	// STARTTLS and AUTH PLAIN
+	s = newSmtpServer(t, serverConfig, false, "STARTTLS", "AUTH LOGIN PLAIN")
+	authenticator = SmtpAuthenticator{Server: s.Addr(), TLSMode: "starttls", TLSConfig: clientConfig, Helo: "localhost"}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("alice@example.com", "bad password")))
+	assert.False(t, s.ClearTextAuth())
+	assert.Empty(t, s.UnknownCommands())
+	assert.Empty(t, s.Messages(), "No mail must be sent")
+	s.Close()
+
+	// STARTTLS not advertised by the server, the password must not be sent
+	s = newSmtpServer(t, serverConfig, false, "AUTH PLAIN")
+	authenticator = SmtpAuthenticator{Server: s.Addr(), TLSMode: "starttls", TLSConfig: clientConfig, Helo: "localhost"}
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.False(t, s.ClearTextAuth())
+	s.Close()
+
+	// implicit TLS and AUTH LOGIN
+	s = newSmtpServer(t, serverConfig, true, "AUTH LOGIN")
+	authenticator = SmtpAuthenticator{Server: s.Addr(), TLSMode: "smtps", TLSConfig: clientConfig, Helo: "localhost"}
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "bad password"))
+
+	// implicit TLS with an untrusted certificate
+	authenticator.TLSConfig = &tls.Config{ServerName: "localhost"}
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	s.Close()
+
+	// no supported AUTH mechanism
+	s = newSmtpServer(t, serverConfig, true, "AUTH CRAM-MD5")
+	authenticator = SmtpAuthenticator{Server: s.Addr(), TLSMode: "smtps", TLSConfig: clientConfig, Helo: "localhost"}
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+	s.Close()
+
+	// no TLS at all, with a username template
+	s = newSmtpServer(t, serverConfig, false, "AUTH PLAIN")
+	authenticator = SmtpAuthenticator{Server: s.Addr(), TLSMode: "none", Helo: "localhost", UsernameTemplate: "%u@example.com"}
+	assert.NoError(t, authenticator.Authenticate("alice@foobar.com", "verysecret"))
+	assert.True(t, s.ClearTextAuth())
+	s.Close()
+}
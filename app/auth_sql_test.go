@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSqlAuthenticator(t *testing.T) {
+	// create our app
+	app := NewApp("../tests/gorgon.ini")
+
+	// create a SQL authenticator
+	authenticator, err := NewAuthenticator(app, "sql")
+	assert.NoError(t, err)
+	assert.IsType(t, SqlAuthenticator{}, authenticator)
+	sqlAuthenticator := authenticator.(SqlAuthenticator)
+	assert.NotNil(t, sqlAuthenticator.DB)
+	assert.Equal(t, "SELECT password, scheme FROM users WHERE email = $1", sqlAuthenticator.Query)
+}
+
+func TestSqlAuthenticate(t *testing.T) {
+	// create an embedded SQLite database
+	dir, err := ioutil.TempDir("", "gorgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "users.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range []string{
+		"CREATE TABLE users (email TEXT, password TEXT, scheme TEXT)",
+		"INSERT INTO users VALUES ('sha512@example.com', '{SHA512-CRYPT}$6$gorgonsalt$yd/u5iLXK2ruQ5s7kAibi9cADU2djGUj0tbUOABTfRo2BrqGx4Si7XgYCUC0CYpWtzqC6IZBGM7cNu5jLfm/o0', NULL)",
+		"INSERT INTO users VALUES ('bcrypt@example.com', '$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga', 'BLF-CRYPT')",
+		"INSERT INTO users VALUES ('argon2id@example.com', '{ARGON2ID}$argon2id$v=19$m=1024,t=1,p=1$Z29yZ29uc2FsdHNhbHQxNg$oiE1NFxatqDn73uPj/xPvsUsFQwJ8E+YhemKrK/ibwQ', '')",
+		"INSERT INTO users VALUES ('mismatch@example.com', '$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga', 'SHA512-CRYPT')",
+		"INSERT INTO users VALUES ('nopassword@example.com', NULL, NULL)",
+		"INSERT INTO users VALUES ('twice@example.com', '$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga', NULL)",
+		"INSERT INTO users VALUES ('twice@example.com', '$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga', NULL)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	authenticator := SqlAuthenticator{
+		DB:    db,
+		Query: "SELECT password, scheme FROM users WHERE email = $1",
+	}
+
+	// try to authenticate with the good password
+	for _, username := range []string{"sha512@example.com", "bcrypt@example.com", "argon2id@example.com"} {
+		assert.NoError(t, authenticator.Authenticate(username, "verysecret"), username)
+	}
+
+	// try to authenticate with a wrong password
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("sha512@example.com", "bad password")))
+
+	// try to authenticate with a hash that does not match the scheme
+	assert.Error(t, authenticator.Authenticate("mismatch@example.com", "verysecret"))
+
+	// try to authenticate an unknown user, a user without a password or a
+	// user with more than one row
+	assert.Error(t, authenticator.Authenticate("unknown@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("nopassword@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("twice@example.com", "verysecret"))
+
+	// try to inject SQL
+	assert.Error(t, authenticator.Authenticate("' OR '1'='1", "verysecret"))
+
+	// the query can return only the password column
+	authenticator.Query = "SELECT password FROM users WHERE email = $1"
+	assert.NoError(t, authenticator.Authenticate("sha512@example.com", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("bcrypt@example.com", "bad password"))
+
+	// the query is not run when the context is done
+	identity, err := authenticator.AuthenticateContext(context.Background(), "sha512@example.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "sha512@example.com"}, identity)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = authenticator.AuthenticateContext(ctx, "sha512@example.com", "verysecret")
+	assert.Equal(t, context.Canceled, err)
+}
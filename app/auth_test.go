@@ -1,8 +1,15 @@
 package app
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mxk/go-imap/imap"
 	"github.com/mxk/go-imap/mock"
@@ -19,6 +26,103 @@ func TestNewAuthenticator(t *testing.T) {
 	assert.Error(t, err)
 }
 
+// blockingAuthenticator is an Authenticator blocking until the release
+// channel is closed.
+type blockingAuthenticator struct {
+	release chan struct{}
+}
+
+func (a blockingAuthenticator) Authenticate(username, password string) error {
+	<-a.release
+	return nil
+}
+
+func TestAuthenticatorAdapter(t *testing.T) {
+	// a ContextAuthenticator is not wrapped
+	chain := ChainAuthenticator{Mode: "first-success"}
+	assert.Equal(t, chain, NewContextAuthenticator(chain))
+
+	// an Authenticator is wrapped
+	authenticator := NewContextAuthenticator(TestAuthenticator{"verysecret"})
+	assert.IsType(t, AuthenticatorAdapter{}, authenticator)
+	identity, err := authenticator.AuthenticateContext(context.Background(), "alice@example.com", "verysecret")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Email: "alice@example.com"}, identity)
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+
+	// wrong password
+	identity, err = authenticator.AuthenticateContext(context.Background(), "alice@example.com", "bad password")
+	assert.Nil(t, identity)
+	assert.True(t, IsCredentialsError(err))
+
+	// context already canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = authenticator.AuthenticateContext(ctx, "alice@example.com", "verysecret")
+	assert.Equal(t, context.Canceled, err)
+
+	// deadline exceeded before the end of the authentication
+	release := make(chan struct{})
+	defer close(release)
+	authenticator = NewContextAuthenticator(blockingAuthenticator{release})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	identity, err = authenticator.AuthenticateContext(ctx, "alice@example.com", "verysecret")
+	assert.Nil(t, identity)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestAuthenticateContextDeadline(t *testing.T) {
+	// the servers accept the connections and never respond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	server := listener.Addr().String()
+	for _, authenticator := range []ContextAuthenticator{
+		ImapAuthenticator{Server: server, TLSMode: "none"},
+		LdapAuthenticator{Server: server, TLSMode: "none", Filter: "(mail=%s)"},
+		DovecotAuthenticator{Network: "tcp", Address: server, Service: "gorgon"},
+		SmtpAuthenticator{Server: server, TLSMode: "none"},
+		Pop3Authenticator{Server: server, TLSMode: "none"},
+		RadiusAuthenticator{Servers: []string{udp.LocalAddr().String()}, Secret: []byte("secret"), Timeout: time.Minute},
+	} {
+		// TEST: the authentication is aborted at the deadline of the context
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		identity, err := authenticator.AuthenticateContext(ctx, "alice@example.com", "verysecret")
+		cancel()
+		assert.Nil(t, identity)
+		assert.Equal(t, context.DeadlineExceeded, err, "%T", authenticator)
+		assert.True(t, time.Since(start) < 5*time.Second, "%T must not wait for its own timeout", authenticator)
+
+		// TEST: the authentication is aborted when the context is cancelled
+		ctx, cancel = context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		_, err = authenticator.AuthenticateContext(ctx, "alice@example.com", "verysecret")
+		assert.Equal(t, context.Canceled, err, "%T", authenticator)
+	}
+}
+
 func TestTestAuthenticator(t *testing.T) {
 	// create our app
 	app := NewApp("../tests/gorgon.ini")
@@ -49,9 +153,26 @@ func TestImapAuthenticator(t *testing.T) {
 	imapAuthenticator := authenticator.(ImapAuthenticator)
 	assert.Equal(t, "imap.example.com", imapAuthenticator.Server)
 	assert.True(t, imapAuthenticator.TLSVerifyCert)
+	assert.Equal(t, "starttls", imapAuthenticator.TLSMode)
+	assert.Equal(t, "imap.example.com", imapAuthenticator.TLSConfig.ServerName)
+	assert.False(t, imapAuthenticator.TLSConfig.InsecureSkipVerify)
+	assert.Equal(t, "%u", imapAuthenticator.UsernameTemplate)
 	assert.NoError(t, err)
 }
 
+func TestFormatUsername(t *testing.T) {
+	assert.Equal(t, "alice@example.com", FormatUsername("", "alice@example.com"))
+	assert.Equal(t, "alice@example.com", FormatUsername("%e", "alice@example.com"))
+	assert.Equal(t, "alice", FormatUsername("%u", "alice@example.com"))
+	assert.Equal(t, "example.com", FormatUsername("%d", "alice@example.com"))
+	assert.Equal(t, "example.com/alice", FormatUsername("%d/%u", "alice@example.com"))
+	assert.Equal(t, "alice%", FormatUsername("%u%%", "alice@example.com"))
+	assert.Equal(t, "%x-alice%", FormatUsername("%x-%u%", "alice@example.com"))
+	assert.Equal(t, "alice@foo", FormatUsername("%u", "alice@foo@example.com"))
+	assert.Equal(t, "alice", FormatUsername("%u", "alice"))
+	assert.Equal(t, "", FormatUsername("%d", "alice"))
+}
+
 func TestImapAuthenticate(t *testing.T) {
 	var (
 		c       *imap.Client
@@ -94,8 +215,10 @@ func TestImapAuthenticate(t *testing.T) {
 		"C: A2 CAPABILITY",
 		"S: * CAPABILITY IMAP4rev1 AUTH=PLAIN STARTTLS",
 		"S: A2 OK Thats all",
-		"C: A3 LOGIN \"alice\" \"verysecret\"",
-		"S: A3 OK LOGIN completed",
+		"C: A3 AUTHENTICATE PLAIN",
+		"S: + ",
+		"C: AGFsaWNlAHZlcnlzZWNyZXQ=",
+		"S: A3 OK AUTHENTICATE completed",
 		"C: A4 CAPABILITY",
 		"S: * CAPABILITY IMAP4rev1 AUTH=PLAIN STARTTLS",
 		"S: A4 OK Thats all",
@@ -116,3 +239,247 @@ func TestImapAuthenticate(t *testing.T) {
 	assert.Error(t, errAuth)
 	s.Join(errMock)
 }
+
+// imapServer is a minimal stand-in IMAP server. It only understands the
+// CAPABILITY, STARTTLS, LOGIN, AUTHENTICATE PLAIN and LOGOUT commands.
+type imapServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config // TLS configuration used by the server
+	implicitTLS bool        // the connection is encrypted from the start (imaps)
+	caps        []string    // capabilities advertised before TLS
+
+	mutex          sync.Mutex
+	clearTextLogin bool   // a LOGIN command has been received in clear
+	lastCommand    string // last LOGIN or AUTHENTICATE command received
+}
+
+// newImapServer starts a stand-in IMAP server listening on a random port.
+func newImapServer(t *testing.T, tlsConfig *tls.Config, implicitTLS bool, caps ...string) *imapServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &imapServer{
+		listener:    listener,
+		tlsConfig:   tlsConfig,
+		implicitTLS: implicitTLS,
+		caps:        caps,
+	}
+	go s.serve()
+	return s
+}
+
+func (s *imapServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *imapServer) Close() {
+	s.listener.Close()
+}
+
+func (s *imapServer) ClearTextLogin() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.clearTextLogin
+}
+
+func (s *imapServer) LastCommand() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastCommand
+}
+
+func (s *imapServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *imapServer) handle(conn net.Conn) {
+	encrypted := s.implicitTLS
+	if encrypted {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	defer conn.Close()
+
+	capabilities := func() string {
+		caps := []string{"IMAP4rev1"}
+		for _, c := range s.caps {
+			if !(encrypted && c == "STARTTLS") {
+				caps = append(caps, c)
+			}
+		}
+		return strings.Join(caps, " ")
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("* OK [CAPABILITY " + capabilities() + "] Server ready\r\n"))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return
+		}
+		tag, command := fields[0], strings.ToUpper(fields[1])
+
+		switch command {
+		case "CAPABILITY":
+			conn.Write([]byte("* CAPABILITY " + capabilities() + "\r\n" + tag + " OK Thats all\r\n"))
+		case "STARTTLS":
+			conn.Write([]byte(tag + " OK Begin TLS negotiation now\r\n"))
+			conn = tls.Server(conn, s.tlsConfig)
+			reader = bufio.NewReader(conn)
+			encrypted = true
+		case "LOGIN":
+			s.mutex.Lock()
+			s.lastCommand = command
+			s.clearTextLogin = s.clearTextLogin || !encrypted
+			s.mutex.Unlock()
+			if len(fields) == 4 && fields[2] == "\"alice\"" && fields[3] == "\"verysecret\"" {
+				conn.Write([]byte(tag + " OK LOGIN completed\r\n"))
+			} else {
+				conn.Write([]byte(tag + " NO [AUTHENTICATIONFAILED] Authentication failed\r\n"))
+			}
+		case "AUTHENTICATE":
+			s.mutex.Lock()
+			s.lastCommand = command
+			s.mutex.Unlock()
+			if len(fields) < 3 || strings.ToUpper(fields[2]) != "PLAIN" {
+				conn.Write([]byte(tag + " NO Unsupported mechanism\r\n"))
+				continue
+			}
+			response := ""
+			if len(fields) == 4 {
+				// initial response (SASL-IR)
+				response = fields[3]
+			} else {
+				conn.Write([]byte("+ \r\n"))
+				if response, err = reader.ReadString('\n'); err != nil {
+					return
+				}
+			}
+			decoded, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(response))
+			if string(decoded) == "\x00alice\x00verysecret" {
+				conn.Write([]byte(tag + " OK AUTHENTICATE completed\r\n"))
+			} else {
+				conn.Write([]byte(tag + " NO [AUTHENTICATIONFAILED] Authentication failed\r\n"))
+			}
+		case "LOGOUT":
+			conn.Write([]byte("* BYE LOGOUT requested\r\n" + tag + " OK Quit\r\n"))
+			return
+		default:
+			conn.Write([]byte(tag + " BAD Unknown command\r\n"))
+		}
+	}
+}
+
+func TestImapAuthenticatorTLS(t *testing.T) {
+	var (
+		s             *imapServer
+		authenticator ImapAuthenticator
+	)
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+
+	// STARTTLS advertised by the server
+	s = newImapServer(t, serverConfig, false, "STARTTLS")
+	authenticator = ImapAuthenticator{Server: s.Addr(), TLSMode: "starttls", TLSConfig: clientConfig}
+	assert.NoError(t, authenticator.Authenticate("alice", "verysecret"))
+	assert.True(t, IsCredentialsError(authenticator.Authenticate("alice", "bad password")))
+	assert.False(t, s.ClearTextLogin())
+	s.Close()
+
+	// STARTTLS not advertised by the server, the password must not be sent
+	s = newImapServer(t, serverConfig, false)
+	authenticator = ImapAuthenticator{Server: s.Addr(), TLSMode: "starttls", TLSConfig: clientConfig}
+	assert.Error(t, authenticator.Authenticate("alice", "verysecret"))
+	assert.False(t, s.ClearTextLogin())
+	s.Close()
+
+	// implicit TLS
+	s = newImapServer(t, serverConfig, true)
+	authenticator = ImapAuthenticator{Server: s.Addr(), TLSMode: "imaps", TLSConfig: clientConfig}
+	assert.NoError(t, authenticator.Authenticate("alice", "verysecret"))
+	assert.Error(t, authenticator.Authenticate("alice", "bad password"))
+
+	// implicit TLS with an untrusted certificate
+	authenticator.TLSConfig = &tls.Config{ServerName: "localhost"}
+	assert.Error(t, authenticator.Authenticate("alice", "verysecret"))
+
+	// implicit TLS with an unexpected server name
+	authenticator.TLSConfig = clientConfig.Clone()
+	authenticator.TLSConfig.ServerName = "imap.example.com"
+	assert.Error(t, authenticator.Authenticate("alice", "verysecret"))
+
+	// implicit TLS with a TLS version not supported by the server
+	serverConfig.MaxVersion = tls.VersionTLS12
+	authenticator.TLSConfig = clientConfig.Clone()
+	authenticator.TLSConfig.MinVersion = tls.VersionTLS13
+	assert.Error(t, authenticator.Authenticate("alice", "verysecret"))
+	s.Close()
+
+	// no TLS at all
+	s = newImapServer(t, serverConfig, false)
+	authenticator = ImapAuthenticator{Server: s.Addr(), TLSMode: "none"}
+	assert.NoError(t, authenticator.Authenticate("alice", "verysecret"))
+	assert.True(t, s.ClearTextLogin())
+	s.Close()
+}
+
+func TestImapAuthenticatorSASL(t *testing.T) {
+	var (
+		s             *imapServer
+		authenticator ImapAuthenticator
+	)
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+
+	// AUTH=PLAIN advertised by the server, LOGIN disabled
+	s = newImapServer(t, serverConfig, true, "AUTH=PLAIN", "LOGINDISABLED")
+	authenticator = ImapAuthenticator{Server: s.Addr(), TLSMode: "imaps", TLSConfig: clientConfig}
+	assert.NoError(t, authenticator.Authenticate("alice", "verysecret"))
+	assert.Equal(t, "AUTHENTICATE", s.LastCommand())
+	assert.Error(t, authenticator.Authenticate("alice", "bad password"))
+	s.Close()
+
+	// AUTH=PLAIN with an initial response
+	s = newImapServer(t, serverConfig, false, "STARTTLS", "AUTH=PLAIN", "SASL-IR")
+	authenticator = ImapAuthenticator{Server: s.Addr(), TLSMode: "starttls", TLSConfig: clientConfig}
+	assert.NoError(t, authenticator.Authenticate("alice", "verysecret"))
+	assert.Equal(t, "AUTHENTICATE", s.LastCommand())
+	s.Close()
+
+	// AUTH=PLAIN not advertised by the server
+	s = newImapServer(t, serverConfig, true)
+	authenticator = ImapAuthenticator{Server: s.Addr(), TLSMode: "imaps", TLSConfig: clientConfig}
+	assert.NoError(t, authenticator.Authenticate("alice", "verysecret"))
+	assert.Equal(t, "LOGIN", s.LastCommand())
+	s.Close()
+
+	// AUTH=PLAIN is never used on an unencrypted connection
+	s = newImapServer(t, serverConfig, false, "AUTH=PLAIN")
+	authenticator = ImapAuthenticator{Server: s.Addr(), TLSMode: "none"}
+	assert.NoError(t, authenticator.Authenticate("alice", "verysecret"))
+	assert.Equal(t, "LOGIN", s.LastCommand())
+	s.Close()
+}
+
+func TestImapAuthenticatorUsernameTemplate(t *testing.T) {
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+	s := newImapServer(t, serverConfig, true, "AUTH=PLAIN")
+	defer s.Close()
+
+	authenticator := ImapAuthenticator{Server: s.Addr(), TLSMode: "imaps", TLSConfig: clientConfig}
+
+	// the email is passed without modification
+	assert.Error(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+
+	// only the local part of the email is used
+	authenticator.UsernameTemplate = "%u"
+	assert.NoError(t, authenticator.Authenticate("alice@example.com", "verysecret"))
+}
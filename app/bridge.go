@@ -0,0 +1,182 @@
+package app
+
+import (
+	"errors"
+	"github.com/vaughan0/go-ini"
+	"sort"
+	"strings"
+)
+
+var (
+	// BridgeConfigKeys are the configuration variables of the "bridge"
+	// section.
+	BridgeConfigKeys = []ConfigKey{
+		{Name: "enabled", Default: "false", Validate: ValidateBool},
+		{Name: "issuer"},
+		{Name: "public_key"},
+		{Name: "private_key"},
+		{Name: "domains"},
+	}
+
+	// BridgeDomainConfigKeys are the configuration variables of the
+	// "bridge:<domain>" sections: the verification method, and the OpenID
+	// Connect provider for the "oidc" method.
+	BridgeDomainConfigKeys = bridgeDomainConfigKeys()
+
+	// errBridgedPassword refuses the passwords of the bridged addresses.
+	errBridgedPassword = CredentialsError{"the addresses of the bridged domains are not verified with a password"}
+)
+
+// bridgeDomainConfigKeys returns the variables of the "bridge:<domain>"
+// sections, the variables of the "oidc" section are reused except "enabled"
+// and "auto_redirect".
+func bridgeDomainConfigKeys() []ConfigKey {
+	keys := []ConfigKey{
+		{Name: "verification", Default: "email", Validate: ValidateOneOf("email", "oidc")},
+	}
+	for _, key := range OIDCConfigKeys {
+		if key.Name != "enabled" && key.Name != "auto_redirect" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Bridge lets Gorgon vouch for the addresses of foreign domains without IdP
+// of their own, as the bridges of Persona: the ownership of an address is
+// proved by email (a magic link, see MagicLink) or by an OpenID Connect
+// provider of the domain, never by a password. The certificates of these
+// addresses are issued by Issuer, acting as a delegated authority: the
+// foreign domains publish a support document delegating to Issuer
+// ({"authority": "<issuer>"}), or the verifiers trust Issuer for them.
+//
+// When Issuer is not the domain of the IdP, the certificates are signed with
+// the key pair of Issuer (public_key and private_key, required), whose public
+// key is published in the support document of Issuer; otherwise they are
+// signed with the keys of the IdP.
+//
+// Bridge is configured in the "bridge" section, and the verification of each
+// domain in a "bridge:<domain>" section, for example:
+//
+// [bridge]
+// enabled = true
+// issuer = bridge.example.com
+// public_key = /etc/gorgon/bridge-public-key.pem
+// private_key = /etc/gorgon/bridge-private-key.pem
+// domains = partner.com, partner.org
+//
+// [bridge:partner.org]
+// verification = oidc
+// issuer = https://sso.partner.org/realms/staff
+// client_id = gorgon
+// client_secret = secret
+// name = Partner SSO
+//
+type Bridge struct {
+	Issuer     string                   // issuer of the certificates (the domain of the IdP by default)
+	PublicKey  *PublicKey               // public key of Issuer (nil if Issuer is the domain of the IdP)
+	PrivateKey *PrivateKey              // private key of Issuer (nil if Issuer is the domain of the IdP)
+	Domains    map[string]*BridgeDomain // foreign domain (lower case) => verification
+}
+
+// BridgeDomain is a foreign domain of a Bridge.
+type BridgeDomain struct {
+	Name string // the foreign domain
+	OIDC *OIDC  // provider verifying the addresses (nil if verified by email)
+}
+
+// NewBridge returns a Bridge issuing the certificates as issuer, without
+// domains. The keys of issuer must be set if it is not the domain of the IdP.
+func NewBridge(issuer string) *Bridge {
+	return &Bridge{Issuer: issuer, Domains: map[string]*BridgeDomain{}}
+}
+
+// Domain returns the bridged domain of the email address, or nil if the
+// domain of the address is not bridged.
+func (b *Bridge) Domain(email string) *BridgeDomain {
+	i := strings.LastIndex(email, "@")
+	if i <= 0 {
+		return nil
+	}
+	return b.Domains[strings.ToLower(email[i+1:])]
+}
+
+// EmailDomains returns the bridged domains verified by email, sorted.
+func (b *Bridge) EmailDomains() []string {
+	var domains []string
+	for name, domain := range b.Domains {
+		if domain.OIDC == nil {
+			domains = append(domains, name)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// NewBridgeFromConfig returns a new Bridge configured from the "bridge"
+// section and the sections of its domains, or nil if the bridge is
+// disabled.
+func NewBridgeFromConfig(config ini.File, domain string) (*Bridge, error) {
+	config, err := checkConfigSection(config, "bridge", BridgeConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	if enabled, _ := config.Get("bridge", "enabled"); enabled != "true" {
+		return nil, nil
+	}
+	if domain == "" {
+		return nil, errors.New("'idp_domain' variable missing from 'global' section")
+	}
+
+	issuer, _ := config.Get("bridge", "issuer")
+	if issuer == "" {
+		issuer = domain
+	}
+	bridge := NewBridge(issuer)
+	if issuer != domain {
+		// another authority signs with its own keys
+		for _, name := range []string{"public_key", "private_key"} {
+			if value, _ := config.Get("bridge", name); value == "" {
+				return nil, errors.New("'" + name + "' variable missing from 'bridge' section")
+			}
+		}
+		public_key_filename, _ := config.Get("bridge", "public_key")
+		if bridge.PublicKey, err = LoadPublicKey(public_key_filename); err != nil {
+			return nil, errors.New("Unable to load public key '" + public_key_filename + "': " + err.Error())
+		}
+		private_key_filename, _ := config.Get("bridge", "private_key")
+		if bridge.PrivateKey, err = LoadPrivateKey(private_key_filename); err != nil {
+			return nil, errors.New("Unable to load private key '" + private_key_filename + "': " + err.Error())
+		}
+	}
+
+	value, _ := config.Get("bridge", "domains")
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == strings.ToLower(domain) || strings.ContainsAny(name, "@/: ") {
+			return nil, errors.New("'" + name + "' can't be a bridged domain in 'bridge' section")
+		}
+
+		section := "bridge:" + name
+		config, err := checkConfigSection(config, section, BridgeDomainConfigKeys)
+		if err != nil {
+			return nil, err
+		}
+		bridgeDomain := &BridgeDomain{Name: name}
+		if verification, _ := config.Get(section, "verification"); verification == "oidc" {
+			// the callback of the provider is on the domain of the IdP
+			if bridgeDomain.OIDC, err = newOIDCFromSection(config, section, domain); err != nil {
+				return nil, err
+			}
+			bridgeDomain.OIDC.Domain = name
+		}
+		bridge.Domains[name] = bridgeDomain
+	}
+	if len(bridge.Domains) == 0 {
+		return nil, errors.New("'domains' variable missing from 'bridge' section")
+	}
+	return bridge, nil
+}
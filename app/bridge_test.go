@@ -0,0 +1,132 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestBridgeDomain(t *testing.T) {
+	bridge := NewBridge("example.com")
+	bridge.Domains["partner.com"] = &BridgeDomain{Name: "partner.com"}
+	bridge.Domains["partner.org"] = &BridgeDomain{Name: "partner.org", OIDC: &OIDC{Domain: "partner.org"}}
+	bridge.Domains["partner.net"] = &BridgeDomain{Name: "partner.net"}
+
+	assert.Equal(t, bridge.Domains["partner.com"], bridge.Domain("alice@partner.com"))
+	assert.Equal(t, bridge.Domains["partner.com"], bridge.Domain("Alice@Partner.COM"))
+	assert.Equal(t, bridge.Domains["partner.org"], bridge.Domain("alice@partner.org"))
+	assert.Nil(t, bridge.Domain("alice@example.com"))
+	assert.Nil(t, bridge.Domain("alice@sub.partner.com"))
+	assert.Nil(t, bridge.Domain("@partner.com"))
+	assert.Nil(t, bridge.Domain("partner.com"))
+	assert.Nil(t, bridge.Domain(""))
+
+	assert.Equal(t, []string{"partner.com", "partner.net"}, bridge.EmailDomains())
+}
+
+func TestNewBridgeFromConfig(t *testing.T) {
+	// the bridge is disabled by default
+	bridge, err := NewBridgeFromConfig(ini.File{}, "example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, bridge)
+
+	// the domains are required
+	_, err = NewBridgeFromConfig(ini.File{"bridge": {"enabled": "true"}}, "example.com")
+	assert.EqualError(t, err, "'domains' variable missing from 'bridge' section")
+	_, err = NewBridgeFromConfig(ini.File{"bridge": {"enabled": "true", "domains": " , "}}, "example.com")
+	assert.EqualError(t, err, "'domains' variable missing from 'bridge' section")
+
+	// the domain of the IdP and invalid names can't be bridged
+	for _, name := range []string{"Example.com", "user@partner.com", "partner.com/path", "partner.com:443"} {
+		_, err = NewBridgeFromConfig(ini.File{"bridge": {"enabled": "true", "domains": name}}, "example.com")
+		assert.Error(t, err, name)
+	}
+
+	// the default values, the domains are verified by email
+	bridge, err = NewBridgeFromConfig(ini.File{"bridge": {
+		"enabled": "true",
+		"domains": "Partner.com, partner.net",
+	}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, bridge) {
+		assert.Equal(t, "example.com", bridge.Issuer)
+		assert.Len(t, bridge.Domains, 2)
+		assert.Equal(t, []string{"partner.com", "partner.net"}, bridge.EmailDomains())
+	}
+
+	// the issuer is the IdP, signing with its own keys
+	bridge, err = NewBridgeFromConfig(ini.File{"bridge": {"enabled": "true", "issuer": "example.com", "domains": "partner.com"}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, bridge) {
+		assert.Nil(t, bridge.PublicKey)
+		assert.Nil(t, bridge.PrivateKey)
+	}
+
+	// another issuer needs its keys
+	_, err = NewBridgeFromConfig(ini.File{"bridge": {"enabled": "true", "issuer": "bridge.example.com", "domains": "partner.com"}}, "example.com")
+	assert.EqualError(t, err, "'public_key' variable missing from 'bridge' section")
+	_, err = NewBridgeFromConfig(ini.File{"bridge": {
+		"enabled":    "true",
+		"issuer":     "bridge.example.com",
+		"public_key": "../tests/ds256-public-key.pem",
+		"domains":    "partner.com",
+	}}, "example.com")
+	assert.EqualError(t, err, "'private_key' variable missing from 'bridge' section")
+	_, err = NewBridgeFromConfig(ini.File{"bridge": {
+		"enabled":     "true",
+		"issuer":      "bridge.example.com",
+		"public_key":  "../tests/ds256-public-key.pem",
+		"private_key": "../tests/missing.pem",
+		"domains":     "partner.com",
+	}}, "example.com")
+	assert.Error(t, err)
+
+	// a domain verified by its OpenID Connect provider, another issuer
+	bridge, err = NewBridgeFromConfig(ini.File{
+		"bridge": {
+			"enabled":     "true",
+			"issuer":      "bridge.example.com",
+			"public_key":  "../tests/ds256-public-key.pem",
+			"private_key": "../tests/ds256-private-key.pem",
+			"domains":     "partner.com, partner.org",
+		},
+		"bridge:partner.org": {
+			"verification":  "oidc",
+			"issuer":        "https://sso.partner.org",
+			"client_id":     "gorgon",
+			"client_secret": "secret",
+			"name":          "Partner SSO",
+		},
+	}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, bridge) {
+		assert.Equal(t, "bridge.example.com", bridge.Issuer)
+		if assert.NotNil(t, bridge.PublicKey) && assert.NotNil(t, bridge.PrivateKey) {
+			assert.Equal(t, "DS", bridge.PublicKey.Algorithm())
+			assert.Equal(t, bridge.PublicKey.DSA.Y, bridge.PrivateKey.DSA.Y)
+		}
+		assert.Equal(t, []string{"partner.com"}, bridge.EmailDomains())
+		oidc := bridge.Domains["partner.org"].OIDC
+		if assert.NotNil(t, oidc) {
+			assert.Equal(t, "https://sso.partner.org", oidc.Issuer)
+			assert.Equal(t, "partner.org", oidc.Domain)
+			assert.Equal(t, "Partner SSO", oidc.Name)
+			assert.Equal(t, "https://example.com/.well-known/browserid/_gorgon/oidc/callback", oidc.RedirectURL)
+		}
+	}
+
+	// the provider of a domain must be configured
+	_, err = NewBridgeFromConfig(ini.File{
+		"bridge":             {"enabled": "true", "domains": "partner.org"},
+		"bridge:partner.org": {"verification": "oidc", "issuer": "https://sso.partner.org", "client_id": "gorgon"},
+	}, "example.com")
+	assert.EqualError(t, err, "'client_secret' variable missing from 'bridge:partner.org' section")
+
+	// an unknown verification
+	_, err = NewBridgeFromConfig(ini.File{
+		"bridge":             {"enabled": "true", "domains": "partner.org"},
+		"bridge:partner.org": {"verification": "password"},
+	}, "example.com")
+	assert.Error(t, err)
+}
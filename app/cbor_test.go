@@ -0,0 +1,72 @@
+package app
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCBORDecode(t *testing.T) {
+	// examples of RFC 7049, appendix A
+	tests := []struct {
+		data  string
+		value interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"62c3bc", "ü"},
+		{"80", []interface{}{}},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a0", map[interface{}]interface{}{}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+		value, rest, err := cborDecode(data)
+		assert.NoError(t, err, test.data)
+		assert.Equal(t, test.value, value, test.data)
+		assert.Empty(t, rest, test.data)
+	}
+
+	// the rest of the data is returned
+	value, rest, err := cborDecode([]byte{0x01, 0x02})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	assert.Equal(t, []byte{0x02}, rest)
+
+	// unsupported or malformed data
+	for _, test := range []string{
+		"",                   // no data
+		"18",                 // truncated integer
+		"1bffffffffffffffff", // integer overflow
+		"4401",               // truncated byte string
+		"5f42010243030405ff", // indefinite length
+		"8301",               // truncated array
+		"a201020103",         // duplicate key
+		"a1400102",           // byte string key
+		"c074323031332d30332d32315432303a30343a30305a", // tag
+		"f93c00", // float
+		"8181818181818181818181818181818181818100", // nesting too deep
+	} {
+		data, _ := hex.DecodeString(test)
+		_, _, err := cborDecode(data)
+		assert.Error(t, err, test)
+	}
+}
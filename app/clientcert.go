@@ -0,0 +1,405 @@
+package app
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"github.com/vaughan0/go-ini"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ClientCertConfigKeys are the configuration variables of the
+	// "clientcert" section.
+	ClientCertConfigKeys = []ConfigKey{
+		{Name: "enabled", Default: "false", Validate: ValidateBool},
+		{Name: "source", Default: "tls", Validate: ValidateOneOf("tls", "header")},
+		{Name: "header", Default: "X-SSL-Client-Cert"},
+		{Name: "trusted_proxies"},
+		{Name: "ca_file"},
+		{Name: "crl_files"},
+		{Name: "mapping", Default: "email", Validate: ValidateOneOf("email", "subject")},
+	}
+
+	// oidEmailAddress is the emailAddress attribute of a subject (PKCS #9).
+	oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+)
+
+// ClientCert authenticates the users with their TLS client certificate,
+// without password. The certificate is read from the TLS connection when
+// Gorgon serves HTTPS itself (source "tls"), or from a header set by a
+// reverse proxy (source "header"): the header is then only accepted from the
+// TrustedProxies.
+//
+// Whatever the source, the certificate is verified by Gorgon: it must be
+// issued, for the client authentication, by one of the CAs (the system CAs
+// are never trusted), and it must not be revoked by one of the CRLs. A CRL is
+// issued by one of the CAs or by an intermediate CA of the verified chains,
+// and its signature is checked with the certificate of its issuer. The CRL
+// files are read again when they are modified; a CRL past its next update
+// refuses all the certificates of its issuer.
+//
+// With the "email" mapping, the identity is the first email address of the
+// domain of the IdP found in the subject alternative names of the
+// certificate, or else the emailAddress attribute of its subject. With the
+// "subject" mapping, the identity is the common name of the subject, followed
+// by "@" and the domain of the IdP if the name is not an email address.
+//
+// ClientCert is configured in the "clientcert" section, for example:
+//
+// [clientcert]
+// enabled = true
+// source = header
+// header = X-SSL-Client-Cert
+// trusted_proxies = 127.0.0.1, ::1
+// ca_file = /etc/gorgon/staff-ca.pem
+// crl_files = /etc/gorgon/staff-ca.crl
+// mapping = email
+//
+type ClientCert struct {
+	Source         string              // "tls" or "header"
+	Header         string              // header containing the certificate (source "header")
+	TrustedProxies []*net.IPNet        // addresses allowed to set the header
+	CAs            []*x509.Certificate // CAs allowed to issue the certificates
+	CRLFiles       []string            // paths of the certificate revocation lists
+	Mapping        string              // "email" or "subject"
+	Domain         string              // domain of the identities
+
+	roots *x509.CertPool            // pool of the CAs
+	mutex sync.Mutex                // protects the fields below
+	crls  map[string]*clientCertCRL // path of a CRL file => loaded CRL
+	now   func() time.Time          // current time (replaced in tests)
+}
+
+// clientCertCRL is a loaded certificate revocation list.
+type clientCertCRL struct {
+	modTime time.Time            // modification time of the file when loaded
+	list    *x509.RevocationList // content of the file
+	revoked map[string]bool      // serial numbers of the revoked certificates
+	signers map[string]bool      // certificates (DER) whose signature of the CRL is checked
+}
+
+// NewClientCert returns a ClientCert reading the certificates from the
+// source, and accepting the certificates issued by the CAs.
+func NewClientCert(source string, cas []*x509.Certificate, domain string) *ClientCert {
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		roots.AddCert(ca)
+	}
+	return &ClientCert{
+		Source:  source,
+		Header:  "X-SSL-Client-Cert",
+		CAs:     cas,
+		Mapping: "email",
+		Domain:  domain,
+		roots:   roots,
+		crls:    map[string]*clientCertCRL{},
+		now:     time.Now,
+	}
+}
+
+// Authenticate returns the identity of the client certificate of the
+// request, or nil if the request has no certificate. Returns a
+// CredentialsError if the certificate is refused.
+func (c *ClientCert) Authenticate(r *http.Request) (*Identity, error) {
+	certificate, intermediates, err := c.Certificate(r)
+	if err != nil || certificate == nil {
+		return nil, err
+	}
+	return c.Verify(certificate, intermediates)
+}
+
+// Certificate returns the client certificate of the request and the
+// intermediate certificates sent by the client, or nil if the request has no
+// certificate.
+func (c *ClientCert) Certificate(r *http.Request) (*x509.Certificate, []*x509.Certificate, error) {
+	if c.Source == "tls" {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return nil, nil, nil
+		}
+		return r.TLS.PeerCertificates[0], r.TLS.PeerCertificates[1:], nil
+	}
+
+	value := r.Header.Get(c.Header)
+	if value == "" {
+		return nil, nil, nil
+	}
+	if !c.trustedProxy(r.RemoteAddr) {
+		return nil, nil, CredentialsError{"ClientCert: '" + c.Header + "' header sent by an untrusted client '" + r.RemoteAddr + "'"}
+	}
+	certificate, err := parseClientCertHeader(value)
+	if err != nil {
+		return nil, nil, CredentialsError{"ClientCert: malformed certificate in '" + c.Header + "' header: " + err.Error()}
+	}
+	return certificate, nil, nil
+}
+
+// trustedProxy returns true if the remote address (host:port) is one of the
+// TrustedProxies.
+func (c *ClientCert) trustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClientCertHeader returns the certificate of a header set by a reverse
+// proxy. The certificate is PEM encoded, possibly URL escaped (nginx
+// $ssl_client_escaped_cert) or with the newlines replaced by spaces, or
+// encoded in base64 (DER).
+func parseClientCertHeader(value string) (*x509.Certificate, error) {
+	if strings.Contains(value, "%") {
+		unescaped, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		value = unescaped
+	}
+	value = strings.TrimSpace(value)
+	value = strings.TrimPrefix(value, "-----BEGIN CERTIFICATE-----")
+	value = strings.TrimSuffix(value, "-----END CERTIFICATE-----")
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// Verify checks that the certificate is issued by one of the CAs for the
+// client authentication and is not revoked, and returns its identity. Returns
+// a CredentialsError if the certificate is refused.
+func (c *ClientCert) Verify(certificate *x509.Certificate, intermediates []*x509.Certificate) (*Identity, error) {
+	pool := x509.NewCertPool()
+	for _, intermediate := range intermediates {
+		pool.AddCert(intermediate)
+	}
+	chains, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         c.roots,
+		Intermediates: pool,
+		CurrentTime:   c.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, CredentialsError{"ClientCert: certificate of '" + certificate.Subject.String() + "' refused: " + err.Error()}
+	}
+	for _, chain := range chains {
+		if err := c.checkRevocation(chain); err != nil {
+			return nil, err
+		}
+	}
+	return c.identity(certificate)
+}
+
+// checkRevocation returns a CredentialsError if a certificate of the chain is
+// revoked by one of the CRLs, or if the CRL of an issuer of the chain is
+// past its next update. The CRL of an issuer must be signed by the issuer.
+func (c *ClientCert) checkRevocation(chain []*x509.Certificate) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.loadCRLs(); err != nil {
+		return err
+	}
+
+	now := c.now()
+	for i := 0; i < len(chain)-1; i++ {
+		certificate, issuer := chain[i], chain[i+1]
+		for path, crl := range c.crls {
+			if !bytes.Equal(crl.list.RawIssuer, issuer.RawSubject) {
+				continue
+			}
+			if !crl.signers[string(issuer.Raw)] {
+				if err := crl.list.CheckSignatureFrom(issuer); err != nil {
+					return errors.New("ClientCert: the CRL '" + path + "' is not signed by '" + issuer.Subject.String() + "'")
+				}
+				crl.signers[string(issuer.Raw)] = true
+			}
+			if !crl.list.NextUpdate.IsZero() && now.After(crl.list.NextUpdate) {
+				return CredentialsError{"ClientCert: the CRL '" + path + "' is outdated"}
+			}
+			if crl.revoked[certificate.SerialNumber.String()] {
+				return CredentialsError{"ClientCert: certificate of '" + certificate.Subject.String() + "' revoked"}
+			}
+		}
+	}
+	return nil
+}
+
+// loadCRLs reads the CRL files modified since their last loading. A CRL
+// issued by one of the CAs must be signed by the CA, the signature of the
+// CRLs of the intermediate CAs is checked with the chains of the client
+// certificates (see checkRevocation).
+func (c *ClientCert) loadCRLs() error {
+	for _, path := range c.CRLFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if crl, ok := c.crls[path]; ok && crl.modTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		list, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return errors.New("ClientCert: malformed CRL '" + path + "': " + err.Error())
+		}
+		signers := map[string]bool{}
+		for _, ca := range c.CAs {
+			if !bytes.Equal(list.RawIssuer, ca.RawSubject) {
+				continue
+			}
+			if list.CheckSignatureFrom(ca) != nil {
+				return errors.New("ClientCert: the CRL '" + path + "' is not signed by a CA")
+			}
+			signers[string(ca.Raw)] = true
+		}
+
+		revoked := map[string]bool{}
+		for _, entry := range list.RevokedCertificateEntries {
+			revoked[entry.SerialNumber.String()] = true
+		}
+		c.crls[path] = &clientCertCRL{info.ModTime(), list, revoked, signers}
+	}
+	return nil
+}
+
+// identity returns the identity of the certificate according to the
+// Mapping. Returns a CredentialsError if the certificate has no email
+// address of the domain.
+func (c *ClientCert) identity(certificate *x509.Certificate) (*Identity, error) {
+	email, displayName := "", ""
+	if c.Mapping == "subject" {
+		email = certificate.Subject.CommonName
+		if email != "" && !strings.Contains(email, "@") {
+			email += "@" + c.Domain
+		}
+	} else {
+		for _, address := range certificate.EmailAddresses {
+			if emailInDomain(address, c.Domain) {
+				email = address
+				break
+			}
+		}
+		if email == "" {
+			for _, name := range certificate.Subject.Names {
+				if value, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) && emailInDomain(value, c.Domain) {
+					email = value
+					break
+				}
+			}
+		}
+		displayName = certificate.Subject.CommonName
+	}
+
+	if !emailInDomain(email, c.Domain) {
+		return nil, CredentialsError{"ClientCert: no email address of '" + c.Domain + "' in the certificate of '" + certificate.Subject.String() + "'"}
+	}
+	return &Identity{Email: email, DisplayName: displayName}, nil
+}
+
+// NewClientCertFromConfig returns the ClientCert configured in the
+// "clientcert" section, or nil if the client certificates are disabled. The
+// CAs are required, and the trusted proxies with the "header" source.
+func NewClientCertFromConfig(config ini.File, domain string) (*ClientCert, error) {
+	config, err := checkConfigSection(config, "clientcert", ClientCertConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	if enabled, _ := config.Get("clientcert", "enabled"); enabled != "true" {
+		return nil, nil
+	}
+	if domain == "" {
+		return nil, errors.New("'idp_domain' variable missing from 'global' section")
+	}
+
+	// the CAs issuing the certificates
+	caFile, _ := config.Get("clientcert", "ca_file")
+	if caFile == "" {
+		return nil, errors.New("'ca_file' variable missing from 'clientcert' section")
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.New("malformed certificate in '" + caFile + "': " + err.Error())
+		}
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return nil, errors.New("no certificate found in '" + caFile + "'")
+	}
+
+	source, _ := config.Get("clientcert", "source")
+	clientCert := NewClientCert(source, cas, domain)
+	clientCert.Header, _ = config.Get("clientcert", "header")
+	clientCert.Mapping, _ = config.Get("clientcert", "mapping")
+
+	// the proxies allowed to send the certificates
+	value, _ := config.Get("clientcert", "trusted_proxies")
+	for _, proxy := range strings.Split(value, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New("'trusted_proxies' must be IP addresses or networks in 'clientcert' section")
+		}
+		clientCert.TrustedProxies = append(clientCert.TrustedProxies, network)
+	}
+	if source == "header" && len(clientCert.TrustedProxies) == 0 {
+		return nil, errors.New("'trusted_proxies' variable missing from 'clientcert' section")
+	}
+
+	// the revocation lists, loaded now to report the errors at startup
+	value, _ = config.Get("clientcert", "crl_files")
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			clientCert.CRLFiles = append(clientCert.CRLFiles, path)
+		}
+	}
+	if err := clientCert.loadCRLs(); err != nil {
+		return nil, err
+	}
+	return clientCert, nil
+}
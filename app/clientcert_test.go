@@ -0,0 +1,407 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// testCA is a CA issuing client certificates and CRLs in tests.
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// newTestCA returns a new self-signed CA.
+func newTestCA(t *testing.T, name string) *testCA {
+	return newTestCASignedBy(t, name, nil)
+}
+
+// Intermediate returns an intermediate CA signed by the CA.
+func (ca *testCA) Intermediate(t *testing.T, name string) *testCA {
+	return newTestCASignedBy(t, name, ca)
+}
+
+// newTestCASignedBy returns a CA signed by the parent CA, or self-signed when
+// parent is nil.
+func newTestCASignedBy(t *testing.T, name string, parent *testCA) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	parentCertificate, parentKey := &template, key
+	if parent != nil {
+		parentCertificate, parentKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parentCertificate, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{certificate, key}
+}
+
+// PEM returns the PEM encoding of the certificate of the CA.
+func (ca *testCA) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.certificate.Raw})
+}
+
+// Issue returns a client certificate for the subject and the email
+// addresses.
+func (ca *testCA) Issue(t *testing.T, serial int64, subject pkix.Name, emails ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        subject,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		EmailAddresses: emails,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// CRL returns a PEM encoded CRL revoking the serial numbers.
+func (ca *testCA) CRL(t *testing.T, number int64, nextUpdate time.Time, serials ...int64) []byte {
+	template := x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &template, ca.certificate, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestClientCertVerify(t *testing.T) {
+	ca := newTestCA(t, "Staff CA")
+	other := newTestCA(t, "Other CA")
+	clientCert := NewClientCert("tls", []*x509.Certificate{ca.certificate}, "example.com")
+
+	// TEST: the email address of the subject alternative names
+	identity, err := clientCert.Verify(ca.Issue(t, 2, pkix.Name{CommonName: "Alice"}, "alice@other.com", "alice@example.com"), nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "alice@example.com", identity.Email)
+		assert.Equal(t, "Alice", identity.DisplayName)
+	}
+
+	// TEST: the emailAddress attribute of the subject
+	subject := pkix.Name{
+		CommonName: "Bob",
+		ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidEmailAddress, Value: "bob@Example.com"}},
+	}
+	identity, err = clientCert.Verify(ca.Issue(t, 3, subject), nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "bob@Example.com", identity.Email)
+	}
+
+	// TEST: no email address of the domain
+	_, err = clientCert.Verify(ca.Issue(t, 4, pkix.Name{CommonName: "Carol"}, "carol@other.com"), nil)
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the common name of the subject
+	clientCert.Mapping = "subject"
+	identity, err = clientCert.Verify(ca.Issue(t, 5, pkix.Name{CommonName: "dave"}), nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "dave@example.com", identity.Email)
+		assert.Equal(t, "", identity.DisplayName)
+	}
+	identity, err = clientCert.Verify(ca.Issue(t, 6, pkix.Name{CommonName: "erin@example.com"}), nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "erin@example.com", identity.Email)
+	}
+	_, err = clientCert.Verify(ca.Issue(t, 7, pkix.Name{CommonName: "frank@other.com"}), nil)
+	assert.True(t, IsCredentialsError(err))
+	clientCert.Mapping = "email"
+
+	// TEST: a certificate issued by another CA
+	_, err = clientCert.Verify(other.Issue(t, 2, pkix.Name{CommonName: "Alice"}, "alice@example.com"), nil)
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: a CA certificate is not a client certificate
+	_, err = clientCert.Verify(ca.certificate, nil)
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: an expired certificate
+	certificate := ca.Issue(t, 8, pkix.Name{CommonName: "Alice"}, "alice@example.com")
+	clientCert.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = clientCert.Verify(certificate, nil)
+	assert.True(t, IsCredentialsError(err))
+}
+
+func TestClientCertRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorgon-clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	crlFile := filepath.Join(dir, "staff.crl")
+
+	ca := newTestCA(t, "Staff CA")
+	clientCert := NewClientCert("tls", []*x509.Certificate{ca.certificate}, "example.com")
+	clientCert.CRLFiles = []string{crlFile}
+	alice := ca.Issue(t, 2, pkix.Name{CommonName: "Alice"}, "alice@example.com")
+	bob := ca.Issue(t, 3, pkix.Name{CommonName: "Bob"}, "bob@example.com")
+
+	// TEST: the certificate of bob is revoked
+	ioutil.WriteFile(crlFile, ca.CRL(t, 1, time.Now().Add(time.Hour), 3), 0644)
+	_, err = clientCert.Verify(alice, nil)
+	assert.NoError(t, err)
+	_, err = clientCert.Verify(bob, nil)
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the CRL is read again once modified
+	ioutil.WriteFile(crlFile, ca.CRL(t, 2, time.Now().Add(time.Hour), 2), 0644)
+	modTime := time.Now().Add(time.Minute)
+	os.Chtimes(crlFile, modTime, modTime)
+	_, err = clientCert.Verify(alice, nil)
+	assert.True(t, IsCredentialsError(err))
+	_, err = clientCert.Verify(bob, nil)
+	assert.NoError(t, err)
+
+	// TEST: an outdated CRL refuses all the certificates
+	ioutil.WriteFile(crlFile, ca.CRL(t, 3, time.Now().Add(time.Minute)), 0644)
+	modTime = modTime.Add(time.Minute)
+	os.Chtimes(crlFile, modTime, modTime)
+	_, err = clientCert.Verify(bob, nil)
+	assert.NoError(t, err)
+	clientCert.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	_, err = clientCert.Verify(bob, nil)
+	assert.True(t, IsCredentialsError(err))
+	clientCert.now = time.Now
+
+	// TEST: the CRL of another CA doesn't apply
+	other := newTestCA(t, "Other CA")
+	ioutil.WriteFile(crlFile, other.CRL(t, 1, time.Now().Add(time.Hour), 3), 0644)
+	modTime = modTime.Add(time.Minute)
+	os.Chtimes(crlFile, modTime, modTime)
+	_, err = clientCert.Verify(bob, nil)
+	assert.NoError(t, err)
+
+	// TEST: a CRL with the name of the CA but not signed by the CA
+	forged := newTestCA(t, "Staff CA")
+	ioutil.WriteFile(crlFile, forged.CRL(t, 1, time.Now().Add(time.Hour)), 0644)
+	modTime = modTime.Add(time.Minute)
+	os.Chtimes(crlFile, modTime, modTime)
+	_, err = clientCert.Verify(bob, nil)
+	assert.Error(t, err)
+	assert.False(t, IsCredentialsError(err))
+
+	// TEST: the CRL of an intermediate CA
+	intermediate := ca.Intermediate(t, "Staff Intermediate CA")
+	carol := intermediate.Issue(t, 4, pkix.Name{CommonName: "Carol"}, "carol@example.com")
+	dave := intermediate.Issue(t, 5, pkix.Name{CommonName: "Dave"}, "dave@example.com")
+	ioutil.WriteFile(crlFile, intermediate.CRL(t, 1, time.Now().Add(time.Hour), 4), 0644)
+	modTime = modTime.Add(time.Minute)
+	os.Chtimes(crlFile, modTime, modTime)
+	_, err = clientCert.Verify(carol, []*x509.Certificate{intermediate.certificate})
+	assert.True(t, IsCredentialsError(err))
+	_, err = clientCert.Verify(dave, []*x509.Certificate{intermediate.certificate})
+	assert.NoError(t, err)
+	_, err = clientCert.Verify(bob, nil)
+	assert.NoError(t, err)
+
+	// TEST: a CRL with the name of the intermediate CA but not signed by it
+	forged = ca.Intermediate(t, "Staff Intermediate CA")
+	ioutil.WriteFile(crlFile, forged.CRL(t, 1, time.Now().Add(time.Hour)), 0644)
+	modTime = modTime.Add(time.Minute)
+	os.Chtimes(crlFile, modTime, modTime)
+	_, err = clientCert.Verify(dave, []*x509.Certificate{intermediate.certificate})
+	assert.Error(t, err)
+	assert.False(t, IsCredentialsError(err))
+
+	// TEST: a missing CRL
+	os.Remove(crlFile)
+	_, err = clientCert.Verify(bob, nil)
+	assert.Error(t, err)
+}
+
+func TestClientCertCertificate(t *testing.T) {
+	ca := newTestCA(t, "Staff CA")
+	alice := ca.Issue(t, 2, pkix.Name{CommonName: "Alice"}, "alice@example.com")
+	pemData := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: alice.Raw}))
+
+	// TEST: the certificate of the TLS connection
+	clientCert := NewClientCert("tls", []*x509.Certificate{ca.certificate}, "example.com")
+	req, _ := http.NewRequest("GET", "", nil)
+	certificate, _, err := clientCert.Certificate(req)
+	assert.NoError(t, err)
+	assert.Nil(t, certificate)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{alice}}
+	identity, err := clientCert.Authenticate(req)
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "alice@example.com", identity.Email)
+	}
+
+	// the header is ignored
+	req, _ = http.NewRequest("GET", "", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-SSL-Client-Cert", pemData)
+	certificate, _, err = clientCert.Certificate(req)
+	assert.NoError(t, err)
+	assert.Nil(t, certificate)
+
+	// TEST: the certificate of the header
+	clientCert = NewClientCert("header", []*x509.Certificate{ca.certificate}, "example.com")
+	clientCert.TrustedProxies = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}}
+	for _, value := range []string{
+		pemData,
+		url.PathEscape(pemData),
+		strings.Replace(strings.TrimSpace(pemData), "\n", " ", -1),
+		base64.StdEncoding.EncodeToString(alice.Raw),
+	} {
+		req.Header.Set("X-SSL-Client-Cert", value)
+		certificate, _, err = clientCert.Certificate(req)
+		assert.NoError(t, err, value)
+		assert.Equal(t, alice, certificate, value)
+	}
+
+	// TEST: a malformed header
+	req.Header.Set("X-SSL-Client-Cert", "-----BEGIN CERTIFICATE----- !!! -----END CERTIFICATE-----")
+	_, _, err = clientCert.Certificate(req)
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the header sent by an untrusted client
+	req.Header.Set("X-SSL-Client-Cert", pemData)
+	req.RemoteAddr = "192.0.2.1:1234"
+	_, _, err = clientCert.Certificate(req)
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: no header
+	req.Header.Del("X-SSL-Client-Cert")
+	identity, err = clientCert.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Nil(t, identity)
+}
+
+func TestNewClientCertFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorgon-clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, "Staff CA")
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, ca.PEM(), 0644)
+	crlFile := filepath.Join(dir, "ca.crl")
+	ioutil.WriteFile(crlFile, ca.CRL(t, 1, time.Now().Add(time.Hour), 2), 0644)
+
+	// client certificates are disabled by default
+	clientCert, err := NewClientCertFromConfig(ini.File{}, "example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, clientCert)
+
+	// the CAs are required
+	_, err = NewClientCertFromConfig(ini.File{"clientcert": {"enabled": "true"}}, "example.com")
+	assert.EqualError(t, err, "'ca_file' variable missing from 'clientcert' section")
+
+	// the default values
+	clientCert, err = NewClientCertFromConfig(ini.File{"clientcert": {"enabled": "true", "ca_file": caFile}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, clientCert) {
+		assert.Equal(t, "tls", clientCert.Source)
+		assert.Equal(t, "X-SSL-Client-Cert", clientCert.Header)
+		assert.Equal(t, "email", clientCert.Mapping)
+		assert.Equal(t, "example.com", clientCert.Domain)
+		assert.Len(t, clientCert.CAs, 1)
+		assert.Empty(t, clientCert.TrustedProxies)
+		assert.Empty(t, clientCert.CRLFiles)
+	}
+
+	// the trusted proxies are required with the "header" source
+	_, err = NewClientCertFromConfig(ini.File{"clientcert": {"enabled": "true", "ca_file": caFile, "source": "header"}}, "example.com")
+	assert.EqualError(t, err, "'trusted_proxies' variable missing from 'clientcert' section")
+
+	// all the values
+	clientCert, err = NewClientCertFromConfig(ini.File{"clientcert": {
+		"enabled":         "true",
+		"source":          "header",
+		"header":          "X-Client-Cert",
+		"trusted_proxies": "127.0.0.1, ::1, 10.0.0.0/8",
+		"ca_file":         caFile,
+		"crl_files":       crlFile,
+		"mapping":         "subject",
+	}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, clientCert) {
+		assert.Equal(t, "header", clientCert.Source)
+		assert.Equal(t, "X-Client-Cert", clientCert.Header)
+		assert.Equal(t, "subject", clientCert.Mapping)
+		assert.Equal(t, []string{crlFile}, clientCert.CRLFiles)
+		assert.True(t, clientCert.trustedProxy("127.0.0.1:1234"))
+		assert.True(t, clientCert.trustedProxy("[::1]:1234"))
+		assert.True(t, clientCert.trustedProxy("10.1.2.3:1234"))
+		assert.False(t, clientCert.trustedProxy("192.0.2.1:1234"))
+	}
+
+	// invalid values
+	ioutil.WriteFile(filepath.Join(dir, "empty.pem"), []byte("nothing"), 0644)
+	for _, section := range []map[string]string{
+		{"enabled": "yes", "ca_file": caFile},
+		{"enabled": "true", "ca_file": caFile, "source": "proxy"},
+		{"enabled": "true", "ca_file": caFile, "mapping": "cn"},
+		{"enabled": "true", "ca_file": caFile, "source": "header", "trusted_proxies": "proxy.example.com"},
+		{"enabled": "true", "ca_file": filepath.Join(dir, "missing.pem")},
+		{"enabled": "true", "ca_file": filepath.Join(dir, "empty.pem")},
+		{"enabled": "true", "ca_file": caFile, "crl_files": filepath.Join(dir, "missing.crl")},
+		{"enabled": "true", "ca_file": caFile, "crl_files": caFile},
+	} {
+		_, err = NewClientCertFromConfig(ini.File{"clientcert": section}, "example.com")
+		assert.Error(t, err, section)
+	}
+}
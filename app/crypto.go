@@ -1,16 +1,47 @@
 package app
 
 import (
+	"crypto/dsa"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"github.com/dgrijalva/jwt-go"
+	"hash"
 	"io/ioutil"
+	"math/big"
 	"strconv"
 	"time"
 )
 
+var (
+	// SigningMethodDS128 signs the certificates with a DSA key of 1024 bits
+	// (q of 160 bits) and SHA-1.
+	SigningMethodDS128 = &SigningMethodDSA{"DS128", sha1.New, 20}
+
+	// SigningMethodDS256 signs the certificates with a DSA key of 2048 bits
+	// (q of 256 bits) and SHA-256.
+	SigningMethodDS256 = &SigningMethodDSA{"DS256", sha256.New, 32}
+
+	// oidPublicKeyDSA identifies the DSA keys in a PKCS #8 private key.
+	oidPublicKeyDSA = asn1.ObjectIdentifier{1, 2, 840, 10040, 4, 1}
+)
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodDS128.Alg(), func() jwt.SigningMethod {
+		return SigningMethodDS128
+	})
+	jwt.RegisterSigningMethod(SigningMethodDS256.Alg(), func() jwt.SigningMethod {
+		return SigningMethodDS256
+	})
+}
+
 // ErrorKey is a base error for public/private key operations
 type ErrorKey struct {
 	s string // error message
@@ -32,22 +63,119 @@ func (e *CertDurationError) Error() string {
 	return e.s
 }
 
-// PublicKey represents an RSA public key that implements the Marshaler interface.
+// SigningMethodDSA implements the DSA signing methods of Persona (DS128 and
+// DS256) for jwt-go. The signature is r followed by s, each of the size of q.
+type SigningMethodDSA struct {
+	Name string           // name of the method ("alg" header)
+	Hash func() hash.Hash // hash of the signed data
+	Size int              // size of q, r and s, in bytes
+}
+
+// dsaSigningMethod returns the signing method of the DSA key parameters.
+func dsaSigningMethod(params *dsa.Parameters) (*SigningMethodDSA, error) {
+	switch {
+	case params.P.BitLen() == 1024 && params.Q.BitLen() == 160:
+		return SigningMethodDS128, nil
+	case params.P.BitLen() == 2048 && params.Q.BitLen() == 256:
+		return SigningMethodDS256, nil
+	}
+	return nil, &ErrorKey{"Unsupported DSA key size (1024/160 or 2048/256 bits)"}
+}
+
+// Alg returns the name of the signing method.
+func (m *SigningMethodDSA) Alg() string {
+	return m.Name
+}
+
+// Verify returns nil if signature is a valid signature of signingString with
+// key, a *dsa.PublicKey.
+func (m *SigningMethodDSA) Verify(signingString, signature string, key interface{}) error {
+	dsaKey, ok := key.(*dsa.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKey
+	}
+	if method, err := dsaSigningMethod(&dsaKey.Parameters); err != nil || method != m {
+		return jwt.ErrInvalidKey
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if len(sig) != 2*m.Size {
+		return jwt.ErrSignatureInvalid
+	}
+
+	hasher := m.Hash()
+	hasher.Write([]byte(signingString))
+	r := new(big.Int).SetBytes(sig[:m.Size])
+	s := new(big.Int).SetBytes(sig[m.Size:])
+	if !dsa.Verify(dsaKey, hasher.Sum(nil), r, s) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// Sign returns the encoded signature of signingString with key, a
+// *dsa.PrivateKey.
+func (m *SigningMethodDSA) Sign(signingString string, key interface{}) (string, error) {
+	dsaKey, ok := key.(*dsa.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKey
+	}
+	if method, err := dsaSigningMethod(&dsaKey.Parameters); err != nil || method != m {
+		return "", jwt.ErrInvalidKey
+	}
+
+	hasher := m.Hash()
+	hasher.Write([]byte(signingString))
+	r, s, err := dsa.Sign(rand.Reader, dsaKey, hasher.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+
+	// r and s are padded to the size of q
+	sig := make([]byte, 2*m.Size)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(sig[m.Size-len(rBytes):m.Size], rBytes)
+	copy(sig[2*m.Size-len(sBytes):], sBytes)
+	return jwt.EncodeSegment(sig), nil
+}
+
+// PublicKey represents an RSA or a DSA public key that implements the
+// Marshaler interface.
 type PublicKey struct {
-	*rsa.PublicKey // anonymous field to the real RSA public key
+	*rsa.PublicKey                // anonymous field to the real RSA public key (nil for a DSA key)
+	DSA            *dsa.PublicKey // the DSA public key (nil for an RSA key)
 }
 
-// MarshalJSON returns the json representation of the RSA public key
+// Algorithm returns the algorithm of the public key in Persona: "RS" or "DS".
+func (pub *PublicKey) Algorithm() string {
+	if pub.DSA != nil {
+		return "DS"
+	}
+	return "RS"
+}
+
+// MarshalJSON returns the json representation of the public key: the modulus
+// and the exponent (in decimal) of an RSA key, the parameters and y (in
+// hexadecimal) of a DSA key.
 func (pub *PublicKey) MarshalJSON() ([]byte, error) {
 	data := map[string]string{}
-	data["algorithm"] = "RS"
-	data["n"] = pub.N.String()
-	data["e"] = strconv.Itoa(pub.E)
+	data["algorithm"] = pub.Algorithm()
+	if pub.DSA != nil {
+		data["p"] = pub.DSA.P.Text(16)
+		data["q"] = pub.DSA.Q.Text(16)
+		data["g"] = pub.DSA.G.Text(16)
+		data["y"] = pub.DSA.Y.Text(16)
+	} else {
+		data["n"] = pub.N.String()
+		data["e"] = strconv.Itoa(pub.E)
+	}
 	return json.Marshal(data)
 }
 
 // LoadPublicKey returns a PublicKey created from the content of a PEM encoded
-// file containing an RSA public key.
+// file containing an RSA or a DSA public key.
 func LoadPublicKey(filename string) (*PublicKey, error) {
 	// load content from filename
 	pem_data, err := ioutil.ReadFile(filename)
@@ -74,20 +202,39 @@ func LoadPublicKey(filename string) (*PublicKey, error) {
 		return nil, err
 	}
 
-	// cast the public key as an RSA public key
-	if rsa_key, ok := public_key.(*rsa.PublicKey); ok {
-		return &PublicKey{rsa_key}, nil
+	// cast the public key as an RSA or a DSA public key
+	switch key := public_key.(type) {
+	case *rsa.PublicKey:
+		return &PublicKey{PublicKey: key}, nil
+	case *dsa.PublicKey:
+		if _, err := dsaSigningMethod(&key.Parameters); err != nil {
+			return nil, err
+		}
+		return &PublicKey{DSA: key}, nil
 	}
-	return nil, &ErrorKey{"Not an RSA public key"}
+	return nil, &ErrorKey{"Not an RSA or DSA public key"}
 }
 
-// PrivateKey represents an RSA private key.
+// PrivateKey represents an RSA or a DSA private key.
 type PrivateKey struct {
-	*rsa.PrivateKey // anonymous field to the read RSA private key
+	*rsa.PrivateKey                 // anonymous field to the read RSA private key (nil for a DSA key)
+	DSA             *dsa.PrivateKey // the DSA private key (nil for an RSA key)
+}
+
+// signingMethod returns the signing method of the certificates and the key
+// given to the method.
+func (priv *PrivateKey) signingMethod() (jwt.SigningMethod, interface{}, error) {
+	if priv.DSA != nil {
+		method, err := dsaSigningMethod(&priv.DSA.Parameters)
+		return method, priv.DSA, err
+	}
+	return jwt.GetSigningMethod("RS256"), priv.PrivateKey, nil
 }
 
 // LoadPrivateKey returns a PrivateKey created from the content of a PEM
-// encoded file containing an RSA private key.
+// encoded file containing an RSA or a DSA private key, in the OpenSSL format
+// ("RSA PRIVATE KEY" or "DSA PRIVATE KEY") or in the PKCS #8 format ("PRIVATE
+// KEY").
 func LoadPrivateKey(filename string) (*PrivateKey, error) {
 	// load content from filename
 	pem_data, err := ioutil.ReadFile(filename)
@@ -95,52 +242,143 @@ func LoadPrivateKey(filename string) (*PrivateKey, error) {
 		return nil, err
 	}
 
-	// iterate an all blocks in the file and search a "RSA PRIVATE KEY" block
+	// iterate an all blocks in the file and search a private key block
 	var block *pem.Block
 	rest := []byte(pem_data)
 	for {
 		block, rest = pem.Decode(rest)
 		if block == nil {
-			return nil, &ErrorKey{"No RSA PRIVATE KEY bloc found"}
+			return nil, &ErrorKey{"No PRIVATE KEY bloc found"}
 		}
-		if block.Type == "RSA PRIVATE KEY" {
+		if block.Type == "RSA PRIVATE KEY" || block.Type == "DSA PRIVATE KEY" || block.Type == "PRIVATE KEY" {
 			break
 		}
 	}
 
-	// we have a "RSA PRIVATE KEY" block, parse it to create an RSA private key
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	// we have a private key block, parse it to create an RSA or a DSA private
+	// key
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "DSA PRIVATE KEY":
+		key, err = parseDSAPrivateKey(block.Bytes)
+	default:
+		key, err = parsePKCS8PrivateKey(block.Bytes)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &PrivateKey{key}, nil
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &PrivateKey{PrivateKey: key}, nil
+	case *dsa.PrivateKey:
+		if _, err := dsaSigningMethod(&key.Parameters); err != nil {
+			return nil, err
+		}
+		return &PrivateKey{DSA: key}, nil
+	}
+	return nil, &ErrorKey{"Not an RSA or DSA private key"}
+}
+
+// parseDSAPrivateKey returns the DSA private key of an OpenSSL "DSA PRIVATE
+// KEY" block (the parameters, y and x).
+func parseDSAPrivateKey(der []byte) (*dsa.PrivateKey, error) {
+	var k struct {
+		Version       int
+		P, Q, G, Y, X *big.Int
+	}
+	if rest, err := asn1.Unmarshal(der, &k); err != nil {
+		return nil, err
+	} else if len(rest) > 0 || k.Version != 0 {
+		return nil, &ErrorKey{"Invalid DSA private key"}
+	}
+	return newDSAPrivateKey(dsa.Parameters{P: k.P, Q: k.Q, G: k.G}, k.X)
+}
+
+// parsePKCS8PrivateKey returns the RSA or DSA private key of a PKCS #8
+// "PRIVATE KEY" block, the DSA keys are not supported by the x509 package.
+func parsePKCS8PrivateKey(der []byte) (interface{}, error) {
+	var k struct {
+		Version    int
+		Algorithm  pkix.AlgorithmIdentifier
+		PrivateKey []byte
+	}
+	if _, err := asn1.Unmarshal(der, &k); err != nil {
+		return nil, err
+	}
+	if !k.Algorithm.Algorithm.Equal(oidPublicKeyDSA) {
+		return x509.ParsePKCS8PrivateKey(der)
+	}
+
+	var params dsa.Parameters
+	if _, err := asn1.Unmarshal(k.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	x := new(big.Int)
+	if _, err := asn1.Unmarshal(k.PrivateKey, &x); err != nil {
+		return nil, err
+	}
+	return newDSAPrivateKey(params, x)
+}
+
+// newDSAPrivateKey returns the DSA private key x with the parameters, y is
+// computed from x.
+func newDSAPrivateKey(params dsa.Parameters, x *big.Int) (*dsa.PrivateKey, error) {
+	if params.P == nil || params.Q == nil || params.G == nil || x == nil ||
+		params.P.Sign() <= 0 || params.Q.Sign() <= 0 || x.Sign() <= 0 || x.Cmp(params.Q) >= 0 {
+		return nil, &ErrorKey{"Invalid DSA private key"}
+	}
+	key := &dsa.PrivateKey{X: x}
+	key.Parameters = params
+	key.Y = new(big.Int).Exp(params.G, x, params.P)
+	return key, nil
 }
 
 // CreateCertificate returns the string representation of a token signed with
-// the given private_key. The token contains the following claims:
+// the given private_key (RS256 for an RSA key, DS128 or DS256 for a DSA key,
+// depending on its size). The token contains the following claims:
 // - iat: timestamp of the generated certificate
 // - exp: expiry timestamp of the certificate
 // - iss: issuer of the certificate (the domain used by the IdP)
-// - public-key: the public key provided by the browser
+// - public-key: the public key provided by the browser (RS or DS)
 // - principal:
 //   - email : the email address of the authenticated user
-func CreateCertificate(private_key *PrivateKey, public_key *PublicKey, email string, cert_duration time.Duration, pubkey map[string]string, iss string) ([]byte, error) {
+//   - name : the display name of the authenticated user (if known)
+//   - groups : the groups of the authenticated user (if known)
+func CreateCertificate(private_key *PrivateKey, public_key *PublicKey, identity *Identity, cert_duration time.Duration, pubkey map[string]string, iss string) ([]byte, error) {
 	// cert_duration must never exceed 24 hours
 	if cert_duration > 24*time.Hour {
 		return nil, &CertDurationError{"CreateCertificate: cert_duration exceed 24 hours"}
 	}
+	if identity == nil || identity.Email == "" {
+		return nil, errors.New("CreateCertificate: no authenticated identity")
+	}
+
+	principal := map[string]interface{}{"email": identity.Email}
+	if identity.DisplayName != "" {
+		principal["name"] = identity.DisplayName
+	}
+	if len(identity.Groups) > 0 {
+		principal["groups"] = identity.Groups
+	}
+
+	method, key, err := private_key.signingMethod()
+	if err != nil {
+		return nil, err
+	}
 
 	// create a new JSON Web Token
-	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token := jwt.New(method)
 	token.Claims["iat"] = time.Now().Add(-time.Duration(10)*time.Second).Unix() * 1000
 	token.Claims["exp"] = time.Now().Add(cert_duration).Unix() * 1000
 	token.Claims["iss"] = iss
 	token.Claims["public-key"] = pubkey
-	token.Claims["principal"] = map[string]string{"email": email}
+	token.Claims["principal"] = principal
 
 	// sign the token with the private key
-	tokenString, err := token.SignedString(private_key.PrivateKey)
+	tokenString, err := token.SignedString(key)
 	if err != nil {
 		return nil, err
 	}
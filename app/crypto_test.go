@@ -0,0 +1,184 @@
+package app
+
+import (
+	"crypto/dsa"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadTestKeys returns the public and private keys of the tests/ folder.
+func loadTestKeys(t *testing.T, prefix string) (*PublicKey, *PrivateKey) {
+	public_key, err := LoadPublicKey("../tests/" + prefix + "public-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	private_key, err := LoadPrivateKey("../tests/" + prefix + "private-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public_key, private_key
+}
+
+func TestLoadKeys(t *testing.T) {
+	// TEST: an RSA key pair
+	public_key, private_key := loadTestKeys(t, "")
+	assert.Equal(t, "RS", public_key.Algorithm())
+	assert.Nil(t, public_key.DSA)
+	assert.Nil(t, private_key.DSA)
+	assert.Equal(t, public_key.PublicKey.N, private_key.PrivateKey.N)
+
+	// TEST: DSA key pairs, in the OpenSSL and the PKCS #8 formats
+	for _, prefix := range []string{"ds256-", "ds128-"} {
+		public_key, private_key = loadTestKeys(t, prefix)
+		assert.Equal(t, "DS", public_key.Algorithm())
+		assert.Nil(t, public_key.PublicKey)
+		assert.Nil(t, private_key.PrivateKey)
+		if assert.NotNil(t, public_key.DSA) && assert.NotNil(t, private_key.DSA) {
+			assert.Equal(t, public_key.DSA.Parameters, private_key.DSA.Parameters)
+			assert.Equal(t, public_key.DSA.Y, private_key.DSA.Y)
+		}
+	}
+
+	// TEST: a private key is not a public key and vice versa
+	_, err := LoadPublicKey("../tests/ds256-private-key.pem")
+	assert.EqualError(t, err, "No PUBLIC KEY bloc found")
+	_, err = LoadPrivateKey("../tests/ds256-public-key.pem")
+	assert.EqualError(t, err, "No PRIVATE KEY bloc found")
+	_, err = LoadPrivateKey("../tests/missing.pem")
+	assert.Error(t, err)
+}
+
+func TestDSASigningMethod(t *testing.T) {
+	size := func(pBits, qBits uint) *dsa.Parameters {
+		one := big.NewInt(1)
+		return &dsa.Parameters{
+			P: new(big.Int).Lsh(one, pBits-1),
+			Q: new(big.Int).Lsh(one, qBits-1),
+			G: big.NewInt(2),
+		}
+	}
+
+	method, err := dsaSigningMethod(size(1024, 160))
+	assert.NoError(t, err)
+	assert.Equal(t, SigningMethodDS128, method)
+	method, err = dsaSigningMethod(size(2048, 256))
+	assert.NoError(t, err)
+	assert.Equal(t, SigningMethodDS256, method)
+	for _, params := range []*dsa.Parameters{size(2048, 224), size(3072, 256), size(1024, 256)} {
+		_, err = dsaSigningMethod(params)
+		assert.Error(t, err)
+	}
+
+	// the methods are registered in jwt-go
+	assert.Equal(t, SigningMethodDS128, jwt.GetSigningMethod("DS128"))
+	assert.Equal(t, SigningMethodDS256, jwt.GetSigningMethod("DS256"))
+
+	// TEST: sign and verify
+	_, ds256 := loadTestKeys(t, "ds256-")
+	_, ds128 := loadTestKeys(t, "ds128-")
+	signature, err := SigningMethodDS256.Sign("header.payload", ds256.DSA)
+	assert.NoError(t, err)
+	assert.Len(t, signature, 86) // 64 bytes
+	assert.NoError(t, SigningMethodDS256.Verify("header.payload", signature, &ds256.DSA.PublicKey))
+	assert.Equal(t, jwt.ErrSignatureInvalid, SigningMethodDS256.Verify("header.other", signature, &ds256.DSA.PublicKey))
+	assert.Equal(t, jwt.ErrSignatureInvalid, SigningMethodDS256.Verify("header.payload", signature[:43], &ds256.DSA.PublicKey))
+
+	signature, err = SigningMethodDS128.Sign("header.payload", ds128.DSA)
+	assert.NoError(t, err)
+	assert.Len(t, signature, 54) // 40 bytes
+	assert.NoError(t, SigningMethodDS128.Verify("header.payload", signature, &ds128.DSA.PublicKey))
+
+	// TEST: the key must match the method
+	_, err = SigningMethodDS128.Sign("header.payload", ds256.DSA)
+	assert.Equal(t, jwt.ErrInvalidKey, err)
+	assert.Equal(t, jwt.ErrInvalidKey, SigningMethodDS256.Verify("header.payload", signature, &ds128.DSA.PublicKey))
+	_, rsa := loadTestKeys(t, "")
+	_, err = SigningMethodDS256.Sign("header.payload", rsa.PrivateKey)
+	assert.Equal(t, jwt.ErrInvalidKey, err)
+}
+
+func TestPublicKeyMarshalJSON(t *testing.T) {
+	// TEST: an RSA key, in decimal
+	public_key, _ := loadTestKeys(t, "")
+	data, err := json.Marshal(public_key)
+	assert.NoError(t, err)
+	var rsaKey map[string]string
+	assert.NoError(t, json.Unmarshal(data, &rsaKey))
+	assert.Equal(t, "RS", rsaKey["algorithm"])
+	assert.Equal(t, "65537", rsaKey["e"])
+	assert.Equal(t, public_key.N.String(), rsaKey["n"])
+	assert.Len(t, rsaKey, 3)
+
+	// TEST: a DSA key, in hexadecimal
+	public_key, _ = loadTestKeys(t, "ds256-")
+	data, err = json.Marshal(public_key)
+	assert.NoError(t, err)
+	var dsaKey map[string]string
+	assert.NoError(t, json.Unmarshal(data, &dsaKey))
+	assert.Equal(t, "DS", dsaKey["algorithm"])
+	assert.Len(t, dsaKey, 5)
+	for name, value := range map[string]*big.Int{
+		"p": public_key.DSA.P,
+		"q": public_key.DSA.Q,
+		"g": public_key.DSA.G,
+		"y": public_key.DSA.Y,
+	} {
+		n, ok := new(big.Int).SetString(dsaKey[name], 16)
+		if assert.True(t, ok, name) {
+			assert.Equal(t, 0, value.Cmp(n), name)
+		}
+		assert.Equal(t, strings.ToLower(dsaKey[name]), dsaKey[name], name)
+	}
+}
+
+func TestCreateCertificate(t *testing.T) {
+	identity := &Identity{Email: "alice@example.com"}
+	pubkey := map[string]string{"algorithm": "DS", "y": "1f", "p": "2f", "q": "3f", "g": "4f"}
+
+	for _, test := range []struct {
+		prefix string
+		alg    string
+	}{
+		{"", "RS256"},
+		{"ds256-", "DS256"},
+		{"ds128-", "DS128"},
+	} {
+		public_key, private_key := loadTestKeys(t, test.prefix)
+		certificate, err := CreateCertificate(private_key, public_key, identity, time.Hour, pubkey, "example.com")
+		if !assert.NoError(t, err, test.alg) {
+			continue
+		}
+
+		token, err := jwt.Parse(string(certificate), func(token *jwt.Token) (interface{}, error) {
+			if public_key.DSA != nil {
+				return public_key.DSA, nil
+			}
+			return public_key.PublicKey, nil
+		})
+		if assert.NoError(t, err, test.alg) {
+			assert.Equal(t, test.alg, token.Header["alg"])
+			assert.Equal(t, "example.com", token.Claims["iss"])
+			assert.Equal(t, map[string]interface{}{"algorithm": "DS", "y": "1f", "p": "2f", "q": "3f", "g": "4f"}, token.Claims["public-key"])
+		}
+	}
+
+	// TEST: the certificate is not valid with another key
+	_, private_key := loadTestKeys(t, "ds256-")
+	certificate, err := CreateCertificate(private_key, nil, identity, time.Hour, pubkey, "example.com")
+	assert.NoError(t, err)
+	other, _ := loadTestKeys(t, "ds128-")
+	_, err = jwt.Parse(string(certificate), func(token *jwt.Token) (interface{}, error) {
+		return other.DSA, nil
+	})
+	assert.Error(t, err)
+
+	// TEST: too long cert duration
+	_, err = CreateCertificate(private_key, nil, identity, 25*time.Hour, pubkey, "example.com")
+	assert.IsType(t, &CertDurationError{}, err)
+}
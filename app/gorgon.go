@@ -1,6 +1,7 @@
 package app
 
 import (
+	"crypto/tls"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/op/go-logging"
@@ -8,6 +9,7 @@ import (
 	"html/template"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -34,8 +36,18 @@ type GorgonApp struct {
 	PrivateKey    *PrivateKey           // private key for the domain
 	Templates     *template.Template    // list of all templates used by the application
 	Domain        string                // domain name used for this IdP
-	Authenticator Authenticator         // method to authenticate users
+	Authenticator ContextAuthenticator  // method to authenticate users
+	AuthTimeout   time.Duration         // maximum duration of an authentication
+	RateLimiter   *RateLimiter          // brute-force protection (nil if disabled)
+	TOTP          *TOTP                 // second authentication factor (nil if disabled)
+	WebAuthn      *WebAuthn             // security keys (nil if disabled)
+	MagicLink     *MagicLink            // sign-in links sent by email (nil if disabled)
+	ClientCert    *ClientCert           // TLS client certificates (nil if disabled)
+	OIDC          *OIDC                 // upstream OpenID Connect provider (nil if disabled)
+	SAML          *SAML                 // upstream SAML identity provider (nil if disabled)
+	Bridge        *Bridge               // foreign domains vouched for by the IdP (nil if disabled)
 	ListenAddress string                // network address on which the app will listens
+	TLSConfig     *tls.Config           // TLS configuration of the listener (nil to serve HTTP)
 	Logger        *logging.Logger       // Logger for this app
 }
 
@@ -85,10 +97,28 @@ func NewApp(config_file string) GorgonApp {
 
 	// the domain used for this IdP (should be the domain part of the email address)
 	domain, _ := config.Get("global", "idp_domain")
+	if domain == "" {
+		logger.Fatal("The 'idp_domain' is empty.")
+	}
 
 	// the listen network address
 	listenAddress, _ := config.Get("global", "listen")
 
+	// serve HTTPS if a certificate is provided
+	var tls_config *tls.Config
+	tls_cert_file, _ := config.Get("global", "tls_cert_file")
+	tls_key_file, _ := config.Get("global", "tls_key_file")
+	if tls_cert_file != "" || tls_key_file != "" {
+		certificate, err := tls.LoadX509KeyPair(tls_cert_file, tls_key_file)
+		if err != nil {
+			logger.Fatal("Unable to load TLS certificate '" + tls_cert_file + "': " + err.Error())
+		}
+		tls_config = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
 	// the session secret key
 	session_secret_key, _ := config.Get("global", "session_secret_key")
 	if session_secret_key == "" {
@@ -98,6 +128,78 @@ func NewApp(config_file string) GorgonApp {
 		logger.Fatalf("The 'session_secret_key' must have a length of 32 or 64 bytes (currently: %d).", len(session_secret_key))
 	}
 
+	// the maximum duration of an authentication (in seconds)
+	auth_timeout := 30 * time.Second
+	if value, ok := config.Get("global", "auth_timeout"); ok {
+		num_seconds, err := strconv.Atoi(value)
+		if err != nil || num_seconds <= 0 {
+			logger.Fatal("The 'auth_timeout' must be a positive number of seconds.")
+		}
+		auth_timeout = time.Duration(num_seconds) * time.Second
+	}
+
+	// the brute-force protection of the authentication endpoint
+	rate_limiter, err := NewRateLimiterFromConfig(config)
+	if err != nil {
+		logger.Fatal("Unable to configure the rate limit: " + err.Error())
+	}
+
+	// the second authentication factor
+	totp, err := NewTOTPFromConfig(config, domain)
+	if err != nil {
+		logger.Fatal("Unable to configure TOTP: " + err.Error())
+	}
+
+	// the security keys, as second factor or without password
+	webauthn, err := NewWebAuthnFromConfig(config, domain)
+	if err != nil {
+		logger.Fatal("Unable to configure WebAuthn: " + err.Error())
+	}
+
+	// the sign-in links sent by email
+	magic_link, err := NewMagicLinkFromConfig(config, domain)
+	if err != nil {
+		logger.Fatal("Unable to configure the magic links: " + err.Error())
+	}
+
+	// the TLS client certificates
+	client_cert, err := NewClientCertFromConfig(config, domain)
+	if err != nil {
+		logger.Fatal("Unable to configure the client certificates: " + err.Error())
+	}
+	if client_cert != nil && client_cert.Source == "tls" {
+		if tls_config == nil {
+			logger.Fatal("The 'tls' source of the client certificates needs 'tls_cert_file' and 'tls_key_file'.")
+		}
+		// the certificates are verified by ClientCert, the pages must
+		// stay available without certificate
+		tls_config.ClientAuth = tls.RequestClientCert
+	}
+
+	// the delegation to an OpenID Connect provider
+	oidc, err := NewOIDCFromConfig(config, domain)
+	if err != nil {
+		logger.Fatal("Unable to configure OIDC: " + err.Error())
+	}
+
+	// the delegation to a SAML identity provider
+	saml, err := NewSAMLFromConfig(config, domain)
+	if err != nil {
+		logger.Fatal("Unable to configure SAML: " + err.Error())
+	}
+
+	// the foreign domains vouched for by the IdP
+	bridge, err := NewBridgeFromConfig(config, domain)
+	if err != nil {
+		logger.Fatal("Unable to configure the bridge: " + err.Error())
+	}
+	if bridge != nil && len(bridge.EmailDomains()) > 0 {
+		if magic_link == nil {
+			logger.Fatal("The domains of the bridge verified by email need the 'magiclink' section.")
+		}
+		magic_link.Domains = bridge.EmailDomains()
+	}
+
 	// create the Gorgon application
 	app := GorgonApp{
 		config,
@@ -108,7 +210,17 @@ func NewApp(config_file string) GorgonApp {
 		templates,
 		domain,
 		nil,
+		auth_timeout,
+		rate_limiter,
+		totp,
+		webauthn,
+		magic_link,
+		client_cert,
+		oidc,
+		saml,
+		bridge,
 		listenAddress,
+		tls_config,
 		logger,
 	}
 
@@ -116,9 +228,9 @@ func NewApp(config_file string) GorgonApp {
 	authenticator_name, _ := config.Get("global", "auth")
 	authenticator, err := NewAuthenticator(app, authenticator_name)
 	if err != nil {
-		logger.Panic("Unable to create auth backend '" + authenticator_name + "': " + err.Error())
+		logger.Fatal("Unable to create auth backend '" + authenticator_name + "': " + err.Error())
 	}
-	app.Authenticator = authenticator
+	app.Authenticator = NewContextAuthenticator(authenticator)
 
 	// define routes
 	app.Router.Handle(
@@ -151,12 +263,93 @@ func NewApp(config_file string) GorgonApp {
 		Methods("GET").
 		Name("check_authenticate")
 
+	app.Router.Handle(
+		"/.well-known/browserid/_gorgon/totp",
+		GorgonHandler{&app, TOTPEnrollmentHandler}).
+		Methods("GET", "POST").
+		Name("totp_enrollment")
+
+	app.Router.Handle(
+		"/.well-known/browserid/_gorgon/webauthn",
+		GorgonHandler{&app, WebAuthnRegistrationHandler}).
+		Methods("GET").
+		Name("webauthn_registration")
+
+	app.Router.Handle(
+		"/.well-known/browserid/_gorgon/webauthn/register/begin",
+		GorgonHandler{&app, WebAuthnRegisterBeginHandler}).
+		Methods("POST").
+		Name("webauthn_register_begin")
+
+	app.Router.Handle(
+		"/.well-known/browserid/_gorgon/webauthn/register/finish",
+		GorgonHandler{&app, WebAuthnRegisterFinishHandler}).
+		Methods("POST").
+		Name("webauthn_register_finish")
+
+	app.Router.Handle(
+		"/.well-known/browserid/_gorgon/webauthn/login/begin",
+		GorgonHandler{&app, WebAuthnLoginBeginHandler}).
+		Methods("POST").
+		Name("webauthn_login_begin")
+
+	app.Router.Handle(
+		"/.well-known/browserid/_gorgon/webauthn/login/finish",
+		GorgonHandler{&app, WebAuthnLoginFinishHandler}).
+		Methods("POST").
+		Name("webauthn_login_finish")
+
+	app.Router.Handle(
+		"/.well-known/browserid/_gorgon/magiclink",
+		GorgonHandler{&app, MagicLinkHandler}).
+		Methods("GET", "POST").
+		Name("magiclink")
+
+	app.Router.Handle(
+		"/.well-known/browserid/_gorgon/oidc/login",
+		GorgonHandler{&app, OIDCLoginHandler}).
+		Methods("GET").
+		Name("oidc_login")
+
+	app.Router.Handle(
+		OIDCCallbackPath,
+		GorgonHandler{&app, OIDCCallbackHandler}).
+		Methods("GET").
+		Name("oidc_callback")
+
+	app.Router.Handle(
+		SAMLMetadataPath,
+		GorgonHandler{&app, SAMLMetadataHandler}).
+		Methods("GET").
+		Name("saml_metadata")
+
+	app.Router.Handle(
+		"/.well-known/browserid/_gorgon/saml/login",
+		GorgonHandler{&app, SAMLLoginHandler}).
+		Methods("GET").
+		Name("saml_login")
+
+	app.Router.Handle(
+		SAMLACSPath,
+		GorgonHandler{&app, SAMLACSHandler}).
+		Methods("POST").
+		Name("saml_acs")
+
 	return app
 }
 
 // ListenAndServe listens on the TCP network address provided by the app
-// configuration and then serve requests on incoming connections.
+// configuration and then serve requests on incoming connections. The requests
+// are served over HTTPS if the app has a TLSConfig.
 func (app GorgonApp) ListenAndServe() error {
+	if app.TLSConfig != nil {
+		server := &http.Server{
+			Addr:      app.ListenAddress,
+			Handler:   app.Router,
+			TLSConfig: app.TLSConfig,
+		}
+		return server.ListenAndServeTLS("", "")
+	}
 	return http.ListenAndServe(app.ListenAddress, app.Router)
 }
 
@@ -1,12 +1,42 @@
 package app
 
 import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"github.com/gorilla/sessions"
+	"html/template"
+	"net"
 	"net/http"
+	"rsc.io/qr"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// pendingIdentityLifetime is the time given to a user to pass the second
+// authentication factor.
+const pendingIdentityLifetime = 5 * time.Minute
+
+// pendingIdentityMaxFailures is the number of bad TOTP codes after which the
+// user must authenticate with the password again.
+const pendingIdentityMaxFailures = 5
+
+// oidcLoginTimeout is the time given to a user to authenticate with the
+// OpenID Connect provider.
+const oidcLoginTimeout = 10 * time.Minute
+
+// samlLoginTimeout is the time given to a user to authenticate with the SAML
+// IdP.
+const samlLoginTimeout = 10 * time.Minute
+
+// samlRequestCookie is the cookie binding an AuthnRequest to the browser, it
+// is sent with the cross-site POST of the SAML IdP (SameSite=None) unlike the
+// session cookie.
+const samlRequestCookie = "persona-saml"
+
 // GorgonHandler implements the Handler interface to add the ability to access
 // our GorgonApp from handlers.
 type GorgonHandler struct {
@@ -40,48 +70,1088 @@ func SupportDocumentHandler(app *GorgonApp, w http.ResponseWriter, r *http.Reque
 // authenticating the user using the app Authenticator and the
 // username/password provided by the user.
 // If the user is successfully authenticated, the "persona-auth" cookie is
-// updated with the username used in the authentication process.
+// updated with the identity returned by the Authenticator (the canonical
+// email, the display name and the groups of the user).
+// When TOTP or WebAuthn is enabled, a user enrolled in TOTP or with a
+// WebAuthn credential must then pass the second factor: the identity is kept
+// as pending in the session until a code is verified (second form) or a
+// WebAuthn assertion is verified (see WebAuthnLoginFinishHandler). A user
+// forced to use TOTP but without second factor yet is redirected to the TOTP
+// enrolment page.
+// When magic links are enabled, the user can ask for a sign-in link instead
+// of entering a password (see MagicLinkHandler): the page then waits for the
+// session to be authenticated.
+// When client certificates are enabled, a user presenting a valid
+// certificate is authenticated without the form.
+// When the authentication is delegated to an OpenID Connect provider, the
+// page proposes to sign in with the provider, or redirects to the provider
+// instead of displaying the form (see OIDCLoginHandler). The same goes for a
+// SAML IdP (see SAMLLoginHandler).
+// When the email address is at a domain of the Bridge, the password is
+// refused: the page proposes to verify the address by email or with the
+// OpenID Connect provider of the domain.
+// When the client or the username is throttled by the app RateLimiter, the
+// Authenticator is not called and the form is returned with an HTTP code 429
+// (Too Many Requests).
 func AuthenticationHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
 	ctx := make(map[string]interface{})
 	ctx["App"] = app
 	ctx["Email"] = ""
 
 	session, _ := app.SessionStore.Get(r, "persona-auth")
+	status := http.StatusOK
+	location := ""
 
 	if r.Method == "POST" {
-		// the user submitted the HTML form
+		// the user submitted one of the HTML forms
 		username := r.FormValue("email")
-		password := r.FormValue("password")
+		step := r.FormValue("step")
+		if step == "totp" {
+			// the second step is done by the user authenticated with a
+			// password
+			if pending := GetSessionPendingIdentity(session); pending != nil {
+				username = pending.Email
+				ctx["TOTPRequired"], ctx["WebAuthnRequired"], err = secondFactors(app, username)
+				if err != nil {
+					return
+				}
+			}
+		}
 
 		ctx["Email"] = username
 
-		// try to authenticate the user
-		err := app.Authenticator.Authenticate(username, password)
-		if err == nil {
-			// the authentication process is ok
-			// add the username in the session
-			session.Values["authenticated_as"] = username
+		// throttled attempts never reach the authenticator
+		ip, throttled := checkRateLimit(app, w, r, ctx, username)
+		if throttled {
+			status = http.StatusTooManyRequests
+		} else if step == "totp" {
+			err = authenticateTOTP(app, session, ctx, ip, r.FormValue("totp_code"))
+		} else if step == "magiclink" && app.MagicLink != nil {
+			err = sendMagicLink(app, session, ctx, ip, username)
 		} else {
-			// the authentication process failed
-			// remove the username from the session
-			delete(session.Values, "authenticated_as")
-			// notify the user
-			ctx["ValidationError"] = true
-
-			app.Logger.Warning("Authentication failed for '" + username + "': " + err.Error())
+			location, err = authenticatePassword(app, r, session, ctx, ip, username, r.FormValue("password"))
+		}
+		if err != nil {
+			return
+		}
+	} else if pending := GetSessionPendingIdentity(session); pending != nil {
+		// the second step of an authentication started elsewhere (with a
+		// magic link)
+		ctx["Email"] = pending.Email
+		ctx["TOTPRequired"], ctx["WebAuthnRequired"], err = secondFactors(app, pending.Email)
+		if err != nil {
+			return
+		}
+	} else if app.ClientCert != nil && GetSessionIdentity(session) == nil {
+		location, err = authenticateClientCert(app, r, session, ctx)
+		if err != nil {
+			return
 		}
 	}
+	bridged := app.Bridge != nil && app.Bridge.Domain(r.FormValue("email")) != nil
+	if app.OIDC != nil && app.OIDC.AutoRedirect && location == "" && r.Method != "POST" && !bridged &&
+		GetSessionIdentity(session) == nil && GetSessionPendingIdentity(session) == nil {
+		// the provider replaces the form
+		oidc_login_url, _ := app.Router.Get("oidc_login").URL()
+		location = oidc_login_url.String()
+	} else if app.SAML != nil && app.SAML.AutoRedirect && location == "" && r.Method != "POST" && !bridged &&
+		GetSessionIdentity(session) == nil && GetSessionPendingIdentity(session) == nil {
+		// the SAML IdP replaces the form
+		saml_login_url, _ := app.Router.Get("saml_login").URL()
+		location = saml_login_url.String()
+	}
 	session.Save(r, w)
+	if location != "" {
+		http.Redirect(w, r, location, http.StatusSeeOther)
+		return
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
 
 	if emails, ok := r.URL.Query()["email"]; ok {
 		ctx["Email"] = emails[0]
 	}
+	if app.WebAuthn != nil {
+		login_begin_url, _ := app.Router.Get("webauthn_login_begin").URL()
+		login_finish_url, _ := app.Router.Get("webauthn_login_finish").URL()
+		ctx["WebAuthnLoginBegin"] = login_begin_url.String()
+		ctx["WebAuthnLoginFinish"] = login_finish_url.String()
+		ctx["WebAuthnPasswordless"] = app.WebAuthn.Passwordless
+	}
+	if app.OIDC != nil {
+		oidc_login_url, _ := app.Router.Get("oidc_login").URL()
+		ctx["OIDCLogin"] = oidc_login_url.String()
+		ctx["OIDCName"] = app.OIDC.Name
+	}
+	if app.SAML != nil {
+		saml_login_url, _ := app.Router.Get("saml_login").URL()
+		ctx["SAMLLogin"] = saml_login_url.String()
+		ctx["SAMLName"] = app.SAML.Name
+	}
+	if app.MagicLink != nil {
+		check_authenticated_url, _ := app.Router.Get("check_authenticate").URL()
+		ctx["MagicLink"] = true
+		ctx["CheckAuthenticatedURL"] = check_authenticated_url.String()
+	}
+	if app.Bridge != nil {
+		if domain := app.Bridge.Domain(ctx["Email"].(string)); domain != nil {
+			ctx["BridgeDomain"] = domain.Name
+			if domain.OIDC != nil {
+				oidc_login_url, _ := app.Router.Get("oidc_login").URL()
+				ctx["BridgeOIDCLogin"] = oidc_login_url.String()
+				ctx["BridgeOIDCName"] = domain.OIDC.Name
+			}
+		}
+	}
 
 	// render the template
 	ctx["Session"] = session
 	return app.Templates.ExecuteTemplate(w, "authentication.html", ctx)
 }
 
+// checkRateLimit checks the attempt of the client for the username with the
+// app RateLimiter. If the attempt is throttled, the template context and the
+// "Retry-After" header are set. Otherwise the attempt is reserved: it counts
+// as a failure unless it is released (RateLimiter.Release). Returns the IP
+// address of the client. An empty username (passwordless authentication) only
+// checks the IP address.
+func checkRateLimit(app *GorgonApp, w http.ResponseWriter, r *http.Request, ctx map[string]interface{}, username string) (string, bool) {
+	if app.RateLimiter == nil {
+		return "", false
+	}
+	ip := app.RateLimiter.ClientIP(r)
+	wait := app.RateLimiter.Check(ip, username)
+	if wait <= 0 {
+		return ip, false
+	}
+
+	// round up, the client must not retry too early
+	retry_after := int((wait + time.Second - 1) / time.Second)
+	ctx["RateLimited"] = true
+	ctx["RetryAfter"] = retry_after
+	w.Header().Set("Retry-After", strconv.Itoa(retry_after))
+
+	app.Logger.Warning("Authentication throttled for '" + username + "' from " + ip)
+	return ip, true
+}
+
+// authenticatePassword is the first step of the authentication: the
+// username/password are checked with the app Authenticator. Returns the URL
+// of the TOTP enrolment page if the user must enroll before being
+// authenticated.
+func authenticatePassword(app *GorgonApp, r *http.Request, session *sessions.Session, ctx map[string]interface{}, ip, username, password string) (string, error) {
+	// try to authenticate the user, the authentication is aborted after
+	// app.AuthTimeout; the addresses of the bridged domains are never
+	// verified with a password. The backends may forward the IP address of
+	// the client (the one of the rate limit, else the remote address).
+	var identity *Identity
+	var err error
+	if app.Bridge != nil && app.Bridge.Domain(username) != nil {
+		err = errBridgedPassword
+	} else {
+		auth_ctx, cancel := context.WithTimeout(r.Context(), app.AuthTimeout)
+		client := AuthClient{IP: ip, Secured: r.TLS != nil}
+		if client.IP == "" {
+			client.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		auth_ctx = WithAuthClient(auth_ctx, client)
+		identity, err = app.Authenticator.AuthenticateContext(auth_ctx, username, password)
+		cancel()
+		if err == nil && (identity == nil || identity.Email == "") {
+			identity = &Identity{Email: username}
+		}
+		// the backends may return another address than the username, the
+		// IdP only vouches for the addresses of its domain
+		if err == nil && app.Bridge != nil && app.Bridge.Domain(identity.Email) != nil {
+			err = errBridgedPassword
+		} else if err == nil && !emailInDomain(identity.Email, app.Domain) {
+			err = CredentialsError{"'" + identity.Email + "' is not an address of '" + app.Domain + "'"}
+		}
+	}
+
+	// remove the previous identity from the session
+	SetSessionIdentity(session, nil, "")
+	SetSessionPendingIdentity(session, nil, "")
+
+	// only rejected credentials count as failed attempts, not the errors of
+	// the backend
+	if app.RateLimiter != nil && (err == nil || !IsCredentialsError(err)) {
+		app.RateLimiter.Release(ip, username)
+	}
+	if err != nil {
+		// the authentication process failed
+		// notify the user
+		ctx["ValidationError"] = true
+
+		app.Logger.Warning("Authentication failed for '" + username + "': " + err.Error())
+		return "", nil
+	}
+
+	// the authentication process is ok
+	return authenticateFirstFactor(app, session, ctx, identity, username)
+}
+
+// authenticateFirstFactor adds the identity of a user who passed the first
+// authentication factor (a password or a magic link) in the session, or
+// keeps it as pending if the user must pass a second factor. Returns the URL
+// of the TOTP enrolment page if the user must enroll before being
+// authenticated.
+func authenticateFirstFactor(app *GorgonApp, session *sessions.Session, ctx map[string]interface{}, identity *Identity, username string) (string, error) {
+	email := identity.Email
+	if email == "" {
+		email = username
+	}
+	totp_enrolled, webauthn_registered, err := secondFactors(app, email)
+	if err != nil {
+		return "", err
+	}
+	totp_required := app.TOTP != nil && app.TOTP.Required(email)
+	if totp_enrolled || webauthn_registered || totp_required {
+		// the user must use a second factor, the failures of the
+		// username are only reset once both factors pass
+		SetSessionPendingIdentity(session, identity, username)
+		if !totp_enrolled && !webauthn_registered {
+			enrollment_url, _ := app.Router.Get("totp_enrollment").URL()
+			return enrollment_url.String(), nil
+		}
+		ctx["TOTPRequired"] = totp_enrolled
+		ctx["WebAuthnRequired"] = webauthn_registered
+		return "", nil
+	}
+
+	// add the identity in the session
+	SetSessionIdentity(session, identity, username)
+	if app.RateLimiter != nil {
+		app.RateLimiter.Succeed(username)
+	}
+	return "", nil
+}
+
+// authenticateClientCert authenticates the user with the client certificate
+// of the request, if any. A refused certificate is logged and the form is
+// displayed with an error. Returns the URL of the TOTP enrolment page if the
+// user must enroll before being authenticated.
+func authenticateClientCert(app *GorgonApp, r *http.Request, session *sessions.Session, ctx map[string]interface{}) (string, error) {
+	identity, err := app.ClientCert.Authenticate(r)
+	if err != nil {
+		ctx["ClientCertError"] = true
+		if IsCredentialsError(err) {
+			app.Logger.Warning("Client certificate refused: " + err.Error())
+		} else {
+			app.Logger.Error("Unable to verify the client certificate: " + err.Error())
+		}
+		return "", nil
+	}
+	if identity == nil {
+		return "", nil
+	}
+
+	ctx["Email"] = identity.Email
+	return authenticateFirstFactor(app, session, ctx, identity, identity.Email)
+}
+
+// sendMagicLink emails a magic link to the user, the identity of the session
+// is removed until the link is followed. Each link sent counts as a failed
+// attempt for the app RateLimiter, to limit the number of emails sent to an
+// address.
+func sendMagicLink(app *GorgonApp, session *sessions.Session, ctx map[string]interface{}, ip, email string) error {
+	SetSessionIdentity(session, nil, "")
+	SetSessionPendingIdentity(session, nil, "")
+
+	if !app.MagicLink.Allowed(email) {
+		if app.RateLimiter != nil {
+			app.RateLimiter.Release(ip, email)
+		}
+		ctx["MagicLinkError"] = true
+		return nil
+	}
+	magiclink_url, _ := app.Router.Get("magiclink").URL()
+	link, err := app.MagicLink.URL(magiclink_url.String(), email)
+	if err != nil {
+		if app.RateLimiter != nil {
+			app.RateLimiter.Release(ip, email)
+		}
+		return err
+	}
+	if err := app.MagicLink.Send(email, link); err != nil {
+		ctx["MagicLinkError"] = true
+		app.Logger.Error("Unable to send a magic link to '" + email + "': " + err.Error())
+		return nil
+	}
+
+	app.Logger.Info("Magic link sent to '" + email + "'")
+	ctx["MagicLinkSent"] = true
+	return nil
+}
+
+// secondFactors returns whether the user is enrolled in TOTP and whether the
+// user has a WebAuthn credential.
+func secondFactors(app *GorgonApp, email string) (totp_enrolled, webauthn_registered bool, err error) {
+	if app.TOTP != nil {
+		if totp_enrolled, err = app.TOTP.Enrolled(email); err != nil {
+			return
+		}
+	}
+	if app.WebAuthn != nil {
+		webauthn_registered, err = app.WebAuthn.Store.Registered(email)
+	}
+	return
+}
+
+// authenticateTOTP is the second step of the authentication: the TOTP code is
+// checked for the pending identity of the session. After
+// pendingIdentityMaxFailures bad codes, the pending identity is removed and
+// the first step must be done again.
+func authenticateTOTP(app *GorgonApp, session *sessions.Session, ctx map[string]interface{}, ip, code string) error {
+	identity := GetSessionPendingIdentity(session)
+	if identity == nil || app.TOTP == nil {
+		// the first step has expired, start again
+		if app.RateLimiter != nil {
+			app.RateLimiter.Release(ip, "")
+		}
+		ctx["TOTPRequired"] = false
+		ctx["ValidationError"] = true
+		return nil
+	}
+
+	err := app.TOTP.Verify(identity.Email, code)
+	if err != nil {
+		if !IsCredentialsError(err) {
+			if app.RateLimiter != nil {
+				app.RateLimiter.Release(ip, identity.Email)
+			}
+			return err
+		}
+		ctx["TOTPError"] = true
+		failures, _ := session.Values["pending_failures"].(int)
+		if failures+1 >= pendingIdentityMaxFailures {
+			SetSessionPendingIdentity(session, nil, "")
+			ctx["TOTPRequired"] = false
+			ctx["WebAuthnRequired"] = false
+			ctx["ValidationError"] = true
+		} else {
+			session.Values["pending_failures"] = failures + 1
+		}
+
+		app.Logger.Warning("Authentication failed for '" + identity.Email + "': " + err.Error())
+		return nil
+	}
+
+	// both factors pass, add the identity in the session
+	SetSessionPendingIdentity(session, nil, "")
+	SetSessionIdentity(session, identity, "")
+	if app.RateLimiter != nil {
+		app.RateLimiter.Release(ip, identity.Email)
+		app.RateLimiter.Succeed(identity.Email)
+	}
+	return nil
+}
+
+// TOTPEnrollmentHandler presents a new TOTP secret as a QR code, and stores
+// the secret once the user has entered a valid code. The user must be
+// authenticated, or be authenticated with a password and not enrolled yet
+// (the TOTP policy forces the user to enroll, see AuthenticationHandler). In
+// the latter case, the user is authenticated once enrolled and redirected to
+// the authentication page (a user with a WebAuthn credential must use it
+// instead). Returns an HTTP code 404 (Not Found) if TOTP is
+// disabled.
+func TOTPEnrollmentHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.TOTP == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+
+	identity := GetSessionIdentity(session)
+	pending := false
+	if identity == nil {
+		identity = GetSessionPendingIdentity(session)
+		if identity == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// a password is not enough to replace an existing secret or
+		// to bypass a WebAuthn credential
+		totp_enrolled, webauthn_registered, err := secondFactors(app, identity.Email)
+		if err != nil {
+			return err
+		}
+		if totp_enrolled || webauthn_registered {
+			w.WriteHeader(http.StatusForbidden)
+			return nil
+		}
+		pending = true
+	}
+
+	ctx := make(map[string]interface{})
+	ctx["App"] = app
+	ctx["Email"] = identity.Email
+
+	// the secret is kept in the session until the user enters a valid code
+	secret, _ := session.Values["totp_secret"].(string)
+	if secret == "" {
+		secret, err = NewTOTPSecret()
+		if err != nil {
+			return
+		}
+		session.Values["totp_secret"] = secret
+	}
+
+	status := http.StatusOK
+	if r.Method == "POST" {
+		ip, throttled := checkRateLimit(app, w, r, ctx, identity.Email)
+		if throttled {
+			status = http.StatusTooManyRequests
+		} else if err = app.TOTP.Enroll(identity.Email, secret, r.FormValue("totp_code")); err == nil {
+			delete(session.Values, "totp_secret")
+			ctx["Enrolled"] = true
+			if pending {
+				SetSessionPendingIdentity(session, nil, "")
+				SetSessionIdentity(session, identity, "")
+			}
+			if app.RateLimiter != nil {
+				app.RateLimiter.Release(ip, identity.Email)
+				app.RateLimiter.Succeed(identity.Email)
+			}
+			app.Logger.Info("TOTP enrolment of '" + identity.Email + "'")
+		} else if IsCredentialsError(err) {
+			err = nil
+			ctx["TOTPError"] = true
+		} else {
+			if app.RateLimiter != nil {
+				app.RateLimiter.Release(ip, identity.Email)
+			}
+			return
+		}
+	}
+	session.Save(r, w)
+
+	if ctx["Enrolled"] == true && pending {
+		// continue the authentication
+		authentication_url, _ := app.Router.Get("authentication").URL()
+		http.Redirect(w, r, authentication_url.String(), http.StatusSeeOther)
+		return
+	}
+
+	// the QR code is embedded in the page
+	code, err := qr.Encode(app.TOTP.ProvisioningURI(identity.Email, secret), qr.M)
+	if err != nil {
+		return
+	}
+	ctx["QRCode"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG()))
+	ctx["Secret"] = secret
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	return app.Templates.ExecuteTemplate(w, "totp_enrollment.html", ctx)
+}
+
+// webAuthnMaxBodySize is the maximum size of a credential sent by the browser.
+const webAuthnMaxBodySize = 64 * 1024
+
+// WebAuthnRegistrationHandler presents the WebAuthn credentials of the
+// authenticated user, and the button to register a new one (see
+// WebAuthnRegisterBeginHandler and WebAuthnRegisterFinishHandler). Returns an
+// HTTP code 403 (Forbidden) if the user is not authenticated, or 404 (Not
+// Found) if WebAuthn is disabled.
+func WebAuthnRegistrationHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.WebAuthn == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+	identity := GetSessionIdentity(session)
+	if identity == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	user, err := app.WebAuthn.Store.Get(identity.Email)
+	if err != nil {
+		return
+	}
+	register_begin_url, _ := app.Router.Get("webauthn_register_begin").URL()
+	register_finish_url, _ := app.Router.Get("webauthn_register_finish").URL()
+
+	ctx := make(map[string]interface{})
+	ctx["App"] = app
+	ctx["Email"] = identity.Email
+	if user != nil {
+		ctx["Credentials"] = user.Credentials
+	}
+	ctx["WebAuthnRegisterBegin"] = register_begin_url.String()
+	ctx["WebAuthnRegisterFinish"] = register_finish_url.String()
+	return app.Templates.ExecuteTemplate(w, "webauthn_registration.html", ctx)
+}
+
+// WebAuthnRegisterBeginHandler starts the registration of a WebAuthn
+// credential for the authenticated user: a challenge is stored in the
+// session and the options of navigator.credentials.create() are returned in
+// a JSON encoded response.
+func WebAuthnRegisterBeginHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.WebAuthn == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+	identity := GetSessionIdentity(session)
+	if identity == nil {
+		return writeJSONError(w, http.StatusForbidden, "not authenticated")
+	}
+
+	challenge, err := setWebAuthnChallenge(session, "webauthn.create")
+	if err != nil {
+		return
+	}
+	options, err := app.WebAuthn.CreationOptions(identity.Email, identity.DisplayName, challenge)
+	if err != nil {
+		return
+	}
+	session.Save(r, w)
+	return writeJSON(w, http.StatusOK, options)
+}
+
+// WebAuthnRegisterFinishHandler verifies the JSON encoded credential created
+// by the browser for the challenge of the session, and stores it with the
+// name given in the "name" parameter of the query string. Returns an HTTP
+// code 400 (Bad Request) if the credential is invalid.
+func WebAuthnRegisterFinishHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.WebAuthn == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+	identity := GetSessionIdentity(session)
+	if identity == nil {
+		return writeJSONError(w, http.StatusForbidden, "not authenticated")
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Security key"
+	}
+	challenge, response, message := readWebAuthnResponse(app, w, r, session, "webauthn.create")
+	if message == "" {
+		err = app.WebAuthn.FinishRegistration(identity.Email, challenge, response, name)
+		if err != nil {
+			if !IsCredentialsError(err) {
+				return
+			}
+			app.Logger.Warning("WebAuthn registration failed for '" + identity.Email + "': " + err.Error())
+			err = nil
+			message = "invalid credential"
+		} else {
+			app.Logger.Info("WebAuthn registration of '" + name + "' for '" + identity.Email + "'")
+		}
+	}
+	session.Save(r, w)
+
+	if message != "" {
+		return writeJSONError(w, http.StatusBadRequest, message)
+	}
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "okay"})
+}
+
+// WebAuthnLoginBeginHandler starts a WebAuthn authentication: a challenge is
+// stored in the session and the options of navigator.credentials.get() are
+// returned in a JSON encoded response. The credentials of the pending
+// identity of the session are allowed (second factor); without pending
+// identity, any discoverable credential is allowed if passwordless
+// authentication is enabled (an HTTP code 403 (Forbidden) is returned
+// otherwise).
+func WebAuthnLoginBeginHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.WebAuthn == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+	email := ""
+	if pending := GetSessionPendingIdentity(session); pending != nil {
+		email = pending.Email
+	} else if !app.WebAuthn.Passwordless {
+		return writeJSONError(w, http.StatusForbidden, "password required")
+	}
+	ip, throttled := checkRateLimit(app, w, r, map[string]interface{}{}, email)
+	if throttled {
+		return writeJSONError(w, http.StatusTooManyRequests, "too many attempts")
+	}
+	if app.RateLimiter != nil {
+		// the attempt is counted when the assertion is verified
+		app.RateLimiter.Release(ip, email)
+	}
+
+	challenge, err := setWebAuthnChallenge(session, "webauthn.get")
+	if err != nil {
+		return
+	}
+	options, err := app.WebAuthn.RequestOptions(email, challenge)
+	if err != nil {
+		if !IsCredentialsError(err) {
+			return
+		}
+		return writeJSONError(w, http.StatusBadRequest, "no credential")
+	}
+	session.Save(r, w)
+	return writeJSON(w, http.StatusOK, options)
+}
+
+// WebAuthnLoginFinishHandler verifies the JSON encoded assertion of the
+// browser for the challenge of the session. On success, the pending identity
+// becomes the identity of the session, or, for a passwordless
+// authentication, the owner of the credential is authenticated. Returns an
+// HTTP code 400 (Bad Request) if the assertion is invalid, the failures are
+// counted by the app RateLimiter.
+func WebAuthnLoginFinishHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.WebAuthn == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+	identity := GetSessionPendingIdentity(session)
+	email := ""
+	if identity != nil {
+		email = identity.Email
+	} else if !app.WebAuthn.Passwordless {
+		return writeJSONError(w, http.StatusForbidden, "password required")
+	}
+	ip, throttled := checkRateLimit(app, w, r, map[string]interface{}{}, email)
+	if throttled {
+		return writeJSONError(w, http.StatusTooManyRequests, "too many attempts")
+	}
+
+	challenge, response, message := readWebAuthnResponse(app, w, r, session, "webauthn.get")
+	if message != "" && app.RateLimiter != nil {
+		app.RateLimiter.Release(ip, email)
+	}
+	if message == "" {
+		owner, err := app.WebAuthn.FinishLogin(email, challenge, response)
+		if err != nil {
+			if !IsCredentialsError(err) {
+				if app.RateLimiter != nil {
+					app.RateLimiter.Release(ip, email)
+				}
+				return err
+			}
+			app.Logger.Warning("WebAuthn authentication failed for '" + email + "': " + err.Error())
+			message = "authentication failed"
+		} else {
+			// the authentication process is ok
+			if identity == nil {
+				identity = &Identity{Email: owner}
+			}
+			SetSessionPendingIdentity(session, nil, "")
+			SetSessionIdentity(session, identity, "")
+			if app.RateLimiter != nil {
+				app.RateLimiter.Release(ip, email)
+				app.RateLimiter.Succeed(owner)
+			}
+		}
+	}
+	session.Save(r, w)
+
+	if message != "" {
+		return writeJSONError(w, http.StatusBadRequest, message)
+	}
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "okay"})
+}
+
+// setWebAuthnChallenge stores a new challenge for the ceremony
+// ("webauthn.create" or "webauthn.get") in the session.
+func setWebAuthnChallenge(session *sessions.Session, ceremony string) ([]byte, error) {
+	challenge, err := NewWebAuthnChallenge()
+	if err != nil {
+		return nil, err
+	}
+	session.Values["webauthn_challenge"] = webAuthnEncoding.EncodeToString(challenge)
+	session.Values["webauthn_ceremony"] = ceremony
+	session.Values["webauthn_since"] = time.Now().Unix()
+	return challenge, nil
+}
+
+// readWebAuthnResponse returns the challenge of the ceremony, removed from
+// the session (a challenge is only used once), and the JSON encoded
+// credential sent by the browser. Returns an error message for the browser
+// if there is no challenge or if the credential is malformed.
+func readWebAuthnResponse(app *GorgonApp, w http.ResponseWriter, r *http.Request, session *sessions.Session, ceremony string) ([]byte, *WebAuthnCredentialResponse, string) {
+	challenge := takeWebAuthnChallenge(app, session, ceremony)
+	if challenge == nil {
+		return nil, nil, "no ceremony in progress"
+	}
+	response := &WebAuthnCredentialResponse{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, webAuthnMaxBodySize)).Decode(response); err != nil {
+		return nil, nil, "malformed credential"
+	}
+	return challenge, response, ""
+}
+
+// takeWebAuthnChallenge removes the challenge from the session and returns
+// it, or nil if there is no challenge for the ceremony or if it has expired.
+func takeWebAuthnChallenge(app *GorgonApp, session *sessions.Session, ceremony string) []byte {
+	encoded, _ := session.Values["webauthn_challenge"].(string)
+	current, _ := session.Values["webauthn_ceremony"].(string)
+	since, _ := session.Values["webauthn_since"].(int64)
+	delete(session.Values, "webauthn_challenge")
+	delete(session.Values, "webauthn_ceremony")
+	delete(session.Values, "webauthn_since")
+
+	if encoded == "" || current != ceremony || time.Since(time.Unix(since, 0)) > app.WebAuthn.Timeout {
+		return nil
+	}
+	challenge, err := webAuthnEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil
+	}
+	return challenge
+}
+
+// writeJSON writes v in a JSON encoded response with the HTTP code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	return nil
+}
+
+// writeJSONError writes an error message in a JSON encoded response with the
+// HTTP code.
+func writeJSONError(w http.ResponseWriter, status int, message string) error {
+	return writeJSON(w, status, map[string]string{"error": message})
+}
+
+// MagicLinkHandler authenticates the user who followed a magic link emailed
+// by AuthenticationHandler. The link (GET) only displays a confirmation page,
+// the token is used when the user submits it (POST): the mail scanners
+// following the links don't use them. A user who must pass a second factor
+// is redirected to the authentication page (or to the TOTP enrolment page).
+// Returns an HTTP code 403 (Forbidden) if the link is invalid, expired or
+// already used, or 404 (Not Found) if magic links are disabled.
+func MagicLinkHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.MagicLink == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+	ctx := make(map[string]interface{})
+	ctx["App"] = app
+
+	var email string
+	if r.Method == "POST" {
+		email, err = app.MagicLink.Verify(r.FormValue("token"))
+	} else {
+		email, err = app.MagicLink.Check(r.URL.Query().Get("token"))
+	}
+	if err != nil {
+		if !IsCredentialsError(err) {
+			return
+		}
+		app.Logger.Warning("Magic link refused: " + err.Error())
+		ctx["LinkError"] = true
+		w.WriteHeader(http.StatusForbidden)
+		return app.Templates.ExecuteTemplate(w, "magiclink.html", ctx)
+	}
+	if r.Method != "POST" {
+		magiclink_url, _ := app.Router.Get("magiclink").URL()
+		ctx["Confirm"] = true
+		ctx["Action"] = magiclink_url.String()
+		ctx["Token"] = r.URL.Query().Get("token")
+		ctx["Email"] = email
+		return app.Templates.ExecuteTemplate(w, "magiclink.html", ctx)
+	}
+
+	// the link replaces the password
+	SetSessionIdentity(session, nil, "")
+	SetSessionPendingIdentity(session, nil, "")
+	location, err := authenticateFirstFactor(app, session, ctx, &Identity{Email: email}, email)
+	if err != nil {
+		return
+	}
+	if location == "" && GetSessionPendingIdentity(session) != nil {
+		// the second factor is asked by the authentication page
+		authentication_url, _ := app.Router.Get("authentication").URL()
+		location = authentication_url.String()
+	}
+	session.Save(r, w)
+	if location != "" {
+		http.Redirect(w, r, location, http.StatusSeeOther)
+		return
+	}
+
+	ctx["Email"] = email
+	return app.Templates.ExecuteTemplate(w, "magiclink.html", ctx)
+}
+
+// oidcFor returns the OpenID Connect provider of the bridged domain, or
+// the provider of the IdP if domain is empty. Returns nil if there is no such
+// provider.
+func oidcFor(app *GorgonApp, domain string) *OIDC {
+	if domain == "" {
+		return app.OIDC
+	}
+	if app.Bridge != nil {
+		if bridged := app.Bridge.Domains[strings.ToLower(domain)]; bridged != nil {
+			return bridged.OIDC
+		}
+	}
+	return nil
+}
+
+// OIDCLoginHandler redirects the user to the OpenID Connect provider (of the
+// bridged domain given by the "domain" parameter), the state, the nonce and
+// the PKCE verifier of the authentication are kept in the session. Returns an
+// HTTP code 502 (Bad Gateway) if the provider can't be reached, or 404 (Not
+// Found) if the delegation is disabled.
+func OIDCLoginHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	domain := r.URL.Query().Get("domain")
+	provider := oidcFor(app, domain)
+	if provider == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+
+	values := map[string]string{}
+	for _, name := range []string{"oidc_state", "oidc_nonce", "oidc_verifier"} {
+		if values[name], err = NewOIDCSecret(); err != nil {
+			return
+		}
+	}
+	location, err := provider.AuthURL(values["oidc_state"], values["oidc_nonce"], values["oidc_verifier"])
+	if err != nil {
+		app.Logger.Error("Unable to reach the OIDC provider: " + err.Error())
+		return renderOIDCError(app, w, domain, http.StatusBadGateway)
+	}
+
+	for name, value := range values {
+		session.Values[name] = value
+	}
+	session.Values["oidc_domain"] = domain
+	session.Values["oidc_since"] = time.Now().Unix()
+	session.Save(r, w)
+	http.Redirect(w, r, location, http.StatusSeeOther)
+	return
+}
+
+// OIDCCallbackHandler authenticates the user coming back from the OpenID
+// Connect provider (of a bridged domain): the state must match the session,
+// and the ID token obtained with the code must be valid. The user is then
+// redirected to the authentication page (or to the TOTP enrolment page).
+// Returns an HTTP code 403 (Forbidden) if the authentication is refused, 502
+// (Bad Gateway) if the provider can't be reached, or 404 (Not Found) if the
+// delegation is disabled.
+func OIDCCallbackHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+	domain, _ := session.Values["oidc_domain"].(string)
+	provider := oidcFor(app, domain)
+	if provider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the values of the authentication are only used once
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	since, _ := session.Values["oidc_since"].(int64)
+	for _, name := range []string{"oidc_state", "oidc_nonce", "oidc_verifier", "oidc_since", "oidc_domain"} {
+		delete(session.Values, name)
+	}
+
+	query := r.URL.Query()
+	if state == "" || time.Since(time.Unix(since, 0)) > oidcLoginTimeout ||
+		!hmac.Equal([]byte(query.Get("state")), []byte(state)) {
+		session.Save(r, w)
+		app.Logger.Warning("OIDC authentication refused: no authentication in progress")
+		return renderOIDCError(app, w, domain, http.StatusForbidden)
+	}
+	if query.Get("error") != "" {
+		session.Save(r, w)
+		app.Logger.Warning("OIDC authentication refused by the provider: " + query.Get("error") + " " + query.Get("error_description"))
+		return renderOIDCError(app, w, domain, http.StatusForbidden)
+	}
+
+	identity, err := provider.Login(query.Get("code"), verifier, nonce)
+	if err != nil {
+		session.Save(r, w)
+		if IsCredentialsError(err) {
+			app.Logger.Warning("OIDC authentication refused: " + err.Error())
+			return renderOIDCError(app, w, domain, http.StatusForbidden)
+		}
+		app.Logger.Error("Unable to reach the OIDC provider: " + err.Error())
+		return renderOIDCError(app, w, domain, http.StatusBadGateway)
+	}
+
+	// the provider replaces the password
+	ctx := make(map[string]interface{})
+	SetSessionIdentity(session, nil, "")
+	SetSessionPendingIdentity(session, nil, "")
+	location, err := authenticateFirstFactor(app, session, ctx, identity, identity.Email)
+	if err != nil {
+		return
+	}
+	if location == "" {
+		authentication_url, _ := app.Router.Get("authentication").URL()
+		location = authentication_url.String()
+	}
+	session.Save(r, w)
+	http.Redirect(w, r, location, http.StatusSeeOther)
+	return
+}
+
+// renderOIDCError renders the page displayed when the OpenID Connect
+// authentication (for the bridged domain) fails, with the HTTP status code.
+func renderOIDCError(app *GorgonApp, w http.ResponseWriter, domain string, status int) error {
+	oidc_login_url, _ := app.Router.Get("oidc_login").URL()
+	provider := oidcFor(app, domain)
+	ctx := map[string]interface{}{
+		"App":           app,
+		"ProviderError": status == http.StatusBadGateway,
+		"OIDCLogin":     oidc_login_url.String(),
+		"OIDCDomain":    domain,
+		"OIDCName":      provider.Name,
+		"Domain":        provider.Domain,
+	}
+	w.WriteHeader(status)
+	return app.Templates.ExecuteTemplate(w, "oidc.html", ctx)
+}
+
+// SAMLMetadataHandler returns the metadata of Gorgon as a SAML service
+// provider, to register it at the IdP. Returns an HTTP code 404 (Not Found) if
+// the delegation is disabled.
+func SAMLMetadataHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.SAML == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, err = w.Write(app.SAML.Metadata())
+	return
+}
+
+// SAMLLoginHandler redirects the user to the SAML IdP with an AuthnRequest,
+// the identifier of the request is kept in the session, in the signed
+// RelayState and in the samlRequestCookie cookie. Returns an HTTP code 404
+// (Not Found) if the delegation is disabled.
+func SAMLLoginHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.SAML == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+
+	id, err := NewSAMLRequestID()
+	if err != nil {
+		return
+	}
+	relayState, err := app.SAML.RelayState(id)
+	if err != nil {
+		return
+	}
+	location, err := app.SAML.AuthnRequestURL(id, relayState)
+	if err != nil {
+		return
+	}
+
+	session.Values["saml_request_id"] = id
+	session.Values["saml_since"] = time.Now().Unix()
+	session.Save(r, w)
+	setSAMLRequestCookie(app, w, id, int(samlLoginTimeout/time.Second))
+	http.Redirect(w, r, location, http.StatusSeeOther)
+	return
+}
+
+// setSAMLRequestCookie sets the samlRequestCookie cookie to the identifier
+// of the AuthnRequest, for maxAge seconds (a negative maxAge removes it).
+func setSAMLRequestCookie(app *GorgonApp, w http.ResponseWriter, id string, maxAge int) {
+	acs_url, _ := app.Router.Get("saml_acs").URL()
+	http.SetCookie(w, &http.Cookie{
+		Name:     samlRequestCookie,
+		Value:    id,
+		Path:     acs_url.Path,
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+// SAMLACSHandler authenticates the user with the response posted by the SAML
+// IdP (assertion consumer service): the response must answer the
+// AuthnRequest of the session, or, when the browser doesn't send the session
+// cookie, the AuthnRequest of the RelayState started by the same browser (the
+// samlRequestCookie cookie, against login CSRF), and its assertion be valid.
+// The user is then redirected to the authentication page (or to the TOTP
+// enrolment page).
+// Returns an HTTP code 403 (Forbidden) if the authentication is refused, or
+// 404 (Not Found) if the delegation is disabled.
+func SAMLACSHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
+	if app.SAML == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := app.SessionStore.Get(r, "persona-auth")
+
+	// the request is only answered once
+	id, _ := session.Values["saml_request_id"].(string)
+	since, _ := session.Values["saml_since"].(int64)
+	delete(session.Values, "saml_request_id")
+	delete(session.Values, "saml_since")
+	if id == "" {
+		relay_id, relay_since, ok := app.SAML.ParseRelayState(r.FormValue("RelayState"))
+		cookie, cookie_err := r.Cookie(samlRequestCookie)
+		if ok && cookie_err == nil && hmac.Equal([]byte(cookie.Value), []byte(relay_id)) {
+			id, since = relay_id, relay_since
+		}
+	}
+	setSAMLRequestCookie(app, w, "", -1)
+
+	if id == "" || time.Since(time.Unix(since, 0)) > samlLoginTimeout {
+		session.Save(r, w)
+		app.Logger.Warning("SAML authentication refused: no authentication in progress")
+		return renderSAMLError(app, w, http.StatusForbidden)
+	}
+	identity, err := app.SAML.Login(r.FormValue("SAMLResponse"), id)
+	if err != nil {
+		session.Save(r, w)
+		app.Logger.Warning("SAML authentication refused: " + err.Error())
+		return renderSAMLError(app, w, http.StatusForbidden)
+	}
+
+	// the IdP replaces the password
+	ctx := make(map[string]interface{})
+	SetSessionIdentity(session, nil, "")
+	SetSessionPendingIdentity(session, nil, "")
+	location, err := authenticateFirstFactor(app, session, ctx, identity, identity.Email)
+	if err != nil {
+		return
+	}
+	if location == "" {
+		authentication_url, _ := app.Router.Get("authentication").URL()
+		location = authentication_url.String()
+	}
+	session.Save(r, w)
+	http.Redirect(w, r, location, http.StatusSeeOther)
+	return
+}
+
+// renderSAMLError renders the page displayed when the SAML authentication
+// fails, with the HTTP status code.
+func renderSAMLError(app *GorgonApp, w http.ResponseWriter, status int) error {
+	saml_login_url, _ := app.Router.Get("saml_login").URL()
+	ctx := map[string]interface{}{
+		"App":       app,
+		"SAMLLogin": saml_login_url.String(),
+		"SAMLName":  app.SAML.Name,
+	}
+	w.WriteHeader(status)
+	return app.Templates.ExecuteTemplate(w, "saml.html", ctx)
+}
+
 // ProvisioningHandler returns the content of hidden iframe. The content
 // depends if the user have an active session or not.
 func ProvisioningHandler(app *GorgonApp, w http.ResponseWriter, r *http.Request) (err error) {
@@ -153,8 +1223,24 @@ func GenerateCertificateHandler(app *GorgonApp, w http.ResponseWriter, r *http.R
 		return
 	}
 
+	// the browsers generate RSA ("RS") or DSA ("DS") keys
+	if pubkey["algorithm"] != "RS" && pubkey["algorithm"] != "DS" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	// with all theses informations, we can now generate a certificate
-	certificate, err := CreateCertificate(app.PrivateKey, app.PublicKey, email, cert_duration, pubkey, app.Domain)
+	// the certificates of the bridged addresses are issued by the bridge,
+	// with its own keys when it is another authority
+	identity := GetSessionIdentity(session)
+	issuer, private_key, public_key := app.Domain, app.PrivateKey, app.PublicKey
+	if app.Bridge != nil && app.Bridge.Domain(email) != nil && app.Bridge.Issuer != app.Domain {
+		issuer, private_key, public_key = app.Bridge.Issuer, app.Bridge.PrivateKey, app.Bridge.PublicKey
+		if private_key == nil {
+			return errors.New("the private key of the bridge issuer '" + issuer + "' is missing")
+		}
+	}
+	certificate, err := CreateCertificate(private_key, public_key, identity, cert_duration, pubkey, issuer)
 	if err != nil {
 		if _, ok := err.(*CertDurationError); ok {
 			app.Logger.Warning(err.Error())
@@ -183,3 +1269,76 @@ func CheckAuthenticatedHandler(app *GorgonApp, w http.ResponseWriter, r *http.Re
 
 	return
 }
+
+// SetSessionIdentity stores the identity of the authenticated user in the
+// session. The username is used when the identity has no email. A nil
+// identity removes the identity from the session.
+func SetSessionIdentity(session *sessions.Session, identity *Identity, username string) {
+	setSessionIdentity(session, "", identity, username)
+}
+
+// SetSessionPendingIdentity stores the identity of a user who passed the
+// first authentication factor (the password) and must pass the second one
+// (TOTP or WebAuthn), see SetSessionIdentity. The pending identity expires after
+// pendingIdentityLifetime.
+func SetSessionPendingIdentity(session *sessions.Session, identity *Identity, username string) {
+	setSessionIdentity(session, "pending_", identity, username)
+	delete(session.Values, "pending_failures")
+	if identity == nil {
+		delete(session.Values, "pending_since")
+	} else {
+		session.Values["pending_since"] = time.Now().Unix()
+	}
+}
+
+// setSessionIdentity stores an identity in the session, the keys are
+// prefixed by the prefix.
+func setSessionIdentity(session *sessions.Session, prefix string, identity *Identity, username string) {
+	delete(session.Values, prefix+"authenticated_as")
+	delete(session.Values, prefix+"display_name")
+	delete(session.Values, prefix+"groups")
+	if identity == nil {
+		return
+	}
+
+	email := identity.Email
+	if email == "" {
+		email = username
+	}
+	session.Values[prefix+"authenticated_as"] = email
+	if identity.DisplayName != "" {
+		session.Values[prefix+"display_name"] = identity.DisplayName
+	}
+	if len(identity.Groups) > 0 {
+		session.Values[prefix+"groups"] = identity.Groups
+	}
+}
+
+// GetSessionIdentity returns the identity of the authenticated user stored in
+// the session, or nil if the user is not authenticated.
+func GetSessionIdentity(session *sessions.Session) *Identity {
+	return getSessionIdentity(session, "")
+}
+
+// GetSessionPendingIdentity returns the pending identity stored in the
+// session, or nil if there is no pending identity or if it has expired.
+func GetSessionPendingIdentity(session *sessions.Session) *Identity {
+	since, ok := session.Values["pending_since"].(int64)
+	if !ok || time.Since(time.Unix(since, 0)) > pendingIdentityLifetime {
+		return nil
+	}
+	return getSessionIdentity(session, "pending_")
+}
+
+// getSessionIdentity returns the identity stored in the session with the
+// prefixed keys.
+func getSessionIdentity(session *sessions.Session, prefix string) *Identity {
+	email, ok := session.Values[prefix+"authenticated_as"].(string)
+	if !ok {
+		return nil
+	}
+	identity := &Identity{Email: email}
+	identity.DisplayName, _ = session.Values[prefix+"display_name"].(string)
+	identity.Groups, _ = session.Values[prefix+"groups"].([]string)
+	return identity
+}
@@ -2,23 +2,44 @@ package app
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
 	"github.com/stretchr/testify/assert"
 )
 
 func GetAuthCookie(username string, codecs ...securecookie.Codec) (*http.Cookie, error) {
+	return GetIdentityCookie(&Identity{Email: username}, codecs...)
+}
+
+func GetIdentityCookie(identity *Identity, codecs ...securecookie.Codec) (*http.Cookie, error) {
 	var authCookie http.Cookie
 	decodedValue := make(map[interface{}]interface{})
-	decodedValue["authenticated_as"] = username
+	decodedValue["authenticated_as"] = identity.Email
+	if identity.DisplayName != "" {
+		decodedValue["display_name"] = identity.DisplayName
+	}
+	if len(identity.Groups) > 0 {
+		decodedValue["groups"] = identity.Groups
+	}
 	encodedValue, err := securecookie.EncodeMulti("persona-auth", decodedValue, codecs...)
 	if err != nil {
 		return nil, err
@@ -69,6 +90,20 @@ func TestSupportDocumentHandler(t *testing.T) {
 	assert.Equal(t, publicKey["n"], "23889456486321623473918665255343177635128710173157669424372875359372320736455301355970875593938909218087760986617640898578679844226631652037745248513549355637358220697959372250835697775454508812368942374589593646559767646333952478128009848675984203746915093496186538141115897660344039231014275918654719281984603972728249059019777484941535089356009107883030164047835349598045162040165036179729458456956010346765443578628841250841421231205777808469647531245961509586074089345598248954243867408603319475227403111600221142603559700387465893230884454715818763876460572694605425473855790697450998747164996944357297066585551",
 		"The public key modulus must match the modulus of the public key in the tests/ folder",
 	)
+
+	// TEST: a DSA key
+	app.PublicKey, app.PrivateKey = loadTestKeys(t, "ds256-")
+	w = httptest.NewRecorder()
+	handle.ServeHTTP(w, req)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &supportDocument))
+	publicKey = supportDocument["public-key"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"algorithm": "DS",
+		"p":         app.PublicKey.DSA.P.Text(16),
+		"q":         app.PublicKey.DSA.Q.Text(16),
+		"g":         app.PublicKey.DSA.G.Text(16),
+		"y":         app.PublicKey.DSA.Y.Text(16),
+	}, publicKey)
 }
 
 func TestProvisioningPageHandler(t *testing.T) {
@@ -124,8 +159,9 @@ func TestProvisioningPageHandler(t *testing.T) {
 }
 
 func TestAuthenticationPageHandler(t *testing.T) {
-	// create our app
+	// create our app, for the addresses of example.com
 	app := NewApp("../tests/gorgon.ini")
+	app.Domain = "example.com"
 
 	// the handle that will be tested
 	handle := GorgonHandler{&app, AuthenticationHandler}
@@ -234,6 +270,1060 @@ func TestAuthenticationPageHandler(t *testing.T) {
 	)
 }
 
+func TestAuthenticationHandlerRateLimit(t *testing.T) {
+	// create our app, with a backend rejecting all the passwords
+	app := NewApp("../tests/gorgon.ini")
+	var calls int
+	app.Authenticator = NewContextAuthenticator(stubAuthenticator{CredentialsError{"bad password"}, &calls})
+	app.RateLimiter = NewRateLimiter(2, 10, 10, 10, time.Minute, time.Hour, time.Hour, time.Hour)
+
+	// the handle that will be tested
+	handle := GorgonHandler{&app, AuthenticationHandler}
+
+	post := func() *httptest.ResponseRecorder {
+		data := url.Values{}
+		data.Set("email", "user@example.com")
+		data.Add("password", "badpassword")
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handle.ServeHTTP(w, req)
+		return w
+	}
+
+	// TEST: the free attempts reach the authenticator
+	for i := 0; i < 2; i++ {
+		w := post()
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "Authentication failed!")
+	}
+	assert.Equal(t, 2, calls)
+
+	// TEST: the next attempt is throttled
+	w := post()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	body := w.Body.String()
+	assert.Contains(t, body, "Too many attempts!",
+		"The rate limit message must be displayed",
+	)
+	assert.Contains(t, body, "<form method=\"POST\">",
+		"The authentication page must display the form",
+	)
+	assert.NotContains(t, body, "Authentication failed!")
+	assert.Equal(t, 2, calls, "The authenticator must not be called")
+
+	// TEST: hard errors of the backend are not counted
+	app.Authenticator = NewContextAuthenticator(stubAuthenticator{errors.New("connection refused"), &calls})
+	app.RateLimiter = NewRateLimiter(1, 10, 10, 10, time.Minute, time.Hour, time.Hour, time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, post().Code)
+	}
+	assert.Len(t, app.RateLimiter.failures, 0, "The attempts must be released")
+}
+
+func TestAuthenticationHandlerIdentityDomain(t *testing.T) {
+	// create our app, the backend returns the identity of another user
+	app := NewApp("../tests/gorgon.ini")
+	handle := GorgonHandler{&app, AuthenticationHandler}
+	post := func(identity *Identity) *httptest.ResponseRecorder {
+		app.Authenticator = identityAuthenticator{identity}
+		data := url.Values{"email": {"user@test.example.com"}, "password": {"secretpasswordfortests"}}
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handle.ServeHTTP(w, req)
+		return w
+	}
+	authenticatedAs := func(w *httptest.ResponseRecorder) interface{} {
+		cookie := getSessionCookie(w)
+		decodedValue := make(map[interface{}]interface{})
+		err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &decodedValue, app.SessionStore.Codecs...)
+		assert.NoError(t, err)
+		return decodedValue["authenticated_as"]
+	}
+
+	// TEST: the address returned by the backend must be an address of the
+	// domain of the IdP
+	w := post(&Identity{Email: "alice@other.com"})
+	assert.Contains(t, w.Body.String(), "Authentication failed!")
+	assert.Nil(t, authenticatedAs(w))
+	w = post(&Identity{Email: "alice@sub.test.example.com"})
+	assert.Nil(t, authenticatedAs(w))
+
+	// TEST: another address of the domain
+	w = post(&Identity{Email: "alice@Test.Example.com"})
+	assert.Equal(t, "alice@Test.Example.com", authenticatedAs(w))
+
+	// TEST: no identity, the username is the address
+	w = post(nil)
+	assert.Equal(t, "user@test.example.com", authenticatedAs(w))
+}
+
+// clientAuthenticator is a ContextAuthenticator accepting any password and
+// recording the client of the last authentication.
+type clientAuthenticator struct {
+	client *AuthClient
+}
+
+func (a clientAuthenticator) Authenticate(username, password string) error {
+	return nil
+}
+
+func (a clientAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*Identity, error) {
+	*a.client = AuthClientFromContext(ctx)
+	return &Identity{Email: username}, nil
+}
+
+func TestAuthenticationHandlerClient(t *testing.T) {
+	// create our app, the backend records the client
+	app := NewApp("../tests/gorgon.ini")
+	var client AuthClient
+	app.Authenticator = clientAuthenticator{&client}
+	handle := GorgonHandler{&app, AuthenticationHandler}
+	post := func(state *tls.ConnectionState) {
+		data := url.Values{"email": {"user@test.example.com"}, "password": {"secretpasswordfortests"}}
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.TLS = state
+		handle.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// TEST: the IP address of the client is passed to the backend
+	post(nil)
+	assert.Equal(t, AuthClient{IP: "192.0.2.1"}, client)
+
+	// TEST: the client is connected with TLS
+	post(&tls.ConnectionState{})
+	assert.Equal(t, AuthClient{IP: "192.0.2.1", Secured: true}, client)
+
+	// TEST: without rate limit, the remote address is used
+	app.RateLimiter = nil
+	post(nil)
+	assert.Equal(t, AuthClient{IP: "192.0.2.1"}, client)
+}
+
+// getSessionCookie returns the "persona-auth" cookie set by a handler.
+func getSessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	resp := http.Response{Header: w.Header()}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "persona-auth" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestAuthenticationHandlerTOTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorgon-totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// create our app, for the addresses of example.com, TOTP is required for
+	// the users of required.example.com
+	app := NewApp("../tests/gorgon.ini")
+	app.Domain = "example.com"
+	app.TOTP = NewTOTP(&TOTPStore{Path: filepath.Join(dir, "totp.json")}, "test.example.com", []string{"@required.example.com"}, 1)
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	key, _ := DecodeTOTPSecret(secret)
+	code := func() string {
+		return HOTPCode(key, uint64(time.Now().Unix()/30), 6)
+	}
+	assert.NoError(t, app.TOTP.Store.Update("user@example.com", func(record *TOTPRecord) error {
+		record.Secret = secret
+		return nil
+	}))
+
+	// the handles that will be tested
+	handle := GorgonHandler{&app, AuthenticationHandler}
+	enrollment := GorgonHandler{&app, TOTPEnrollmentHandler}
+
+	post := func(handle GorgonHandler, cookie *http.Cookie, data url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handle.ServeHTTP(w, req)
+		return w
+	}
+	authenticatedAs := func(cookie *http.Cookie) interface{} {
+		decodedValue := make(map[interface{}]interface{})
+		err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &decodedValue, app.SessionStore.Codecs...)
+		assert.NoError(t, err)
+		return decodedValue["authenticated_as"]
+	}
+
+	// TEST: an enrolled user must enter a code after the password
+	w := post(handle, nil, url.Values{"email": {"user@example.com"}, "password": {"secretpasswordfortests"}})
+	body := w.Body.String()
+	assert.Contains(t, body, "<input id=\"input_totp_code\" type=\"text\" name=\"totp_code\"",
+		"The authentication page must display a form with a code field",
+	)
+	assert.NotContains(t, body, "navigator.id.completeAuthentication")
+	cookie := getSessionCookie(w)
+	assert.Nil(t, authenticatedAs(cookie), "The user must not be authenticated yet")
+
+	// TEST: submit a bad code
+	w = post(handle, cookie, url.Values{"step": {"totp"}, "totp_code": {"000000"}})
+	body = w.Body.String()
+	assert.Contains(t, body, "Your authentication code is invalid")
+	assert.Contains(t, body, "name=\"totp_code\"")
+	cookie = getSessionCookie(w)
+	assert.Nil(t, authenticatedAs(cookie))
+
+	// TEST: submit the good code
+	w = post(handle, cookie, url.Values{"step": {"totp"}, "totp_code": {code()}})
+	assert.Contains(t, w.Body.String(), "navigator.id.completeAuthentication",
+		"completeAuthentication must be called",
+	)
+	assert.Equal(t, "user@example.com", authenticatedAs(getSessionCookie(w)))
+
+	// TEST: the code step without a password step
+	w = post(handle, nil, url.Values{"step": {"totp"}, "totp_code": {code()}})
+	assert.Contains(t, w.Body.String(), "Your email address or your password is invalid.")
+
+	// TEST: after too many bad codes, the password must be entered again,
+	// even without rate limit
+	rateLimiter := app.RateLimiter
+	app.RateLimiter = nil
+	w = post(handle, nil, url.Values{"email": {"user@example.com"}, "password": {"secretpasswordfortests"}})
+	cookie = getSessionCookie(w)
+	for i := 0; i < pendingIdentityMaxFailures; i++ {
+		w = post(handle, cookie, url.Values{"step": {"totp"}, "totp_code": {"000000"}})
+		cookie = getSessionCookie(w)
+	}
+	assert.Contains(t, w.Body.String(), "Your email address or your password is invalid.")
+	assert.NotContains(t, w.Body.String(), "name=\"totp_code\"")
+	w = post(handle, cookie, url.Values{"step": {"totp"}, "totp_code": {code()}})
+	assert.NotContains(t, w.Body.String(), "navigator.id.completeAuthentication")
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+	app.RateLimiter = rateLimiter
+
+	// TEST: a user not enrolled and not forced to use TOTP
+	w = post(handle, nil, url.Values{"email": {"other@example.com"}, "password": {"secretpasswordfortests"}})
+	assert.Contains(t, w.Body.String(), "navigator.id.completeAuthentication")
+
+	// TEST: a user forced to use TOTP is redirected to the enrolment page
+	app.Domain = "required.example.com"
+	w = post(handle, nil, url.Values{"email": {"bob@required.example.com"}, "password": {"secretpasswordfortests"}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/.well-known/browserid/_gorgon/totp", w.Header().Get("Location"))
+	cookie = getSessionCookie(w)
+	assert.Nil(t, authenticatedAs(cookie))
+
+	// the enrolment page displays a QR code and the secret
+	req, _ := http.NewRequest("GET", "", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	enrollment.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body = w.Body.String()
+	assert.Contains(t, body, "src=\"data:image/png;base64,")
+	matches := regexp.MustCompile(`id="totp_secret" class="secret">([A-Z2-7]+)<`).FindStringSubmatch(body)
+	if !assert.Len(t, matches, 2, "The secret must be displayed") {
+		return
+	}
+	bobKey, _ := DecodeTOTPSecret(matches[1])
+	cookie = getSessionCookie(w)
+
+	// the secret is stored once the user entered a valid code
+	w = post(enrollment, cookie, url.Values{"totp_code": {"000000"}})
+	assert.Contains(t, w.Body.String(), "Enrolment failed!")
+	cookie = getSessionCookie(w)
+	w = post(enrollment, cookie, url.Values{"totp_code": {HOTPCode(bobKey, uint64(time.Now().Unix()/30), 6)}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/.well-known/browserid/_gorgon/authentication", w.Header().Get("Location"))
+	assert.Equal(t, "bob@required.example.com", authenticatedAs(getSessionCookie(w)))
+	enrolled, err := app.TOTP.Enrolled("bob@required.example.com")
+	assert.NoError(t, err)
+	assert.True(t, enrolled)
+
+	// TEST: the enrolment page needs a session
+	req, _ = http.NewRequest("GET", "", nil)
+	w = httptest.NewRecorder()
+	enrollment.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// TEST: a password is not enough to replace a secret
+	app.Domain = "example.com"
+	w = post(handle, nil, url.Values{"email": {"user@example.com"}, "password": {"secretpasswordfortests"}})
+	req, _ = http.NewRequest("GET", "", nil)
+	req.AddCookie(getSessionCookie(w))
+	w = httptest.NewRecorder()
+	enrollment.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// TEST: the enrolment page does not exist when TOTP is disabled
+	app.TOTP = nil
+	req, _ = http.NewRequest("GET", "", nil)
+	w = httptest.NewRecorder()
+	enrollment.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWebAuthnHandlers(t *testing.T) {
+	// create our app, for the addresses of example.com, WebAuthn is enabled
+	// with the passwordless authentication, alice has a credential
+	app := NewApp("../tests/gorgon.ini")
+	app.Domain = "example.com"
+	webauthn, cleanup := newTestWebAuthn(t, true)
+	defer cleanup()
+	app.WebAuthn = webauthn
+	alice := registerSoftAuthenticator(t, webauthn, "user@example.com")
+
+	// the handles that will be tested
+	handle := GorgonHandler{&app, AuthenticationHandler}
+	registration := GorgonHandler{&app, WebAuthnRegistrationHandler}
+	registerBegin := GorgonHandler{&app, WebAuthnRegisterBeginHandler}
+	registerFinish := GorgonHandler{&app, WebAuthnRegisterFinishHandler}
+	loginBegin := GorgonHandler{&app, WebAuthnLoginBeginHandler}
+	loginFinish := GorgonHandler{&app, WebAuthnLoginFinishHandler}
+
+	serve := func(handle GorgonHandler, method, target string, cookie *http.Cookie, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, target, bytes.NewBuffer(body))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handle.ServeHTTP(w, req)
+		return w
+	}
+	postJSON := func(handle GorgonHandler, target string, cookie *http.Cookie, v interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(v)
+		return serve(handle, "POST", target, cookie, body)
+	}
+	authenticatedAs := func(cookie *http.Cookie) interface{} {
+		decodedValue := make(map[interface{}]interface{})
+		err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &decodedValue, app.SessionStore.Codecs...)
+		assert.NoError(t, err)
+		return decodedValue["authenticated_as"]
+	}
+
+	// TEST: a user with a credential must use it after the password
+	data := url.Values{"email": {"user@example.com"}, "password": {"secretpasswordfortests"}}
+	req, _ := http.NewRequest("POST", "", bytes.NewBufferString(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handle.ServeHTTP(w, req)
+	body := w.Body.String()
+	assert.Contains(t, body, "<button id=\"btn_webauthn\" type=\"button\">Use your security key</button>")
+	assert.Contains(t, body, "/.well-known/browserid/_gorgon/webauthn/login/begin")
+	assert.NotContains(t, body, "name=\"totp_code\"")
+	assert.NotContains(t, body, "navigator.id.completeAuthentication")
+	cookie := getSessionCookie(w)
+	assert.Nil(t, authenticatedAs(cookie), "The user must not be authenticated yet")
+
+	// the options allow the credential of the user
+	w = serve(loginBegin, "POST", "", cookie, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var options WebAuthnRequestOptions
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &options))
+	assert.Equal(t, []WebAuthnCredentialDescriptor{{Type: "public-key", ID: alice.id()}}, options.AllowCredentials)
+	cookie = getSessionCookie(w)
+
+	// an invalid assertion is refused
+	w = postJSON(loginFinish, "", cookie, alice.get(&options, "https://evil.example.com"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "\"error\"")
+
+	// the challenge is only used once
+	w = postJSON(loginFinish, "", getSessionCookie(w), alice.get(&options, "https://example.com"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "no ceremony in progress")
+
+	// a valid assertion authenticates the user
+	w = postJSON(loginFinish, "", cookie, alice.get(&options, "https://example.com"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "okay"}`, w.Body.String())
+	assert.Equal(t, "user@example.com", authenticatedAs(getSessionCookie(w)))
+
+	// TEST: the passwordless authentication
+	w = serve(loginBegin, "POST", "", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	options = WebAuthnRequestOptions{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &options))
+	assert.Empty(t, options.AllowCredentials)
+	w = postJSON(loginFinish, "", getSessionCookie(w), alice.get(&options, "https://example.com"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "user@example.com", authenticatedAs(getSessionCookie(w)))
+
+	// the passwordless authentication can be disabled
+	webauthn.Passwordless = false
+	w = serve(loginBegin, "POST", "", nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serve(handle, "GET", "", nil, nil)
+	assert.NotContains(t, w.Body.String(), "btn_webauthn\"")
+
+	// TEST: a password is not enough to enroll in TOTP
+	dir, err := ioutil.TempDir("", "gorgon-totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	app.TOTP = NewTOTP(&TOTPStore{Path: filepath.Join(dir, "totp.json")}, "test.example.com", []string{"*"}, 1)
+	req, _ = http.NewRequest("POST", "", bytes.NewBufferString(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	handle.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "A credential satisfies the TOTP policy")
+	w = serve(GorgonHandler{&app, TOTPEnrollmentHandler}, "GET", "", getSessionCookie(w), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	app.TOTP = nil
+
+	// TEST: an authenticated user registers a new credential
+	w = serve(registration, "GET", "", nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serve(registerBegin, "POST", "", nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	cookie, _ = GetAuthCookie("user@example.com", app.SessionStore.Codecs...)
+	w = serve(registerBegin, "POST", "", cookie, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var creationOptions WebAuthnCreationOptions
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &creationOptions))
+	assert.Equal(t, []WebAuthnCredentialDescriptor{{Type: "public-key", ID: alice.id()}}, creationOptions.ExcludeCredentials)
+	laptop := newSoftAuthenticator(t)
+	w = postJSON(registerFinish, "?name=Laptop", getSessionCookie(w), laptop.create(&creationOptions, "https://example.com", "none"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "okay"}`, w.Body.String())
+
+	w = serve(registration, "GET", "", cookie, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<li>Laptop (registered on ")
+	assert.Contains(t, w.Body.String(), "/.well-known/browserid/_gorgon/webauthn/register/begin")
+
+	// TEST: the endpoints do not exist when WebAuthn is disabled
+	app.WebAuthn = nil
+	for _, handle := range []GorgonHandler{registration, registerBegin, registerFinish, loginBegin, loginFinish} {
+		w = serve(handle, "POST", "", nil, nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+}
+
+func TestMagicLinkHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorgon-magiclink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// create our app, the links are sent through a stand-in SMTP server,
+	// TOTP is enabled for second@test.example.com
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+	s := newSmtpServer(t, serverConfig, false, "STARTTLS")
+	defer s.Close()
+	app := NewApp("../tests/gorgon.ini")
+	app.MagicLink = NewMagicLink([]byte("secret"), s.Addr(), "starttls", clientConfig, "gorgon@test.example.com", "test.example.com", "https://test.example.com", 15*time.Minute)
+	app.TOTP = NewTOTP(&TOTPStore{Path: filepath.Join(dir, "totp.json")}, "test.example.com", nil, 1)
+	assert.NoError(t, app.TOTP.Store.Update("second@test.example.com", func(record *TOTPRecord) error {
+		record.Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+		return nil
+	}))
+
+	// the handles that will be tested
+	handle := GorgonHandler{&app, AuthenticationHandler}
+	magicLink := GorgonHandler{&app, MagicLinkHandler}
+
+	serve := func(handle GorgonHandler, method, target string, cookie *http.Cookie, data url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, target, bytes.NewBufferString(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handle.ServeHTTP(w, req)
+		return w
+	}
+	authenticatedAs := func(cookie *http.Cookie) interface{} {
+		decodedValue := make(map[interface{}]interface{})
+		err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &decodedValue, app.SessionStore.Codecs...)
+		assert.NoError(t, err)
+		return decodedValue["authenticated_as"]
+	}
+	lastLink := func() string {
+		messages := s.Messages()
+		if len(messages) == 0 {
+			t.Fatal("no message sent")
+		}
+		return magicLinkFromMessage(t, messages[len(messages)-1]).RequestURI()
+	}
+	// confirm posts the token of the link from the confirmation page
+	confirm := func(link string) *httptest.ResponseRecorder {
+		u, _ := url.Parse(link)
+		return serve(magicLink, "POST", u.Path, nil, url.Values{"token": {u.Query().Get("token")}})
+	}
+
+	// TEST: the authentication page proposes a link
+	w := serve(handle, "GET", "", nil, nil)
+	assert.Contains(t, w.Body.String(), "id=\"btn_magiclink\"")
+
+	// TEST: ask for a link, the page waits for the session
+	w = serve(handle, "POST", "", nil, url.Values{"email": {"user@test.example.com"}, "step": {"magiclink"}})
+	body := w.Body.String()
+	assert.Contains(t, body, "Check your mailbox!")
+	assert.Contains(t, body, "/.well-known/browserid/_gorgon/is_authenticated")
+	assert.NotContains(t, body, "navigator.id.completeAuthentication")
+	if !assert.Len(t, s.Messages(), 1, "The link must be sent") {
+		return
+	}
+	assert.Equal(t, []string{"user@test.example.com"}, s.Messages()[0].To)
+	link := lastLink()
+
+	// TEST: following the link displays a confirmation page, the link is
+	// not used (the mail scanners follow the links)
+	for i := 0; i < 2; i++ {
+		w = serve(magicLink, "GET", link, nil, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		body = w.Body.String()
+		assert.Contains(t, body, "Sign in to test.example.com as <strong>user@test.example.com</strong>?")
+		assert.Contains(t, body, "<form method=\"POST\" action=\"/.well-known/browserid/_gorgon/magiclink\">")
+		u, _ := url.Parse(link)
+		assert.Contains(t, body, "name=\"token\" value=\""+u.Query().Get("token")+"\"")
+		assert.NotContains(t, body, "You are now signed in")
+		if cookie := getSessionCookie(w); cookie != nil {
+			assert.Nil(t, authenticatedAs(cookie))
+		}
+	}
+
+	// TEST: confirm the link
+	w = confirm(link)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "You are now signed in as user@test.example.com")
+	cookie := getSessionCookie(w)
+	assert.Equal(t, "user@test.example.com", authenticatedAs(cookie))
+
+	// the authentication page completes the authentication
+	w = serve(handle, "GET", "", cookie, nil)
+	assert.Contains(t, w.Body.String(), "navigator.id.completeAuthentication")
+
+	// TEST: a link can only be used once
+	w = confirm(link)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "Sign-in failed!")
+	w = serve(magicLink, "GET", link, nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// TEST: a forged link
+	w = serve(magicLink, "GET", "/.well-known/browserid/_gorgon/magiclink?token=abc.def", nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = confirm("/.well-known/browserid/_gorgon/magiclink?token=abc.def")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// TEST: asking for a link removes the identity of the session
+	w = serve(handle, "POST", "", cookie, url.Values{"email": {"second@test.example.com"}, "step": {"magiclink"}})
+	assert.Contains(t, w.Body.String(), "Check your mailbox!")
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+
+	// TEST: the second factor is asked after the link
+	w = confirm(lastLink())
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/.well-known/browserid/_gorgon/authentication", w.Header().Get("Location"))
+	cookie = getSessionCookie(w)
+	assert.Nil(t, authenticatedAs(cookie))
+	w = serve(handle, "GET", "", cookie, nil)
+	body = w.Body.String()
+	assert.Contains(t, body, "Authentication code for second@test.example.com")
+	key, _ := DecodeTOTPSecret("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	w = serve(handle, "POST", "", cookie, url.Values{"step": {"totp"}, "totp_code": {HOTPCode(key, uint64(time.Now().Unix()/30), 6)}})
+	assert.Contains(t, w.Body.String(), "navigator.id.completeAuthentication")
+	assert.Equal(t, "second@test.example.com", authenticatedAs(getSessionCookie(w)))
+
+	// TEST: no link is sent to the addresses of other domains
+	w = serve(handle, "POST", "", nil, url.Values{"email": {"user@example.com"}, "step": {"magiclink"}})
+	assert.Contains(t, w.Body.String(), "No sign-in link can be sent to this email address.")
+	assert.Len(t, s.Messages(), 2)
+
+	// TEST: the links are disabled
+	app.MagicLink = nil
+	w = serve(handle, "GET", "", nil, nil)
+	assert.NotContains(t, w.Body.String(), "id=\"btn_magiclink\"")
+	w = serve(magicLink, "GET", link, nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAuthenticationHandlerClientCert(t *testing.T) {
+	// create our app, the client certificates are read from the TLS
+	// connection
+	ca := newTestCA(t, "Staff CA")
+	app := NewApp("../tests/gorgon.ini")
+	app.ClientCert = NewClientCert("tls", []*x509.Certificate{ca.certificate}, "test.example.com")
+
+	// the handle that will be tested
+	handle := GorgonHandler{&app, AuthenticationHandler}
+
+	get := func(certificate *x509.Certificate) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "", nil)
+		if certificate != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+		}
+		w := httptest.NewRecorder()
+		handle.ServeHTTP(w, req)
+		return w
+	}
+	authenticatedAs := func(w *httptest.ResponseRecorder) interface{} {
+		cookie := getSessionCookie(w)
+		decodedValue := make(map[interface{}]interface{})
+		err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &decodedValue, app.SessionStore.Codecs...)
+		assert.NoError(t, err)
+		return decodedValue["authenticated_as"]
+	}
+
+	// TEST: a valid certificate authenticates the user without the form
+	w := get(ca.Issue(t, 2, pkix.Name{CommonName: "User"}, "user@test.example.com"))
+	body := w.Body.String()
+	assert.Contains(t, body, "navigator.id.completeAuthentication")
+	assert.NotContains(t, body, "name=\"password\"")
+	assert.Equal(t, "user@test.example.com", authenticatedAs(w))
+
+	// TEST: no certificate, the form is displayed
+	w = get(nil)
+	body = w.Body.String()
+	assert.Contains(t, body, "name=\"password\"")
+	assert.NotContains(t, body, "Certificate refused!")
+	assert.Nil(t, authenticatedAs(w))
+
+	// TEST: a certificate of another CA
+	w = get(newTestCA(t, "Other CA").Issue(t, 2, pkix.Name{CommonName: "User"}, "user@test.example.com"))
+	body = w.Body.String()
+	assert.Contains(t, body, "Certificate refused!")
+	assert.Contains(t, body, "name=\"password\"")
+	assert.Nil(t, authenticatedAs(w))
+
+	// TEST: a certificate of another domain
+	w = get(ca.Issue(t, 3, pkix.Name{CommonName: "User"}, "user@example.com"))
+	assert.Contains(t, w.Body.String(), "Certificate refused!")
+	assert.Nil(t, authenticatedAs(w))
+}
+
+func TestOIDCHandlers(t *testing.T) {
+	// create our app, the authentication is delegated to a stand-in
+	// provider
+	provider := newOIDCTestProvider(t)
+	defer provider.Close()
+	provider.Email = "user@test.example.com"
+	app := NewApp("../tests/gorgon.ini")
+	app.OIDC = NewOIDC(provider.Issuer(), "gorgon", "secret", "https://test.example.com"+OIDCCallbackPath, "test.example.com")
+
+	// the handles that will be tested
+	handle := GorgonHandler{&app, AuthenticationHandler}
+	login := GorgonHandler{&app, OIDCLoginHandler}
+	callback := GorgonHandler{&app, OIDCCallbackHandler}
+
+	get := func(handle GorgonHandler, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", target, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handle.ServeHTTP(w, req)
+		return w
+	}
+	authenticatedAs := func(cookie *http.Cookie) interface{} {
+		decodedValue := make(map[interface{}]interface{})
+		err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &decodedValue, app.SessionStore.Codecs...)
+		assert.NoError(t, err)
+		return decodedValue["authenticated_as"]
+	}
+	// start returns the session cookie and the query sent back by the
+	// provider
+	start := func() (*http.Cookie, url.Values) {
+		w := get(login, "", nil)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		return getSessionCookie(w), provider.authorize(t, w.Header().Get("Location"))
+	}
+
+	// TEST: the authentication page proposes the provider
+	w := get(handle, "", nil)
+	body := w.Body.String()
+	assert.Contains(t, body, "action=\"/.well-known/browserid/_gorgon/oidc/login\"")
+	assert.Contains(t, body, "Sign in with SSO")
+	assert.Contains(t, body, "name=\"password\"")
+
+	// TEST: authenticate with the provider
+	cookie, values := start()
+	w = get(callback, OIDCCallbackPath+"?"+values.Encode(), cookie)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/.well-known/browserid/_gorgon/authentication", w.Header().Get("Location"))
+	cookie = getSessionCookie(w)
+	assert.Equal(t, "user@test.example.com", authenticatedAs(cookie))
+	w = get(handle, "", cookie)
+	assert.Contains(t, w.Body.String(), "navigator.id.completeAuthentication")
+
+	// TEST: the callback can't be replayed
+	w = get(callback, OIDCCallbackPath+"?"+values.Encode(), cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "Authentication failed!")
+
+	// TEST: a bad state
+	cookie, values = start()
+	values.Set("state", "other")
+	w = get(callback, OIDCCallbackPath+"?"+values.Encode(), cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+
+	// TEST: the callback without session
+	_, values = start()
+	w = get(callback, OIDCCallbackPath+"?"+values.Encode(), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// TEST: an error returned by the provider
+	cookie, values = start()
+	w = get(callback, OIDCCallbackPath+"?"+url.Values{"state": {values.Get("state")}, "error": {"access_denied"}}.Encode(), cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// TEST: a user of another domain
+	provider.Email = "user@example.com"
+	cookie, values = start()
+	w = get(callback, OIDCCallbackPath+"?"+values.Encode(), cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "did not authenticate you with an email address of test.example.com")
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+	provider.Email = "user@test.example.com"
+
+	// TEST: the form is replaced by the provider
+	app.OIDC.AutoRedirect = true
+	w = get(handle, "", nil)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/.well-known/browserid/_gorgon/oidc/login", w.Header().Get("Location"))
+
+	// TEST: the provider can't be reached
+	app.OIDC = NewOIDC("http://127.0.0.1:1", "gorgon", "secret", "https://test.example.com"+OIDCCallbackPath, "test.example.com")
+	w = get(login, "", nil)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "can't be reached")
+
+	// TEST: the delegation is disabled
+	app.OIDC = nil
+	w = get(login, "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = get(callback, OIDCCallbackPath, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotContains(t, get(handle, "", nil).Body.String(), "id=\"btn_oidc\"")
+}
+
+func TestSAMLHandlers(t *testing.T) {
+	// create our app, the authentication is delegated to a test IdP
+	idp := newSAMLTestIdP(t)
+	app := NewApp("../tests/gorgon.ini")
+	app.SAML = NewSAML("https://test.example.com"+SAMLMetadataPath, "https://test.example.com"+SAMLACSPath, idp.EntityID, "https://idp.example.com/saml", []*x509.Certificate{idp.certificate}, "test.example.com")
+	app.SAML.RelayKey = []byte("relay state key")
+
+	// the handles that will be tested
+	handle := GorgonHandler{&app, AuthenticationHandler}
+	metadata := GorgonHandler{&app, SAMLMetadataHandler}
+	login := GorgonHandler{&app, SAMLLoginHandler}
+	acs := GorgonHandler{&app, SAMLACSHandler}
+
+	serve := func(handle GorgonHandler, method string, cookie *http.Cookie, data url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "", bytes.NewBufferString(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handle.ServeHTTP(w, req)
+		return w
+	}
+	authenticatedAs := func(cookie *http.Cookie) interface{} {
+		decodedValue := make(map[interface{}]interface{})
+		err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &decodedValue, app.SessionStore.Codecs...)
+		assert.NoError(t, err)
+		return decodedValue["authenticated_as"]
+	}
+	// start returns the session cookie and the identifier of the
+	// AuthnRequest
+	start := func() (*http.Cookie, string) {
+		w := serve(login, "GET", nil, nil)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.True(t, strings.HasPrefix(w.Header().Get("Location"), "https://idp.example.com/saml?RelayState="))
+		return getSessionCookie(w), samlAuthnRequest(t, w.Header().Get("Location")).Attr("ID")
+	}
+
+	// TEST: the metadata of the SP
+	w := serve(metadata, "GET", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/samlmetadata+xml", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `Location="https://test.example.com/.well-known/browserid/_gorgon/saml/acs"`)
+
+	// TEST: the authentication page proposes the IdP
+	w = serve(handle, "GET", nil, nil)
+	assert.Contains(t, w.Body.String(), "action=\"/.well-known/browserid/_gorgon/saml/login\"")
+	assert.Contains(t, w.Body.String(), "id=\"btn_saml\"")
+
+	// TEST: authenticate with the IdP
+	cookie, id := start()
+	response := idp.Response(app.SAML, id, "user@test.example.com")
+	data := url.Values{"SAMLResponse": {idp.Encode(t, response)}}
+	w = serve(acs, "POST", cookie, data)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/.well-known/browserid/_gorgon/authentication", w.Header().Get("Location"))
+	cookie = getSessionCookie(w)
+	assert.Equal(t, "user@test.example.com", authenticatedAs(cookie))
+	w = serve(handle, "GET", cookie, nil)
+	assert.Contains(t, w.Body.String(), "navigator.id.completeAuthentication")
+
+	// TEST: the response can't be replayed
+	w = serve(acs, "POST", cookie, data)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "Authentication failed!")
+
+	// TEST: the response answers another request
+	cookie, _ = start()
+	_, id = start()
+	response = idp.Response(app.SAML, id, "user@test.example.com")
+	w = serve(acs, "POST", cookie, url.Values{"SAMLResponse": {idp.Encode(t, response)}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+
+	// TEST: the response without session
+	w = serve(acs, "POST", nil, url.Values{"SAMLResponse": {idp.Encode(t, response)}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// getSAMLRequestCookie returns the cookie binding the AuthnRequest to
+	// the browser
+	getSAMLRequestCookie := func(w *httptest.ResponseRecorder) *http.Cookie {
+		resp := http.Response{Header: w.Header()}
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == samlRequestCookie {
+				return cookie
+			}
+		}
+		return nil
+	}
+
+	// startRelayState returns the identifier of the AuthnRequest, its
+	// RelayState and the cookie sent to the browser
+	startRelayState := func() (string, string, *http.Cookie) {
+		w := serve(login, "GET", nil, nil)
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return samlAuthnRequest(t, location.String()).Attr("ID"), location.Query().Get("RelayState"), getSAMLRequestCookie(w)
+	}
+
+	// TEST: the cookie binding the request to the browser is sent with the
+	// cross-site POST of the IdP
+	id, relayState, requestCookie := startRelayState()
+	if assert.NotNil(t, requestCookie) {
+		assert.Equal(t, id, requestCookie.Value)
+		assert.Equal(t, SAMLACSPath, requestCookie.Path)
+		assert.True(t, requestCookie.Secure)
+		assert.True(t, requestCookie.HttpOnly)
+		assert.Equal(t, http.SameSiteNoneMode, requestCookie.SameSite)
+	}
+
+	// TEST: the session cookie is not sent with the POST of the IdP
+	// (SameSite=Lax), the request is identified by the RelayState
+	response = idp.Response(app.SAML, id, "user@test.example.com")
+	w = serve(acs, "POST", requestCookie, url.Values{"SAMLResponse": {idp.Encode(t, response)}, "RelayState": {relayState}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/.well-known/browserid/_gorgon/authentication", w.Header().Get("Location"))
+	assert.Equal(t, "user@test.example.com", authenticatedAs(getSessionCookie(w)))
+	if cleared := getSAMLRequestCookie(w); assert.NotNil(t, cleared) {
+		assert.True(t, cleared.MaxAge < 0, "The request cookie must be deleted")
+	}
+
+	// TEST: login CSRF, the RelayState and the response of the attacker
+	// are posted from the browser of the victim
+	id, relayState, _ = startRelayState()
+	response = idp.Response(app.SAML, id, "attacker@test.example.com")
+	w = serve(acs, "POST", nil, url.Values{"SAMLResponse": {idp.Encode(t, response)}, "RelayState": {relayState}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+
+	// TEST: login CSRF, the victim has started another login
+	id, relayState, _ = startRelayState()
+	_, _, requestCookie = startRelayState()
+	response = idp.Response(app.SAML, id, "attacker@test.example.com")
+	w = serve(acs, "POST", requestCookie, url.Values{"SAMLResponse": {idp.Encode(t, response)}, "RelayState": {relayState}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+
+	// TEST: the RelayState of another request
+	_, relayState, _ = startRelayState()
+	id, _, requestCookie = startRelayState()
+	response = idp.Response(app.SAML, id, "user@test.example.com")
+	w = serve(acs, "POST", requestCookie, url.Values{"SAMLResponse": {idp.Encode(t, response)}, "RelayState": {relayState}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// TEST: an expired RelayState
+	app.SAML.now = func() time.Time { return time.Now().Add(-samlLoginTimeout - time.Minute) }
+	id, relayState, requestCookie = startRelayState()
+	app.SAML.now = time.Now
+	response = idp.Response(app.SAML, id, "user@test.example.com")
+	w = serve(acs, "POST", requestCookie, url.Values{"SAMLResponse": {idp.Encode(t, response)}, "RelayState": {relayState}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// TEST: a user of another domain
+	cookie, id = start()
+	response = idp.Response(app.SAML, id, "user@example.com")
+	w = serve(acs, "POST", cookie, url.Values{"SAMLResponse": {idp.Encode(t, response)}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "did not authenticate you with an email address of test.example.com")
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+
+	// TEST: the form is replaced by the IdP
+	app.SAML.AutoRedirect = true
+	w = serve(handle, "GET", nil, nil)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/.well-known/browserid/_gorgon/saml/login", w.Header().Get("Location"))
+
+	// TEST: the delegation is disabled
+	app.SAML = nil
+	assert.Equal(t, http.StatusNotFound, serve(metadata, "GET", nil, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(login, "GET", nil, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(acs, "POST", nil, nil).Code)
+	assert.NotContains(t, serve(handle, "GET", nil, nil).Body.String(), "id=\"btn_saml\"")
+}
+
+func TestBridgeHandlers(t *testing.T) {
+	// create our app, partner.com is verified by email and partner.org by a
+	// stand-in provider
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+	s := newSmtpServer(t, serverConfig, false, "STARTTLS")
+	defer s.Close()
+	provider := newOIDCTestProvider(t)
+	defer provider.Close()
+	provider.Email = "carol@partner.org"
+	app := NewApp("../tests/gorgon.ini")
+	app.MagicLink = NewMagicLink([]byte("secret"), s.Addr(), "starttls", clientConfig, "gorgon@test.example.com", "test.example.com", "https://test.example.com", 15*time.Minute)
+	app.MagicLink.Domains = []string{"partner.com"}
+	app.Bridge = NewBridge("bridge.example.com")
+	app.Bridge.PublicKey, app.Bridge.PrivateKey = loadTestKeys(t, "ds256-")
+	app.Bridge.Domains["partner.com"] = &BridgeDomain{Name: "partner.com"}
+	oidc := NewOIDC(provider.Issuer(), "gorgon", "secret", "https://test.example.com"+OIDCCallbackPath, "partner.org")
+	oidc.Name = "Partner SSO"
+	app.Bridge.Domains["partner.org"] = &BridgeDomain{Name: "partner.org", OIDC: oidc}
+
+	// the handles that will be tested
+	handle := GorgonHandler{&app, AuthenticationHandler}
+	magicLink := GorgonHandler{&app, MagicLinkHandler}
+	login := GorgonHandler{&app, OIDCLoginHandler}
+	callback := GorgonHandler{&app, OIDCCallbackHandler}
+	certificate := GorgonHandler{&app, GenerateCertificateHandler}
+
+	serve := func(handle GorgonHandler, method, target string, cookie *http.Cookie, data url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, target, bytes.NewBufferString(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handle.ServeHTTP(w, req)
+		return w
+	}
+	authenticatedAs := func(cookie *http.Cookie) interface{} {
+		decodedValue := make(map[interface{}]interface{})
+		err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &decodedValue, app.SessionStore.Codecs...)
+		assert.NoError(t, err)
+		return decodedValue["authenticated_as"]
+	}
+	// issuer returns the issuer of a certificate generated for email, the
+	// certificate must be signed with the keys of its issuer
+	issuer := func(cookie *http.Cookie, email string) interface{} {
+		data := url.Values{"email": {email}, "cert_duration": {"3600"}, "public_key": {"{\"algorithm\":\"DS\",\"y\":\"foobar\"}"}}
+		w := serve(certificate, "POST", "", cookie, data)
+		if !assert.Equal(t, http.StatusOK, w.Code) {
+			return nil
+		}
+		token, err := jwt.Parse(w.Body.String(), func(token *jwt.Token) (interface{}, error) {
+			if token.Claims["iss"] == app.Bridge.Issuer && app.Bridge.PublicKey != nil {
+				return app.Bridge.PublicKey.DSA, nil
+			}
+			return app.PublicKey.PublicKey, nil
+		})
+		assert.NoError(t, err)
+		return token.Claims["iss"]
+	}
+
+	// TEST: the password of a bridged address is refused
+	w := serve(handle, "POST", "", nil, url.Values{"email": {"bob@partner.com"}, "password": {"secretpasswordfortests"}})
+	body := w.Body.String()
+	assert.NotContains(t, body, "navigator.id.completeAuthentication")
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+
+	// TEST: the authentication page proposes a link for a bridged address
+	w = serve(handle, "GET", "?email=bob@partner.com", nil, nil)
+	body = w.Body.String()
+	assert.Contains(t, body, "test.example.com vouches for the email addresses of partner.com")
+	assert.Contains(t, body, "id=\"btn_magiclink\"")
+	assert.NotContains(t, body, "name=\"password\"")
+
+	// TEST: verify a bridged address by email
+	w = serve(handle, "POST", "", nil, url.Values{"email": {"bob@partner.com"}, "step": {"magiclink"}})
+	assert.Contains(t, w.Body.String(), "Check your mailbox!")
+	if !assert.Len(t, s.Messages(), 1, "The link must be sent") {
+		return
+	}
+	assert.Equal(t, []string{"bob@partner.com"}, s.Messages()[0].To)
+	link := magicLinkFromMessage(t, s.Messages()[0])
+	w = serve(magicLink, "POST", link.Path, nil, url.Values{"token": {link.Query().Get("token")}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	cookie := getSessionCookie(w)
+	assert.Equal(t, "bob@partner.com", authenticatedAs(cookie))
+
+	// the certificate is issued by the bridge
+	assert.Equal(t, "bridge.example.com", issuer(cookie, "bob@partner.com"))
+
+	// TEST: the authentication page proposes the provider of the domain
+	w = serve(handle, "GET", "?email=carol@partner.org", nil, nil)
+	body = w.Body.String()
+	assert.Contains(t, body, "action=\"/.well-known/browserid/_gorgon/oidc/login\"")
+	assert.Contains(t, body, "name=\"domain\" value=\"partner.org\"")
+	assert.Contains(t, body, "Sign in with Partner SSO")
+	assert.NotContains(t, body, "name=\"password\"")
+
+	// TEST: verify a bridged address with the provider of the domain
+	w = serve(login, "GET", "?domain=partner.org", nil, nil)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	values := provider.authorize(t, w.Header().Get("Location"))
+	w = serve(callback, "GET", OIDCCallbackPath+"?"+values.Encode(), getSessionCookie(w), nil)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	cookie = getSessionCookie(w)
+	assert.Equal(t, "carol@partner.org", authenticatedAs(cookie))
+	assert.Equal(t, "bridge.example.com", issuer(cookie, "carol@partner.org"))
+
+	// TEST: the provider of a domain can't vouch for another domain
+	provider.Email = "carol@partner.com"
+	w = serve(login, "GET", "?domain=partner.org", nil, nil)
+	values = provider.authorize(t, w.Header().Get("Location"))
+	w = serve(callback, "GET", OIDCCallbackPath+"?"+values.Encode(), getSessionCookie(w), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Nil(t, authenticatedAs(getSessionCookie(w)))
+
+	// TEST: a domain without provider
+	w = serve(login, "GET", "?domain=partner.com", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(login, "GET", "?domain=other.com", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// TEST: the certificates of the domain of the IdP are still issued by the
+	// IdP
+	cookie, err := GetAuthCookie("user@test.example.com", app.SessionStore.Codecs...)
+	assert.NoError(t, err)
+	assert.Equal(t, "test.example.com", issuer(cookie, "user@test.example.com"))
+
+	// TEST: a bridge issued by the IdP signs with the keys of the IdP
+	app.Bridge.Issuer, app.Bridge.PublicKey, app.Bridge.PrivateKey = "test.example.com", nil, nil
+	cookie, err = GetAuthCookie("bob@partner.com", app.SessionStore.Codecs...)
+	assert.NoError(t, err)
+	assert.Equal(t, "test.example.com", issuer(cookie, "bob@partner.com"))
+
+	// TEST: another issuer never signs with the keys of the IdP
+	app.Bridge.Issuer = "bridge.example.com"
+	data := url.Values{"email": {"bob@partner.com"}, "cert_duration": {"3600"}, "public_key": {"{\"algorithm\":\"DS\",\"y\":\"foobar\"}"}}
+	w = serve(certificate, "POST", "", cookie, data)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
 func TestCheckAuthenticatedHandler(t *testing.T) {
 	// create our app
 	app := NewApp("../tests/gorgon.ini")
@@ -411,4 +1501,89 @@ func TestGenerateCertificateHandler(t *testing.T) {
 
 	exp := time.Unix(int64(token.Claims["exp"].(float64)/1000), 0)
 	assert.True(t, exp.After(time.Now()))
+	assert.NotContains(t, token.Claims["principal"], "name")
+	assert.NotContains(t, token.Claims["principal"], "groups")
+
+	// TEST: display name and groups from the session
+	identityCookie, err := GetIdentityCookie(&Identity{
+		Email:       "user@example.com",
+		DisplayName: "Example User",
+		Groups:      []string{"staff", "admins"},
+	}, app.SessionStore.Codecs...)
+	assert.NoError(t, err)
+	data = url.Values{}
+	data.Set("email", "user@example.com")
+	data.Add("cert_duration", "3600")
+	data.Add("public_key", "{\"algorithm\":\"DS\",\"y\":\"foobar\"}")
+	req, _ = http.NewRequest("POST", "", bytes.NewBufferString(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
+	req.AddCookie(identityCookie)
+	w = httptest.NewRecorder()
+	handle.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	token, err = jwt.Parse(w.Body.String(), func(token *jwt.Token) (interface{}, error) {
+		return app.PublicKey.PublicKey, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"email":  "user@example.com",
+		"name":   "Example User",
+		"groups": []interface{}{"staff", "admins"},
+	}, token.Claims["principal"])
+
+	// TEST: unknown browser key algorithm
+	data = url.Values{}
+	data.Set("email", "user@example.com")
+	data.Add("cert_duration", "3600")
+	data.Add("public_key", "{\"algorithm\":\"EC\",\"x\":\"foobar\"}")
+	req, _ = http.NewRequest("POST", "", bytes.NewBufferString(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
+	req.AddCookie(authCookie)
+	w = httptest.NewRecorder()
+	handle.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// TEST: a DSA key of the IdP signs the certificates of the DSA keys of
+	// the browsers
+	app.PublicKey, app.PrivateKey = loadTestKeys(t, "ds256-")
+	browserKey := map[string]string{"algorithm": "DS", "p": "ff", "q": "7f", "g": "2", "y": "1a"}
+	browserJSON, _ := json.Marshal(browserKey)
+	data = url.Values{}
+	data.Set("email", "user@example.com")
+	data.Add("cert_duration", "3600")
+	data.Add("public_key", string(browserJSON))
+	req, _ = http.NewRequest("POST", "", bytes.NewBufferString(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
+	req.AddCookie(identityCookie)
+	w = httptest.NewRecorder()
+	handle.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	token, err = jwt.Parse(w.Body.String(), func(token *jwt.Token) (interface{}, error) {
+		return app.PublicKey.DSA, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "DS256", token.Header["alg"])
+		assert.Equal(t, map[string]interface{}{"algorithm": "DS", "p": "ff", "q": "7f", "g": "2", "y": "1a"}, token.Claims["public-key"])
+	}
+}
+
+func TestSessionIdentity(t *testing.T) {
+	session := sessions.NewSession(nil, "persona-auth")
+	assert.Nil(t, GetSessionIdentity(session))
+
+	// the username is used when the identity has no email
+	SetSessionIdentity(session, &Identity{DisplayName: "Alice"}, "alice@example.com")
+	assert.Equal(t, &Identity{Email: "alice@example.com", DisplayName: "Alice"}, GetSessionIdentity(session))
+
+	// a new identity replaces the previous one
+	SetSessionIdentity(session, &Identity{Email: "bob@example.com", Groups: []string{"staff"}}, "bob")
+	assert.Equal(t, &Identity{Email: "bob@example.com", Groups: []string{"staff"}}, GetSessionIdentity(session))
+
+	// a nil identity removes the identity
+	SetSessionIdentity(session, nil, "")
+	assert.Nil(t, GetSessionIdentity(session))
+	assert.Empty(t, session.Values)
 }
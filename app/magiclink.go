@@ -0,0 +1,367 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/vaughan0/go-ini"
+	"mime"
+	"net"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// MagicLinkConfigKeys are the configuration variables of the
+	// "magiclink" section.
+	MagicLinkConfigKeys = append([]ConfigKey{
+		{Name: "enabled", Default: "false", Validate: ValidateBool},
+		{Name: "server"},
+		{Name: "tls_mode", Default: "starttls", Validate: ValidateOneOf("smtps", "starttls", "none")},
+		{Name: "helo", Default: "localhost"},
+		{Name: "username"},
+		{Name: "password"},
+		{Name: "from"},
+		{Name: "subject"},
+		{Name: "base_url"},
+		{Name: "lifetime", Default: "900", Validate: ValidateSeconds},
+	}, TLSConfigKeys...)
+
+	// magicLinkEncoding is the encoding of the tokens (base64url without
+	// padding).
+	magicLinkEncoding = base64.RawURLEncoding
+)
+
+// MagicLink lets the users authenticate without a password: a single-use
+// link, valid for Lifetime, is sent by email to the address being
+// authenticated, and following the link authenticates the user. As in the
+// original Persona, the possession of the mailbox proves the identity. Only
+// the addresses of the domain of the IdP, and of the bridged domains verified
+// by email (see Bridge), can receive a link.
+//
+// The links are signed with a key derived from the session secret key. The
+// used links are remembered in memory until they expire: with several
+// instances of Gorgon, a link could be used once per instance.
+//
+// The emails are sent through an SMTP relay, the connection is secured
+// according to the TLS mode (see SmtpAuthenticator). The relay
+// authentication is optional.
+//
+// MagicLink is configured in the "magiclink" section, for example:
+//
+// [magiclink]
+// enabled = true
+// server = smtp.example.com:587
+// tls_mode = starttls
+// username = gorgon@example.com
+// password = secret
+// from = Gorgon <gorgon@example.com>
+// subject = Sign in to example.com
+// base_url = https://example.com
+// lifetime = 900
+//
+type MagicLink struct {
+	Server    string        // address (host:port) of the SMTP relay
+	TLSMode   string        // "smtps", "starttls" or "none"
+	TLSConfig *tls.Config   // TLS configuration used to connect to the relay
+	Helo      string        // name sent in the EHLO command
+	Username  string        // login name on the relay (optional)
+	Password  string        // password on the relay
+	From      string        // sender of the emails
+	Subject   string        // subject of the emails
+	Domain    string        // domain of the addresses allowed to receive a link
+	Domains   []string      // other domains allowed to receive a link (bridged domains)
+	BaseURL   string        // URL of the IdP, used to build the links
+	Lifetime  time.Duration // lifetime of a link
+	Timeout   time.Duration // maximum duration of the SMTP session
+
+	key   []byte               // key used to sign the links
+	mutex sync.Mutex           // protects the fields below
+	used  map[string]time.Time // nonce of the used links => expiration time
+	now   func() time.Time     // current time (replaced in tests)
+}
+
+// magicLinkToken is the signed content of a link.
+type magicLinkToken struct {
+	Email   string `json:"email"`
+	Expires int64  `json:"expires"`
+	Nonce   string `json:"nonce"`
+}
+
+// NewMagicLink returns a MagicLink signing the links with the key, sending
+// the emails through the SMTP server.
+func NewMagicLink(key []byte, server, tlsMode string, tlsConfig *tls.Config, from, domain, baseURL string, lifetime time.Duration) *MagicLink {
+	return &MagicLink{
+		Server:    server,
+		TLSMode:   tlsMode,
+		TLSConfig: tlsConfig,
+		Helo:      "localhost",
+		From:      from,
+		Subject:   "Sign in to " + domain,
+		Domain:    domain,
+		BaseURL:   strings.TrimRight(baseURL, "/"),
+		Lifetime:  lifetime,
+		Timeout:   30 * time.Second,
+		key:       key,
+		used:      map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+// Allowed returns true if the email address can receive a link: a single
+// address, without display name, of the domain of the IdP or of Domains.
+func (m *MagicLink) Allowed(email string) bool {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || address.Address != email {
+		return false
+	}
+	for _, domain := range append([]string{m.Domain}, m.Domains...) {
+		if strings.HasSuffix(strings.ToLower(email), "@"+strings.ToLower(domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Token returns a new signed token for the email address, valid for
+// Lifetime.
+func (m *MagicLink) Token(email string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(magicLinkToken{
+		Email:   email,
+		Expires: m.now().Add(m.Lifetime).Unix(),
+		Nonce:   magicLinkEncoding.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := magicLinkEncoding.EncodeToString(payload)
+	return encoded + "." + magicLinkEncoding.EncodeToString(m.sign(encoded)), nil
+}
+
+// Check checks the signature and the expiration time of the token, and
+// returns its email address, without using the token (see Verify). Returns a
+// CredentialsError if the token is invalid, expired or already used.
+func (m *MagicLink) Check(token string) (string, error) {
+	return m.verify(token, false)
+}
+
+// Verify checks the signature and the expiration time of the token, and
+// returns its email address. A token can only be used once. Returns a
+// CredentialsError if the token is invalid, expired or already used.
+func (m *MagicLink) Verify(token string) (string, error) {
+	return m.verify(token, true)
+}
+
+// verify checks the token, and marks it as used if use is true.
+func (m *MagicLink) verify(token string, use bool) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", CredentialsError{"MagicLink: malformed link"}
+	}
+	signature, err := magicLinkEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, m.sign(parts[0])) {
+		return "", CredentialsError{"MagicLink: invalid signature"}
+	}
+	payload, err := magicLinkEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", CredentialsError{"MagicLink: malformed link"}
+	}
+	var content magicLinkToken
+	if err := json.Unmarshal(payload, &content); err != nil {
+		return "", CredentialsError{"MagicLink: malformed link"}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	expires := time.Unix(content.Expires, 0)
+	if !now.Before(expires) {
+		return "", CredentialsError{"MagicLink: expired link for '" + content.Email + "'"}
+	}
+	if _, ok := m.used[content.Nonce]; ok {
+		return "", CredentialsError{"MagicLink: link already used for '" + content.Email + "'"}
+	}
+	if !use {
+		return content.Email, nil
+	}
+
+	// the expired links can't be used anyway
+	for nonce, expiration := range m.used {
+		if !now.Before(expiration) {
+			delete(m.used, nonce)
+		}
+	}
+	m.used[content.Nonce] = expires
+	return content.Email, nil
+}
+
+// sign returns the signature of the encoded payload of a token.
+func (m *MagicLink) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// URL returns the link following the path of the IdP with a new token for
+// the email address.
+func (m *MagicLink) URL(path, email string) (string, error) {
+	token, err := m.Token(email)
+	if err != nil {
+		return "", err
+	}
+	return m.BaseURL + path + "?" + url.Values{"token": {token}}.Encode(), nil
+}
+
+// Send emails the link to the email address through the SMTP relay.
+func (m *MagicLink) Send(email, link string) error {
+	if !m.Allowed(email) {
+		return errors.New("MagicLink: '" + email + "' can't receive a link")
+	}
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return errors.New("MagicLink: invalid sender '" + m.From + "'")
+	}
+
+	ctx, cancel := contextWithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+	client, err := dialSMTP(ctx, m.Server, m.TLSMode, m.TLSConfig, m.Helo)
+	if err != nil {
+		return errors.New("MagicLink: " + err.Error())
+	}
+	defer client.Close()
+
+	if m.Username != "" {
+		auth, err := newSMTPAuth(client, m.Username, m.Password)
+		if err != nil {
+			return errors.New("MagicLink: " + err.Error())
+		}
+		if err := client.Auth(auth); err != nil {
+			return errors.New("MagicLink: " + err.Error())
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return errors.New("MagicLink: " + err.Error())
+	}
+	if err := client.Rcpt(email); err != nil {
+		return errors.New("MagicLink: " + err.Error())
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return errors.New("MagicLink: " + err.Error())
+	}
+	if _, err := writer.Write(m.message(from, email, link)); err != nil {
+		return errors.New("MagicLink: " + err.Error())
+	}
+	if err := writer.Close(); err != nil {
+		return errors.New("MagicLink: " + err.Error())
+	}
+	return client.Quit()
+}
+
+// message returns the email containing the link.
+func (m *MagicLink) message(from *mail.Address, email, link string) []byte {
+	id := make([]byte, 16)
+	rand.Read(id)
+	minutes := int(m.Lifetime / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+
+	var message bytes.Buffer
+	header := func(name, value string) {
+		message.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", from.String())
+	header("To", "<"+email+">")
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", m.now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+magicLinkEncoding.EncodeToString(id)+"@"+m.Domain+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	message.WriteString("\r\n")
+	message.WriteString("Hello,\r\n\r\n")
+	message.WriteString("Follow this link to sign in to " + m.Domain + " as " + email + ":\r\n\r\n")
+	message.WriteString(link + "\r\n\r\n")
+	message.WriteString("The link expires in " + strconv.Itoa(minutes) + " minutes and can only be used once.\r\n")
+	message.WriteString("If you did not ask to sign in, you can ignore this email.\r\n")
+	return message.Bytes()
+}
+
+// NewMagicLinkFromConfig returns the MagicLink configured in the "magiclink"
+// section, or nil if the magic links are disabled. The links are signed with
+// a key derived from the session secret key of the "global" section, the
+// base URL defaults to "https://" followed by the domain of the IdP.
+func NewMagicLinkFromConfig(config ini.File, domain string) (*MagicLink, error) {
+	config, err := checkConfigSection(config, "magiclink", MagicLinkConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	if enabled, _ := config.Get("magiclink", "enabled"); enabled != "true" {
+		return nil, nil
+	}
+
+	for _, key := range []string{"server", "from"} {
+		if value, _ := config.Get("magiclink", key); value == "" {
+			return nil, errors.New("'" + key + "' variable missing from 'magiclink' section")
+		}
+	}
+	if domain == "" {
+		return nil, errors.New("'idp_domain' variable missing from 'global' section")
+	}
+	server, _ := config.Get("magiclink", "server")
+	tlsMode, _ := config.Get("magiclink", "tls_mode")
+	from, _ := config.Get("magiclink", "from")
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, errors.New("'from' is not a valid address in 'magiclink' section")
+	}
+	baseURL, _ := config.Get("magiclink", "base_url")
+	if baseURL == "" {
+		baseURL = "https://" + domain
+	}
+	value, _ := config.Get("magiclink", "lifetime")
+	lifetime, _ := strconv.Atoi(value)
+
+	// use the default port if none is provided
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+		if tlsMode == "smtps" {
+			server = net.JoinHostPort(server, "465")
+		} else {
+			server = net.JoinHostPort(server, "587")
+		}
+	}
+	tlsConfig, err := NewTLSConfig(config, "magiclink", host)
+	if err != nil {
+		return nil, err
+	}
+
+	// the signing key is derived from the session secret key
+	secret, _ := config.Get("global", "session_secret_key")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("gorgon magic link"))
+
+	magicLink := NewMagicLink(mac.Sum(nil), server, tlsMode, tlsConfig, from, domain, baseURL, time.Duration(lifetime)*time.Second)
+	magicLink.Helo, _ = config.Get("magiclink", "helo")
+	magicLink.Username, _ = config.Get("magiclink", "username")
+	magicLink.Password, _ = config.Get("magiclink", "password")
+	if subject, _ := config.Get("magiclink", "subject"); subject != "" {
+		magicLink.Subject = subject
+	}
+	return magicLink, nil
+}
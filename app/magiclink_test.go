@@ -0,0 +1,248 @@
+package app
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// linkPattern matches the link of a magic link email.
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+// magicLinkFromMessage returns the link contained in a captured email.
+func magicLinkFromMessage(t *testing.T, message smtpMessage) *url.URL {
+	link := linkPattern.FindString(message.Data)
+	if link == "" {
+		t.Fatal("no link in the message")
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestMagicLinkToken(t *testing.T) {
+	magicLink := NewMagicLink([]byte("secret"), "", "none", nil, "gorgon@example.com", "example.com", "https://example.com", 15*time.Minute)
+	now := time.Unix(1500000000, 0)
+	magicLink.now = func() time.Time { return now }
+
+	// TEST: a valid token
+	token, err := magicLink.Token("alice@example.com")
+	assert.NoError(t, err)
+
+	// TEST: checking a token doesn't use it
+	for i := 0; i < 2; i++ {
+		email, err := magicLink.Check(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice@example.com", email)
+	}
+	email, err := magicLink.Verify(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", email)
+
+	// TEST: a token can only be used once
+	_, err = magicLink.Verify(token)
+	assert.True(t, IsCredentialsError(err))
+	_, err = magicLink.Check(token)
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the tokens are different
+	token1, _ := magicLink.Token("alice@example.com")
+	token2, _ := magicLink.Token("alice@example.com")
+	assert.NotEqual(t, token1, token2)
+
+	// TEST: an expired token
+	token, _ = magicLink.Token("alice@example.com")
+	now = now.Add(15 * time.Minute)
+	_, err = magicLink.Verify(token)
+	assert.True(t, IsCredentialsError(err))
+	assert.Contains(t, err.Error(), "expired")
+
+	// TEST: the tokens signed with another key
+	other := NewMagicLink([]byte("other secret"), "", "none", nil, "gorgon@example.com", "example.com", "https://example.com", 15*time.Minute)
+	token, _ = other.Token("alice@example.com")
+	_, err = magicLink.Verify(token)
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: a modified token
+	token, _ = magicLink.Token("alice@example.com")
+	parts := strings.Split(token, ".")
+	payload, _ := magicLinkEncoding.DecodeString(parts[0])
+	payload = []byte(strings.Replace(string(payload), "alice", "admin", 1))
+	_, err = magicLink.Verify(magicLinkEncoding.EncodeToString(payload) + "." + parts[1])
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: malformed tokens
+	for _, token := range []string{"", ".", "abc", "abc.def.ghi", "!!!.!!!"} {
+		_, err = magicLink.Verify(token)
+		assert.True(t, IsCredentialsError(err), token)
+	}
+
+	// TEST: the used tokens are forgotten once expired
+	assert.Len(t, magicLink.used, 1)
+	now = now.Add(15 * time.Minute)
+	token, _ = magicLink.Token("alice@example.com")
+	_, err = magicLink.Verify(token)
+	assert.NoError(t, err)
+	assert.Len(t, magicLink.used, 1)
+}
+
+func TestMagicLinkAllowed(t *testing.T) {
+	magicLink := NewMagicLink([]byte("secret"), "", "none", nil, "gorgon@example.com", "example.com", "https://example.com", 15*time.Minute)
+	assert.True(t, magicLink.Allowed("alice@example.com"))
+	assert.True(t, magicLink.Allowed("Alice@Example.COM"))
+	assert.False(t, magicLink.Allowed("alice@other.com"))
+	assert.False(t, magicLink.Allowed("alice@sub.example.com"))
+	assert.False(t, magicLink.Allowed("alice@evilexample.com"))
+	assert.False(t, magicLink.Allowed("Alice <alice@example.com>"))
+	assert.False(t, magicLink.Allowed("alice@example.com, bob@example.com"))
+	assert.False(t, magicLink.Allowed("alice"))
+	assert.False(t, magicLink.Allowed(""))
+
+	// the bridged domains
+	magicLink.Domains = []string{"partner.com"}
+	assert.True(t, magicLink.Allowed("alice@example.com"))
+	assert.True(t, magicLink.Allowed("alice@Partner.com"))
+	assert.False(t, magicLink.Allowed("alice@partner.org"))
+}
+
+func TestMagicLinkSend(t *testing.T) {
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+	s := newSmtpServer(t, serverConfig, false, "STARTTLS", "AUTH LOGIN PLAIN")
+	defer s.Close()
+
+	magicLink := NewMagicLink([]byte("secret"), s.Addr(), "starttls", clientConfig, "Gorgon <gorgon@example.com>", "example.com", "https://example.com/", 15*time.Minute)
+	magicLink.Username = "alice@example.com"
+	magicLink.Password = "verysecret"
+
+	// TEST: the link is sent to the address
+	link, err := magicLink.URL("/.well-known/browserid/_gorgon/magiclink", "bob@example.com")
+	assert.NoError(t, err)
+	assert.NoError(t, magicLink.Send("bob@example.com", link))
+	assert.False(t, s.ClearTextAuth())
+	messages := s.Messages()
+	if !assert.Len(t, messages, 1) {
+		return
+	}
+	assert.Equal(t, "gorgon@example.com", messages[0].From)
+	assert.Equal(t, []string{"bob@example.com"}, messages[0].To)
+	assert.Contains(t, messages[0].Data, "From: \"Gorgon\" <gorgon@example.com>\n")
+	assert.Contains(t, messages[0].Data, "To: <bob@example.com>\n")
+	assert.Contains(t, messages[0].Data, "Subject: Sign in to example.com\n")
+	assert.Contains(t, messages[0].Data, "The link expires in 15 minutes")
+
+	// the link contains a valid token
+	u := magicLinkFromMessage(t, messages[0])
+	assert.Equal(t, "https", u.Scheme)
+	assert.Equal(t, "example.com", u.Host)
+	assert.Equal(t, "/.well-known/browserid/_gorgon/magiclink", u.Path)
+	email, err := magicLink.Verify(u.Query().Get("token"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bob@example.com", email)
+
+	// TEST: the addresses of other domains can't receive a link
+	assert.Error(t, magicLink.Send("bob@other.com", link))
+	assert.Len(t, s.Messages(), 1)
+
+	// TEST: the relay refuses the credentials
+	magicLink.Password = "bad password"
+	assert.Error(t, magicLink.Send("bob@example.com", link))
+	assert.Len(t, s.Messages(), 1)
+
+	// TEST: the relay is unreachable
+	magicLink = NewMagicLink([]byte("secret"), "127.0.0.1:1", "none", nil, "gorgon@example.com", "example.com", "https://example.com", 15*time.Minute)
+	assert.Error(t, magicLink.Send("bob@example.com", link))
+}
+
+func TestNewMagicLinkFromConfig(t *testing.T) {
+	global := map[string]string{"session_secret_key": "VuIJs9Up3vG6GMysAV3Duz4iaPYg4bdt"}
+
+	// magic links are disabled by default
+	magicLink, err := NewMagicLinkFromConfig(ini.File{"global": global}, "example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, magicLink)
+
+	// the server and the sender are required
+	_, err = NewMagicLinkFromConfig(ini.File{"global": global, "magiclink": {"enabled": "true", "from": "gorgon@example.com"}}, "example.com")
+	assert.EqualError(t, err, "'server' variable missing from 'magiclink' section")
+	_, err = NewMagicLinkFromConfig(ini.File{"global": global, "magiclink": {"enabled": "true", "server": "smtp.example.com"}}, "example.com")
+	assert.EqualError(t, err, "'from' variable missing from 'magiclink' section")
+
+	// the default values
+	magicLink, err = NewMagicLinkFromConfig(ini.File{"global": global, "magiclink": {
+		"enabled": "true",
+		"server":  "smtp.example.com",
+		"from":    "gorgon@example.com",
+	}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, magicLink) {
+		assert.Equal(t, "smtp.example.com:587", magicLink.Server)
+		assert.Equal(t, "starttls", magicLink.TLSMode)
+		assert.Equal(t, "smtp.example.com", magicLink.TLSConfig.ServerName)
+		assert.Equal(t, "localhost", magicLink.Helo)
+		assert.Equal(t, "", magicLink.Username)
+		assert.Equal(t, "Sign in to example.com", magicLink.Subject)
+		assert.Equal(t, "https://example.com", magicLink.BaseURL)
+		assert.Equal(t, 15*time.Minute, magicLink.Lifetime)
+	}
+
+	// all the values
+	magicLink, err = NewMagicLinkFromConfig(ini.File{"global": global, "magiclink": {
+		"enabled":  "true",
+		"server":   "smtp.example.com",
+		"tls_mode": "smtps",
+		"helo":     "login.example.com",
+		"username": "gorgon",
+		"password": "secret",
+		"from":     "Gorgon <gorgon@example.com>",
+		"subject":  "Your sign-in link",
+		"base_url": "https://login.example.com:8443/",
+		"lifetime": "300",
+	}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, magicLink) {
+		assert.Equal(t, "smtp.example.com:465", magicLink.Server)
+		assert.Equal(t, "smtps", magicLink.TLSMode)
+		assert.Equal(t, "login.example.com", magicLink.Helo)
+		assert.Equal(t, "gorgon", magicLink.Username)
+		assert.Equal(t, "secret", magicLink.Password)
+		assert.Equal(t, "Your sign-in link", magicLink.Subject)
+		assert.Equal(t, "https://login.example.com:8443", magicLink.BaseURL)
+		assert.Equal(t, 5*time.Minute, magicLink.Lifetime)
+	}
+
+	// the links are signed with a key derived from the session secret key
+	other, _ := NewMagicLinkFromConfig(ini.File{"global": {"session_secret_key": "another secret key"}, "magiclink": {
+		"enabled": "true",
+		"server":  "smtp.example.com",
+		"from":    "gorgon@example.com",
+	}}, "example.com")
+	token, _ := other.Token("alice@example.com")
+	_, err = magicLink.Verify(token)
+	assert.True(t, IsCredentialsError(err))
+
+	// invalid values
+	for _, section := range []map[string]string{
+		{"enabled": "yes", "server": "smtp.example.com", "from": "gorgon@example.com"},
+		{"enabled": "true", "server": "smtp.example.com", "from": "gorgon"},
+		{"enabled": "true", "server": "smtp.example.com", "from": "gorgon@example.com", "tls_mode": "ssl"},
+		{"enabled": "true", "server": "smtp.example.com", "from": "gorgon@example.com", "lifetime": "0"},
+	} {
+		_, err = NewMagicLinkFromConfig(ini.File{"global": global, "magiclink": section}, "example.com")
+		assert.Error(t, err, section)
+	}
+
+	// the domain of the IdP is required
+	_, err = NewMagicLinkFromConfig(ini.File{"global": global, "magiclink": {
+		"enabled": "true",
+		"server":  "smtp.example.com",
+		"from":    "gorgon@example.com",
+	}}, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,495 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/vaughan0/go-ini"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// OIDCConfigKeys are the configuration variables of the "oidc" section.
+	OIDCConfigKeys = append([]ConfigKey{
+		{Name: "enabled", Default: "false", Validate: ValidateBool},
+		{Name: "issuer"},
+		{Name: "client_id"},
+		{Name: "client_secret"},
+		{Name: "redirect_url"},
+		{Name: "scopes", Default: "openid email profile"},
+		{Name: "name", Default: "SSO"},
+		{Name: "auto_redirect", Default: "false", Validate: ValidateBool},
+		{Name: "require_verified_email", Default: "true", Validate: ValidateBool},
+		{Name: "timeout", Default: "10", Validate: ValidateSeconds},
+	}, TLSConfigKeys...)
+
+	// oidcEncoding is the encoding of the random values and of the keys
+	// (base64url without padding).
+	oidcEncoding = base64.RawURLEncoding
+
+	// OIDCCallbackPath is the path of OIDCCallbackHandler, used by the
+	// default redirect URL.
+	OIDCCallbackPath = "/.well-known/browserid/_gorgon/oidc/callback"
+)
+
+// OIDC delegates the authentication of the users to an upstream OpenID
+// Connect provider (Keycloak, ...), with the authorization code flow and
+// PKCE: the user is redirected to the provider, and the ID token returned to
+// the RedirectURL is validated (signature with the keys of the provider,
+// issuer, audience, expiration and nonce). The "email" claim is the
+// identity, it must be an address of the domain of the IdP (and be verified
+// by the provider if RequireVerifiedEmail).
+//
+// The endpoints and the keys of the provider are discovered from the issuer
+// ("/.well-known/openid-configuration"). The ID tokens must be signed with
+// RS256 or ES256.
+//
+// OIDC is configured in the "oidc" section, for example:
+//
+// [oidc]
+// enabled = true
+// issuer = https://sso.example.com/realms/staff
+// client_id = gorgon
+// client_secret = secret
+// redirect_url = https://example.com/.well-known/browserid/_gorgon/oidc/callback
+// scopes = openid email profile
+// name = Example SSO
+// auto_redirect = false
+// require_verified_email = true
+// timeout = 10
+//
+type OIDC struct {
+	Issuer               string       // URL of the provider
+	ClientID             string       // client identifier at the provider
+	ClientSecret         string       // client secret at the provider
+	RedirectURL          string       // URL of OIDCCallbackHandler, registered at the provider
+	Scopes               []string     // scopes asked to the provider
+	Name                 string       // name of the provider displayed to the users
+	AutoRedirect         bool         // redirect to the provider instead of displaying the form
+	RequireVerifiedEmail bool         // the "email_verified" claim must be true
+	Domain               string       // domain of the identities
+	Client               *http.Client // HTTP client used to talk to the provider
+
+	mutex       sync.Mutex             // protects the fields below
+	provider    *oidcProvider          // discovered metadata of the provider
+	keys        map[string]interface{} // key identifier => public key of the provider
+	keysFetched time.Time              // last time the keys were fetched
+	now         func() time.Time       // current time (replaced in tests)
+}
+
+// oidcProvider is the metadata of an OpenID Connect provider.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcJWK is a public key of a JSON Web Key Set.
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewOIDC returns an OIDC delegating the authentication to the provider.
+func NewOIDC(issuer, clientID, clientSecret, redirectURL, domain string) *OIDC {
+	return &OIDC{
+		Issuer:               issuer,
+		ClientID:             clientID,
+		ClientSecret:         clientSecret,
+		RedirectURL:          redirectURL,
+		Scopes:               []string{"openid", "email", "profile"},
+		Name:                 "SSO",
+		RequireVerifiedEmail: true,
+		Domain:               domain,
+		Client:               &http.Client{Timeout: 10 * time.Second},
+		keys:                 map[string]interface{}{},
+		now:                  time.Now,
+	}
+}
+
+// NewOIDCSecret returns a random value for the state, the nonce or the PKCE
+// verifier of an authentication.
+func NewOIDCSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return oidcEncoding.EncodeToString(secret), nil
+}
+
+// AuthURL returns the URL of the provider where the user authenticates. The
+// state and the nonce are checked when the user comes back, the verifier is
+// sent with the code (PKCE).
+func (o *OIDC) AuthURL(state, nonce, verifier string) (string, error) {
+	provider, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	values := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.ClientID},
+		"redirect_uri":          {o.RedirectURL},
+		"scope":                 {strings.Join(o.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {oidcEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + values.Encode(), nil
+}
+
+// Login exchanges the authorization code returned by the provider for an ID
+// token, and returns the identity of the token. Returns a CredentialsError
+// if the provider refuses the code or if the token is invalid.
+func (o *OIDC) Login(code, verifier, nonce string) (*Identity, error) {
+	provider, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("User-Agent", "Gorgon/"+Version)
+	request.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	response, err := o.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&token); err != nil {
+		return nil, errors.New("OIDC: invalid response from the token endpoint (" + response.Status + ")")
+	}
+	if token.Error == "invalid_grant" {
+		return nil, CredentialsError{"OIDC: code refused by the provider: " + token.ErrorDescription}
+	}
+	if response.StatusCode != http.StatusOK || token.IDToken == "" {
+		return nil, errors.New("OIDC: no ID token from the token endpoint (" + response.Status + " " + token.Error + ")")
+	}
+	return o.VerifyIDToken(token.IDToken, nonce)
+}
+
+// VerifyIDToken checks the ID token and returns its identity. Returns a
+// CredentialsError if the token is invalid.
+func (o *OIDC) VerifyIDToken(raw, nonce string) (*Identity, error) {
+	var keyErr error
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := o.key(kid)
+		if err != nil {
+			keyErr = err
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if token.Method.Alg() == "RS256" {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if token.Method.Alg() == "ES256" {
+				return key, nil
+			}
+		}
+		return nil, errors.New("unexpected signing method " + token.Method.Alg())
+	})
+	if err != nil {
+		// the keys of the provider can't be fetched
+		if _, unknown := keyErr.(oidcKeyError); keyErr != nil && !unknown {
+			return nil, keyErr
+		}
+		return nil, CredentialsError{"OIDC: invalid ID token: " + err.Error()}
+	}
+
+	claims := token.Claims
+	if issuer, _ := claims["iss"].(string); issuer != o.Issuer {
+		return nil, CredentialsError{"OIDC: unexpected issuer '" + issuer + "'"}
+	}
+	if !o.audience(claims) {
+		return nil, CredentialsError{"OIDC: the ID token is not issued for '" + o.ClientID + "'"}
+	}
+	expires, ok := claims["exp"].(float64)
+	if !ok || !o.now().Before(time.Unix(int64(expires), 0)) {
+		return nil, CredentialsError{"OIDC: expired ID token"}
+	}
+	if value, _ := claims["nonce"].(string); nonce == "" || value != nonce {
+		return nil, CredentialsError{"OIDC: invalid nonce"}
+	}
+
+	email, _ := claims["email"].(string)
+	if !emailInDomain(email, o.Domain) {
+		return nil, CredentialsError{"OIDC: the email '" + email + "' is not an address of '" + o.Domain + "'"}
+	}
+	if verified, _ := claims["email_verified"].(bool); o.RequireVerifiedEmail && !verified {
+		return nil, CredentialsError{"OIDC: the email '" + email + "' is not verified by the provider"}
+	}
+	name, _ := claims["name"].(string)
+	return &Identity{Email: email, DisplayName: name}, nil
+}
+
+// audience returns true if the ID token is issued for the client: the "aud"
+// claim contains the client identifier, and the "azp" claim is the client if
+// there are several audiences.
+func (o *OIDC) audience(claims map[string]interface{}) bool {
+	var audiences []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, value := range aud {
+			if s, ok := value.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != o.ClientID {
+		return false
+	} else if !ok && len(audiences) > 1 {
+		return false
+	}
+	for _, audience := range audiences {
+		if audience == o.ClientID {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcKeyError is returned when the ID token is signed with an unknown key.
+type oidcKeyError struct {
+	kid string
+}
+
+func (e oidcKeyError) Error() string {
+	return "unknown key '" + e.kid + "'"
+}
+
+// key returns the public key of the provider with the identifier (the only
+// key if the identifier is empty). The keys are fetched again when the key
+// is unknown (key rotation), at most once per minute.
+func (o *OIDC) key(kid string) (interface{}, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	find := func() interface{} {
+		if kid == "" && len(o.keys) == 1 {
+			for _, key := range o.keys {
+				return key
+			}
+		}
+		return o.keys[kid]
+	}
+	if key := find(); key != nil {
+		return key, nil
+	}
+	if o.now().Sub(o.keysFetched) < time.Minute {
+		return nil, oidcKeyError{kid}
+	}
+
+	provider := o.provider
+	if provider == nil {
+		return nil, errors.New("OIDC: provider not discovered")
+	}
+	var jwks struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := o.get(provider.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key := jwk.publicKey(); key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	o.keys = keys
+	o.keysFetched = o.now()
+
+	if key := find(); key != nil {
+		return key, nil
+	}
+	return nil, oidcKeyError{kid}
+}
+
+// publicKey returns the RSA or P-256 public key, or nil if the key is not
+// supported.
+func (k oidcJWK) publicKey() interface{} {
+	decode := func(value string) *big.Int {
+		data, err := oidcEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil || len(data) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(data)
+	}
+	switch {
+	case k.Kty == "RSA":
+		n, e := decode(k.N), decode(k.E)
+		if n == nil || e == nil || !e.IsInt64() || n.BitLen() < 2048 {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, y := decode(k.X), decode(k.Y)
+		if x == nil || y == nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	}
+	return nil
+}
+
+// discover returns the metadata of the provider, fetched once from the
+// issuer.
+func (o *OIDC) discover() (*oidcProvider, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+
+	var provider oidcProvider
+	if err := o.get(strings.TrimRight(o.Issuer, "/")+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != o.Issuer {
+		return nil, errors.New("OIDC: the provider is '" + provider.Issuer + "', not '" + o.Issuer + "'")
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("OIDC: incomplete metadata from '" + o.Issuer + "'")
+	}
+	o.provider = &provider
+	return o.provider, nil
+}
+
+// get decodes the JSON document of the URL.
+func (o *OIDC) get(rawURL string, v interface{}) error {
+	request, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("User-Agent", "Gorgon/"+Version)
+	response, err := o.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("OIDC: unexpected response from '" + rawURL + "' (" + response.Status + ")")
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(v); err != nil {
+		return errors.New("OIDC: invalid JSON from '" + rawURL + "': " + err.Error())
+	}
+	return nil
+}
+
+// NewOIDCFromConfig returns the OIDC configured in the "oidc" section, or nil
+// if the delegation is disabled. The redirect URL defaults to "https://"
+// followed by the domain of the IdP and the path of OIDCCallbackHandler.
+func NewOIDCFromConfig(config ini.File, domain string) (*OIDC, error) {
+	config, err := checkConfigSection(config, "oidc", OIDCConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	if enabled, _ := config.Get("oidc", "enabled"); enabled != "true" {
+		return nil, nil
+	}
+	return newOIDCFromSection(config, "oidc", domain)
+}
+
+// newOIDCFromSection returns a new OIDC configured from the checked section.
+// The identities are addresses of the domain, the default redirect URL is on
+// the domain.
+func newOIDCFromSection(config ini.File, section, domain string) (*OIDC, error) {
+	for _, key := range []string{"issuer", "client_id", "client_secret"} {
+		if value, _ := config.Get(section, key); value == "" {
+			return nil, errors.New("'" + key + "' variable missing from '" + section + "' section")
+		}
+	}
+	if domain == "" {
+		return nil, errors.New("'idp_domain' variable missing from 'global' section")
+	}
+	issuer, _ := config.Get(section, "issuer")
+	u, err := url.Parse(issuer)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, errors.New("'issuer' must be an http or https URL in '" + section + "' section")
+	}
+	clientID, _ := config.Get(section, "client_id")
+	clientSecret, _ := config.Get(section, "client_secret")
+	redirectURL, _ := config.Get(section, "redirect_url")
+	if redirectURL == "" {
+		redirectURL = "https://" + domain + OIDCCallbackPath
+	}
+
+	tlsConfig, err := NewTLSConfig(config, section, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	value, _ := config.Get(section, "timeout")
+	seconds, _ := strconv.Atoi(value)
+
+	oidc := NewOIDC(issuer, clientID, clientSecret, redirectURL, domain)
+	value, _ = config.Get(section, "scopes")
+	oidc.Scopes = []string{"openid"}
+	for _, scope := range strings.Fields(value) {
+		if scope != "openid" {
+			oidc.Scopes = append(oidc.Scopes, scope)
+		}
+	}
+	oidc.Name, _ = config.Get(section, "name")
+	value, _ = config.Get(section, "auto_redirect")
+	oidc.AutoRedirect = value == "true"
+	value, _ = config.Get(section, "require_verified_email")
+	oidc.RequireVerifiedEmail = value == "true"
+	oidc.Client = &http.Client{
+		Timeout:   time.Duration(seconds) * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		// the endpoints are given by the provider
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return oidc, nil
+}
@@ -0,0 +1,406 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// oidcTestProvider is a stand-in OpenID Connect provider. Its authorization
+// endpoint authenticates the user Email without asking anything, and
+// redirects back with a code.
+type oidcTestProvider struct {
+	server *httptest.Server
+
+	mutex  sync.Mutex
+	key    *rsa.PrivateKey                     // signing key of the ID tokens
+	kid    string                              // identifier of the signing key
+	Email  string                              // user authenticated by the provider
+	Claims func(claims map[string]interface{}) // modifies the claims of the ID tokens (optional)
+	codes  map[string]url.Values               // code => parameters of the authorization request
+}
+
+// newOIDCTestProvider starts a stand-in OpenID Connect provider.
+func newOIDCTestProvider(t *testing.T) *oidcTestProvider {
+	p := &oidcTestProvider{codes: map[string]url.Values{}}
+	p.RotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.Issuer(),
+			"authorization_endpoint": p.Issuer() + "/authorize",
+			"token_endpoint":         p.Issuer() + "/token",
+			"jwks_uri":               p.Issuer() + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": p.kid,
+			"use": "sig",
+			"n":   oidcEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   oidcEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		code, _ := NewOIDCSecret()
+		p.mutex.Lock()
+		p.codes[code] = query
+		p.mutex.Unlock()
+		http.Redirect(w, r, query.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		p.mutex.Lock()
+		request, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.mutex.Unlock()
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if clientID != "gorgon" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		if !ok || request.Get("client_id") != clientID || request.Get("redirect_uri") != r.FormValue("redirect_uri") ||
+			request.Get("code_challenge") != oidcEncoding.EncodeToString(challenge[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     p.IDToken(t, request.Get("nonce")),
+		})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *oidcTestProvider) Close() {
+	p.server.Close()
+}
+
+func (p *oidcTestProvider) Issuer() string {
+	return p.server.URL
+}
+
+// RotateKey replaces the signing key of the provider.
+func (p *oidcTestProvider) RotateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.key = key
+	p.kid = "key-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// IDToken returns a signed ID token for the user of the provider.
+func (p *oidcTestProvider) IDToken(t *testing.T, nonce string) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = p.kid
+	token.Claims["iss"] = p.Issuer()
+	token.Claims["sub"] = "1234"
+	token.Claims["aud"] = "gorgon"
+	token.Claims["iat"] = time.Now().Unix()
+	token.Claims["exp"] = time.Now().Add(5 * time.Minute).Unix()
+	token.Claims["nonce"] = nonce
+	token.Claims["email"] = p.Email
+	token.Claims["email_verified"] = true
+	token.Claims["name"] = "Example User"
+	if p.Claims != nil {
+		p.Claims(token.Claims)
+	}
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// authorize follows the authorization URL, and returns the parameters sent
+// back to the redirect URL.
+func (p *oidcTestProvider) authorize(t *testing.T, authURL string) url.Values {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query()
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.Close()
+	provider.Email = "alice@example.com"
+	oidc := NewOIDC(provider.Issuer(), "gorgon", "secret", "https://example.com"+OIDCCallbackPath, "example.com")
+
+	login := func(nonce string) (*Identity, error) {
+		authURL, err := oidc.AuthURL("state", "nonce", "verifier")
+		if !assert.NoError(t, err) {
+			return nil, err
+		}
+		values := provider.authorize(t, authURL)
+		assert.Equal(t, "state", values.Get("state"))
+		return oidc.Login(values.Get("code"), "verifier", nonce)
+	}
+
+	// TEST: the authorization request
+	authURL, err := oidc.AuthURL("state", "nonce", "verifier")
+	assert.NoError(t, err)
+	u, _ := url.Parse(authURL)
+	assert.Equal(t, provider.Issuer()+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, "code", u.Query().Get("response_type"))
+	assert.Equal(t, "gorgon", u.Query().Get("client_id"))
+	assert.Equal(t, "https://example.com"+OIDCCallbackPath, u.Query().Get("redirect_uri"))
+	assert.Equal(t, "openid email profile", u.Query().Get("scope"))
+	assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+
+	// TEST: a valid ID token
+	identity, err := login("nonce")
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "alice@example.com", identity.Email)
+		assert.Equal(t, "Example User", identity.DisplayName)
+	}
+
+	// TEST: a code can only be used once
+	values := provider.authorize(t, authURL)
+	_, err = oidc.Login(values.Get("code"), "verifier", "nonce")
+	assert.NoError(t, err)
+	_, err = oidc.Login(values.Get("code"), "verifier", "nonce")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: a bad PKCE verifier
+	values = provider.authorize(t, authURL)
+	_, err = oidc.Login(values.Get("code"), "other verifier", "nonce")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: a bad nonce
+	_, err = login("other nonce")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the rotation of the keys of the provider
+	provider.RotateKey(t)
+	oidc.keysFetched = time.Time{}
+	_, err = login("nonce")
+	assert.NoError(t, err)
+
+	// TEST: invalid claims
+	for name, modify := range map[string]func(map[string]interface{}){
+		"expired":          func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"no expiration":    func(claims map[string]interface{}) { delete(claims, "exp") },
+		"issuer":           func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" },
+		"audience":         func(claims map[string]interface{}) { claims["aud"] = "other" },
+		"audiences":        func(claims map[string]interface{}) { claims["aud"] = []string{"gorgon", "other"} },
+		"authorized party": func(claims map[string]interface{}) { claims["azp"] = "other" },
+		"domain":           func(claims map[string]interface{}) { claims["email"] = "alice@other.com" },
+		"no email":         func(claims map[string]interface{}) { delete(claims, "email") },
+		"unverified":       func(claims map[string]interface{}) { claims["email_verified"] = false },
+	} {
+		provider.Claims = modify
+		_, err = login("nonce")
+		assert.True(t, IsCredentialsError(err), name)
+	}
+
+	// TEST: several audiences with the authorized party
+	provider.Claims = func(claims map[string]interface{}) {
+		claims["aud"] = []string{"other", "gorgon"}
+		claims["azp"] = "gorgon"
+	}
+	_, err = login("nonce")
+	assert.NoError(t, err)
+
+	// TEST: the verification of the email can be disabled
+	provider.Claims = func(claims map[string]interface{}) { delete(claims, "email_verified") }
+	_, err = login("nonce")
+	assert.True(t, IsCredentialsError(err))
+	oidc.RequireVerifiedEmail = false
+	_, err = login("nonce")
+	assert.NoError(t, err)
+	provider.Claims = nil
+
+	// TEST: a bad client secret
+	oidc.ClientSecret = "bad secret"
+	_, err = login("nonce")
+	assert.Error(t, err)
+	assert.False(t, IsCredentialsError(err))
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.Close()
+	provider.Email = "alice@example.com"
+	oidc := NewOIDC(provider.Issuer(), "gorgon", "secret", "https://example.com"+OIDCCallbackPath, "example.com")
+	_, err := oidc.AuthURL("state", "nonce", "verifier")
+	assert.NoError(t, err)
+
+	// TEST: a valid token
+	_, err = oidc.VerifyIDToken(provider.IDToken(t, "nonce"), "nonce")
+	assert.NoError(t, err)
+
+	// TEST: a token signed with an unknown key
+	other := newOIDCTestProvider(t)
+	defer other.Close()
+	other.Email = "alice@example.com"
+	other.Claims = func(claims map[string]interface{}) { claims["iss"] = provider.Issuer() }
+	_, err = oidc.VerifyIDToken(other.IDToken(t, "nonce"), "nonce")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: a token signed with the key of the provider under another name
+	other.key, other.kid = provider.key, "unknown"
+	_, err = oidc.VerifyIDToken(other.IDToken(t, "nonce"), "nonce")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the unsigned tokens and the HMAC are refused
+	for _, method := range []jwt.SigningMethod{jwt.SigningMethodHS256, jwt.SigningMethodNone} {
+		token := jwt.New(method)
+		token.Header["kid"] = provider.kid
+		token.Claims["iss"] = provider.Issuer()
+		token.Claims["aud"] = "gorgon"
+		token.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+		token.Claims["nonce"] = "nonce"
+		token.Claims["email"] = "alice@example.com"
+		token.Claims["email_verified"] = true
+		var key interface{} = provider.key.N.Bytes()
+		if method == jwt.SigningMethodNone {
+			key = jwt.UnsafeAllowNoneSignatureType
+		}
+		signed, err := token.SignedString(key)
+		assert.NoError(t, err)
+		_, err = oidc.VerifyIDToken(signed, "nonce")
+		assert.True(t, IsCredentialsError(err), method.Alg())
+	}
+
+	// TEST: an ES256 key
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	oidc.keys["ec"] = &key.PublicKey
+	token := jwt.New(jwt.SigningMethodES256)
+	token.Header["kid"] = "ec"
+	token.Claims["iss"] = provider.Issuer()
+	token.Claims["aud"] = "gorgon"
+	token.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+	token.Claims["nonce"] = "nonce"
+	token.Claims["email"] = "alice@example.com"
+	token.Claims["email_verified"] = true
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	identity, err := oidc.VerifyIDToken(signed, "nonce")
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "alice@example.com", identity.Email)
+	}
+
+	// TEST: a malformed token
+	_, err = oidc.VerifyIDToken("abc", "nonce")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the provider can't be reached
+	oidc = NewOIDC("http://127.0.0.1:1", "gorgon", "secret", "https://example.com"+OIDCCallbackPath, "example.com")
+	_, err = oidc.AuthURL("state", "nonce", "verifier")
+	assert.Error(t, err)
+}
+
+func TestNewOIDCFromConfig(t *testing.T) {
+	// the delegation is disabled by default
+	oidc, err := NewOIDCFromConfig(ini.File{}, "example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, oidc)
+
+	// the provider and the client are required
+	for _, key := range []string{"issuer", "client_id", "client_secret"} {
+		section := map[string]string{
+			"enabled":       "true",
+			"issuer":        "https://sso.example.com",
+			"client_id":     "gorgon",
+			"client_secret": "secret",
+		}
+		delete(section, key)
+		_, err = NewOIDCFromConfig(ini.File{"oidc": section}, "example.com")
+		assert.EqualError(t, err, "'"+key+"' variable missing from 'oidc' section")
+	}
+
+	// the default values
+	oidc, err = NewOIDCFromConfig(ini.File{"oidc": {
+		"enabled":       "true",
+		"issuer":        "https://sso.example.com/realms/staff",
+		"client_id":     "gorgon",
+		"client_secret": "secret",
+	}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, oidc) {
+		assert.Equal(t, "https://sso.example.com/realms/staff", oidc.Issuer)
+		assert.Equal(t, "gorgon", oidc.ClientID)
+		assert.Equal(t, "secret", oidc.ClientSecret)
+		assert.Equal(t, "https://example.com/.well-known/browserid/_gorgon/oidc/callback", oidc.RedirectURL)
+		assert.Equal(t, []string{"openid", "email", "profile"}, oidc.Scopes)
+		assert.Equal(t, "SSO", oidc.Name)
+		assert.False(t, oidc.AutoRedirect)
+		assert.True(t, oidc.RequireVerifiedEmail)
+		assert.Equal(t, 10*time.Second, oidc.Client.Timeout)
+	}
+
+	// all the values
+	oidc, err = NewOIDCFromConfig(ini.File{"oidc": {
+		"enabled":                "true",
+		"issuer":                 "https://sso.example.com",
+		"client_id":              "gorgon",
+		"client_secret":          "secret",
+		"redirect_url":           "https://login.example.com/callback",
+		"scopes":                 "email groups",
+		"name":                   "Example SSO",
+		"auto_redirect":          "true",
+		"require_verified_email": "false",
+		"timeout":                "5",
+	}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, oidc) {
+		assert.Equal(t, "https://login.example.com/callback", oidc.RedirectURL)
+		assert.Equal(t, []string{"openid", "email", "groups"}, oidc.Scopes)
+		assert.Equal(t, "Example SSO", oidc.Name)
+		assert.True(t, oidc.AutoRedirect)
+		assert.False(t, oidc.RequireVerifiedEmail)
+		assert.Equal(t, 5*time.Second, oidc.Client.Timeout)
+	}
+
+	// invalid values
+	for _, section := range []map[string]string{
+		{"enabled": "yes", "issuer": "https://sso.example.com", "client_id": "gorgon", "client_secret": "secret"},
+		{"enabled": "true", "issuer": "sso.example.com", "client_id": "gorgon", "client_secret": "secret"},
+		{"enabled": "true", "issuer": "https://sso.example.com", "client_id": "gorgon", "client_secret": "secret", "timeout": "0"},
+		{"enabled": "true", "issuer": "https://sso.example.com", "client_id": "gorgon", "client_secret": "secret", "auto_redirect": "1"},
+	} {
+		_, err = NewOIDCFromConfig(ini.File{"oidc": section}, "example.com")
+		assert.Error(t, err, section)
+	}
+}
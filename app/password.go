@@ -0,0 +1,193 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/sha256_crypt"
+	_ "github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"strings"
+)
+
+var (
+	// ErrPasswordMismatch is returned when a password does not match a hash.
+	ErrPasswordMismatch = errors.New("password mismatch")
+
+	// dummyPasswordHash is checked when a user is unknown, to take the same
+	// time as the check of a real hash (bcrypt, cost 10).
+	dummyPasswordHash = "$2a$10$1BqY8Nw2LSSXi0zdfHxOn.u5Qj7GXWc9NFR6LCzpxpJzL34BZ7ci."
+
+	// DovecotSchemes maps the Dovecot "{SCHEME}" prefixes to the prefixes of
+	// the hashes they can contain (nil means any supported hash).
+	DovecotSchemes = map[string][]string{
+		"CRYPT":        nil,
+		"SHA256-CRYPT": {"$5$"},
+		"SHA512-CRYPT": {"$6$"},
+		"BLF-CRYPT":    {"$2a$", "$2b$", "$2y$"},
+		"ARGON2ID":     {"$argon2id$"},
+	}
+)
+
+// PasswordHashError is returned when a password hash is malformed or uses an
+// unsupported scheme.
+type PasswordHashError struct {
+	s string // error message
+}
+
+// Error returns the error message
+func (e *PasswordHashError) Error() string {
+	return e.s
+}
+
+// CheckPasswordHash compares a hashed password with its possible plaintext
+// equivalent. The scheme is detected from the prefix of the hash:
+// - bcrypt: "$2a$", "$2b$" or "$2y$"
+// - SHA-256-crypt: "$5$"
+// - SHA-512-crypt: "$6$"
+// - yescrypt: "$y$"
+// - argon2id: "$argon2id$v=19$m=...,t=...,p=...$salt$hash"
+// - scrypt: "$scrypt$ln=...,r=...,p=...$salt$hash"
+// The hash can be prefixed by a Dovecot scheme (for example
+// "{SHA512-CRYPT}$6$..."), see DovecotSchemes.
+// Returns nil on success, ErrPasswordMismatch if the password does not match
+// or a PasswordHashError if the hash can't be used.
+func CheckPasswordHash(hash, password string) error {
+	if strings.HasPrefix(hash, "{") {
+		end := strings.Index(hash, "}")
+		if end == -1 {
+			return &PasswordHashError{"malformed password scheme"}
+		}
+		scheme := strings.ToUpper(hash[1:end])
+		hash = hash[end+1:]
+
+		prefixes, ok := DovecotSchemes[scheme]
+		if !ok {
+			return &PasswordHashError{"unsupported password scheme '" + scheme + "'"}
+		}
+		if prefixes != nil && !hasAnyPrefix(hash, prefixes) {
+			return &PasswordHashError{"password hash does not match scheme '" + scheme + "'"}
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrPasswordMismatch
+		} else if err != nil {
+			return &PasswordHashError{"bcrypt: " + err.Error()}
+		}
+		return nil
+	case strings.HasPrefix(hash, "$6$"):
+		err := crypt.SHA512.New().Verify(hash, []byte(password))
+		if err == crypt.ErrKeyMismatch {
+			return ErrPasswordMismatch
+		} else if err != nil {
+			return &PasswordHashError{"sha512-crypt: " + err.Error()}
+		}
+		return nil
+	case strings.HasPrefix(hash, "$5$"):
+		err := crypt.SHA256.New().Verify(hash, []byte(password))
+		if err == crypt.ErrKeyMismatch {
+			return ErrPasswordMismatch
+		} else if err != nil {
+			return &PasswordHashError{"sha256-crypt: " + err.Error()}
+		}
+		return nil
+	case strings.HasPrefix(hash, "$y$"):
+		return checkYescryptHash(hash, password)
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return checkArgon2idHash(hash, password)
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return checkScryptHash(hash, password)
+	}
+	return &PasswordHashError{"unsupported password hash scheme"}
+}
+
+// checkArgon2idHash checks a password against an argon2id hash encoded in the
+// PHC string format, the memory ("m", in KiB) being at most 2 GiB.
+func checkArgon2idHash(hash, password string) error {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return &PasswordHashError{"argon2id: malformed hash"}
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return &PasswordHashError{"argon2id: unsupported version"}
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil ||
+		memory < 1 || memory > 1<<21 || iterations < 1 || threads < 1 {
+		return &PasswordHashError{"argon2id: malformed parameters"}
+	}
+	salt, key, err := decodeSaltAndKey(parts[4], parts[5])
+	if err != nil {
+		return &PasswordHashError{"argon2id: " + err.Error()}
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// checkScryptHash checks a password against an scrypt hash encoded in the PHC
+// string format, "ln" being the log2 of the CPU/memory cost parameter. The
+// memory (128*r*2^ln bytes) is at most 2 GiB and r*p is below 2^30.
+func checkScryptHash(hash, password string) error {
+	// "", "scrypt", "ln=15,r=8,p=1", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return &PasswordHashError{"scrypt: malformed hash"}
+	}
+	var ln, r, p int
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &ln, &r, &p); err != nil ||
+		ln < 1 || ln > 24 || r < 1 || r > 1<<uint(24-ln) || p < 1 || p >= (1<<30)/r {
+		return &PasswordHashError{"scrypt: malformed parameters"}
+	}
+	salt, key, err := decodeSaltAndKey(parts[3], parts[4])
+	if err != nil {
+		return &PasswordHashError{"scrypt: " + err.Error()}
+	}
+
+	computed, err := scrypt.Key([]byte(password), salt, 1<<uint(ln), r, p, len(key))
+	if err != nil {
+		return &PasswordHashError{"scrypt: " + err.Error()}
+	}
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// decodeSaltAndKey decodes the base64 encoded (with or without padding) salt
+// and key of a PHC string.
+func decodeSaltAndKey(encodedSalt, encodedKey string) (salt, key []byte, err error) {
+	salt, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(encodedSalt, "="))
+	if err != nil {
+		return nil, nil, errors.New("malformed salt")
+	}
+	key, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(encodedKey, "="))
+	if err != nil || len(key) == 0 {
+		return nil, nil, errors.New("malformed key")
+	}
+	return
+}
+
+// hasAnyPrefix tests whether the string s begins with one of the prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPasswordHash(t *testing.T) {
+	hashes := []string{
+		"$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga",
+		"$2b$04$gorgonsaltgorgonsalt1uSQtdJTpkRukWY8YHsEMqoOmMCIdn3SK",
+		"$5$gorgonsalt$4suWjsurwiusgb/Mh7bPszCyIDZkGpbE.Qttnmxj.a6",
+		"$6$gorgonsalt$yd/u5iLXK2ruQ5s7kAibi9cADU2djGUj0tbUOABTfRo2BrqGx4Si7XgYCUC0CYpWtzqC6IZBGM7cNu5jLfm/o0",
+		"$y$j9T$abcdefghijklmnop$oD2n0ADM.NaBXH.wrQPc9pVIydBxdgEt3x2dQqm3RrA",
+		"$argon2id$v=19$m=1024,t=1,p=1$Z29yZ29uc2FsdHNhbHQxNg$oiE1NFxatqDn73uPj/xPvsUsFQwJ8E+YhemKrK/ibwQ",
+		"$scrypt$ln=10,r=8,p=1$Z29yZ29uc2FsdHNhbHQxNg$VqSJvtufsF+pORaJPvKSoVppegqQpqAhO5C0W2gqYmQ",
+	}
+	for _, hash := range hashes {
+		// try with the good password
+		assert.NoError(t, CheckPasswordHash(hash, "verysecret"), hash)
+
+		// try with a wrong password
+		assert.Equal(t, ErrPasswordMismatch, CheckPasswordHash(hash, "bad password"), hash)
+	}
+
+	// Dovecot schemes
+	for _, hash := range []string{
+		"{SHA512-CRYPT}$6$gorgonsalt$yd/u5iLXK2ruQ5s7kAibi9cADU2djGUj0tbUOABTfRo2BrqGx4Si7XgYCUC0CYpWtzqC6IZBGM7cNu5jLfm/o0",
+		"{BLF-CRYPT}$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga",
+		"{ARGON2ID}$argon2id$v=19$m=1024,t=1,p=1$Z29yZ29uc2FsdHNhbHQxNg$oiE1NFxatqDn73uPj/xPvsUsFQwJ8E+YhemKrK/ibwQ",
+		"{CRYPT}$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga",
+	} {
+		assert.NoError(t, CheckPasswordHash(hash, "verysecret"), hash)
+		assert.Equal(t, ErrPasswordMismatch, CheckPasswordHash(hash, "bad password"), hash)
+	}
+
+	// yescrypt flavors and parameters (classic scrypt, WORM, p and t)
+	for _, hash := range []string{
+		"$y$.75$gorgonsaltgorgonsalt$vLS8d7ovQOwACQ8RqTvNx4QFUtFqKxKPCw8WGH8ehr.",
+		"$y$/75$gorgonsaltgorgonsalt$/XFHOBbw7AsB0pi6Ms812X2C37v.UO5VIXcjckI1QO8",
+		"$y$/75/.$gorgonsaltgorgonsalt$nYSRfOp5pAxlUv2q6RndT/EZNNqHet/QSSAHealkUN1",
+		"$y$j75$gorgonsaltgorgonsalt$3LZjJLKoXF2fEnD9eDIpyx2QWtvmhN2s10GTRYD6Zv7",
+		"$y$jC5$gorgonsaltgorgonsalt$qYcjKjwsriW/PlbIZw8rtvyJkP0Rk0eUPXiIJrJZ2pB",
+		"$y$j75..$gorgonsaltgorgonsalt$tCD48L6rSQF5ou6Z5xyuCxKgEl3CvTKWACY8ZeHP8J0",
+		"$y$j75/.$gorgonsaltgorgonsalt$zCIeUybjGGPPcpT2gdc2opRlmIDZ2S85/oecfAAzPh8",
+	} {
+		assert.NoError(t, CheckPasswordHash(hash, "verysecret"), hash)
+		assert.Equal(t, ErrPasswordMismatch, CheckPasswordHash(hash, "bad password"), hash)
+	}
+
+	// test vector from the SHA-crypt specification
+	assert.NoError(t, CheckPasswordHash("$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"))
+
+	// unsupported or malformed hashes
+	for _, hash := range []string{
+		"verysecret",
+		"$1$gorgon$1jVkYk2JwRDQK9z5GD5k/1",
+		"{PLAIN}verysecret",
+		"{SHA512-CRYPT}$2a$04$fimCFH55rBor0.8DmsCbAuzIu591YSOfMGB8UCWiYhnlu/.T.ryga",
+		"{SHA512-CRYPT",
+		"$argon2id$v=19$m=1024,t=1,p=1$Z29yZ29uc2FsdHNhbHQxNg",
+		"$argon2id$v=19$m=1024,t=1,p=0$Z29yZ29uc2FsdHNhbHQxNg$oiE1NFxatqDn73uPj/xPvsUsFQwJ8E+YhemKrK/ibwQ",
+		"$argon2id$v=19$m=1024,t=0,p=1$Z29yZ29uc2FsdHNhbHQxNg$oiE1NFxatqDn73uPj/xPvsUsFQwJ8E+YhemKrK/ibwQ",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$Z29yZ29uc2FsdHNhbHQxNg$oiE1NFxatqDn73uPj/xPvsUsFQwJ8E+YhemKrK/ibwQ",
+		"$argon2i$v=19$m=1024,t=1,p=1$Z29yZ29uc2FsdHNhbHQxNg$oiE1NFxatqDn73uPj/xPvsUsFQwJ8E+YhemKrK/ibwQ",
+		"$y$j9T$abcdefghijklmnop",
+		"$y$k9T$abcdefghijklmnop$oD2n0ADM.NaBXH.wrQPc9pVIydBxdgEt3x2dQqm3RrA",
+		"$y$j9T$abcdefghijklmno!$oD2n0ADM.NaBXH.wrQPc9pVIydBxdgEt3x2dQqm3RrA",
+		"$scrypt$ln=foo,r=8,p=1$Z29yZ29uc2FsdHNhbHQxNg$VqSJvtufsF+pORaJPvKSoVppegqQpqAhO5C0W2gqYmQ",
+		"$scrypt$ln=10,r=0,p=1$Z29yZ29uc2FsdHNhbHQxNg$VqSJvtufsF+pORaJPvKSoVppegqQpqAhO5C0W2gqYmQ",
+		"$scrypt$ln=10,r=8,p=0$Z29yZ29uc2FsdHNhbHQxNg$VqSJvtufsF+pORaJPvKSoVppegqQpqAhO5C0W2gqYmQ",
+		"$scrypt$ln=20,r=32,p=1$Z29yZ29uc2FsdHNhbHQxNg$VqSJvtufsF+pORaJPvKSoVppegqQpqAhO5C0W2gqYmQ",
+		"$scrypt$ln=10,r=8,p=134217728$Z29yZ29uc2FsdHNhbHQxNg$VqSJvtufsF+pORaJPvKSoVppegqQpqAhO5C0W2gqYmQ",
+		"$scrypt$ln=10,r=1048576,p=1$Z29yZ29uc2FsdHNhbHQxNg$VqSJvtufsF+pORaJPvKSoVppegqQpqAhO5C0W2gqYmQ",
+	} {
+		err := CheckPasswordHash(hash, "verysecret")
+		assert.IsType(t, &PasswordHashError{}, err, hash)
+	}
+
+	// the dummy hash checked for the unknown users is a real hash
+	assert.Equal(t, ErrPasswordMismatch, CheckPasswordHash(dummyPasswordHash, "verysecret"))
+}
@@ -0,0 +1,304 @@
+package app
+
+import (
+	"container/list"
+	"github.com/vaughan0/go-ini"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// RateLimitConfigKeys are the configuration variables of the
+	// "ratelimit" section.
+	RateLimitConfigKeys = []ConfigKey{
+		{Name: "enabled", Default: "true", Validate: ValidateBool},
+		{Name: "username_attempts", Default: "5", Validate: ValidatePositiveInt},
+		{Name: "username_lockout", Default: "20", Validate: ValidatePositiveInt},
+		{Name: "ip_attempts", Default: "20", Validate: ValidatePositiveInt},
+		{Name: "ip_lockout", Default: "100", Validate: ValidatePositiveInt},
+		{Name: "backoff", Default: "1", Validate: ValidateSeconds},
+		{Name: "max_backoff", Default: "60", Validate: ValidateSeconds},
+		{Name: "lockout_duration", Default: "900", Validate: ValidateSeconds},
+		{Name: "reset_after", Default: "3600", Validate: ValidateSeconds},
+		{Name: "max_entries", Default: "100000", Validate: ValidatePositiveInt},
+		{Name: "client_ip_header"},
+	}
+)
+
+// RateLimiter protects the authentication endpoint against brute-force
+// attacks. The failed authentications are counted per client IP address and
+// per username:
+// - after the free attempts (UsernameAttempts or IPAttempts), each new
+//   attempt must wait for a delay starting at Backoff and doubled after each
+//   failure (up to MaxBackoff)
+// - after UsernameLockout or IPLockout failures, the username or the IP
+//   address is locked out for LockoutDuration
+// Each attempt allowed by Check is reserved: it counts as a failure until it
+// is released (Release), so that parallel attempts can't pass before the
+// failure of the first one is known.
+// The failures are forgotten after ResetAfter without failure, a successful
+// authentication resets the failures of the username (but not those of the
+// IP address). At most MaxEntries IP addresses and usernames are tracked, the
+// least recently failed are forgotten first when the limit is reached, but
+// never an active lockout.
+//
+// The rate limiter is configured in the "ratelimit" section, for example:
+//
+// [ratelimit]
+// enabled = true
+// username_attempts = 5
+// username_lockout = 20
+// ip_attempts = 20
+// ip_lockout = 100
+// backoff = 1
+// max_backoff = 60
+// lockout_duration = 900
+// reset_after = 3600
+// max_entries = 100000
+// client_ip_header = X-Forwarded-For
+//
+type RateLimiter struct {
+	UsernameAttempts int           // failures per username before the backoff
+	UsernameLockout  int           // failures per username before a lockout
+	IPAttempts       int           // failures per IP address before the backoff
+	IPLockout        int           // failures per IP address before a lockout
+	Backoff          time.Duration // first delay imposed after the free attempts
+	MaxBackoff       time.Duration // maximum delay between two attempts
+	LockoutDuration  time.Duration // duration of a lockout
+	ResetAfter       time.Duration // failures are forgotten after this duration
+	MaxEntries       int           // maximum number of IP addresses and usernames tracked (no limit if 0)
+	ClientIPHeader   string        // header set by a reverse proxy with the client IP address (optional)
+
+	mutex    sync.Mutex               // protects the fields below
+	failures map[string]*list.Element // "ip:<address>" or "user:<username>" => failures
+	lru      *list.List               // records, most recent failure first
+	now      func() time.Time         // current time (replaced in tests)
+}
+
+// rateLimitRecord counts the failures of an IP address or a username.
+type rateLimitRecord struct {
+	key      string
+	failures int
+	last     time.Time // time of the last failure
+}
+
+// NewRateLimiter returns a RateLimiter without failures.
+func NewRateLimiter(usernameAttempts, usernameLockout, ipAttempts, ipLockout int, backoff, maxBackoff, lockoutDuration, resetAfter time.Duration) *RateLimiter {
+	return &RateLimiter{
+		UsernameAttempts: usernameAttempts,
+		UsernameLockout:  usernameLockout,
+		IPAttempts:       ipAttempts,
+		IPLockout:        ipLockout,
+		Backoff:          backoff,
+		MaxBackoff:       maxBackoff,
+		LockoutDuration:  lockoutDuration,
+		ResetAfter:       resetAfter,
+		failures:         map[string]*list.Element{},
+		lru:              list.New(),
+		now:              time.Now,
+	}
+}
+
+// Check returns how long the client must wait before its next authentication
+// attempt for the username, 0 if the attempt is allowed. An allowed attempt is
+// reserved and counted as a failure, it must be released with Release if it
+// does not fail. An empty username (authentication without username) only
+// counts for the IP address.
+func (l *RateLimiter) Check(ip, username string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	wait := l.wait(l.record("ip:"+ip), l.IPAttempts, l.IPLockout, now)
+	if username != "" {
+		if w := l.wait(l.record("user:"+normalizeUsername(username)), l.UsernameAttempts, l.UsernameLockout, now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	l.sweep(now)
+	for _, key := range rateLimitKeys(ip, username) {
+		element, ok := l.failures[key]
+		if !ok {
+			if l.MaxEntries > 0 && len(l.failures) >= l.MaxEntries && !l.evict(now) {
+				// only active lockouts are tracked
+				continue
+			}
+			element = l.lru.PushFront(&rateLimitRecord{key: key})
+			l.failures[key] = element
+		} else {
+			l.lru.MoveToFront(element)
+		}
+		record := element.Value.(*rateLimitRecord)
+		if now.Sub(record.last) >= l.ResetAfter {
+			// not swept yet (see evict)
+			record.failures = 0
+		}
+		record.failures++
+		record.last = now
+	}
+	return 0
+}
+
+// Release cancels an attempt reserved by Check which did not fail (the
+// credentials were accepted, or the backend failed): it is no longer counted
+// as a failure.
+func (l *RateLimiter) Release(ip, username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, key := range rateLimitKeys(ip, username) {
+		if element, ok := l.failures[key]; ok {
+			record := element.Value.(*rateLimitRecord)
+			record.failures--
+			if record.failures <= 0 {
+				l.remove(element)
+			}
+		}
+	}
+}
+
+// rateLimitKeys returns the keys of the records of an attempt.
+func rateLimitKeys(ip, username string) []string {
+	keys := []string{"ip:" + ip}
+	if username != "" {
+		keys = append(keys, "user:"+normalizeUsername(username))
+	}
+	return keys
+}
+
+// record returns the failures of the key, or nil.
+func (l *RateLimiter) record(key string) *rateLimitRecord {
+	if element, ok := l.failures[key]; ok {
+		return element.Value.(*rateLimitRecord)
+	}
+	return nil
+}
+
+// remove forgets the failures of a record.
+func (l *RateLimiter) remove(element *list.Element) {
+	l.lru.Remove(element)
+	delete(l.failures, element.Value.(*rateLimitRecord).key)
+}
+
+// sweep removes the forgotten failures from the back of the list, where the
+// least recent failures are (except the active lockouts moved by evict).
+func (l *RateLimiter) sweep(now time.Time) {
+	for element := l.lru.Back(); element != nil; element = l.lru.Back() {
+		if now.Sub(element.Value.(*rateLimitRecord).last) < l.ResetAfter {
+			return
+		}
+		l.remove(element)
+	}
+}
+
+// evict makes room for a new record when MaxEntries is reached: the least
+// recently failed record is removed, unless it is an active lockout. The
+// active lockouts are moved to the front of the list, so that they are not
+// scanned again by the next evictions. Returns false if all the records are
+// active lockouts.
+func (l *RateLimiter) evict(now time.Time) bool {
+	for n := l.lru.Len(); n > 0; n-- {
+		element := l.lru.Back()
+		record := element.Value.(*rateLimitRecord)
+		lockout := l.UsernameLockout
+		if strings.HasPrefix(record.key, "ip:") {
+			lockout = l.IPLockout
+		}
+		if record.failures < lockout || now.Sub(record.last) >= l.LockoutDuration {
+			l.remove(element)
+			return true
+		}
+		l.lru.MoveToFront(element)
+	}
+	return false
+}
+
+// Succeed records a successful authentication for the username.
+func (l *RateLimiter) Succeed(username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if element, ok := l.failures["user:"+normalizeUsername(username)]; ok {
+		l.remove(element)
+	}
+}
+
+// wait returns the remaining delay imposed by the failures of a record.
+func (l *RateLimiter) wait(record *rateLimitRecord, attempts, lockout int, now time.Time) time.Duration {
+	if record == nil || now.Sub(record.last) >= l.ResetAfter {
+		return 0
+	}
+
+	var delay time.Duration
+	switch {
+	case record.failures >= lockout:
+		delay = l.LockoutDuration
+	case record.failures >= attempts:
+		delay = l.MaxBackoff
+		if n := uint(record.failures - attempts); n < 32 && l.Backoff<<n < l.MaxBackoff {
+			delay = l.Backoff << n
+		}
+	default:
+		return 0
+	}
+
+	if wait := record.last.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// ClientIP returns the IP address of the client, read from the
+// ClientIPHeader (last address of the header) if set.
+func (l *RateLimiter) ClientIP(r *http.Request) string {
+	if l.ClientIPHeader != "" {
+		if value := r.Header.Get(l.ClientIPHeader); value != "" {
+			addresses := strings.Split(value, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// normalizeUsername returns the username used to count the failures, the same
+// user can't escape the rate limit by changing the case of the email.
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// NewRateLimiterFromConfig returns the RateLimiter configured in the
+// "ratelimit" section, or nil if the rate limit is disabled.
+func NewRateLimiterFromConfig(config ini.File) (*RateLimiter, error) {
+	config, err := checkConfigSection(config, "ratelimit", RateLimitConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	if enabled, _ := config.Get("ratelimit", "enabled"); enabled != "true" {
+		return nil, nil
+	}
+
+	number := func(key string) int {
+		value, _ := config.Get("ratelimit", key)
+		n, _ := strconv.Atoi(value)
+		return n
+	}
+	seconds := func(key string) time.Duration {
+		return time.Duration(number(key)) * time.Second
+	}
+	limiter := NewRateLimiter(number("username_attempts"), number("username_lockout"),
+		number("ip_attempts"), number("ip_lockout"),
+		seconds("backoff"), seconds("max_backoff"), seconds("lockout_duration"), seconds("reset_after"))
+	limiter.MaxEntries = number("max_entries")
+	limiter.ClientIPHeader, _ = config.Get("ratelimit", "client_ip_header")
+	return limiter, nil
+}
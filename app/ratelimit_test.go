@@ -0,0 +1,191 @@
+package app
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(2, 6, 4, 8, time.Second, 4*time.Second, time.Hour, 24*time.Hour)
+	limiter.now = func() time.Time { return now }
+
+	// the free attempts are not throttled, each allowed attempt is counted
+	// as a failure
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.1", "alice@example.com"))
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.1", "alice@example.com"))
+
+	// then the delay is doubled after each failure, up to the maximum
+	for _, delay := range []time.Duration{1, 2, 4, 4} {
+		assert.Equal(t, delay*time.Second, limiter.Check("192.0.2.1", "alice@example.com"))
+		assert.Equal(t, delay*time.Second, limiter.Check("192.0.2.2", "Alice@example.com"))
+		now = now.Add(delay * time.Second)
+		assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.1", "alice@example.com"))
+	}
+
+	// the username is locked out
+	assert.Equal(t, time.Hour, limiter.Check("192.0.2.2", "alice@example.com"))
+	now = now.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.2", "alice@example.com"))
+
+	// a released attempt is not counted
+	limiter.Release("192.0.2.2", "alice@example.com")
+	assert.Equal(t, 6, limiter.record("user:alice@example.com").failures)
+	assert.Nil(t, limiter.record("ip:192.0.2.2"))
+
+	// the IP address is throttled for the other usernames
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.1", "bob@example.com"))
+	assert.Equal(t, 4*time.Second, limiter.Check("192.0.2.1", "carol@example.com"))
+
+	// a successful authentication resets the failures of the username only
+	limiter.Succeed("alice@example.com")
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.2", "alice@example.com"))
+	assert.Equal(t, 4*time.Second, limiter.Check("192.0.2.1", "carol@example.com"))
+
+	// the failures are forgotten
+	now = now.Add(24 * time.Hour)
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.1", "carol@example.com"))
+	assert.Len(t, limiter.failures, 2)
+
+	// an attempt without username only counts for the IP address
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.3", ""))
+	assert.Len(t, limiter.failures, 3)
+}
+
+func TestRateLimiterParallel(t *testing.T) {
+	limiter := NewRateLimiter(2, 6, 20, 40, time.Minute, time.Hour, time.Hour, time.Hour)
+
+	// the parallel attempts can't pass before the failures are known
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.Check("192.0.2.1", "alice@example.com") == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), allowed)
+
+	// the attempts are released once they pass
+	limiter.Release("192.0.2.1", "alice@example.com")
+	limiter.Release("192.0.2.1", "alice@example.com")
+	assert.Len(t, limiter.failures, 0)
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.1", "alice@example.com"))
+}
+
+func TestRateLimiterMaxEntries(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(2, 6, 4, 8, time.Second, 4*time.Second, time.Hour, time.Hour)
+	limiter.MaxEntries = 3
+	limiter.now = func() time.Time { return now }
+
+	// fail counts a failure, after the delay imposed by the previous ones
+	fail := func(ip, username string) {
+		if wait := limiter.Check(ip, username); wait > 0 {
+			now = now.Add(wait)
+			assert.Equal(t, time.Duration(0), limiter.Check(ip, username))
+		}
+	}
+
+	// a client spraying usernames: the oldest usernames are forgotten, the
+	// IP address is still tracked
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		fail("192.0.2.1", username+"@example.com")
+		now = now.Add(time.Second)
+		assert.True(t, len(limiter.failures) <= 3)
+	}
+	assert.Contains(t, limiter.failures, "ip:192.0.2.1")
+	assert.Equal(t, 4, limiter.record("ip:192.0.2.1").failures)
+	assert.NotContains(t, limiter.failures, "user:alice@example.com")
+	assert.NotContains(t, limiter.failures, "user:bob@example.com")
+	assert.Contains(t, limiter.failures, "user:dave@example.com")
+
+	// the forgotten failures are removed first
+	now = now.Add(time.Hour)
+	fail("192.0.2.2", "")
+	assert.Len(t, limiter.failures, 1)
+
+	// an active lockout is never evicted
+	for i := 0; i < 6; i++ {
+		fail("192.0.2.3", "alice@example.com")
+	}
+	assert.Equal(t, time.Hour, limiter.Check("192.0.2.4", "alice@example.com"))
+	for _, username := range []string{"bob", "carol", "dave", "erin"} {
+		now = now.Add(time.Second)
+		fail("192.0.2.5", username+"@example.com")
+		assert.Len(t, limiter.failures, 3)
+	}
+	assert.Contains(t, limiter.failures, "user:alice@example.com")
+	assert.Contains(t, limiter.failures, "user:erin@example.com")
+	assert.Equal(t, time.Hour-4*time.Second, limiter.Check("192.0.2.4", "alice@example.com"))
+
+	// only active lockouts: the new IP addresses and usernames are not
+	// tracked
+	limiter = NewRateLimiter(1, 1, 1, 1, time.Second, time.Second, time.Hour, time.Hour)
+	limiter.MaxEntries = 2
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.1", "alice@example.com"))
+	assert.Equal(t, time.Duration(0), limiter.Check("192.0.2.2", "bob@example.com"))
+	assert.Len(t, limiter.failures, 2)
+	assert.Contains(t, limiter.failures, "ip:192.0.2.1")
+	assert.Contains(t, limiter.failures, "user:alice@example.com")
+}
+
+func TestRateLimiterClientIP(t *testing.T) {
+	limiter := NewRateLimiter(1, 1, 1, 1, time.Second, time.Second, time.Second, time.Second)
+	req, _ := http.NewRequest("POST", "", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.1")
+	assert.Equal(t, "192.0.2.1", limiter.ClientIP(req))
+
+	// the header is used only if configured
+	limiter.ClientIPHeader = "X-Forwarded-For"
+	assert.Equal(t, "203.0.113.1", limiter.ClientIP(req))
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "192.0.2.1", limiter.ClientIP(req))
+}
+
+func TestNewRateLimiterFromConfig(t *testing.T) {
+	// enabled by default, with the default values
+	limiter, err := NewRateLimiterFromConfig(ini.File{})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, limiter.UsernameAttempts)
+	assert.Equal(t, 20, limiter.UsernameLockout)
+	assert.Equal(t, 20, limiter.IPAttempts)
+	assert.Equal(t, 100, limiter.IPLockout)
+	assert.Equal(t, time.Second, limiter.Backoff)
+	assert.Equal(t, time.Minute, limiter.MaxBackoff)
+	assert.Equal(t, 15*time.Minute, limiter.LockoutDuration)
+	assert.Equal(t, time.Hour, limiter.ResetAfter)
+	assert.Equal(t, 100000, limiter.MaxEntries)
+	assert.Equal(t, "", limiter.ClientIPHeader)
+
+	limiter, err = NewRateLimiterFromConfig(ini.File{"ratelimit": ini.Section{
+		"username_attempts": "3",
+		"max_backoff":       "30",
+		"client_ip_header":  "X-Real-IP",
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, limiter.UsernameAttempts)
+	assert.Equal(t, 30*time.Second, limiter.MaxBackoff)
+	assert.Equal(t, "X-Real-IP", limiter.ClientIPHeader)
+
+	// disabled
+	limiter, err = NewRateLimiterFromConfig(ini.File{"ratelimit": ini.Section{"enabled": "false"}})
+	assert.NoError(t, err)
+	assert.Nil(t, limiter)
+
+	// invalid configuration
+	_, err = NewRateLimiterFromConfig(ini.File{"ratelimit": ini.Section{"backoff": "0", "ip_lockuot": "10"}})
+	assert.EqualError(t, err, "'backoff' must be a positive number of seconds in 'ratelimit' section; "+
+		"unknown variable 'ip_lockuot' in 'ratelimit' section")
+}
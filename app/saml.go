@@ -0,0 +1,559 @@
+package app
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/vaughan0/go-ini"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// samlNS is the namespace of the SAML assertions.
+	samlNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	// samlProtocolNS is the namespace of the SAML protocol messages.
+	samlProtocolNS = "urn:oasis:names:tc:SAML:2.0:protocol"
+	// samlMetadataNS is the namespace of the SAML metadata.
+	samlMetadataNS = "urn:oasis:names:tc:SAML:2.0:metadata"
+	// samlPOSTBinding and samlRedirectBinding are the bindings of the
+	// messages.
+	samlPOSTBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	// samlEmailNameID is the format of the NameID asked when the identity is
+	// the NameID.
+	samlEmailNameID = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	// samlBearer is the method of the subject confirmations accepted.
+	samlBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	// samlSuccess is the status of a successful response.
+	samlSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	// samlClockSkew is the tolerated difference between the clocks of the
+	// IdP and Gorgon.
+	samlClockSkew = 3 * time.Minute
+)
+
+var (
+	// SAMLConfigKeys are the configuration variables of the "saml" section.
+	SAMLConfigKeys = []ConfigKey{
+		{Name: "enabled", Default: "false", Validate: ValidateBool},
+		{Name: "idp_metadata_file"},
+		{Name: "idp_entity_id"},
+		{Name: "idp_sso_url"},
+		{Name: "idp_cert_file"},
+		{Name: "entity_id"},
+		{Name: "acs_url"},
+		{Name: "attribute"},
+		{Name: "name", Default: "SSO"},
+		{Name: "auto_redirect", Default: "false", Validate: ValidateBool},
+	}
+
+	// SAMLMetadataPath and SAMLACSPath are the paths of SAMLMetadataHandler
+	// and SAMLACSHandler, used by the default entity ID and ACS URL.
+	SAMLMetadataPath = "/.well-known/browserid/_gorgon/saml/metadata"
+	SAMLACSPath      = "/.well-known/browserid/_gorgon/saml/acs"
+)
+
+// SAML delegates the authentication of the users to an upstream SAML 2.0
+// identity provider (ADFS, Shibboleth, ...), Gorgon being the service
+// provider: the user is redirected to the IdP with an AuthnRequest (HTTP
+// redirect binding), and the IdP posts the response to the ACSURL (HTTP POST
+// binding). The response or its assertion must be signed by one of the
+// IdPCertificates (exclusive canonicalization, RSA or ECDSA with SHA-256 or
+// SHA-512), answer the request, and the assertion must be issued for
+// EntityID. The identity is the NameID, or the first value of Attribute, and
+// must be an address of the domain of the IdP. The encrypted assertions are
+// not supported.
+//
+// The entity ID, the single sign-on URL and the certificates of the IdP are
+// read from its metadata, or given in the configuration. SAML is configured
+// in the "saml" section, for example:
+//
+// [saml]
+// enabled = true
+// idp_metadata_file = /etc/gorgon/adfs-metadata.xml
+// entity_id = https://example.com/.well-known/browserid/_gorgon/saml/metadata
+// acs_url = https://example.com/.well-known/browserid/_gorgon/saml/acs
+// attribute = mail
+// name = Example SSO
+// auto_redirect = false
+//
+type SAML struct {
+	EntityID        string              // entity ID of Gorgon (the URL of its metadata)
+	ACSURL          string              // URL of SAMLACSHandler, where the IdP posts the responses
+	IdPEntityID     string              // entity ID of the IdP
+	IdPSSOURL       string              // single sign-on URL of the IdP (HTTP redirect binding)
+	IdPCertificates []*x509.Certificate // certificates signing the responses
+	Attribute       string              // attribute containing the email ("" for the NameID)
+	Name            string              // name of the IdP displayed to the users
+	AutoRedirect    bool                // redirect to the IdP instead of displaying the form
+	Domain          string              // domain of the identities
+	RelayKey        []byte              // key signing the RelayState (derived from the session secret key)
+
+	mutex sync.Mutex           // protects the fields below
+	used  map[string]time.Time // assertion ID => expiration of the assertions already used
+	now   func() time.Time     // current time (replaced in tests)
+}
+
+// NewSAML returns a SAML delegating the authentication to the IdP.
+func NewSAML(entityID, acsURL, idpEntityID, idpSSOURL string, idpCertificates []*x509.Certificate, domain string) *SAML {
+	return &SAML{
+		EntityID:        entityID,
+		ACSURL:          acsURL,
+		IdPEntityID:     idpEntityID,
+		IdPSSOURL:       idpSSOURL,
+		IdPCertificates: idpCertificates,
+		Name:            "SSO",
+		Domain:          domain,
+		used:            map[string]time.Time{},
+		now:             time.Now,
+	}
+}
+
+// NewSAMLRequestID returns a random identifier for an AuthnRequest.
+func NewSAMLRequestID() (string, error) {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	// the identifiers must not start with a digit
+	return "id" + hex.EncodeToString(id), nil
+}
+
+// RelayState returns the signed RelayState of the AuthnRequest id, sent back
+// by the IdP with its response. It carries the identifier and the time of the
+// request, as the session cookie is not sent with the cross-site POST of the
+// IdP (SameSite=Lax); it is at most 80 bytes long. The RelayState doesn't
+// bind the request to the browser, see SAMLACSHandler.
+func (s *SAML) RelayState(id string) (string, error) {
+	if len(s.RelayKey) == 0 {
+		return "", errors.New("SAML: no key to sign the RelayState")
+	}
+	value := id + "." + strconv.FormatInt(s.now().Unix(), 10)
+	return value + "." + s.relaySignature(value), nil
+}
+
+// ParseRelayState returns the identifier and the time (Unix) of the
+// AuthnRequest of a RelayState, or false if its signature is invalid.
+func (s *SAML) ParseRelayState(relayState string) (string, int64, bool) {
+	parts := strings.Split(relayState, ".")
+	if len(s.RelayKey) == 0 || len(parts) != 3 {
+		return "", 0, false
+	}
+	signature := s.relaySignature(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(signature), []byte(parts[2])) {
+		return "", 0, false
+	}
+	since, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], since, true
+}
+
+// relaySignature returns the signature (truncated HMAC-SHA256) of a
+// RelayState.
+func (s *SAML) relaySignature(value string) string {
+	mac := hmac.New(sha256.New, s.RelayKey)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Metadata returns the metadata of Gorgon, to register it at the IdP.
+func (s *SAML) Metadata() []byte {
+	nameIDFormat := ""
+	if s.Attribute == "" {
+		nameIDFormat = "\n    <md:NameIDFormat>" + samlEmailNameID + "</md:NameIDFormat>"
+	}
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="` + samlMetadataNS + `" entityID="` + xmlEscapeAttr(s.EntityID) + `">
+  <md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="` + samlProtocolNS + `">` + nameIDFormat + `
+    <md:AssertionConsumerService Binding="` + samlPOSTBinding + `" Location="` + xmlEscapeAttr(s.ACSURL) + `" index="0" isDefault="true"></md:AssertionConsumerService>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>
+`)
+}
+
+// AuthnRequestURL returns the URL of the IdP where the user authenticates,
+// with the AuthnRequest identified by id and the relayState (if not empty).
+func (s *SAML) AuthnRequestURL(id, relayState string) (string, error) {
+	nameIDPolicy := ""
+	if s.Attribute == "" {
+		nameIDPolicy = `<samlp:NameIDPolicy Format="` + samlEmailNameID + `" AllowCreate="true"></samlp:NameIDPolicy>`
+	}
+	request := `<samlp:AuthnRequest xmlns:samlp="` + samlProtocolNS + `" xmlns:saml="` + samlNS + `"` +
+		` ID="` + xmlEscapeAttr(id) + `" Version="2.0" IssueInstant="` + s.now().UTC().Format(time.RFC3339) + `"` +
+		` Destination="` + xmlEscapeAttr(s.IdPSSOURL) + `" AssertionConsumerServiceURL="` + xmlEscapeAttr(s.ACSURL) + `"` +
+		` ProtocolBinding="` + samlPOSTBinding + `">` +
+		`<saml:Issuer>` + xmlEscapeText(s.EntityID) + `</saml:Issuer>` + nameIDPolicy +
+		`</samlp:AuthnRequest>`
+
+	// DEFLATE, base64 and URL encoding
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	writer.Write([]byte(request))
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	values := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(buffer.Bytes())}}
+	if relayState != "" {
+		values.Set("RelayState", relayState)
+	}
+	separator := "?"
+	if strings.Contains(s.IdPSSOURL, "?") {
+		separator = "&"
+	}
+	return s.IdPSSOURL + separator + values.Encode(), nil
+}
+
+// Login checks the response posted by the IdP (base64 encoded) to the
+// AuthnRequest requestID, and returns the identity of its assertion. An
+// assertion is only accepted once. Returns a CredentialsError if the response
+// is refused.
+func (s *SAML) Login(encoded, requestID string) (*Identity, error) {
+	data, err := xmlDecodeBase64(encoded)
+	if err != nil {
+		return nil, CredentialsError{"SAML: malformed response"}
+	}
+	response, err := parseXML(data)
+	if err != nil {
+		return nil, CredentialsError{"SAML: malformed response: " + err.Error()}
+	}
+	if response.Space != samlProtocolNS || response.Local != "Response" {
+		return nil, CredentialsError{"SAML: not a response"}
+	}
+
+	// the response
+	if destination := response.Attr("Destination"); destination != "" && destination != s.ACSURL {
+		return nil, CredentialsError{"SAML: the response is sent to '" + destination + "'"}
+	}
+	if requestID == "" || response.Attr("InResponseTo") != requestID {
+		return nil, CredentialsError{"SAML: the response does not answer the authentication request"}
+	}
+	if issuer := response.Child(samlNS, "Issuer"); issuer != nil && issuer.Text() != s.IdPEntityID {
+		return nil, CredentialsError{"SAML: unexpected issuer '" + issuer.Text() + "'"}
+	}
+	if status := samlStatus(response); status != samlSuccess {
+		return nil, CredentialsError{"SAML: authentication refused by the IdP (" + status + ")"}
+	}
+
+	// the signed assertion
+	if len(response.ChildrenNamed(samlNS, "EncryptedAssertion")) != 0 {
+		return nil, CredentialsError{"SAML: the encrypted assertions are not supported"}
+	}
+	assertions := response.ChildrenNamed(samlNS, "Assertion")
+	if len(assertions) != 1 {
+		return nil, CredentialsError{"SAML: the response must contain exactly one assertion"}
+	}
+	assertion := assertions[0]
+	signed := false
+	for _, node := range []*xmlNode{response, assertion} {
+		if node.Child(xmlDSigNS, "Signature") == nil {
+			continue
+		}
+		if err := verifyXMLSignature(node, s.IdPCertificates); err != nil {
+			return nil, CredentialsError{"SAML: invalid signature of the " + strings.ToLower(node.Local) + ": " + err.Error()}
+		}
+		signed = true
+	}
+	if !signed {
+		return nil, CredentialsError{"SAML: the response is not signed"}
+	}
+	if issuer := assertion.Child(samlNS, "Issuer"); issuer == nil || issuer.Text() != s.IdPEntityID {
+		return nil, CredentialsError{"SAML: the assertion is not issued by '" + s.IdPEntityID + "'"}
+	}
+	expires, err := s.checkAssertion(assertion, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the identity
+	identity, err := s.identity(assertion)
+	if err != nil {
+		return nil, err
+	}
+
+	// the assertions are only used once
+	id := assertion.Attr("ID")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	for used, expiration := range s.used {
+		if now.After(expiration) {
+			delete(s.used, used)
+		}
+	}
+	if _, ok := s.used[id]; ok || id == "" {
+		return nil, CredentialsError{"SAML: assertion already used"}
+	}
+	s.used[id] = expires.Add(samlClockSkew)
+	return identity, nil
+}
+
+// checkAssertion checks the conditions and the subject confirmation of the
+// assertion. Returns the expiration of the assertion.
+func (s *SAML) checkAssertion(assertion *xmlNode, requestID string) (time.Time, error) {
+	now := s.now()
+
+	// the conditions
+	conditions := assertion.Child(samlNS, "Conditions")
+	if conditions == nil {
+		return time.Time{}, CredentialsError{"SAML: no conditions in the assertion"}
+	}
+	if notBefore := conditions.Attr("NotBefore"); notBefore != "" {
+		t, err := time.Parse(time.RFC3339Nano, notBefore)
+		if err != nil || now.Add(samlClockSkew).Before(t) {
+			return time.Time{}, CredentialsError{"SAML: the assertion is not yet valid"}
+		}
+	}
+	if notOnOrAfter := conditions.Attr("NotOnOrAfter"); notOnOrAfter != "" {
+		t, err := time.Parse(time.RFC3339Nano, notOnOrAfter)
+		if err != nil || !now.Add(-samlClockSkew).Before(t) {
+			return time.Time{}, CredentialsError{"SAML: expired assertion"}
+		}
+	}
+	for _, restriction := range conditions.ChildrenNamed(samlNS, "AudienceRestriction") {
+		allowed := false
+		for _, audience := range restriction.ChildrenNamed(samlNS, "Audience") {
+			allowed = allowed || audience.Text() == s.EntityID
+		}
+		if !allowed {
+			return time.Time{}, CredentialsError{"SAML: the assertion is not issued for '" + s.EntityID + "'"}
+		}
+	}
+
+	// a bearer subject confirmation for this request
+	subject := assertion.Child(samlNS, "Subject")
+	if subject == nil {
+		return time.Time{}, CredentialsError{"SAML: no subject in the assertion"}
+	}
+	for _, confirmation := range subject.ChildrenNamed(samlNS, "SubjectConfirmation") {
+		data := confirmation.Child(samlNS, "SubjectConfirmationData")
+		if confirmation.Attr("Method") != samlBearer || data == nil || data.Attr("Recipient") != s.ACSURL {
+			continue
+		}
+		if inResponseTo := data.Attr("InResponseTo"); inResponseTo != "" && inResponseTo != requestID {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339Nano, data.Attr("NotOnOrAfter"))
+		if err != nil || !now.Add(-samlClockSkew).Before(expires) {
+			continue
+		}
+		return expires, nil
+	}
+	return time.Time{}, CredentialsError{"SAML: no valid subject confirmation in the assertion"}
+}
+
+// identity returns the identity of the assertion: the NameID, or the first
+// value of the attribute. The "displayName" attribute is the name of the
+// user.
+func (s *SAML) identity(assertion *xmlNode) (*Identity, error) {
+	email := ""
+	if s.Attribute == "" {
+		if subject := assertion.Child(samlNS, "Subject"); subject != nil {
+			if nameID := subject.Child(samlNS, "NameID"); nameID != nil {
+				email = nameID.Text()
+			}
+		}
+	} else {
+		email = samlAttribute(assertion, s.Attribute)
+	}
+
+	if !emailInDomain(email, s.Domain) {
+		return nil, CredentialsError{"SAML: the email '" + email + "' is not an address of '" + s.Domain + "'"}
+	}
+	return &Identity{Email: email, DisplayName: samlAttribute(assertion, "displayName")}, nil
+}
+
+// samlAttribute returns the first value of the attribute of the assertion,
+// found by its name or its friendly name.
+func samlAttribute(assertion *xmlNode, name string) string {
+	for _, statement := range assertion.ChildrenNamed(samlNS, "AttributeStatement") {
+		for _, attribute := range statement.ChildrenNamed(samlNS, "Attribute") {
+			if attribute.Attr("Name") != name && attribute.Attr("FriendlyName") != name {
+				continue
+			}
+			if value := attribute.Child(samlNS, "AttributeValue"); value != nil {
+				return value.Text()
+			}
+		}
+	}
+	return ""
+}
+
+// samlStatus returns the status code of the response, followed by the
+// second-level status code if any.
+func samlStatus(response *xmlNode) string {
+	status := response.Child(samlProtocolNS, "Status")
+	if status == nil {
+		return ""
+	}
+	code := status.Child(samlProtocolNS, "StatusCode")
+	if code == nil {
+		return ""
+	}
+	value := code.Attr("Value")
+	if code = code.Child(samlProtocolNS, "StatusCode"); code != nil {
+		value += " " + code.Attr("Value")
+	}
+	return value
+}
+
+// parseSAMLMetadata returns the entity ID, the single sign-on URL (HTTP
+// redirect binding) and the signing certificates of the IdP described by the
+// metadata.
+func parseSAMLMetadata(data []byte) (string, string, []*x509.Certificate, error) {
+	root, err := parseXML(data)
+	if err != nil {
+		return "", "", nil, err
+	}
+	entity := root
+	if root.Space == samlMetadataNS && root.Local == "EntitiesDescriptor" {
+		entity = root.Child(samlMetadataNS, "EntityDescriptor")
+	}
+	if entity == nil || entity.Space != samlMetadataNS || entity.Local != "EntityDescriptor" {
+		return "", "", nil, errors.New("no EntityDescriptor in the metadata")
+	}
+	descriptor := entity.Child(samlMetadataNS, "IDPSSODescriptor")
+	if descriptor == nil {
+		return "", "", nil, errors.New("no IDPSSODescriptor in the metadata")
+	}
+
+	ssoURL := ""
+	for _, service := range descriptor.ChildrenNamed(samlMetadataNS, "SingleSignOnService") {
+		if service.Attr("Binding") == samlRedirectBinding {
+			ssoURL = service.Attr("Location")
+			break
+		}
+	}
+	var certificates []*x509.Certificate
+	for _, key := range descriptor.ChildrenNamed(samlMetadataNS, "KeyDescriptor") {
+		if use := key.Attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		keyInfo := key.Child(xmlDSigNS, "KeyInfo")
+		if keyInfo == nil {
+			continue
+		}
+		for _, x509Data := range keyInfo.ChildrenNamed(xmlDSigNS, "X509Data") {
+			for _, value := range x509Data.ChildrenNamed(xmlDSigNS, "X509Certificate") {
+				der, err := xmlDecodeBase64(value.Text())
+				if err != nil {
+					return "", "", nil, errors.New("malformed certificate in the metadata")
+				}
+				certificate, err := x509.ParseCertificate(der)
+				if err != nil {
+					return "", "", nil, errors.New("malformed certificate in the metadata: " + err.Error())
+				}
+				certificates = append(certificates, certificate)
+			}
+		}
+	}
+	return entity.Attr("entityID"), ssoURL, certificates, nil
+}
+
+// NewSAMLFromConfig returns a new SAML configured from the "saml" section,
+// or nil if the delegation is disabled.
+func NewSAMLFromConfig(config ini.File, domain string) (*SAML, error) {
+	config, err := checkConfigSection(config, "saml", SAMLConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	if enabled, _ := config.Get("saml", "enabled"); enabled != "true" {
+		return nil, nil
+	}
+	if domain == "" {
+		return nil, errors.New("'idp_domain' variable missing from 'global' section")
+	}
+
+	// the IdP, from its metadata and the configuration
+	var idpEntityID, idpSSOURL string
+	var certificates []*x509.Certificate
+	if path, _ := config.Get("saml", "idp_metadata_file"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if idpEntityID, idpSSOURL, certificates, err = parseSAMLMetadata(data); err != nil {
+			return nil, errors.New("malformed metadata in '" + path + "': " + err.Error())
+		}
+	}
+	if value, _ := config.Get("saml", "idp_entity_id"); value != "" {
+		idpEntityID = value
+	}
+	if value, _ := config.Get("saml", "idp_sso_url"); value != "" {
+		idpSSOURL = value
+	}
+	if path, _ := config.Get("saml", "idp_cert_file"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		certificates = nil
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.New("malformed certificate in '" + path + "': " + err.Error())
+			}
+			certificates = append(certificates, certificate)
+		}
+		if len(certificates) == 0 {
+			return nil, errors.New("no certificate found in '" + path + "'")
+		}
+	}
+	if idpEntityID == "" {
+		return nil, errors.New("'idp_entity_id' variable missing from 'saml' section")
+	}
+	if idpSSOURL == "" {
+		return nil, errors.New("'idp_sso_url' variable missing from 'saml' section")
+	}
+	if err := validateHttpURL(idpSSOURL); err != nil {
+		return nil, errors.New("'idp_sso_url' must be an http or https URL in 'saml' section")
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("'idp_cert_file' variable missing from 'saml' section")
+	}
+
+	// Gorgon
+	entityID, _ := config.Get("saml", "entity_id")
+	if entityID == "" {
+		entityID = "https://" + domain + SAMLMetadataPath
+	}
+	acsURL, _ := config.Get("saml", "acs_url")
+	if acsURL == "" {
+		acsURL = "https://" + domain + SAMLACSPath
+	} else if err := validateHttpURL(acsURL); err != nil {
+		return nil, errors.New("'acs_url' must be an http or https URL in 'saml' section")
+	}
+
+	saml := NewSAML(entityID, acsURL, idpEntityID, idpSSOURL, certificates, domain)
+
+	// the RelayState key is derived from the session secret key, the
+	// RelayStates are still valid after a restart or on another instance
+	secret, _ := config.Get("global", "session_secret_key")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("gorgon saml relay state"))
+	saml.RelayKey = mac.Sum(nil)
+
+	saml.Attribute, _ = config.Get("saml", "attribute")
+	saml.Name, _ = config.Get("saml", "name")
+	value, _ := config.Get("saml", "auto_redirect")
+	saml.AutoRedirect = value == "true"
+	return saml, nil
+}
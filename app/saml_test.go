@@ -0,0 +1,467 @@
+package app
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// samlTestResponse describes a response of the test IdP.
+type samlTestResponse struct {
+	ID            string
+	InResponseTo  string
+	Destination   string
+	Issuer        string
+	Status        string
+	AssertionID   string
+	NameID        string
+	Recipient     string
+	Audience      string
+	NotBefore     time.Time
+	NotOnOrAfter  time.Time
+	Attributes    map[string]string
+	SignResponse  bool
+	SignAssertion bool
+}
+
+// samlTestIdP is a SAML identity provider signing responses in tests.
+type samlTestIdP struct {
+	*testRSACertificate
+	EntityID string
+}
+
+// newSAMLTestIdP returns a new IdP with its own key.
+func newSAMLTestIdP(t *testing.T) *samlTestIdP {
+	return &samlTestIdP{newTestRSACertificate(t), "https://idp.example.com/saml"}
+}
+
+// Response returns a valid response to the request of the SAML SP, where
+// the NameID is the email.
+func (idp *samlTestIdP) Response(s *SAML, requestID, email string) samlTestResponse {
+	return samlTestResponse{
+		ID:            "response" + requestID,
+		InResponseTo:  requestID,
+		Destination:   s.ACSURL,
+		Issuer:        idp.EntityID,
+		Status:        samlSuccess,
+		AssertionID:   "assertion" + requestID,
+		NameID:        email,
+		Recipient:     s.ACSURL,
+		Audience:      s.EntityID,
+		NotBefore:     time.Now().Add(-time.Minute),
+		NotOnOrAfter:  time.Now().Add(5 * time.Minute),
+		SignAssertion: true,
+	}
+}
+
+// XML returns the XML document of the response, signed as asked.
+func (idp *samlTestIdP) XML(t *testing.T, r samlTestResponse) string {
+	attributes := ""
+	for name, value := range r.Attributes {
+		attributes += `
+      <saml:Attribute Name="` + name + `" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:basic">
+        <saml:AttributeValue xsi:type="xs:string">` + value + `</saml:AttributeValue>
+      </saml:Attribute>`
+	}
+	document := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="` + r.ID + `" Version="2.0" IssueInstant="` + r.NotBefore.UTC().Format(time.RFC3339) + `" Destination="` + r.Destination + `" InResponseTo="` + r.InResponseTo + `">
+  <saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">` + r.Issuer + `</saml:Issuer>
+  <!--Signature:` + r.ID + `-->
+  <samlp:Status><samlp:StatusCode Value="` + r.Status + `"/></samlp:Status>
+  <saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" ID="` + r.AssertionID + `" Version="2.0" IssueInstant="` + r.NotBefore.UTC().Format(time.RFC3339) + `">
+    <saml:Issuer>` + r.Issuer + `</saml:Issuer>
+    <!--Signature:` + r.AssertionID + `-->
+    <saml:Subject>
+      <saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">` + r.NameID + `</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData InResponseTo="` + r.InResponseTo + `" NotOnOrAfter="` + r.NotOnOrAfter.UTC().Format(time.RFC3339Nano) + `" Recipient="` + r.Recipient + `"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotBefore="` + r.NotBefore.UTC().Format(time.RFC3339) + `" NotOnOrAfter="` + r.NotOnOrAfter.UTC().Format(time.RFC3339) + `">
+      <saml:AudienceRestriction><saml:Audience>` + r.Audience + `</saml:Audience></saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AuthnStatement AuthnInstant="` + r.NotBefore.UTC().Format(time.RFC3339) + `">
+      <saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext>
+    </saml:AuthnStatement>
+    <saml:AttributeStatement>` + attributes + `
+    </saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`
+	if r.SignAssertion {
+		document = signXML(t, document, r.AssertionID, idp.key)
+	}
+	if r.SignResponse {
+		document = signXML(t, document, r.ID, idp.key)
+	}
+	return document
+}
+
+// Encode returns the response as posted to the ACS.
+func (idp *samlTestIdP) Encode(t *testing.T, r samlTestResponse) string {
+	return base64.StdEncoding.EncodeToString([]byte(idp.XML(t, r)))
+}
+
+// Metadata returns the metadata of the IdP.
+func (idp *samlTestIdP) Metadata() string {
+	return `<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="` + idp.EntityID + `">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="encryption">
+      <ds:KeyInfo><ds:X509Data><ds:X509Certificate>MIIB</ds:X509Certificate></ds:X509Data></ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo><ds:X509Data><ds:X509Certificate>
+        ` + base64.StdEncoding.EncodeToString(idp.certificate.Raw) + `
+      </ds:X509Certificate></ds:X509Data></ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/saml/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/saml/redirect"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`
+}
+
+// samlAuthnRequest returns the AuthnRequest of the redirect URL.
+func samlAuthnRequest(t *testing.T, location string) *xmlNode {
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := parseXML(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestSAMLAuthnRequestURL(t *testing.T) {
+	idp := newSAMLTestIdP(t)
+	saml := NewSAML("https://example.com/sp", "https://example.com/acs", idp.EntityID, "https://idp.example.com/saml?tenant=1", nil, "example.com")
+
+	location, err := saml.AuthnRequestURL("id1234", "")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(location, "https://idp.example.com/saml?tenant=1&SAMLRequest="))
+	request := samlAuthnRequest(t, location)
+	assert.Equal(t, samlProtocolNS, request.Space)
+	assert.Equal(t, "AuthnRequest", request.Local)
+	assert.Equal(t, "id1234", request.Attr("ID"))
+	assert.Equal(t, "https://idp.example.com/saml?tenant=1", request.Attr("Destination"))
+	assert.Equal(t, "https://example.com/acs", request.Attr("AssertionConsumerServiceURL"))
+	assert.Equal(t, samlPOSTBinding, request.Attr("ProtocolBinding"))
+	assert.Equal(t, "https://example.com/sp", request.Child(samlNS, "Issuer").Text())
+	assert.Equal(t, samlEmailNameID, request.Child(samlProtocolNS, "NameIDPolicy").Attr("Format"))
+
+	// the NameID is not asked when the identity is an attribute
+	saml.Attribute = "mail"
+	location, _ = saml.AuthnRequestURL("id1234", "")
+	assert.Nil(t, samlAuthnRequest(t, location).Child(samlProtocolNS, "NameIDPolicy"))
+
+	// the RelayState
+	location, _ = saml.AuthnRequestURL("id1234", "state")
+	parsed, err := url.Parse(location)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "state", parsed.Query().Get("RelayState"))
+	}
+}
+
+func TestSAMLRelayState(t *testing.T) {
+	saml := NewSAML("https://example.com/sp", "https://example.com/acs", "https://idp.example.com/saml", "https://idp.example.com/saml", nil, "example.com")
+	id, err := NewSAMLRequestID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TEST: a key is required
+	_, err = saml.RelayState(id)
+	assert.Error(t, err)
+	_, _, ok := saml.ParseRelayState("id1234.1.signature")
+	assert.False(t, ok)
+
+	// TEST: the identifier and the time of the request
+	saml.RelayKey = []byte("relay state key")
+	saml.now = func() time.Time { return time.Unix(1500000000, 0) }
+	relayState, err := saml.RelayState(id)
+	assert.NoError(t, err)
+	assert.True(t, len(relayState) <= 80, relayState)
+	parsedID, since, ok := saml.ParseRelayState(relayState)
+	assert.True(t, ok)
+	assert.Equal(t, id, parsedID)
+	assert.Equal(t, int64(1500000000), since)
+
+	// TEST: a modified RelayState
+	parts := strings.Split(relayState, ".")
+	for _, modified := range []string{
+		"id1234." + parts[1] + "." + parts[2],
+		parts[0] + ".1600000000." + parts[2],
+		parts[0] + "." + parts[1] + ".",
+		parts[0] + "." + parts[1],
+		"",
+	} {
+		_, _, ok = saml.ParseRelayState(modified)
+		assert.False(t, ok, modified)
+	}
+
+	// TEST: a RelayState signed by another instance, with the same key or
+	// another key
+	other := NewSAML("https://example.com/sp", "https://example.com/acs", "https://idp.example.com/saml", "https://idp.example.com/saml", nil, "example.com")
+	other.RelayKey = []byte("relay state key")
+	relayState, _ = other.RelayState(id)
+	_, _, ok = saml.ParseRelayState(relayState)
+	assert.True(t, ok)
+	other.RelayKey = []byte("another key")
+	relayState, _ = other.RelayState(id)
+	_, _, ok = saml.ParseRelayState(relayState)
+	assert.False(t, ok)
+}
+
+func TestSAMLMetadata(t *testing.T) {
+	saml := NewSAML("https://example.com/sp?a=1&b=2", "https://example.com/acs", "https://idp.example.com/saml", "https://idp.example.com/saml", nil, "example.com")
+	metadata, err := parseXML(saml.Metadata())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "EntityDescriptor", metadata.Local)
+	assert.Equal(t, "https://example.com/sp?a=1&b=2", metadata.Attr("entityID"))
+	descriptor := metadata.Child(samlMetadataNS, "SPSSODescriptor")
+	if assert.NotNil(t, descriptor) {
+		service := descriptor.Child(samlMetadataNS, "AssertionConsumerService")
+		assert.Equal(t, samlPOSTBinding, service.Attr("Binding"))
+		assert.Equal(t, "https://example.com/acs", service.Attr("Location"))
+		assert.Equal(t, samlEmailNameID, descriptor.Child(samlMetadataNS, "NameIDFormat").Text())
+	}
+}
+
+func TestSAMLLogin(t *testing.T) {
+	idp := newSAMLTestIdP(t)
+	saml := NewSAML("https://example.com/sp", "https://example.com/acs", idp.EntityID, "https://idp.example.com/saml", []*x509.Certificate{idp.certificate}, "example.com")
+	login := func(r samlTestResponse) (*Identity, error) {
+		return saml.Login(idp.Encode(t, r), r.InResponseTo)
+	}
+
+	// TEST: a signed assertion
+	response := idp.Response(saml, "id1", "alice@example.com")
+	identity, err := login(response)
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "alice@example.com", identity.Email)
+	}
+
+	// TEST: an assertion is only used once
+	_, err = login(response)
+	assert.True(t, IsCredentialsError(err))
+	assert.Contains(t, err.Error(), "already used")
+
+	// TEST: a signed response
+	response = idp.Response(saml, "id2", "alice@example.com")
+	response.SignAssertion, response.SignResponse = false, true
+	_, err = login(response)
+	assert.NoError(t, err)
+	response = idp.Response(saml, "id3", "alice@example.com")
+	response.SignResponse = true
+	_, err = login(response)
+	assert.NoError(t, err)
+
+	// TEST: the response must answer the request
+	response = idp.Response(saml, "id4", "alice@example.com")
+	_, err = saml.Login(idp.Encode(t, response), "other")
+	assert.True(t, IsCredentialsError(err))
+	_, err = saml.Login(idp.Encode(t, response), "")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: an attribute as identity, the display name
+	saml.Attribute = "mail"
+	response = idp.Response(saml, "id5", "alice@example.com")
+	response.Attributes = map[string]string{"mail": "bob@example.com", "displayName": "Bob"}
+	identity, err = login(response)
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "bob@example.com", identity.Email)
+		assert.Equal(t, "Bob", identity.DisplayName)
+	}
+	response = idp.Response(saml, "id6", "alice@example.com")
+	_, err = login(response)
+	assert.True(t, IsCredentialsError(err))
+	saml.Attribute = ""
+
+	// TEST: the invalid responses
+	for name, modify := range map[string]func(*samlTestResponse){
+		"unsigned":      func(r *samlTestResponse) { r.SignAssertion = false },
+		"other domain":  func(r *samlTestResponse) { r.NameID = "alice@other.com" },
+		"no email":      func(r *samlTestResponse) { r.NameID = "alice" },
+		"destination":   func(r *samlTestResponse) { r.Destination = "https://other.com/acs" },
+		"issuer":        func(r *samlTestResponse) { r.Issuer = "https://other.com/saml" },
+		"status":        func(r *samlTestResponse) { r.Status = "urn:oasis:names:tc:SAML:2.0:status:Requester" },
+		"recipient":     func(r *samlTestResponse) { r.Recipient = "https://other.com/acs" },
+		"audience":      func(r *samlTestResponse) { r.Audience = "https://other.com/sp" },
+		"not yet valid": func(r *samlTestResponse) { r.NotBefore = time.Now().Add(10 * time.Minute) },
+		"expired":       func(r *samlTestResponse) { r.NotOnOrAfter = time.Now().Add(-10 * time.Minute) },
+		"other request": func(r *samlTestResponse) { r.InResponseTo = "other" },
+	} {
+		response = idp.Response(saml, "id-"+strings.Replace(name, " ", "-", -1), "alice@example.com")
+		requestID := response.InResponseTo
+		modify(&response)
+		_, err = saml.Login(idp.Encode(t, response), requestID)
+		assert.True(t, IsCredentialsError(err), name)
+	}
+
+	// TEST: the signature of another IdP
+	other := newSAMLTestIdP(t)
+	response = idp.Response(saml, "id7", "alice@example.com")
+	_, err = saml.Login(other.Encode(t, response), "id7")
+	assert.True(t, IsCredentialsError(err))
+	assert.Contains(t, err.Error(), "signature")
+
+	// TEST: the signed assertion is modified
+	response = idp.Response(saml, "id8", "alice@example.com")
+	document := strings.Replace(idp.XML(t, response), "alice@example.com", "admin@example.com", 1)
+	_, err = saml.Login(base64.StdEncoding.EncodeToString([]byte(document)), "id8")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: an assertion is added to a signed response
+	response = idp.Response(saml, "id9", "alice@example.com")
+	signed := idp.XML(t, response)
+	start := strings.Index(signed, "<saml:Assertion")
+	end := strings.Index(signed, "</saml:Assertion>") + len("</saml:Assertion>")
+	evil := strings.Replace(signed[start:end], `ID="assertionid9"`, `ID="evil"`, 1)
+	evil = strings.Replace(evil, "alice@example.com", "admin@example.com", 1)
+	_, err = saml.Login(base64.StdEncoding.EncodeToString([]byte(signed[:start]+evil+signed[start:])), "id9")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the signed assertion is moved into an unsigned one
+	wrapped := signed[:start] + evil[:strings.Index(evil, "<saml:Subject>")] + "<saml:Advice>" + signed[start:end] + "</saml:Advice>" + evil[strings.Index(evil, "<saml:Subject>"):] + signed[end:]
+	_, err = saml.Login(base64.StdEncoding.EncodeToString([]byte(wrapped)), "id9")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the encrypted assertions and the malformed responses
+	for _, document := range []string{
+		"",
+		"<samlp:Response",
+		`<Response xmlns="urn:other"/>`,
+		strings.Replace(signed, "</samlp:Response>", `<saml:EncryptedAssertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"/></samlp:Response>`, 1),
+		strings.Replace(signed[:start]+signed[end:], "<samlp:Status>", `<!DOCTYPE x><samlp:Status>`, 1),
+	} {
+		_, err = saml.Login(base64.StdEncoding.EncodeToString([]byte(document)), "id9")
+		assert.True(t, IsCredentialsError(err), document)
+	}
+	_, err = saml.Login("!!!", "id9")
+	assert.True(t, IsCredentialsError(err))
+
+	// TEST: the used assertions are forgotten once expired
+	assert.Len(t, saml.used, 4)
+	saml.now = func() time.Time { return time.Now().Add(time.Hour) }
+	response = idp.Response(saml, "id10", "alice@example.com")
+	response.NotBefore = saml.now().Add(-time.Minute)
+	response.NotOnOrAfter = saml.now().Add(5 * time.Minute)
+	_, err = login(response)
+	assert.NoError(t, err)
+	assert.Len(t, saml.used, 1)
+}
+
+func TestNewSAMLFromConfig(t *testing.T) {
+	idp := newSAMLTestIdP(t)
+	dir, err := ioutil.TempDir("", "gorgon-saml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	metadataFile := filepath.Join(dir, "metadata.xml")
+	certFile := filepath.Join(dir, "idp.pem")
+	ioutil.WriteFile(metadataFile, []byte(idp.Metadata()), 0600)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idp.certificate.Raw}), 0600)
+
+	// SAML is disabled by default
+	saml, err := NewSAMLFromConfig(ini.File{}, "example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, saml)
+
+	// the IdP is required
+	_, err = NewSAMLFromConfig(ini.File{"saml": {"enabled": "true"}}, "example.com")
+	assert.EqualError(t, err, "'idp_entity_id' variable missing from 'saml' section")
+	_, err = NewSAMLFromConfig(ini.File{"saml": {"enabled": "true", "idp_entity_id": idp.EntityID}}, "example.com")
+	assert.EqualError(t, err, "'idp_sso_url' variable missing from 'saml' section")
+	_, err = NewSAMLFromConfig(ini.File{"saml": {"enabled": "true", "idp_entity_id": idp.EntityID, "idp_sso_url": "https://idp.example.com/saml"}}, "example.com")
+	assert.EqualError(t, err, "'idp_cert_file' variable missing from 'saml' section")
+
+	// the IdP given by its metadata, the default values; the RelayState key
+	// is derived from the session secret key
+	global := ini.Section{"session_secret_key": "secret key"}
+	saml, err = NewSAMLFromConfig(ini.File{"global": global, "saml": {"enabled": "true", "idp_metadata_file": metadataFile}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, saml) {
+		assert.Len(t, saml.RelayKey, 32)
+		assert.NotEqual(t, []byte("secret key"), saml.RelayKey)
+		again, _ := NewSAMLFromConfig(ini.File{"global": global, "saml": {"enabled": "true", "idp_metadata_file": metadataFile}}, "example.com")
+		assert.Equal(t, saml.RelayKey, again.RelayKey)
+		assert.Equal(t, idp.EntityID, saml.IdPEntityID)
+		assert.Equal(t, "https://idp.example.com/saml/redirect", saml.IdPSSOURL)
+		assert.Equal(t, []*x509.Certificate{idp.certificate}, saml.IdPCertificates)
+		assert.Equal(t, "https://example.com/.well-known/browserid/_gorgon/saml/metadata", saml.EntityID)
+		assert.Equal(t, "https://example.com/.well-known/browserid/_gorgon/saml/acs", saml.ACSURL)
+		assert.Equal(t, "", saml.Attribute)
+		assert.Equal(t, "SSO", saml.Name)
+		assert.False(t, saml.AutoRedirect)
+	}
+
+	// all the values
+	other := newSAMLTestIdP(t)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.certificate.Raw}), 0600)
+	saml, err = NewSAMLFromConfig(ini.File{"saml": {
+		"enabled":           "true",
+		"idp_metadata_file": metadataFile,
+		"idp_entity_id":     "urn:idp",
+		"idp_sso_url":       "https://sso.example.com/adfs/ls/",
+		"idp_cert_file":     certFile,
+		"entity_id":         "urn:gorgon",
+		"acs_url":           "https://login.example.com/acs",
+		"attribute":         "mail",
+		"name":              "ADFS",
+		"auto_redirect":     "true",
+	}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, saml) {
+		assert.Equal(t, "urn:idp", saml.IdPEntityID)
+		assert.Equal(t, "https://sso.example.com/adfs/ls/", saml.IdPSSOURL)
+		assert.Equal(t, []*x509.Certificate{other.certificate}, saml.IdPCertificates)
+		assert.Equal(t, "urn:gorgon", saml.EntityID)
+		assert.Equal(t, "https://login.example.com/acs", saml.ACSURL)
+		assert.Equal(t, "mail", saml.Attribute)
+		assert.Equal(t, "ADFS", saml.Name)
+		assert.True(t, saml.AutoRedirect)
+	}
+
+	// invalid values
+	for _, section := range []map[string]string{
+		{"enabled": "yes", "idp_metadata_file": metadataFile},
+		{"enabled": "true", "idp_metadata_file": filepath.Join(dir, "missing.xml")},
+		{"enabled": "true", "idp_metadata_file": certFile},
+		{"enabled": "true", "idp_metadata_file": metadataFile, "idp_cert_file": metadataFile},
+		{"enabled": "true", "idp_metadata_file": metadataFile, "idp_sso_url": "ftp://idp.example.com"},
+		{"enabled": "true", "idp_metadata_file": metadataFile, "acs_url": "/acs"},
+		{"enabled": "true", "idp_metadata_file": metadataFile, "auto_redirect": "1"},
+	} {
+		_, err = NewSAMLFromConfig(ini.File{"saml": section}, "example.com")
+		assert.Error(t, err, section)
+	}
+
+	// the domain of the IdP is required
+	_, err = NewSAMLFromConfig(ini.File{"saml": {"enabled": "true", "idp_metadata_file": metadataFile}}, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/vaughan0/go-ini"
+	"io/ioutil"
+)
+
+var (
+	// TLSVersions maps the values allowed for the "min_tls_version" option
+	// to TLS versions.
+	TLSVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// TLSConfigKeys are the configuration variables read by NewTLSConfig,
+	// added to the keys of the authentication backends using NewTLSConfig.
+	TLSConfigKeys = []ConfigKey{
+		{Name: "verify_cert", Default: "true", Validate: ValidateBool},
+		{Name: "ca_file"},
+		{Name: "server_name"},
+		{Name: "min_tls_version", Validate: ValidateOneOf("1.0", "1.1", "1.2", "1.3")},
+	}
+)
+
+// NewTLSConfig returns a *tls.Config used to connect to a server, configured
+// from the following variables of the given section:
+// - verify_cert: should verify the certificate presented by the server
+//   (default: true)
+// - ca_file: PEM encoded CA certificates used to verify the certificate
+//   presented by the server (default: system CAs)
+// - server_name: name expected in the certificate presented by the server
+//   (default: serverName)
+// - min_tls_version: minimum TLS version accepted, "1.0", "1.1", "1.2" or
+//   "1.3" (default: 1.2)
+func NewTLSConfig(config ini.File, section, serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if verifyCert, ok := config.Get(section, "verify_cert"); ok && verifyCert != "true" {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if caFile, ok := config.Get(section, "ca_file"); ok && caFile != "" {
+		pemData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, errors.New("no certificate found in '" + caFile + "'")
+		}
+	}
+
+	if name, ok := config.Get(section, "server_name"); ok && name != "" {
+		tlsConfig.ServerName = name
+	}
+
+	if version, ok := config.Get(section, "min_tls_version"); ok && version != "" {
+		if tlsConfig.MinVersion, ok = TLSVersions[version]; !ok {
+			return nil, errors.New("'min_tls_version' must be one of '1.0', '1.1', '1.2' or '1.3' in '" + section + "' section")
+		}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// newTestCertificate returns a self-signed certificate valid for "localhost"
+// and 127.0.0.1, and the PEM encoding of this certificate.
+func newTestCertificate(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// newTestTLSConfigs returns a server *tls.Config using a self-signed
+// certificate, and a client *tls.Config trusting this certificate.
+func newTestTLSConfigs(t *testing.T) (serverConfig, clientConfig *tls.Config) {
+	certificate, pemData := newTestCertificate(t)
+	serverConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	clientConfig = &tls.Config{ServerName: "localhost", RootCAs: x509.NewCertPool()}
+	clientConfig.RootCAs.AppendCertsFromPEM(pemData)
+	return
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	_, pemData := newTestCertificate(t)
+	caFile, err := ioutil.TempFile("", "gorgon-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	caFile.Write(pemData)
+	caFile.Close()
+
+	// default values
+	tlsConfig, err := NewTLSConfig(ini.File{}, "auth:test", "imap.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "imap.example.com", tlsConfig.ServerName)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+	assert.Nil(t, tlsConfig.RootCAs)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+
+	// all values
+	config := ini.File{"auth:test": ini.Section{
+		"verify_cert":     "false",
+		"ca_file":         caFile.Name(),
+		"server_name":     "mail.example.com",
+		"min_tls_version": "1.3",
+	}}
+	tlsConfig, err = NewTLSConfig(config, "auth:test", "imap.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "mail.example.com", tlsConfig.ServerName)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+
+	// invalid values
+	config = ini.File{"auth:test": ini.Section{"min_tls_version": "2.0"}}
+	_, err = NewTLSConfig(config, "auth:test", "imap.example.com")
+	assert.Error(t, err)
+
+	config = ini.File{"auth:test": ini.Section{"ca_file": "../tests/gorgon.ini"}}
+	_, err = NewTLSConfig(config, "auth:test", "imap.example.com")
+	assert.Error(t, err)
+
+	config = ini.File{"auth:test": ini.Section{"ca_file": "/this/file/does/not/exist"}}
+	_, err = NewTLSConfig(config, "auth:test", "imap.example.com")
+	assert.Error(t, err)
+}
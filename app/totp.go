@@ -0,0 +1,299 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	totpDigits = 6  // number of digits of a code
+	totpPeriod = 30 // lifetime of a code, in seconds
+)
+
+var (
+	// TOTPConfigKeys are the configuration variables of the "totp" section.
+	TOTPConfigKeys = []ConfigKey{
+		{Name: "enabled", Default: "false", Validate: ValidateBool},
+		{Name: "store"},
+		{Name: "issuer"},
+		{Name: "require"},
+		{Name: "skew", Default: "1", Validate: ValidateNonNegativeInt},
+	}
+
+	// totpEncoding is the encoding of the secrets (base32 without padding,
+	// as expected by the authenticator apps).
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// TOTP is the second authentication factor: time-based one-time passwords
+// (RFC 6238) of 6 digits, changing every 30 seconds. A user enrolled in the
+// TOTP store must enter a code after the Authenticator accepted the
+// password. The Require policy forces the users to enroll, each entry being
+// an email address, a domain ("@example.com") or "*" (all the users). The
+// other users can enroll if they want to.
+//
+// TOTP is configured in the "totp" section, for example:
+//
+// [totp]
+// enabled = true
+// store = /var/lib/gorgon/totp.json
+// issuer = example.com
+// require = @example.com, bob@example.org
+// skew = 1
+//
+type TOTP struct {
+	Store   *TOTPStore // secrets of the enrolled users
+	Issuer  string     // name displayed by the authenticator apps
+	Require []string   // users who must use TOTP
+	Skew    int        // number of periods accepted before and after the current one
+
+	now func() time.Time // current time (replaced in tests)
+}
+
+// NewTOTP returns a TOTP.
+func NewTOTP(store *TOTPStore, issuer string, require []string, skew int) *TOTP {
+	return &TOTP{Store: store, Issuer: issuer, Require: require, Skew: skew, now: time.Now}
+}
+
+// Required returns true if the policy forces the user to use TOTP.
+func (t *TOTP) Required(email string) bool {
+	email = strings.ToLower(email)
+	for _, entry := range t.Require {
+		entry = strings.ToLower(entry)
+		switch {
+		case entry == "*":
+			return true
+		case strings.HasPrefix(entry, "@") && strings.HasSuffix(email, entry):
+			return true
+		case entry == email:
+			return true
+		}
+	}
+	return false
+}
+
+// Enrolled returns true if the user has a TOTP secret.
+func (t *TOTP) Enrolled(email string) (bool, error) {
+	record, err := t.Store.Get(email)
+	if err != nil {
+		return false, err
+	}
+	return record != nil, nil
+}
+
+// Verify checks a code of an enrolled user. A code can't be used twice.
+// Returns a CredentialsError if the code is invalid.
+func (t *TOTP) Verify(email, code string) error {
+	return t.Store.Update(email, func(record *TOTPRecord) error {
+		if record.Secret == "" {
+			return CredentialsError{"TOTP: '" + email + "' is not enrolled"}
+		}
+		counter, ok := t.check(record.Secret, code, record.LastCounter)
+		if !ok {
+			return CredentialsError{"TOTP: invalid code for '" + email + "'"}
+		}
+		record.LastCounter = counter
+		return nil
+	})
+}
+
+// Enroll stores the secret of the user once the user has proven, with a
+// valid code, that the secret is known by their authenticator app. An
+// existing secret is replaced. Returns a CredentialsError if the code is
+// invalid.
+func (t *TOTP) Enroll(email, secret, code string) error {
+	counter, ok := t.check(secret, code, 0)
+	if !ok {
+		return CredentialsError{"TOTP: invalid enrolment code for '" + email + "'"}
+	}
+	return t.Store.Update(email, func(record *TOTPRecord) error {
+		record.Secret = secret
+		record.LastCounter = counter
+		return nil
+	})
+}
+
+// check compares the code with the codes of the accepted periods, newer than
+// the last used period. Returns the period of the code.
+func (t *TOTP) check(secret, code string, last uint64) (uint64, bool) {
+	key, err := DecodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := uint64(t.now().Unix()) / totpPeriod
+	for i := -t.Skew; i <= t.Skew; i++ {
+		counter := current + uint64(i)
+		if counter <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(HOTPCode(key, counter, totpDigits)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningURI returns the "otpauth://" URI of a secret, displayed as a QR
+// code and read by the authenticator apps.
+func (t *TOTP) ProvisioningURI(email, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", t.Issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + t.Issuer + ":" + email,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// NewTOTPSecret returns a new random secret of 160 bits, encoded in base32.
+func NewTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// DecodeTOTPSecret decodes a base32 secret, spaces and case are ignored.
+func DecodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return totpEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// HOTPCode returns the HMAC-based one-time password (RFC 4226) of the key for
+// the counter.
+func HOTPCode(key []byte, counter uint64, digits int) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
+
+// TOTPStore keeps the TOTP secrets of the users in a JSON file, only
+// readable by Gorgon. The file is created when the first user enrolls.
+type TOTPStore struct {
+	Path string // path to the JSON file
+
+	mutex sync.Mutex // serializes the updates of the file
+}
+
+// TOTPRecord is the TOTP secret of a user.
+type TOTPRecord struct {
+	Secret      string `json:"secret"`       // base32 encoded secret
+	LastCounter uint64 `json:"last_counter"` // period of the last used code
+}
+
+// Get returns the record of the user, nil if the user is not enrolled.
+func (s *TOTPStore) Get(email string) (*TOTPRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	record, ok := records[strings.ToLower(email)]
+	if !ok {
+		return nil, nil
+	}
+	return record, nil
+}
+
+// Update calls fn with the record of the user (empty if the user is not
+// enrolled) and saves the modified record, unless fn returns an error.
+func (s *TOTPStore) Update(email string, fn func(record *TOTPRecord) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	email = strings.ToLower(email)
+	record, ok := records[email]
+	if !ok {
+		record = &TOTPRecord{}
+	}
+	if err := fn(record); err != nil {
+		return err
+	}
+	records[email] = record
+	return s.save(records)
+}
+
+// load reads the file, a missing file is an empty store.
+func (s *TOTPStore) load() (map[string]*TOTPRecord, error) {
+	records := make(map[string]*TOTPRecord)
+	if err := readJSONFile(s.Path, &records); err != nil {
+		return nil, errors.New("TOTPStore: " + err.Error())
+	}
+	return records, nil
+}
+
+// save replaces the file atomically.
+func (s *TOTPStore) save(records map[string]*TOTPRecord) error {
+	return writeJSONFile(s.Path, records)
+}
+
+// NewTOTPFromConfig returns the TOTP configured in the "totp" section, or nil
+// if TOTP is disabled. The issuer defaults to the domain of the IdP.
+func NewTOTPFromConfig(config ini.File, domain string) (*TOTP, error) {
+	config, err := checkConfigSection(config, "totp", TOTPConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	if enabled, _ := config.Get("totp", "enabled"); enabled != "true" {
+		return nil, nil
+	}
+
+	path, _ := config.Get("totp", "store")
+	if path == "" {
+		return nil, errors.New("'store' variable missing from 'totp' section")
+	}
+	issuer, _ := config.Get("totp", "issuer")
+	if issuer == "" {
+		issuer = domain
+	}
+	require := []string{}
+	value, _ := config.Get("totp", "require")
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			require = append(require, entry)
+		}
+	}
+	value, _ = config.Get("totp", "skew")
+	skew, _ := strconv.Atoi(value)
+
+	store := &TOTPStore{Path: path}
+	// read the store a first time to detect errors early
+	if _, err := store.Get(""); err != nil {
+		return nil, err
+	}
+	return NewTOTP(store, issuer, require, skew), nil
+}
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestHOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	// test vectors from RFC 4226
+	for counter, code := range []string{"755224", "287082", "359152", "969429", "338314"} {
+		assert.Equal(t, code, HOTPCode(key, uint64(counter), 6))
+	}
+
+	// test vectors from RFC 6238 (SHA-1)
+	for timestamp, code := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		assert.Equal(t, code, HOTPCode(key, uint64(timestamp/30), 8))
+	}
+}
+
+func TestTOTPSecret(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	assert.NoError(t, err)
+	assert.Len(t, secret, 32)
+	key, err := DecodeTOTPSecret(secret)
+	assert.NoError(t, err)
+	assert.Len(t, key, 20)
+
+	// spaces, case and padding are ignored
+	key, err = DecodeTOTPSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("12345678901234567890"), key)
+	_, err = DecodeTOTPSecret("not base32!")
+	assert.Error(t, err)
+}
+
+func TestTOTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorgon-totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1111111111, 0)
+	totp := NewTOTP(&TOTPStore{Path: filepath.Join(dir, "totp.json")}, "example.com", []string{"@example.org", "Bob@example.com"}, 1)
+	totp.now = func() time.Time { return now }
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	key, _ := DecodeTOTPSecret(secret)
+	code := func(offset int) string {
+		return HOTPCode(key, uint64(now.Unix()/30+int64(offset)), 6)
+	}
+
+	// policy
+	assert.True(t, totp.Required("alice@example.org"))
+	assert.True(t, totp.Required("bob@example.com"))
+	assert.False(t, totp.Required("alice@example.com"))
+	assert.True(t, NewTOTP(nil, "", []string{"*"}, 1).Required("alice@example.com"))
+
+	// the user is not enrolled
+	enrolled, err := totp.Enrolled("alice@example.com")
+	assert.NoError(t, err)
+	assert.False(t, enrolled)
+	assert.True(t, IsCredentialsError(totp.Verify("alice@example.com", code(0))))
+
+	// enrolment needs a valid code
+	assert.True(t, IsCredentialsError(totp.Enroll("alice@example.com", secret, "000000")))
+	assert.NoError(t, totp.Enroll("Alice@example.com", secret, code(0)))
+	enrolled, err = totp.Enrolled("alice@example.com")
+	assert.NoError(t, err)
+	assert.True(t, enrolled)
+	info, err := os.Stat(totp.Store.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// a code can't be used twice, even the code used for the enrolment
+	assert.True(t, IsCredentialsError(totp.Verify("alice@example.com", code(0))))
+	assert.True(t, IsCredentialsError(totp.Verify("alice@example.com", code(-1))))
+	assert.NoError(t, totp.Verify("alice@example.com", code(1)))
+	assert.True(t, IsCredentialsError(totp.Verify("alice@example.com", code(1))))
+
+	// codes out of the accepted periods are refused
+	now = now.Add(time.Minute)
+	assert.True(t, IsCredentialsError(totp.Verify("alice@example.com", code(2))))
+	assert.True(t, IsCredentialsError(totp.Verify("alice@example.com", "12345")))
+	assert.NoError(t, totp.Verify("alice@example.com", code(0)))
+
+	// the secrets are kept in the store
+	store := &TOTPStore{Path: totp.Store.Path}
+	record, err := store.Get("alice@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, &TOTPRecord{Secret: secret, LastCounter: uint64(now.Unix() / 30)}, record)
+
+	// a malformed store is an error
+	ioutil.WriteFile(totp.Store.Path, []byte("{"), 0600)
+	_, err = totp.Enrolled("alice@example.com")
+	assert.Error(t, err)
+	assert.False(t, IsCredentialsError(err))
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	totp := NewTOTP(nil, "Example Corp", nil, 1)
+	assert.Equal(t,
+		"otpauth://totp/Example%20Corp:alice@example.com?algorithm=SHA1&digits=6&issuer=Example+Corp&period=30&secret=GEZDGNBVGY3TQOJQ",
+		totp.ProvisioningURI("alice@example.com", "GEZDGNBVGY3TQOJQ"))
+}
+
+func TestNewTOTPFromConfig(t *testing.T) {
+	// disabled by default
+	totp, err := NewTOTPFromConfig(ini.File{}, "example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, totp)
+
+	totp, err = NewTOTPFromConfig(ini.File{"totp": ini.Section{
+		"enabled": "true",
+		"store":   "../tests/missing-totp.json",
+		"require": "@example.com, bob@example.org,",
+	}}, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "../tests/missing-totp.json", totp.Store.Path)
+	assert.Equal(t, "example.com", totp.Issuer)
+	assert.Equal(t, []string{"@example.com", "bob@example.org"}, totp.Require)
+	assert.Equal(t, 1, totp.Skew)
+
+	// invalid configurations
+	for _, section := range []ini.Section{
+		{"enabled": "true"},
+		{"enabled": "yes", "store": "../tests/missing-totp.json"},
+		{"enabled": "true", "store": "../tests/missing-totp.json", "skew": "-1"},
+		{"enabled": "true", "store": "../tests/gorgon.ini"},
+	} {
+		_, err = NewTOTPFromConfig(ini.File{"totp": section}, "example.com")
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,760 @@
+package app
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/vaughan0/go-ini"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// COSE algorithms (RFC 8152) of the supported credential keys.
+const (
+	coseAlgES256 = -7   // ECDSA P-256 with SHA-256
+	coseAlgEdDSA = -8   // Ed25519
+	coseAlgRS256 = -257 // RSASSA-PKCS1-v1_5 with SHA-256
+)
+
+// flags of the authenticator data
+const (
+	webAuthnFlagUserPresent  = 0x01
+	webAuthnFlagUserVerified = 0x04
+	webAuthnFlagAttested     = 0x40
+	webAuthnFlagExtensions   = 0x80
+)
+
+var (
+	// WebAuthnConfigKeys are the configuration variables of the "webauthn"
+	// section.
+	WebAuthnConfigKeys = []ConfigKey{
+		{Name: "enabled", Default: "false", Validate: ValidateBool},
+		{Name: "store"},
+		{Name: "rp_id"},
+		{Name: "rp_name"},
+		{Name: "origin"},
+		{Name: "passwordless", Default: "false", Validate: ValidateBool},
+		{Name: "timeout", Default: "60", Validate: ValidateSeconds},
+	}
+
+	// webAuthnEncoding is the encoding of the binary values exchanged with
+	// the browser (base64url without padding).
+	webAuthnEncoding = base64.RawURLEncoding
+)
+
+// WebAuthn lets the users authenticate with security keys and platform
+// authenticators (Web Authentication, W3C). A registered credential is
+// either a second authentication factor, asked after the Authenticator
+// accepted the password, or, if Passwordless is set, a way to authenticate
+// without a password (the authenticator must then verify the user, with a
+// PIN or a biometric sensor). A user with a registered credential must use
+// it, or TOTP if enrolled, as second factor; a credential also satisfies the
+// TOTP policy.
+//
+// The users register their credentials once authenticated. Only the "none"
+// and "packed" attestation formats are accepted, and the attestation
+// certificates are not checked against trusted roots: the credentials are
+// bound to the accounts, not to authenticator models.
+//
+// WebAuthn is configured in the "webauthn" section, for example:
+//
+// [webauthn]
+// enabled = true
+// store = /var/lib/gorgon/webauthn.json
+// rp_id = example.com
+// rp_name = Example
+// origin = https://example.com
+// passwordless = true
+// timeout = 60
+//
+type WebAuthn struct {
+	Store        *WebAuthnStore // credentials of the users
+	RPID         string         // relying party ID: the domain the credentials are bound to
+	RPName       string         // name displayed by the browsers
+	Origin       string         // origin of the authentication page
+	Passwordless bool           // allow authentication without a password
+	Timeout      time.Duration  // time given to the user to complete a ceremony
+
+	now func() time.Time // current time (replaced in tests)
+}
+
+// NewWebAuthn returns a WebAuthn.
+func NewWebAuthn(store *WebAuthnStore, rpID, rpName, origin string, passwordless bool, timeout time.Duration) *WebAuthn {
+	return &WebAuthn{
+		Store:        store,
+		RPID:         rpID,
+		RPName:       rpName,
+		Origin:       origin,
+		Passwordless: passwordless,
+		Timeout:      timeout,
+		now:          time.Now,
+	}
+}
+
+// WebAuthnCreationOptions are the options of a registration, passed by the
+// browser to navigator.credentials.create(). The binary values are encoded
+// in base64url.
+type WebAuthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUserEntity             `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+// WebAuthnRequestOptions are the options of an authentication, passed by the
+// browser to navigator.credentials.get(). The binary values are encoded in
+// base64url.
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	RPID             string                         `json:"rpId"`
+	Timeout          int64                          `json:"timeout"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+// WebAuthnRelyingParty describes the IdP to the authenticators.
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebAuthnUserEntity describes the user to the authenticators.
+type WebAuthnUserEntity struct {
+	ID          string `json:"id"` // user handle
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// WebAuthnCredentialParameter is an accepted credential algorithm.
+type WebAuthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// WebAuthnCredentialDescriptor identifies a credential.
+type WebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// WebAuthnAuthenticatorSelection are the requirements on the authenticators.
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnCredentialResponse is the credential returned by the browser at
+// the end of a registration or an authentication. The binary values are
+// encoded in base64url.
+type WebAuthnCredentialResponse struct {
+	ID       string                        `json:"id"`
+	Type     string                        `json:"type"`
+	Response WebAuthnAuthenticatorResponse `json:"response"`
+}
+
+// WebAuthnAuthenticatorResponse is the response of the authenticator, with
+// an attestation object for a registration, or the authenticator data and a
+// signature for an authentication.
+type WebAuthnAuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// NewWebAuthnChallenge returns a new random challenge of 256 bits.
+func NewWebAuthnChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// CreationOptions returns the options of the registration of a new
+// credential for the user. The credentials already registered are excluded.
+func (a *WebAuthn) CreationOptions(email, displayName string, challenge []byte) (*WebAuthnCreationOptions, error) {
+	user, err := a.Store.Get(email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		// the user handle must not change between the registrations
+		err = a.Store.Update(email, func(u *WebAuthnUser) error {
+			user = u
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if displayName == "" {
+		displayName = email
+	}
+
+	selection := WebAuthnAuthenticatorSelection{ResidentKey: "discouraged", UserVerification: "preferred"}
+	if a.Passwordless {
+		// the credential must be discoverable to be used without username
+		selection = WebAuthnAuthenticatorSelection{ResidentKey: "required", UserVerification: "required"}
+	}
+	return &WebAuthnCreationOptions{
+		Challenge: webAuthnEncoding.EncodeToString(challenge),
+		RP:        WebAuthnRelyingParty{ID: a.RPID, Name: a.RPName},
+		User:      WebAuthnUserEntity{ID: user.Handle, Name: email, DisplayName: displayName},
+		PubKeyCredParams: []WebAuthnCredentialParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:                int64(a.Timeout / time.Millisecond),
+		ExcludeCredentials:     user.descriptors(),
+		AuthenticatorSelection: selection,
+		Attestation:            "none",
+	}, nil
+}
+
+// FinishRegistration verifies the credential created by the authenticator
+// for the challenge and stores it under the name. Returns a
+// CredentialsError if the credential is invalid.
+func (a *WebAuthn) FinishRegistration(email string, challenge []byte, response *WebAuthnCredentialResponse, name string) error {
+	clientDataJSON, err := a.checkClientData(response, "webauthn.create", challenge)
+	if err != nil {
+		return err
+	}
+	attestationObject, err := webAuthnDecode(response.Response.AttestationObject)
+	if err != nil {
+		return err
+	}
+	item, rest, err := cborDecode(attestationObject)
+	attestation, ok := item.(map[interface{}]interface{})
+	if err != nil || !ok || len(rest) != 0 {
+		return CredentialsError{"WebAuthn: malformed attestation object"}
+	}
+	rawAuthData, _ := attestation["authData"].([]byte)
+	authData, err := parseWebAuthnAuthData(rawAuthData)
+	if err != nil {
+		return err
+	}
+	if err := a.checkAuthData(authData, a.Passwordless); err != nil {
+		return err
+	}
+	if authData.flags&webAuthnFlagAttested == 0 {
+		return CredentialsError{"WebAuthn: no attested credential"}
+	}
+	if response.ID != webAuthnEncoding.EncodeToString(authData.credentialID) {
+		return CredentialsError{"WebAuthn: credential ID mismatch"}
+	}
+	key, alg, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		return err
+	}
+
+	// verify the attestation statement
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	switch format, _ := attestation["fmt"].(string); format {
+	case "none":
+		if len(statement) != 0 {
+			return CredentialsError{"WebAuthn: unexpected attestation statement"}
+		}
+	case "packed":
+		if err := checkPackedAttestation(statement, key, alg, signed); err != nil {
+			return err
+		}
+	default:
+		return CredentialsError{"WebAuthn: unsupported attestation format '" + format + "'"}
+	}
+
+	// a credential can only be registered once
+	owner, _, err := a.Store.Find(response.ID)
+	if err != nil {
+		return err
+	}
+	if owner != "" {
+		return CredentialsError{"WebAuthn: credential already registered"}
+	}
+	return a.Store.Update(email, func(user *WebAuthnUser) error {
+		user.Credentials = append(user.Credentials, &WebAuthnCredential{
+			ID:        response.ID,
+			PublicKey: authData.publicKey,
+			SignCount: authData.signCount,
+			Name:      name,
+			Created:   a.now().UTC(),
+		})
+		return nil
+	})
+}
+
+// RequestOptions returns the options of an authentication. The credentials of
+// the user are allowed, an empty email allows any discoverable credential
+// (passwordless authentication).
+func (a *WebAuthn) RequestOptions(email string, challenge []byte) (*WebAuthnRequestOptions, error) {
+	options := &WebAuthnRequestOptions{
+		Challenge:        webAuthnEncoding.EncodeToString(challenge),
+		RPID:             a.RPID,
+		Timeout:          int64(a.Timeout / time.Millisecond),
+		AllowCredentials: []WebAuthnCredentialDescriptor{},
+		UserVerification: "preferred",
+	}
+	if email == "" {
+		options.UserVerification = "required"
+		return options, nil
+	}
+	user, err := a.Store.Get(email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || len(user.Credentials) == 0 {
+		return nil, CredentialsError{"WebAuthn: no credential for '" + email + "'"}
+	}
+	options.AllowCredentials = user.descriptors()
+	return options, nil
+}
+
+// FinishLogin verifies the assertion of the authenticator for the challenge
+// and returns the email of the owner of the credential. The credential must
+// belong to the user, unless the email is empty (passwordless
+// authentication, the authenticator must have verified the user). Returns a
+// CredentialsError if the assertion is invalid.
+func (a *WebAuthn) FinishLogin(email string, challenge []byte, response *WebAuthnCredentialResponse) (string, error) {
+	owner, user, err := a.Store.Find(response.ID)
+	if err != nil {
+		return "", err
+	}
+	if owner == "" {
+		return "", CredentialsError{"WebAuthn: unknown credential"}
+	}
+	if email != "" && !strings.EqualFold(owner, email) {
+		return "", CredentialsError{"WebAuthn: the credential does not belong to '" + email + "'"}
+	}
+	if response.Response.UserHandle != "" && response.Response.UserHandle != user.Handle {
+		return "", CredentialsError{"WebAuthn: user handle mismatch"}
+	}
+
+	clientDataJSON, err := a.checkClientData(response, "webauthn.get", challenge)
+	if err != nil {
+		return "", err
+	}
+	rawAuthData, err := webAuthnDecode(response.Response.AuthenticatorData)
+	if err != nil {
+		return "", err
+	}
+	authData, err := parseWebAuthnAuthData(rawAuthData)
+	if err != nil {
+		return "", err
+	}
+	if err := a.checkAuthData(authData, email == ""); err != nil {
+		return "", err
+	}
+	signature, err := webAuthnDecode(response.Response.Signature)
+	if err != nil {
+		return "", err
+	}
+
+	err = a.Store.Update(owner, func(user *WebAuthnUser) error {
+		credential := user.credential(response.ID)
+		if credential == nil {
+			return CredentialsError{"WebAuthn: unknown credential"}
+		}
+		key, alg, err := parseCOSEKey(credential.PublicKey)
+		if err != nil {
+			return err
+		}
+		clientDataHash := sha256.Sum256(clientDataJSON)
+		signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+		if !verifyCOSESignature(key, alg, signed, signature) {
+			return CredentialsError{"WebAuthn: invalid signature for '" + owner + "'"}
+		}
+
+		// the counter of an authenticator always increases, unless it
+		// has no counter: a lower value means a cloned authenticator
+		if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+			return CredentialsError{"WebAuthn: signature counter of '" + owner + "' did not increase, the authenticator may be cloned"}
+		}
+		credential.SignCount = authData.signCount
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return owner, nil
+}
+
+// checkClientData verifies the type, the challenge and the origin of the
+// client data, and returns the raw client data.
+func (a *WebAuthn) checkClientData(response *WebAuthnCredentialResponse, ceremony string, challenge []byte) ([]byte, error) {
+	if response.Type != "public-key" {
+		return nil, CredentialsError{"WebAuthn: unexpected credential type '" + response.Type + "'"}
+	}
+	data, err := webAuthnDecode(response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	var clientData struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	if err := json.Unmarshal(data, &clientData); err != nil {
+		return nil, CredentialsError{"WebAuthn: malformed client data"}
+	}
+	if clientData.Type != ceremony {
+		return nil, CredentialsError{"WebAuthn: unexpected client data type '" + clientData.Type + "'"}
+	}
+	received, err := webAuthnDecode(clientData.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return nil, CredentialsError{"WebAuthn: challenge mismatch"}
+	}
+	if clientData.Origin != a.Origin || clientData.CrossOrigin {
+		return nil, CredentialsError{"WebAuthn: unexpected origin '" + clientData.Origin + "'"}
+	}
+	return data, nil
+}
+
+// checkAuthData verifies the relying party and the user presence (and the
+// user verification if required) of the authenticator data.
+func (a *WebAuthn) checkAuthData(authData *webAuthnAuthData, verification bool) error {
+	rpIDHash := sha256.Sum256([]byte(a.RPID))
+	if subtle.ConstantTimeCompare(authData.rpIDHash, rpIDHash[:]) != 1 {
+		return CredentialsError{"WebAuthn: relying party ID mismatch"}
+	}
+	if authData.flags&webAuthnFlagUserPresent == 0 {
+		return CredentialsError{"WebAuthn: user not present"}
+	}
+	if verification && authData.flags&webAuthnFlagUserVerified == 0 {
+		return CredentialsError{"WebAuthn: user not verified"}
+	}
+	return nil
+}
+
+// webAuthnAuthData is the data signed by an authenticator.
+type webAuthnAuthData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte // attested credential only
+	publicKey    []byte // COSE key of the attested credential
+}
+
+// parseWebAuthnAuthData decodes the authenticator data.
+func parseWebAuthnAuthData(data []byte) (*webAuthnAuthData, error) {
+	malformed := CredentialsError{"WebAuthn: malformed authenticator data"}
+	if len(data) < 37 {
+		return nil, malformed
+	}
+	authData := &webAuthnAuthData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	data = data[37:]
+
+	if authData.flags&webAuthnFlagAttested != 0 {
+		// AAGUID, length of the credential ID, credential ID, key
+		if len(data) < 18 {
+			return nil, malformed
+		}
+		length := int(binary.BigEndian.Uint16(data[16:18]))
+		data = data[18:]
+		if len(data) < length {
+			return nil, malformed
+		}
+		authData.credentialID, data = data[:length], data[length:]
+		_, rest, err := cborDecode(data)
+		if err != nil {
+			return nil, malformed
+		}
+		authData.publicKey, data = data[:len(data)-len(rest)], rest
+	}
+	if authData.flags&webAuthnFlagExtensions != 0 {
+		_, rest, err := cborDecode(data)
+		if err != nil {
+			return nil, malformed
+		}
+		data = rest
+	}
+	if len(data) != 0 {
+		return nil, malformed
+	}
+	return authData, nil
+}
+
+// parseCOSEKey decodes a COSE public key and returns the key and its
+// algorithm.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	malformed := CredentialsError{"WebAuthn: malformed public key"}
+	item, rest, err := cborDecode(data)
+	values, ok := item.(map[interface{}]interface{})
+	if err != nil || !ok || len(rest) != 0 {
+		return nil, 0, malformed
+	}
+	kty, _ := values[int64(1)].(int64)
+	alg, _ := values[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		x, _ := values[int64(-2)].([]byte)
+		y, _ := values[int64(-3)].([]byte)
+		if crv, _ := values[int64(-1)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, malformed
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, malformed
+		}
+		return key, alg, nil
+	case kty == 1 && alg == coseAlgEdDSA:
+		x, _ := values[int64(-2)].([]byte)
+		if crv, _ := values[int64(-1)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, malformed
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := values[int64(-1)].([]byte)
+		e, _ := values[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, malformed
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+	}
+	return nil, 0, CredentialsError{"WebAuthn: unsupported public key algorithm " + strconv.FormatInt(alg, 10)}
+}
+
+// verifyCOSESignature verifies the signature of the message with the key of
+// the algorithm.
+func verifyCOSESignature(key crypto.PublicKey, alg int64, message, signature []byte) bool {
+	digest := sha256.Sum256(message)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return alg == coseAlgES256 && ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		return alg == coseAlgEdDSA && ed25519.Verify(key, message, signature)
+	case *rsa.PublicKey:
+		return alg == coseAlgRS256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// checkPackedAttestation verifies a "packed" attestation statement, signed
+// by the credential itself (self attestation) or by the attestation
+// certificate of the authenticator.
+func checkPackedAttestation(statement map[interface{}]interface{}, key crypto.PublicKey, alg int64, signed []byte) error {
+	statementAlg, _ := statement["alg"].(int64)
+	signature, _ := statement["sig"].([]byte)
+	if chain, ok := statement["x5c"].([]interface{}); ok {
+		if len(chain) == 0 {
+			return CredentialsError{"WebAuthn: malformed attestation certificate"}
+		}
+		leaf, _ := chain[0].([]byte)
+		certificate, err := x509.ParseCertificate(leaf)
+		if err != nil {
+			return CredentialsError{"WebAuthn: malformed attestation certificate"}
+		}
+		key = certificate.PublicKey
+	} else if statementAlg != alg {
+		return CredentialsError{"WebAuthn: attestation algorithm mismatch"}
+	}
+	if !verifyCOSESignature(key, statementAlg, signed, signature) {
+		return CredentialsError{"WebAuthn: invalid attestation signature"}
+	}
+	return nil
+}
+
+// webAuthnDecode decodes a base64url value sent by the browser, with or
+// without padding.
+func webAuthnDecode(value string) ([]byte, error) {
+	data, err := webAuthnEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, CredentialsError{"WebAuthn: malformed value"}
+	}
+	return data, nil
+}
+
+// WebAuthnStore keeps the credentials of the users in a JSON file, only
+// readable by Gorgon. The file is created when the first user registers a
+// credential.
+type WebAuthnStore struct {
+	Path string // path to the JSON file
+
+	mutex sync.Mutex // serializes the updates of the file
+}
+
+// WebAuthnUser holds the credentials of a user.
+type WebAuthnUser struct {
+	Handle      string                `json:"handle"`      // random user handle, base64url encoded
+	Credentials []*WebAuthnCredential `json:"credentials"` // registered credentials
+}
+
+// WebAuthnCredential is a credential registered by a user.
+type WebAuthnCredential struct {
+	ID        string    `json:"id"`         // credential ID, base64url encoded
+	PublicKey []byte    `json:"public_key"` // COSE public key
+	SignCount uint32    `json:"sign_count"` // last signature counter
+	Name      string    `json:"name"`       // name given by the user
+	Created   time.Time `json:"created"`    // registration time
+}
+
+// descriptors returns the descriptors of the credentials of the user.
+func (u *WebAuthnUser) descriptors() []WebAuthnCredentialDescriptor {
+	descriptors := []WebAuthnCredentialDescriptor{}
+	for _, credential := range u.Credentials {
+		descriptors = append(descriptors, WebAuthnCredentialDescriptor{Type: "public-key", ID: credential.ID})
+	}
+	return descriptors
+}
+
+// credential returns the credential of the user with the ID, or nil.
+func (u *WebAuthnUser) credential(id string) *WebAuthnCredential {
+	for _, credential := range u.Credentials {
+		if credential.ID == id {
+			return credential
+		}
+	}
+	return nil
+}
+
+// Get returns the credentials of the user, nil if the user never registered
+// a credential.
+func (s *WebAuthnStore) Get(email string) (*WebAuthnUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	users, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return users[strings.ToLower(email)], nil
+}
+
+// Registered returns true if the user has at least one credential.
+func (s *WebAuthnStore) Registered(email string) (bool, error) {
+	user, err := s.Get(email)
+	if err != nil {
+		return false, err
+	}
+	return user != nil && len(user.Credentials) > 0, nil
+}
+
+// Find returns the email and the credentials of the owner of the credential,
+// an empty email if the credential is unknown.
+func (s *WebAuthnStore) Find(id string) (string, *WebAuthnUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	users, err := s.load()
+	if err != nil {
+		return "", nil, err
+	}
+	for email, user := range users {
+		if user.credential(id) != nil {
+			return email, user, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// Update calls fn with the credentials of the user (with a new user handle
+// if the user is unknown) and saves them, unless fn returns an error.
+func (s *WebAuthnStore) Update(email string, fn func(user *WebAuthnUser) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+	email = strings.ToLower(email)
+	user, ok := users[email]
+	if !ok {
+		handle, err := NewWebAuthnChallenge()
+		if err != nil {
+			return err
+		}
+		user = &WebAuthnUser{Handle: webAuthnEncoding.EncodeToString(handle), Credentials: []*WebAuthnCredential{}}
+	}
+	if err := fn(user); err != nil {
+		return err
+	}
+	users[email] = user
+	return s.save(users)
+}
+
+// load reads the file, a missing file is an empty store.
+func (s *WebAuthnStore) load() (map[string]*WebAuthnUser, error) {
+	users := make(map[string]*WebAuthnUser)
+	if err := readJSONFile(s.Path, &users); err != nil {
+		return nil, errors.New("WebAuthnStore: " + err.Error())
+	}
+	return users, nil
+}
+
+// save replaces the file atomically.
+func (s *WebAuthnStore) save(users map[string]*WebAuthnUser) error {
+	return writeJSONFile(s.Path, users)
+}
+
+// NewWebAuthnFromConfig returns the WebAuthn configured in the "webauthn"
+// section, or nil if WebAuthn is disabled. The relying party ID defaults to
+// the domain of the IdP, the name to the relying party ID and the origin to
+// "https://" followed by the relying party ID.
+func NewWebAuthnFromConfig(config ini.File, domain string) (*WebAuthn, error) {
+	config, err := checkConfigSection(config, "webauthn", WebAuthnConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	if enabled, _ := config.Get("webauthn", "enabled"); enabled != "true" {
+		return nil, nil
+	}
+
+	path, _ := config.Get("webauthn", "store")
+	if path == "" {
+		return nil, errors.New("'store' variable missing from 'webauthn' section")
+	}
+	rpID, _ := config.Get("webauthn", "rp_id")
+	if rpID == "" {
+		rpID = domain
+	}
+	if rpID == "" {
+		return nil, errors.New("'rp_id' variable missing from 'webauthn' section")
+	}
+	rpName, _ := config.Get("webauthn", "rp_name")
+	if rpName == "" {
+		rpName = rpID
+	}
+	origin, _ := config.Get("webauthn", "origin")
+	if origin == "" {
+		origin = "https://" + rpID
+	}
+	origin = strings.TrimRight(origin, "/")
+	value, _ := config.Get("webauthn", "passwordless")
+	passwordless := value == "true"
+	value, _ = config.Get("webauthn", "timeout")
+	seconds, _ := strconv.Atoi(value)
+
+	store := &WebAuthnStore{Path: path}
+	// read the store a first time to detect errors early
+	if _, err := store.Get(""); err != nil {
+		return nil, err
+	}
+	return NewWebAuthn(store, rpID, rpName, origin, passwordless, time.Duration(seconds)*time.Second), nil
+}
@@ -0,0 +1,456 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+// cborEncode encodes the value in CBOR, the map keys are sorted (int keys
+// before string keys).
+func cborEncode(value interface{}) []byte {
+	header := func(major byte, argument uint64) []byte {
+		switch {
+		case argument < 24:
+			return []byte{major<<5 | byte(argument)}
+		case argument < 1<<8:
+			return []byte{major<<5 | 24, byte(argument)}
+		case argument < 1<<16:
+			return []byte{major<<5 | 25, byte(argument >> 8), byte(argument)}
+		}
+		data := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(data[1:], uint32(argument))
+		return data
+	}
+	switch value := value.(type) {
+	case int:
+		return cborEncode(int64(value))
+	case int64:
+		if value < 0 {
+			return header(1, uint64(-1-value))
+		}
+		return header(0, uint64(value))
+	case []byte:
+		return append(header(2, uint64(len(value))), value...)
+	case string:
+		return append(header(3, uint64(len(value))), value...)
+	case []interface{}:
+		data := header(4, uint64(len(value)))
+		for _, item := range value {
+			data = append(data, cborEncode(item)...)
+		}
+		return data
+	case map[interface{}]interface{}:
+		keys := make([]interface{}, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, aInt := keys[i].(int)
+			b, bInt := keys[j].(int)
+			if aInt && bInt {
+				return a < b
+			}
+			if aInt != bInt {
+				return aInt
+			}
+			return keys[i].(string) < keys[j].(string)
+		})
+		data := header(5, uint64(len(value)))
+		for _, key := range keys {
+			data = append(data, cborEncode(key)...)
+			data = append(data, cborEncode(value[key])...)
+		}
+		return data
+	}
+	panic("cborEncode: unsupported value")
+}
+
+// softAuthenticator is a WebAuthn authenticator with an ECDSA P-256 key.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	userVerified bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+// id returns the credential ID in base64url.
+func (s *softAuthenticator) id() string {
+	return webAuthnEncoding.EncodeToString(s.credentialID)
+}
+
+// coseKey returns the public key of the credential in the COSE format.
+func (s *softAuthenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	s.key.X.FillBytes(x)
+	s.key.Y.FillBytes(y)
+	return cborEncode(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: x, -3: y})
+}
+
+// clientData returns the client data created by the browser.
+func (s *softAuthenticator) clientData(ceremony, challenge, origin string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{"type": ceremony, "challenge": challenge, "origin": origin})
+	return data
+}
+
+// authData returns the authenticator data, with the attested credential if
+// attested is set. The signature counter is increased.
+func (s *softAuthenticator) authData(rpID string, attested bool) []byte {
+	s.signCount++
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(webAuthnFlagUserPresent)
+	if s.userVerified {
+		flags |= webAuthnFlagUserVerified
+	}
+	if attested {
+		flags |= webAuthnFlagAttested
+	}
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], s.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = append(data, byte(len(s.credentialID)>>8), byte(len(s.credentialID)))
+		data = append(data, s.credentialID...)
+		data = append(data, s.coseKey()...)
+	}
+	return data
+}
+
+// sign returns the signature of the authenticator data and the client data.
+func (s *softAuthenticator) sign(authData, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+	return signature
+}
+
+// create returns the credential created for the options, with a "packed"
+// self attestation or a "none" attestation.
+func (s *softAuthenticator) create(options *WebAuthnCreationOptions, origin, format string) *WebAuthnCredentialResponse {
+	clientData := s.clientData("webauthn.create", options.Challenge, origin)
+	authData := s.authData(options.RP.ID, true)
+	statement := map[interface{}]interface{}{}
+	if format == "packed" {
+		statement["alg"] = coseAlgES256
+		statement["sig"] = s.sign(authData, clientData)
+	}
+	attestation := cborEncode(map[interface{}]interface{}{"fmt": format, "attStmt": statement, "authData": authData})
+	return &WebAuthnCredentialResponse{
+		ID:   s.id(),
+		Type: "public-key",
+		Response: WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    webAuthnEncoding.EncodeToString(clientData),
+			AttestationObject: webAuthnEncoding.EncodeToString(attestation),
+		},
+	}
+}
+
+// get returns the assertion for the options.
+func (s *softAuthenticator) get(options *WebAuthnRequestOptions, origin string) *WebAuthnCredentialResponse {
+	clientData := s.clientData("webauthn.get", options.Challenge, origin)
+	authData := s.authData(options.RPID, false)
+	return &WebAuthnCredentialResponse{
+		ID:   s.id(),
+		Type: "public-key",
+		Response: WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    webAuthnEncoding.EncodeToString(clientData),
+			AuthenticatorData: webAuthnEncoding.EncodeToString(authData),
+			Signature:         webAuthnEncoding.EncodeToString(s.sign(authData, clientData)),
+		},
+	}
+}
+
+// newTestWebAuthn returns a WebAuthn for example.com with a store in a
+// temporary directory, removed by the returned function.
+func newTestWebAuthn(t *testing.T, passwordless bool) (*WebAuthn, func()) {
+	dir, err := ioutil.TempDir("", "gorgon-webauthn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &WebAuthnStore{Path: filepath.Join(dir, "webauthn.json")}
+	webauthn := NewWebAuthn(store, "example.com", "Example", "https://example.com", passwordless, time.Minute)
+	return webauthn, func() { os.RemoveAll(dir) }
+}
+
+// registerSoftAuthenticator registers a new softAuthenticator for the user.
+func registerSoftAuthenticator(t *testing.T, webauthn *WebAuthn, email string) *softAuthenticator {
+	authenticator := newSoftAuthenticator(t)
+	authenticator.userVerified = webauthn.Passwordless
+	challenge, _ := NewWebAuthnChallenge()
+	options, err := webauthn.CreationOptions(email, "", challenge)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = webauthn.FinishRegistration(email, challenge, authenticator.create(options, webauthn.Origin, "packed"), "Soft key")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return authenticator
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	webauthn, cleanup := newTestWebAuthn(t, false)
+	defer cleanup()
+
+	challenge, _ := NewWebAuthnChallenge()
+	options, err := webauthn.CreationOptions("Alice@example.com", "Alice", challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, webAuthnEncoding.EncodeToString(challenge), options.Challenge)
+	assert.Equal(t, WebAuthnRelyingParty{ID: "example.com", Name: "Example"}, options.RP)
+	assert.Equal(t, "Alice@example.com", options.User.Name)
+	assert.Equal(t, "Alice", options.User.DisplayName)
+	assert.NotEmpty(t, options.User.ID)
+	assert.Equal(t, int64(60000), options.Timeout)
+	assert.Empty(t, options.ExcludeCredentials)
+	assert.Equal(t, "discouraged", options.AuthenticatorSelection.ResidentKey)
+
+	// the invalid credentials are refused
+	authenticator := newSoftAuthenticator(t)
+	otherChallenge, _ := NewWebAuthnChallenge()
+	otherOptions := *options
+	otherOptions.RP.ID = "example.org"
+	for name, response := range map[string]*WebAuthnCredentialResponse{
+		"challenge": authenticator.create(options, "https://example.com", "packed"),
+		"origin":    authenticator.create(options, "https://evil.example.com", "packed"),
+		"rp id":     authenticator.create(&otherOptions, "https://example.com", "packed"),
+	} {
+		expected := challenge
+		if name == "challenge" {
+			expected = otherChallenge
+		}
+		err := webauthn.FinishRegistration("alice@example.com", expected, response, "Soft key")
+		assert.True(t, IsCredentialsError(err), name)
+	}
+	response := authenticator.create(options, "https://example.com", "packed")
+	response.Type = "password"
+	assert.True(t, IsCredentialsError(webauthn.FinishRegistration("alice@example.com", challenge, response, "Soft key")))
+	other := newSoftAuthenticator(t)
+	response = authenticator.create(options, "https://example.com", "packed")
+	response.ID = other.id()
+	assert.True(t, IsCredentialsError(webauthn.FinishRegistration("alice@example.com", challenge, response, "Soft key")))
+	registered, err := webauthn.Store.Registered("alice@example.com")
+	assert.NoError(t, err)
+	assert.False(t, registered)
+
+	// the attestation signature is verified
+	response = authenticator.create(options, "https://example.com", "packed")
+	attestation, _ := webAuthnDecode(response.Response.AttestationObject)
+	attestation[len(attestation)-1] ^= 0x01
+	response.Response.AttestationObject = webAuthnEncoding.EncodeToString(attestation)
+	assert.True(t, IsCredentialsError(webauthn.FinishRegistration("alice@example.com", challenge, response, "Soft key")))
+
+	// a valid credential is stored
+	response = authenticator.create(options, "https://example.com", "packed")
+	assert.NoError(t, webauthn.FinishRegistration("alice@example.com", challenge, response, "Soft key"))
+	registered, err = webauthn.Store.Registered("ALICE@example.com")
+	assert.NoError(t, err)
+	assert.True(t, registered)
+	user, err := webauthn.Store.Get("alice@example.com")
+	assert.NoError(t, err)
+	if assert.Len(t, user.Credentials, 1) {
+		assert.Equal(t, authenticator.id(), user.Credentials[0].ID)
+		assert.Equal(t, "Soft key", user.Credentials[0].Name)
+		assert.Equal(t, authenticator.coseKey(), user.Credentials[0].PublicKey)
+		assert.Equal(t, authenticator.signCount, user.Credentials[0].SignCount)
+	}
+
+	// a credential can't be registered twice
+	err = webauthn.FinishRegistration("bob@example.com", challenge, authenticator.create(options, "https://example.com", "packed"), "Soft key")
+	assert.True(t, IsCredentialsError(err))
+
+	// the user handle is kept and the registered credentials are excluded,
+	// a "none" attestation is accepted
+	options2, err := webauthn.CreationOptions("alice@example.com", "", challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, options.User.ID, options2.User.ID)
+	assert.Equal(t, "alice@example.com", options2.User.DisplayName)
+	assert.Equal(t, []WebAuthnCredentialDescriptor{{Type: "public-key", ID: authenticator.id()}}, options2.ExcludeCredentials)
+	assert.NoError(t, webauthn.FinishRegistration("alice@example.com", challenge, other.create(options2, "https://example.com", "none"), "Other key"))
+	user, _ = webauthn.Store.Get("alice@example.com")
+	assert.Len(t, user.Credentials, 2)
+
+	// the passwordless credentials must be discoverable and verify the user
+	webauthn.Passwordless = true
+	options, err = webauthn.CreationOptions("carol@example.com", "", challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, WebAuthnAuthenticatorSelection{ResidentKey: "required", UserVerification: "required"}, options.AuthenticatorSelection)
+	authenticator = newSoftAuthenticator(t)
+	assert.True(t, IsCredentialsError(webauthn.FinishRegistration("carol@example.com", challenge, authenticator.create(options, "https://example.com", "none"), "Soft key")))
+	authenticator.userVerified = true
+	assert.NoError(t, webauthn.FinishRegistration("carol@example.com", challenge, authenticator.create(options, "https://example.com", "none"), "Soft key"))
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	webauthn, cleanup := newTestWebAuthn(t, true)
+	defer cleanup()
+	alice := registerSoftAuthenticator(t, webauthn, "alice@example.com")
+	registerSoftAuthenticator(t, webauthn, "bob@example.com")
+
+	// the credentials of the user are allowed
+	challenge, _ := NewWebAuthnChallenge()
+	options, err := webauthn.RequestOptions("alice@example.com", challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", options.RPID)
+	assert.Equal(t, []WebAuthnCredentialDescriptor{{Type: "public-key", ID: alice.id()}}, options.AllowCredentials)
+	assert.Equal(t, "preferred", options.UserVerification)
+	_, err = webauthn.RequestOptions("carol@example.com", challenge)
+	assert.True(t, IsCredentialsError(err))
+
+	// a valid assertion
+	response := alice.get(options, "https://example.com")
+	owner, err := webauthn.FinishLogin("alice@example.com", challenge, response)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", owner)
+	user, _ := webauthn.Store.Get("alice@example.com")
+	assert.Equal(t, alice.signCount, user.Credentials[0].SignCount)
+
+	// a replayed assertion (or a cloned authenticator) is refused
+	_, err = webauthn.FinishLogin("alice@example.com", challenge, response)
+	assert.True(t, IsCredentialsError(err))
+
+	// the credential must belong to the user
+	_, err = webauthn.FinishLogin("bob@example.com", challenge, alice.get(options, "https://example.com"))
+	assert.True(t, IsCredentialsError(err))
+
+	// the invalid assertions are refused
+	otherChallenge, _ := NewWebAuthnChallenge()
+	_, err = webauthn.FinishLogin("alice@example.com", otherChallenge, alice.get(options, "https://example.com"))
+	assert.True(t, IsCredentialsError(err))
+	_, err = webauthn.FinishLogin("alice@example.com", challenge, alice.get(options, "https://example.com:8443"))
+	assert.True(t, IsCredentialsError(err))
+	response = alice.get(options, "https://example.com")
+	signature, _ := webAuthnDecode(response.Response.Signature)
+	signature[len(signature)-1] ^= 0x01
+	response.Response.Signature = webAuthnEncoding.EncodeToString(signature)
+	_, err = webauthn.FinishLogin("alice@example.com", challenge, response)
+	assert.True(t, IsCredentialsError(err))
+	response = alice.get(options, "https://example.com")
+	response.Response.UserHandle = webAuthnEncoding.EncodeToString([]byte("someone else"))
+	_, err = webauthn.FinishLogin("alice@example.com", challenge, response)
+	assert.True(t, IsCredentialsError(err))
+	_, err = webauthn.FinishLogin("alice@example.com", challenge, newSoftAuthenticator(t).get(options, "https://example.com"))
+	assert.True(t, IsCredentialsError(err))
+
+	// a passwordless authentication allows any credential, but the user
+	// must be verified
+	options, err = webauthn.RequestOptions("", challenge)
+	assert.NoError(t, err)
+	assert.Empty(t, options.AllowCredentials)
+	assert.Equal(t, "required", options.UserVerification)
+	alice.userVerified = false
+	_, err = webauthn.FinishLogin("", challenge, alice.get(options, "https://example.com"))
+	assert.True(t, IsCredentialsError(err))
+	alice.userVerified = true
+	response = alice.get(options, "https://example.com")
+	response.Response.UserHandle = user.Handle
+	owner, err = webauthn.FinishLogin("", challenge, response)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", owner)
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	key, alg, err := parseCOSEKey(newSoftAuthenticator(t).coseKey())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(coseAlgES256), alg)
+	assert.IsType(t, &ecdsa.PublicKey{}, key)
+
+	x := make([]byte, 32)
+	_, alg, err = parseCOSEKey(cborEncode(map[interface{}]interface{}{1: 1, 3: coseAlgEdDSA, -1: 6, -2: x}))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(coseAlgEdDSA), alg)
+
+	for name, data := range map[string][]byte{
+		"not on the curve":  cborEncode(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: x, -3: x}),
+		"unsupported curve": cborEncode(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 2, -2: x, -3: x}),
+		"unsupported alg":   cborEncode(map[interface{}]interface{}{1: 2, 3: -35, -1: 2, -2: x, -3: x}),
+		"short RSA key":     cborEncode(map[interface{}]interface{}{1: 3, 3: coseAlgRS256, -1: x, -2: []byte{1, 0, 1}}),
+		"not a map":         cborEncode([]interface{}{1, 2}),
+	} {
+		_, _, err := parseCOSEKey(data)
+		assert.True(t, IsCredentialsError(err), name)
+	}
+}
+
+func TestNewWebAuthnFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorgon-webauthn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webauthn.json")
+
+	// WebAuthn is disabled by default
+	webauthn, err := NewWebAuthnFromConfig(ini.File{}, "example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, webauthn)
+
+	// the store is required
+	_, err = NewWebAuthnFromConfig(ini.File{"webauthn": {"enabled": "true"}}, "example.com")
+	assert.EqualError(t, err, "'store' variable missing from 'webauthn' section")
+
+	// the default values
+	webauthn, err = NewWebAuthnFromConfig(ini.File{"webauthn": {"enabled": "true", "store": path}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, webauthn) {
+		assert.Equal(t, "example.com", webauthn.RPID)
+		assert.Equal(t, "example.com", webauthn.RPName)
+		assert.Equal(t, "https://example.com", webauthn.Origin)
+		assert.False(t, webauthn.Passwordless)
+		assert.Equal(t, time.Minute, webauthn.Timeout)
+		assert.Equal(t, path, webauthn.Store.Path)
+	}
+
+	// all the values
+	webauthn, err = NewWebAuthnFromConfig(ini.File{"webauthn": {
+		"enabled":      "true",
+		"store":        path,
+		"rp_id":        "login.example.org",
+		"rp_name":      "Example",
+		"origin":       "https://login.example.org:8443/",
+		"passwordless": "true",
+		"timeout":      "120",
+	}}, "example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, webauthn) {
+		assert.Equal(t, "login.example.org", webauthn.RPID)
+		assert.Equal(t, "Example", webauthn.RPName)
+		assert.Equal(t, "https://login.example.org:8443", webauthn.Origin)
+		assert.True(t, webauthn.Passwordless)
+		assert.Equal(t, 2*time.Minute, webauthn.Timeout)
+	}
+
+	// invalid values
+	_, err = NewWebAuthnFromConfig(ini.File{"webauthn": {"enabled": "yes", "store": path}}, "example.com")
+	assert.Error(t, err)
+	_, err = NewWebAuthnFromConfig(ini.File{"webauthn": {"enabled": "true", "store": path, "timeout": "0"}}, "example.com")
+	assert.Error(t, err)
+
+	// a malformed store
+	ioutil.WriteFile(path, []byte("{"), 0600)
+	_, err = NewWebAuthnFromConfig(ini.File{"webauthn": {"enabled": "true", "store": path}}, "example.com")
+	assert.Error(t, err)
+}
@@ -0,0 +1,438 @@
+package app
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+const (
+	// xmlDSigNS is the namespace of the XML signatures.
+	xmlDSigNS = "http://www.w3.org/2000/09/xmldsig#"
+	// xmlExcC14N is the exclusive XML canonicalization (without comments),
+	// the only canonicalization accepted.
+	xmlExcC14N = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	// xmlEnvelopedSignature is the transform removing the signature from the
+	// signed element.
+	xmlEnvelopedSignature = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	// xmlNamespaceNS is the namespace bound to the "xml" prefix.
+	xmlNamespaceNS = "http://www.w3.org/XML/1998/namespace"
+)
+
+var (
+	// xmlSignatureMethods are the accepted signature algorithms.
+	xmlSignatureMethods = map[string]crypto.Hash{
+		"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":   crypto.SHA256,
+		"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512":   crypto.SHA512,
+		"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256": crypto.SHA256,
+	}
+
+	// xmlDigestMethods are the accepted digest algorithms.
+	xmlDigestMethods = map[string]crypto.Hash{
+		"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+		"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+	}
+)
+
+// xmlNode is an element of a parsed XML document. The prefixes and the
+// namespace declarations are kept to canonicalize the element.
+type xmlNode struct {
+	Prefix   string            // prefix of the name ("" if none)
+	Local    string            // local name
+	Space    string            // namespace URI ("" if none)
+	Attrs    []xmlAttr         // attributes, without the namespace declarations
+	NS       map[string]string // namespaces declared by the element (prefix => URI, "" for the default namespace)
+	Children []interface{}     // *xmlNode, xmlText or xml.ProcInst
+	Parent   *xmlNode          // parent element (nil for the root)
+}
+
+// xmlAttr is an attribute of an xmlNode.
+type xmlAttr struct {
+	Prefix string
+	Local  string
+	Space  string
+	Value  string
+}
+
+// xmlText is the character data of an xmlNode.
+type xmlText string
+
+// parseXML parses the XML document and returns its root element. The
+// document type declarations are refused, and the "ID" attributes must be
+// unique.
+func parseXML(data []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var root, current *xmlNode
+	ids := map[string]bool{}
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			if root != nil && current == nil {
+				return nil, errors.New("XML: several root elements")
+			}
+			node := &xmlNode{Prefix: token.Name.Space, Local: token.Name.Local, NS: map[string]string{}, Parent: current}
+			for _, attr := range token.Attr {
+				if attr.Name.Space == "xmlns" {
+					node.NS[attr.Name.Local] = attr.Value
+				} else if attr.Name.Space == "" && attr.Name.Local == "xmlns" {
+					node.NS[""] = attr.Value
+				}
+			}
+			space, ok := node.lookupNS(node.Prefix)
+			if !ok {
+				return nil, errors.New("XML: undeclared prefix '" + node.Prefix + "'")
+			}
+			node.Space = space
+			for _, attr := range token.Attr {
+				if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+					continue
+				}
+				a := xmlAttr{Prefix: attr.Name.Space, Local: attr.Name.Local, Value: attr.Value}
+				if a.Prefix != "" {
+					if a.Space, ok = node.lookupNS(a.Prefix); !ok {
+						return nil, errors.New("XML: undeclared prefix '" + a.Prefix + "'")
+					}
+				} else if a.Local == "ID" {
+					if ids[a.Value] {
+						return nil, errors.New("XML: duplicate ID '" + a.Value + "'")
+					}
+					ids[a.Value] = true
+				}
+				node.Attrs = append(node.Attrs, a)
+			}
+			if current != nil {
+				current.Children = append(current.Children, node)
+			} else {
+				root = node
+			}
+			current = node
+		case xml.EndElement:
+			if current == nil || token.Name.Space != current.Prefix || token.Name.Local != current.Local {
+				return nil, errors.New("XML: unexpected end element '" + token.Name.Local + "'")
+			}
+			current = current.Parent
+		case xml.CharData:
+			if current != nil {
+				current.Children = append(current.Children, xmlText(token))
+			} else if len(bytes.TrimSpace(token)) != 0 {
+				return nil, errors.New("XML: text outside of the root element")
+			}
+		case xml.ProcInst:
+			if current != nil {
+				current.Children = append(current.Children, token.Copy())
+			}
+		case xml.Directive:
+			return nil, errors.New("XML: directives are not allowed")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("XML: incomplete document")
+	}
+	return root, nil
+}
+
+// lookupNS returns the namespace URI bound to the prefix in the scope of the
+// element.
+func (n *xmlNode) lookupNS(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNamespaceNS, true
+	}
+	for node := n; node != nil; node = node.Parent {
+		if space, ok := node.NS[prefix]; ok {
+			return space, true
+		}
+	}
+	// no default namespace
+	return "", prefix == ""
+}
+
+// Attr returns the value of the attribute without namespace.
+func (n *xmlNode) Attr(local string) string {
+	for _, attr := range n.Attrs {
+		if attr.Space == "" && attr.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Child returns the first child element with the name, or nil.
+func (n *xmlNode) Child(space, local string) *xmlNode {
+	if children := n.ChildrenNamed(space, local); len(children) > 0 {
+		return children[0]
+	}
+	return nil
+}
+
+// ChildrenNamed returns the child elements with the name.
+func (n *xmlNode) ChildrenNamed(space, local string) []*xmlNode {
+	var nodes []*xmlNode
+	for _, child := range n.Children {
+		if node, ok := child.(*xmlNode); ok && node.Space == space && node.Local == local {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Text returns the character data of the element, without the leading and
+// trailing spaces.
+func (n *xmlNode) Text() string {
+	var text []string
+	for _, child := range n.Children {
+		if data, ok := child.(xmlText); ok {
+			text = append(text, string(data))
+		}
+	}
+	return strings.TrimSpace(strings.Join(text, ""))
+}
+
+// canonicalizeXML returns the exclusive canonicalization of the element.
+// The excluded element (the enveloped signature) is removed, and the
+// namespaces of the inclusive prefixes are rendered as in the inclusive
+// canonicalization ("#default" for the default namespace).
+func canonicalizeXML(n *xmlNode, excluded *xmlNode, inclusive []string) []byte {
+	var buffer bytes.Buffer
+	c := xmlCanonicalizer{excluded: excluded, inclusive: map[string]bool{}}
+	for _, prefix := range inclusive {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		c.inclusive[prefix] = true
+	}
+	c.element(&buffer, n, map[string]string{"": ""})
+	return buffer.Bytes()
+}
+
+// xmlCanonicalizer renders the elements of the exclusive canonicalization.
+type xmlCanonicalizer struct {
+	excluded  *xmlNode
+	inclusive map[string]bool
+}
+
+// element renders the element and its content. rendered contains the
+// namespaces already declared by the rendered ancestors.
+func (c xmlCanonicalizer) element(buffer *bytes.Buffer, n *xmlNode, rendered map[string]string) {
+	// the namespaces visibly utilized by the element
+	prefixes := map[string]bool{n.Prefix: true}
+	for _, attr := range n.Attrs {
+		if attr.Prefix != "" {
+			prefixes[attr.Prefix] = true
+		}
+	}
+	for prefix := range c.inclusive {
+		if _, ok := n.lookupNS(prefix); ok {
+			prefixes[prefix] = true
+		}
+	}
+	delete(prefixes, "xml")
+
+	scope := map[string]string{}
+	for prefix, space := range rendered {
+		scope[prefix] = space
+	}
+	var declarations []string
+	for prefix := range prefixes {
+		space, _ := n.lookupNS(prefix)
+		if current, ok := rendered[prefix]; (ok && current == space) || (!ok && space == "") {
+			continue
+		}
+		scope[prefix] = space
+		declarations = append(declarations, prefix)
+	}
+	sort.Strings(declarations)
+
+	attrs := append([]xmlAttr{}, n.Attrs...)
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].Space != attrs[j].Space {
+			return attrs[i].Space < attrs[j].Space
+		}
+		return attrs[i].Local < attrs[j].Local
+	})
+
+	buffer.WriteString("<" + xmlQName(n.Prefix, n.Local))
+	for _, prefix := range declarations {
+		buffer.WriteString(" xmlns")
+		if prefix != "" {
+			buffer.WriteString(":" + prefix)
+		}
+		buffer.WriteString("=\"" + xmlEscapeAttr(scope[prefix]) + "\"")
+	}
+	for _, attr := range attrs {
+		buffer.WriteString(" " + xmlQName(attr.Prefix, attr.Local) + "=\"" + xmlEscapeAttr(attr.Value) + "\"")
+	}
+	buffer.WriteString(">")
+
+	for _, child := range n.Children {
+		switch child := child.(type) {
+		case *xmlNode:
+			if child != c.excluded {
+				c.element(buffer, child, scope)
+			}
+		case xmlText:
+			buffer.WriteString(xmlEscapeText(string(child)))
+		case xml.ProcInst:
+			buffer.WriteString("<?" + child.Target)
+			if len(child.Inst) > 0 {
+				buffer.WriteString(" " + string(child.Inst))
+			}
+			buffer.WriteString("?>")
+		}
+	}
+	buffer.WriteString("</" + xmlQName(n.Prefix, n.Local) + ">")
+}
+
+// xmlQName returns the qualified name "prefix:local".
+func xmlQName(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+// xmlEscapeText escapes the character data as in the canonical XML.
+var xmlEscapeText = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;").Replace
+
+// xmlEscapeAttr escapes the attribute values as in the canonical XML.
+var xmlEscapeAttr = strings.NewReplacer("&", "&amp;", "<", "&lt;", "\"", "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace
+
+// verifyXMLSignature checks the enveloped signature of the element: the
+// signature must reference the element itself (by its "ID" attribute), with
+// the exclusive canonicalization, and be made by the key of one of the
+// certificates. The keys given in the signature are ignored.
+func verifyXMLSignature(n *xmlNode, certificates []*x509.Certificate) error {
+	signature := n.Child(xmlDSigNS, "Signature")
+	if signature == nil {
+		return errors.New("the element is not signed")
+	}
+	signedInfo := signature.Child(xmlDSigNS, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("no SignedInfo in the signature")
+	}
+
+	// the signed element is the element itself (no signature wrapping)
+	references := signedInfo.ChildrenNamed(xmlDSigNS, "Reference")
+	if len(references) != 1 {
+		return errors.New("the signature must have exactly one reference")
+	}
+	reference := references[0]
+	if id := n.Attr("ID"); id == "" || reference.Attr("URI") != "#"+id {
+		return errors.New("the signature does not reference the signed element")
+	}
+	canonicalized := false
+	var inclusive []string
+	if transforms := reference.Child(xmlDSigNS, "Transforms"); transforms != nil {
+		for _, transform := range transforms.ChildrenNamed(xmlDSigNS, "Transform") {
+			switch transform.Attr("Algorithm") {
+			case xmlEnvelopedSignature:
+			case xmlExcC14N:
+				canonicalized = true
+				inclusive = xmlInclusivePrefixes(transform)
+			default:
+				return errors.New("unsupported transform '" + transform.Attr("Algorithm") + "'")
+			}
+		}
+	}
+	if !canonicalized {
+		return errors.New("the signed element must use the exclusive canonicalization")
+	}
+
+	// the digest of the element
+	digestMethod := reference.Child(xmlDSigNS, "DigestMethod")
+	digestValue := reference.Child(xmlDSigNS, "DigestValue")
+	if digestMethod == nil || digestValue == nil {
+		return errors.New("no digest in the reference")
+	}
+	hash, ok := xmlDigestMethods[digestMethod.Attr("Algorithm")]
+	if !ok {
+		return errors.New("unsupported digest method '" + digestMethod.Attr("Algorithm") + "'")
+	}
+	expected, err := xmlDecodeBase64(digestValue.Text())
+	if err != nil {
+		return errors.New("malformed digest value")
+	}
+	h := hash.New()
+	h.Write(canonicalizeXML(n, signature, inclusive))
+	if subtle.ConstantTimeCompare(h.Sum(nil), expected) != 1 {
+		return errors.New("the digest of the signed element does not match")
+	}
+
+	// the signature of SignedInfo
+	canonicalizationMethod := signedInfo.Child(xmlDSigNS, "CanonicalizationMethod")
+	if canonicalizationMethod == nil || canonicalizationMethod.Attr("Algorithm") != xmlExcC14N {
+		return errors.New("SignedInfo must use the exclusive canonicalization")
+	}
+	signatureMethod := signedInfo.Child(xmlDSigNS, "SignatureMethod")
+	if signatureMethod == nil {
+		return errors.New("no signature method")
+	}
+	algorithm := signatureMethod.Attr("Algorithm")
+	hash, ok = xmlSignatureMethods[algorithm]
+	if !ok {
+		return errors.New("unsupported signature method '" + algorithm + "'")
+	}
+	signatureValue := signature.Child(xmlDSigNS, "SignatureValue")
+	if signatureValue == nil {
+		return errors.New("no signature value")
+	}
+	value, err := xmlDecodeBase64(signatureValue.Text())
+	if err != nil {
+		return errors.New("malformed signature value")
+	}
+	h = hash.New()
+	h.Write(canonicalizeXML(signedInfo, nil, xmlInclusivePrefixes(canonicalizationMethod)))
+	digest := h.Sum(nil)
+
+	for _, certificate := range certificates {
+		switch key := certificate.PublicKey.(type) {
+		case *rsa.PublicKey:
+			if strings.HasSuffix(algorithm, "#rsa-sha256") || strings.HasSuffix(algorithm, "#rsa-sha512") {
+				if rsa.VerifyPKCS1v15(key, hash, digest, value) == nil {
+					return nil
+				}
+			}
+		case *ecdsa.PublicKey:
+			// the signature is the concatenation of r and s
+			if strings.HasSuffix(algorithm, "#ecdsa-sha256") && len(value)%2 == 0 {
+				r := new(big.Int).SetBytes(value[:len(value)/2])
+				s := new(big.Int).SetBytes(value[len(value)/2:])
+				if ecdsa.Verify(key, digest, r, s) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("the signature is not made by a trusted certificate")
+}
+
+// xmlInclusivePrefixes returns the prefixes of the InclusiveNamespaces of
+// an exclusive canonicalization.
+func xmlInclusivePrefixes(method *xmlNode) []string {
+	if inclusive := method.Child(xmlExcC14N, "InclusiveNamespaces"); inclusive != nil {
+		return strings.Fields(inclusive.Attr("PrefixList"))
+	}
+	return nil
+}
+
+// xmlDecodeBase64 decodes the base64 content of an element, the spaces are
+// ignored.
+func xmlDecodeBase64(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+}
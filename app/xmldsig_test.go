@@ -0,0 +1,261 @@
+package app
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRSACertificate is a self-signed RSA certificate signing XML documents
+// in tests.
+type testRSACertificate struct {
+	certificate *x509.Certificate
+	key         *rsa.PrivateKey
+}
+
+// newTestRSACertificate returns a new self-signed RSA certificate.
+func newTestRSACertificate(t *testing.T) *testRSACertificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "IdP"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRSACertificate{certificate, key}
+}
+
+// findXMLID returns the element of the document with the ID.
+func findXMLID(n *xmlNode, id string) *xmlNode {
+	if n.Attr("ID") == id {
+		return n
+	}
+	for _, child := range n.Children {
+		if node, ok := child.(*xmlNode); ok {
+			if found := findXMLID(node, id); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// signXML signs the element of the document with the ID (enveloped
+// signature, exclusive canonicalization, SHA-256). The signature replaces the
+// "<!--Signature:ID-->" comment of the document.
+func signXML(t *testing.T, document, id string, key crypto.Signer) string {
+	root, err := parseXML([]byte(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := findXMLID(root, id)
+	if node == nil {
+		t.Fatal("no element with the ID " + id)
+	}
+	digest := sha256.Sum256(canonicalizeXML(node, nil, nil))
+
+	method := "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		method = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	}
+	signedInfo := `<ds:SignedInfo>` +
+		`<ds:CanonicalizationMethod Algorithm="` + xmlExcC14N + `"/>` +
+		`<ds:SignatureMethod Algorithm="` + method + `"/>` +
+		`<ds:Reference URI="#` + id + `">` +
+		`<ds:Transforms><ds:Transform Algorithm="` + xmlEnvelopedSignature + `"/><ds:Transform Algorithm="` + xmlExcC14N + `"/></ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue>` +
+		`</ds:Reference></ds:SignedInfo>`
+	signature := `<ds:Signature xmlns:ds="` + xmlDSigNS + `">` + signedInfo + `<ds:SignatureValue>%s</ds:SignatureValue></ds:Signature>`
+
+	parsed, err := parseXML([]byte(signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest = sha256.Sum256(canonicalizeXML(parsed.Child(xmlDSigNS, "SignedInfo"), nil, nil))
+	var value []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		value, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		value = make([]byte, 2*size)
+		r.FillBytes(value[:size])
+		s.FillBytes(value[size:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature = strings.Replace(signature, "%s", base64.StdEncoding.EncodeToString(value), 1)
+	return strings.Replace(document, "<!--Signature:"+id+"-->", signature, 1)
+}
+
+func TestParseXML(t *testing.T) {
+	root, err := parseXML([]byte(`<?xml version="1.0"?>
+<a:root xmlns:a="urn:a" xmlns="urn:d" ID="id1">
+  <a:child b="1">text &amp; <![CDATA[<data>]]></a:child>
+  <child xmlns="" ID="id2"/>
+</a:root>`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "urn:a", root.Space)
+	assert.Equal(t, "root", root.Local)
+	assert.Equal(t, "id1", root.Attr("ID"))
+	child := root.Child("urn:a", "child")
+	if assert.NotNil(t, child) {
+		assert.Equal(t, "1", child.Attr("b"))
+		assert.Equal(t, "text & <data>", child.Text())
+	}
+	assert.Nil(t, root.Child("urn:d", "child"))
+	assert.Len(t, root.ChildrenNamed("", "child"), 1)
+
+	// invalid documents
+	for _, document := range []string{
+		``,
+		`<a>`,
+		`<a></b>`,
+		`<a/><b/>`,
+		`<a/>text`,
+		`<p:a/>`,
+		`<a p:b="1"/>`,
+		`<a ID="1"><b ID="1"/></a>`,
+		`<!DOCTYPE a [<!ENTITY e "e">]><a>&e;</a>`,
+	} {
+		_, err := parseXML([]byte(document))
+		assert.Error(t, err, document)
+	}
+}
+
+func TestCanonicalizeXML(t *testing.T) {
+	canonicalize := func(document, id string, inclusive ...string) string {
+		root, err := parseXML([]byte(document))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(canonicalizeXML(findXMLID(root, id), nil, inclusive))
+	}
+
+	// TEST: the examples of the exclusive canonicalization specification
+	expected := "<n1:elem2 xmlns:n1=\"http://example.net\" ID=\"e\" xml:lang=\"en\">\n" +
+		"    <n3:stuff xmlns:n3=\"ftp://example.org\"></n3:stuff>\n" +
+		"  </n1:elem2>"
+	assert.Equal(t, expected, canonicalize(`<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org">
+  <n1:elem2 xmlns:n1="http://example.net" xml:lang="en" ID="e">
+    <n3:stuff xmlns:n3="ftp://example.org"/>
+  </n1:elem2>
+</n0:local>`, "e"))
+	assert.Equal(t, expected, canonicalize(`<n2:pdu xmlns:n1="http://example.com" xmlns:n2="http://foo.example" xml:lang="fr" xml:space="retain">
+  <n1:elem2 xmlns:n1="http://example.net" xml:lang="en" ID="e">
+    <n3:stuff xmlns:n3="ftp://example.org"/>
+  </n1:elem2>
+</n2:pdu>`, "e"))
+
+	// TEST: the order of the namespaces and of the attributes, the escaping
+	// and the comments
+	assert.Equal(t,
+		`<a xmlns="urn:d" xmlns:b="urn:b" ID="r" x="3" y="&quot;&#x9;&lt;>" b:a="2" b:z="1"><b:c>&amp;&lt;&gt;&#xD;</b:c><e></e></a>`,
+		canonicalize(`<a xmlns:b="urn:b" b:z="1" xmlns="urn:d" y='"&#9;&lt;>' b:a="2" x="3" ID="r"><!-- comment --><b:c>&amp;&lt;&gt;&#13;</b:c><e/></a>`, "r"))
+
+	// TEST: the default namespace
+	assert.Equal(t,
+		`<a xmlns="urn:a" ID="r"><b xmlns=""><c></c></b></a>`,
+		canonicalize(`<a xmlns="urn:a" ID="r"><b xmlns=""><c/></b></a>`, "r"))
+	assert.Equal(t,
+		`<b ID="b"><c></c></b>`,
+		canonicalize(`<a xmlns="urn:a"><b xmlns="" ID="b"><c/></b></a>`, "b"))
+	assert.Equal(t,
+		`<b xmlns="urn:a" ID="b"></b>`,
+		canonicalize(`<a xmlns="urn:a"><b ID="b"/></a>`, "b"))
+
+	// TEST: the inclusive namespaces
+	document := `<r xmlns:xs="urn:xs" xmlns:u="urn:u" xmlns="urn:d"><v ID="v" xs:type="xs:string"><w/></v></r>`
+	assert.Equal(t, `<v xmlns="urn:d" xmlns:xs="urn:xs" ID="v" xs:type="xs:string"><w></w></v>`, canonicalize(document, "v"))
+	assert.Equal(t, `<v xmlns="urn:d" xmlns:u="urn:u" xmlns:xs="urn:xs" ID="v" xs:type="xs:string"><w></w></v>`, canonicalize(document, "v", "u", "unknown"))
+
+	// TEST: the excluded element
+	root, _ := parseXML([]byte(`<a ID="a">1<b>2</b>3</a>`))
+	assert.Equal(t, `<a ID="a">13</a>`, string(canonicalizeXML(root, root.Child("", "b"), nil)))
+}
+
+func TestVerifyXMLSignature(t *testing.T) {
+	rsaCA := newTestRSACertificate(t)
+	ecdsaCA := newTestCA(t, "IdP")
+	document := `<r:root xmlns:r="urn:r" ID="root">
+  <r:issuer>idp</r:issuer>
+  <!--Signature:root-->
+  <r:data ID="data" value="1">content</r:data>
+</r:root>`
+	verify := func(document, id string, certificates ...*x509.Certificate) error {
+		root, err := parseXML([]byte(document))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return verifyXMLSignature(findXMLID(root, id), certificates)
+	}
+
+	// TEST: valid signatures
+	signed := signXML(t, document, "root", rsaCA.key)
+	assert.NoError(t, verify(signed, "root", ecdsaCA.certificate, rsaCA.certificate))
+	assert.NoError(t, verify(signXML(t, document, "root", ecdsaCA.key), "root", ecdsaCA.certificate))
+
+	// TEST: the signature is made by another key
+	assert.Error(t, verify(signed, "root", ecdsaCA.certificate))
+	assert.Error(t, verify(signed, "root"))
+
+	// TEST: the element is modified
+	assert.Error(t, verify(strings.Replace(signed, "content", "modified", 1), "root", rsaCA.certificate))
+	assert.Error(t, verify(strings.Replace(signed, `value="1"`, `value="2"`, 1), "root", rsaCA.certificate))
+	assert.Error(t, verify(strings.Replace(signed, "<r:data", "<r:data other=\"1\"", 1), "root", rsaCA.certificate))
+
+	// TEST: the whitespaces and the namespace prefixes are canonicalized
+	assert.NoError(t, verify(strings.Replace(signed, `value="1"`, `value = '1'`, 1), "root", rsaCA.certificate))
+	assert.NoError(t, verify(strings.Replace(signed, "<r:data ID=\"data\" value=\"1\">content</r:data>", "<r:data value=\"1\" ID=\"data\">content</r:data>", 1), "root", rsaCA.certificate))
+
+	// TEST: the SignedInfo is modified
+	assert.Error(t, verify(strings.Replace(signed, "xmlenc#sha256", "xmlenc#sha512", 1), "root", rsaCA.certificate))
+
+	// TEST: the signature must reference the element
+	assert.Error(t, verify(strings.Replace(signed, `ID="root"`, `ID="other"`, 1), "other", rsaCA.certificate))
+	assert.Error(t, verify(document, "root", rsaCA.certificate))
+
+	// TEST: the unsupported algorithms
+	for _, algorithm := range []string{
+		"http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+		"http://www.w3.org/2000/09/xmldsig#sha1",
+		"http://www.w3.org/TR/2001/REC-xml-c14n-20010315",
+		"http://www.w3.org/TR/1999/REC-xslt-19991116",
+	} {
+		modified := strings.Replace(signed, "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256", algorithm, 1)
+		modified = strings.Replace(modified, "http://www.w3.org/2001/04/xmlenc#sha256", algorithm, 1)
+		modified = strings.Replace(modified, xmlExcC14N, algorithm, 1)
+		modified = strings.Replace(modified, xmlEnvelopedSignature, algorithm, 1)
+		assert.Error(t, verify(modified, "root", rsaCA.certificate), algorithm)
+	}
+}
@@ -0,0 +1,521 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/pbkdf2"
+	"strings"
+)
+
+// yescrypt flags (see yescrypt.h in the reference implementation)
+const (
+	yescryptWORM       = 0x001
+	yescryptRW         = 0x002
+	yescryptRWDefaults = 0x0b6 // RW, 6 rounds, gather 4, simple 2, 12 KiB S-boxes
+	yescryptFlavorMask = 0x3fc
+)
+
+// pwxform parameters of the default yescrypt flavor
+const (
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	sWidth    = 8
+
+	pwxWords = pwxGather * pwxSimple * 2           // size of a pwxform block, in 32-bit words
+	sWords   = 3 * (1 << sWidth) * pwxSimple * 2   // size of the S-boxes, in 32-bit words
+	sMask    = ((1 << sWidth) - 1) * pwxSimple * 8 // mask applied to select an S-box entry
+	sPairs   = (1 << sWidth) * pwxSimple           // number of 64-bit entries in an S-box
+)
+
+// yescryptMaxMemory is the maximum size of V, in bytes, larger costs are
+// rejected.
+const yescryptMaxMemory = 1 << 30
+
+// yescryptItoa64 is the alphabet used by the crypt(3) encoding of yescrypt.
+const yescryptItoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// pwxformCtx holds the S-boxes of pwxform: S0, S1 and S2 are offsets (in
+// 32-bit words) in S, w is the write position in S2 (in 64-bit entries).
+type pwxformCtx struct {
+	S          []uint32
+	s0, s1, s2 int
+	w          int
+}
+
+// checkYescryptHash checks a password against a yescrypt hash in the crypt(3)
+// format: "$y$" params "$" salt "$" hash.
+func checkYescryptHash(hash, password string) error {
+	// "", "y", params, salt, hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return &PasswordHashError{"yescrypt: malformed hash"}
+	}
+	flags, N, r, p, t, err := decodeYescryptParams(parts[2])
+	if err != nil {
+		return &PasswordHashError{"yescrypt: " + err.Error()}
+	}
+	salt, ok := yescryptDecode64(parts[3])
+	if !ok {
+		return &PasswordHashError{"yescrypt: malformed salt"}
+	}
+	key, ok := yescryptDecode64(parts[4])
+	if !ok || len(key) != 32 {
+		return &PasswordHashError{"yescrypt: malformed key"}
+	}
+
+	computed, err := yescryptKey([]byte(password), salt, flags, N, r, p, t, len(key))
+	if err != nil {
+		return &PasswordHashError{"yescrypt: " + err.Error()}
+	}
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// decodeYescryptParams decodes the parameters of a yescrypt hash: the flavor,
+// log2(N), r and the optional p and t.
+func decodeYescryptParams(params string) (flags int, N uint64, r, p, t uint32, err error) {
+	src := params
+	var flavor, logN, have uint32
+	var ok bool
+	if flavor, src, ok = yescryptDecode64Uint32(src, 0); !ok {
+		return 0, 0, 0, 0, 0, errors.New("malformed flavor")
+	}
+	switch {
+	case flavor < yescryptRW:
+		flags = int(flavor)
+	case flavor <= yescryptRW+(yescryptFlavorMask>>2):
+		flags = yescryptRW + int(flavor-yescryptRW)<<2
+	default:
+		return 0, 0, 0, 0, 0, errors.New("unsupported flavor")
+	}
+	if flags&yescryptRW != 0 && flags != yescryptRWDefaults {
+		return 0, 0, 0, 0, 0, errors.New("unsupported flavor")
+	}
+	if logN, src, ok = yescryptDecode64Uint32(src, 1); !ok || logN > 63 {
+		return 0, 0, 0, 0, 0, errors.New("malformed N")
+	}
+	if r, src, ok = yescryptDecode64Uint32(src, 1); !ok {
+		return 0, 0, 0, 0, 0, errors.New("malformed r")
+	}
+	p = 1
+	if src != "" {
+		if have, src, ok = yescryptDecode64Uint32(src, 1); !ok {
+			return 0, 0, 0, 0, 0, errors.New("malformed parameters")
+		}
+		if have&1 != 0 {
+			if p, src, ok = yescryptDecode64Uint32(src, 2); !ok {
+				return 0, 0, 0, 0, 0, errors.New("malformed p")
+			}
+		}
+		if have&2 != 0 {
+			if t, src, ok = yescryptDecode64Uint32(src, 1); !ok {
+				return 0, 0, 0, 0, 0, errors.New("malformed t")
+			}
+		}
+		// g (hash upgrades) and NROM (ROM) are not supported
+		if have&^3 != 0 || src != "" {
+			return 0, 0, 0, 0, 0, errors.New("unsupported parameters")
+		}
+	}
+	return flags, uint64(1) << logN, r, p, t, nil
+}
+
+// yescryptDecode64Uint32 decodes a variable length integer, returns the
+// integer and the rest of the string.
+func yescryptDecode64Uint32(src string, min uint32) (uint32, string, bool) {
+	if src == "" {
+		return 0, src, false
+	}
+	c := strings.IndexByte(yescryptItoa64, src[0])
+	if c < 0 {
+		return 0, src, false
+	}
+	src = src[1:]
+
+	start, end, chars, bits := uint32(0), uint32(47), 1, uint32(0)
+	dst := uint64(min)
+	for uint32(c) > end {
+		dst += uint64(end+1-start) << bits
+		start = end + 1
+		end = start + (62-end)/2
+		chars++
+		bits += 6
+	}
+	dst += uint64(uint32(c)-start) << bits
+
+	for ; chars > 1; chars-- {
+		if src == "" {
+			return 0, src, false
+		}
+		c = strings.IndexByte(yescryptItoa64, src[0])
+		if c < 0 {
+			return 0, src, false
+		}
+		src = src[1:]
+		bits -= 6
+		dst += uint64(c) << bits
+	}
+	if dst > 0xffffffff {
+		return 0, src, false
+	}
+	return uint32(dst), src, true
+}
+
+// yescryptDecode64 decodes a string encoded with the yescrypt variant of
+// base64 (little-endian groups of 24 bits).
+func yescryptDecode64(src string) ([]byte, bool) {
+	dst := []byte{}
+	for len(src) > 0 {
+		value, bits := uint32(0), uint32(0)
+		for len(src) > 0 && bits < 24 {
+			c := strings.IndexByte(yescryptItoa64, src[0])
+			if c < 0 {
+				return nil, false
+			}
+			src = src[1:]
+			value |= uint32(c) << bits
+			bits += 6
+		}
+		// a group must contain at least one full byte, the unused bits
+		// must be 0
+		if bits < 12 {
+			return nil, false
+		}
+		for ; bits >= 8; bits -= 8 {
+			dst = append(dst, byte(value))
+			value >>= 8
+		}
+		if value != 0 {
+			return nil, false
+		}
+	}
+	return dst, true
+}
+
+// yescryptKey derives a key from the password with yescrypt. Only the modes
+// used by crypt(3) are supported: classic scrypt (flags 0), YESCRYPT_WORM and
+// YESCRYPT_RW with the default flavor, without ROM.
+func yescryptKey(password, salt []byte, flags int, N uint64, r, p, t uint32, keyLen int) ([]byte, error) {
+	if flags == 0 && t != 0 {
+		return nil, errors.New("invalid parameters")
+	}
+	if N < 2 || N&(N-1) != 0 || r == 0 || p == 0 || uint64(r)*uint64(p) >= 1<<30 {
+		return nil, errors.New("invalid parameters")
+	}
+	if N > yescryptMaxMemory/128/uint64(r) {
+		return nil, errors.New("too much memory required")
+	}
+	if flags&yescryptRW != 0 && (N/uint64(p) <= 1 || uint64(p)*sWords*4 > yescryptMaxMemory) {
+		return nil, errors.New("invalid parameters")
+	}
+
+	// with large memory costs, the password is first hashed with 1/64 of
+	// the memory, as in the reference implementation
+	if flags&yescryptRW != 0 && N/uint64(p) >= 0x100 && N/uint64(p)*uint64(r) >= 0x20000 {
+		password = yescryptKDF(password, salt, flags, N>>6, r, p, 0, 32, true)
+	}
+	return yescryptKDF(password, salt, flags, N, r, p, t, keyLen, false), nil
+}
+
+// yescryptKDF computes yescrypt with checked parameters. The prehash mode is
+// used by yescryptKey for large memory costs.
+func yescryptKDF(password, salt []byte, flags int, N uint64, r, p, t uint32, keyLen int, prehash bool) []byte {
+	if flags != 0 {
+		key := "yescrypt"
+		if prehash {
+			key = "yescrypt-prehash"
+		}
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(password)
+		password = mac.Sum(nil)
+	}
+
+	s := 32 * int(r)
+	b := pbkdf2.Key(password, salt, 1, int(p)*128*int(r), sha256.New)
+	B := make([]uint32, int(p)*s)
+	for i := range B {
+		B[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	if flags != 0 {
+		// password is a copy (the HMAC), it is updated by smix
+		copy(password, b[:32])
+	}
+
+	V := make([]uint32, int(N)*s)
+	if p == 1 || flags&yescryptRW != 0 {
+		yescryptSmix(B, int(r), N, p, t, flags, V, password)
+	} else {
+		for i := 0; i < int(p); i++ {
+			yescryptSmix(B[i*s:(i+1)*s], int(r), N, 1, t, flags, V, nil)
+		}
+	}
+
+	for i, word := range B {
+		binary.LittleEndian.PutUint32(b[i*4:], word)
+	}
+	dkLen := keyLen
+	if dkLen < 32 {
+		dkLen = 32
+	}
+	dk := pbkdf2.Key(password, b, 1, dkLen, sha256.New)
+	if flags != 0 && !prehash {
+		// ClientKey and StoredKey, as in SCRAM
+		mac := hmac.New(sha256.New, dk[:32])
+		mac.Write([]byte("Client Key"))
+		storedKey := sha256.Sum256(mac.Sum(nil))
+		copy(dk, storedKey[:])
+	}
+	return dk[:keyLen]
+}
+
+// yescryptSmix runs SMix1 and SMix2 on the p blocks of B. The password (32
+// bytes) is updated when the YESCRYPT_RW flag is set.
+func yescryptSmix(B []uint32, r int, N uint64, p, t uint32, flags int, V []uint32, password []byte) {
+	s := 32 * r
+	X := make([]uint32, s)
+	Y := make([]uint32, s)
+
+	nChunk := N / uint64(p)
+	nLoopAll := nChunk
+	if flags&yescryptRW != 0 {
+		if t <= 1 {
+			if t != 0 {
+				nLoopAll *= 2
+			}
+			nLoopAll = (nLoopAll + 2) / 3
+		} else {
+			nLoopAll *= uint64(t - 1)
+		}
+	} else if t != 0 {
+		if t == 1 {
+			nLoopAll += (nLoopAll + 1) / 2
+		}
+		nLoopAll *= uint64(t)
+	}
+	nLoopRW := uint64(0)
+	if flags&yescryptRW != 0 {
+		nLoopRW = nLoopAll / uint64(p)
+	}
+	nChunk &^= 1
+	nLoopAll = (nLoopAll + 1) &^ 1
+	nLoopRW = (nLoopRW + 1) &^ 1
+
+	ctxs := make([]*pwxformCtx, p)
+	vChunk := uint64(0)
+	for i := 0; i < int(p); i++ {
+		np := nChunk
+		if i == int(p)-1 {
+			np = N - vChunk
+		}
+		Bp := B[i*s : (i+1)*s]
+		Vp := V[int(vChunk)*s : int(vChunk+np)*s]
+		if flags&yescryptRW != 0 {
+			ctx := &pwxformCtx{S: make([]uint32, sWords)}
+			yescryptSmix1(Bp[:32], 1, sWords/32, 0, ctx.S, X, Y, nil)
+			ctx.s2, ctx.s1, ctx.s0 = 0, 2*sPairs, 4*sPairs
+			ctxs[i] = ctx
+			if i == 0 {
+				key := make([]byte, 64)
+				for k, word := range Bp[s-16:] {
+					binary.LittleEndian.PutUint32(key[k*4:], word)
+				}
+				mac := hmac.New(sha256.New, key)
+				mac.Write(password)
+				copy(password, mac.Sum(nil))
+			}
+		}
+		yescryptSmix1(Bp, r, np, flags, Vp, X, Y, ctxs[i])
+		yescryptSmix2(Bp, r, yescryptP2floor(np), nLoopRW, flags, Vp, X, Y, ctxs[i])
+		vChunk += nChunk
+	}
+
+	for i := 0; i < int(p); i++ {
+		yescryptSmix2(B[i*s:(i+1)*s], r, N, nLoopAll-nLoopRW, flags&^yescryptRW, V, X, Y, ctxs[i])
+	}
+}
+
+// yescryptSmix1 fills V from B (sequential writes). X and Y are temporary
+// buffers of 32r words.
+func yescryptSmix1(B []uint32, r int, N uint64, flags int, V, X, Y []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	yescryptShuffle(X, B)
+	for i := uint64(0); i < N; i++ {
+		copy(V[int(i)*s:], X[:s])
+		if flags&yescryptRW != 0 && i > 1 {
+			j := yescryptWrap(yescryptIntegerify(X, r), i)
+			yescryptXor(X[:s], V[int(j)*s:])
+		}
+		yescryptBlockmix(X, Y, r, ctx)
+	}
+	yescryptUnshuffle(B, X[:s])
+}
+
+// yescryptSmix2 reads and writes V (random accesses). X and Y are temporary
+// buffers of 32r words.
+func yescryptSmix2(B []uint32, r int, N, nLoop uint64, flags int, V, X, Y []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	yescryptShuffle(X, B)
+	for i := uint64(0); i < nLoop; i++ {
+		j := yescryptIntegerify(X, r) & (N - 1)
+		yescryptXor(X[:s], V[int(j)*s:])
+		if flags&yescryptRW != 0 {
+			copy(V[int(j)*s:], X[:s])
+		}
+		yescryptBlockmix(X, Y, r, ctx)
+	}
+	yescryptUnshuffle(B, X[:s])
+}
+
+// yescryptShuffle copies the 64-byte blocks of B to X in the SIMD order of
+// the reference implementation, pwxform depends on this order.
+func yescryptShuffle(X, B []uint32) {
+	for k := 0; k < len(B); k += 16 {
+		for i := 0; i < 16; i++ {
+			X[k+i] = B[k+i*5%16]
+		}
+	}
+}
+
+// yescryptUnshuffle is the reverse of yescryptShuffle.
+func yescryptUnshuffle(B, X []uint32) {
+	for k := 0; k < len(B); k += 16 {
+		for i := 0; i < 16; i++ {
+			B[k+i*5%16] = X[k+i]
+		}
+	}
+}
+
+func yescryptXor(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func yescryptP2floor(x uint64) uint64 {
+	for y := x & (x - 1); y != 0; y = x & (x - 1) {
+		x = y
+	}
+	return x
+}
+
+func yescryptWrap(x, i uint64) uint64 {
+	n := yescryptP2floor(i)
+	return (x & (n - 1)) + (i - n)
+}
+
+func yescryptIntegerify(X []uint32, r int) uint64 {
+	last := X[(2*r-1)*16:]
+	return uint64(last[13])<<32 | uint64(last[0])
+}
+
+// yescryptBlockmix runs BlockMix_pwxform if a pwxform context is provided,
+// BlockMix_salsa20/8 otherwise.
+func yescryptBlockmix(B, Y []uint32, r int, ctx *pwxformCtx) {
+	if ctx == nil {
+		var X [16]uint32
+		copy(X[:], B[(2*r-1)*16:])
+		for i := 0; i < 2*r; i++ {
+			yescryptXor(X[:], B[i*16:])
+			yescryptSalsa20(X[:], 8)
+			copy(Y[i*16:], X[:])
+		}
+		for i := 0; i < r; i++ {
+			copy(B[i*16:(i+1)*16], Y[(2*i)*16:])
+			copy(B[(i+r)*16:(i+r+1)*16], Y[(2*i+1)*16:])
+		}
+		return
+	}
+
+	// pwxform blocks are 64 bytes long, as the salsa20 blocks
+	r1 := 2 * r
+	var X [pwxWords]uint32
+	copy(X[:], B[(r1-1)*pwxWords:])
+	for i := 0; i < r1; i++ {
+		if r1 > 1 {
+			yescryptXor(X[:], B[i*pwxWords:])
+		}
+		ctx.pwxform(X[:])
+		copy(B[i*pwxWords:], X[:])
+	}
+	yescryptSalsa20(B[(r1-1)*16:r1*16], 2)
+}
+
+// pwxform transforms a block with the S-boxes, and updates the S-boxes.
+func (ctx *pwxformCtx) pwxform(B []uint32) {
+	S := ctx.S
+	w := ctx.w
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			p0 := ctx.s0 + int(B[j*pwxSimple*2]&sMask)/4
+			p1 := ctx.s1 + int(B[j*pwxSimple*2+1]&sMask)/4
+			for k := 0; k < pwxSimple; k++ {
+				n := (j*pwxSimple + k) * 2
+				s0 := uint64(S[p0+2*k+1])<<32 + uint64(S[p0+2*k])
+				s1 := uint64(S[p1+2*k+1])<<32 + uint64(S[p1+2*k])
+				x := uint64(B[n+1]) * uint64(B[n])
+				x += s0
+				x ^= s1
+				B[n], B[n+1] = uint32(x), uint32(x>>32)
+				if i != 0 && i != pwxRounds-1 {
+					S[ctx.s2+2*w], S[ctx.s2+2*w+1] = uint32(x), uint32(x>>32)
+					w++
+				}
+			}
+		}
+	}
+	ctx.s0, ctx.s1, ctx.s2 = ctx.s2, ctx.s0, ctx.s1
+	ctx.w = w & (sPairs - 1)
+}
+
+// yescryptSalsa20 applies the Salsa20 core to a shuffled 64-byte block.
+func yescryptSalsa20(B []uint32, rounds int) {
+	var x [16]uint32
+	for i := 0; i < 16; i++ {
+		x[i*5%16] = B[i]
+	}
+	rotl := func(a uint32, b uint) uint32 { return a<<b | a>>(32-b) }
+	for i := 0; i < rounds; i += 2 {
+		x[4] ^= rotl(x[0]+x[12], 7)
+		x[8] ^= rotl(x[4]+x[0], 9)
+		x[12] ^= rotl(x[8]+x[4], 13)
+		x[0] ^= rotl(x[12]+x[8], 18)
+		x[9] ^= rotl(x[5]+x[1], 7)
+		x[13] ^= rotl(x[9]+x[5], 9)
+		x[1] ^= rotl(x[13]+x[9], 13)
+		x[5] ^= rotl(x[1]+x[13], 18)
+		x[14] ^= rotl(x[10]+x[6], 7)
+		x[2] ^= rotl(x[14]+x[10], 9)
+		x[6] ^= rotl(x[2]+x[14], 13)
+		x[10] ^= rotl(x[6]+x[2], 18)
+		x[3] ^= rotl(x[15]+x[11], 7)
+		x[7] ^= rotl(x[3]+x[15], 9)
+		x[11] ^= rotl(x[7]+x[3], 13)
+		x[15] ^= rotl(x[11]+x[7], 18)
+
+		x[1] ^= rotl(x[0]+x[3], 7)
+		x[2] ^= rotl(x[1]+x[0], 9)
+		x[3] ^= rotl(x[2]+x[1], 13)
+		x[0] ^= rotl(x[3]+x[2], 18)
+		x[6] ^= rotl(x[5]+x[4], 7)
+		x[7] ^= rotl(x[6]+x[5], 9)
+		x[4] ^= rotl(x[7]+x[6], 13)
+		x[5] ^= rotl(x[4]+x[7], 18)
+		x[11] ^= rotl(x[10]+x[9], 7)
+		x[8] ^= rotl(x[11]+x[10], 9)
+		x[9] ^= rotl(x[8]+x[11], 13)
+		x[10] ^= rotl(x[9]+x[8], 18)
+		x[12] ^= rotl(x[15]+x[14], 7)
+		x[13] ^= rotl(x[12]+x[15], 9)
+		x[14] ^= rotl(x[13]+x[12], 13)
+		x[15] ^= rotl(x[14]+x[13], 18)
+	}
+	for i := 0; i < 16; i++ {
+		B[i] += x[i*5%16]
+	}
+}
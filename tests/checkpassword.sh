@@ -0,0 +1,22 @@
+#!/bin/sh
+# checkpassword program used by the tests of the exec authenticator
+credentials=$(tr '\0' '\n' <&3)
+username=$(echo "$credentials" | sed -n 1p)
+password=$(echo "$credentials" | sed -n 2p)
+
+case "$username" in
+slow@example.com)
+	exec sleep 5
+	;;
+broken@example.com)
+	echo "database unavailable" >&2
+	exit 111
+	;;
+env@example.com)
+	[ "$GORGON_TEST" = "hello" ] && [ -z "$HOME" ] && exec "$@"
+	exit 1
+	;;
+esac
+
+[ "$username" = "alice@example.com" ] && [ "$password" = "verysecret" ] && exec "$@"
+exit 1